@@ -0,0 +1,28 @@
+-- Books can belong to several genres and carry free-form tags.
+-- Replaces the single "Books"."Genre_ID" column with the "Book_Genres" relation.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "Book_Genres" (
+    "Book_ID"  integer NOT NULL REFERENCES "Books"("ID") ON DELETE CASCADE,
+    "Genre_ID" integer NOT NULL REFERENCES "Genres"("ID") ON DELETE CASCADE,
+    PRIMARY KEY ("Book_ID", "Genre_ID")
+);
+CREATE INDEX IF NOT EXISTS "Book_Genres_Genre_ID_idx" ON "Book_Genres"("Genre_ID");
+
+CREATE TABLE IF NOT EXISTS "Book_Tags" (
+    "Book_ID" integer NOT NULL REFERENCES "Books"("ID") ON DELETE CASCADE,
+    "Tag"     text    NOT NULL CHECK ("Tag" <> ''),
+    PRIMARY KEY ("Book_ID", "Tag")
+);
+CREATE INDEX IF NOT EXISTS "Book_Tags_Tag_idx" ON "Book_Tags"("Tag");
+
+INSERT INTO "Book_Genres"("Book_ID", "Genre_ID")
+SELECT b."ID", b."Genre_ID"
+FROM "Books" b
+JOIN "Genres" g ON g."ID" = b."Genre_ID"
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE "Books" DROP COLUMN IF EXISTS "Genre_ID";
+
+COMMIT;
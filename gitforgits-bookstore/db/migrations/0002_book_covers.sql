@@ -0,0 +1,7 @@
+-- Cover images are stored outside the database (see fileStorage); the book only records
+-- which content version is current. NULL means the book has no cover. "Cover_Ext" is the
+-- extension the original upload is stored under (".jpg", ".png" or ".webp"), so its URL can be
+-- built; thumbnails are always JPEG.
+
+ALTER TABLE "Books" ADD COLUMN IF NOT EXISTS "Cover_Version" text;
+ALTER TABLE "Books" ADD COLUMN IF NOT EXISTS "Cover_Ext" text;
@@ -0,0 +1,22 @@
+-- Book reviews with a 1-5 star rating. Each user may review a book once.
+-- The review count and average rating are kept on "Books" so listings don't have to aggregate.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "Reviews" (
+    "ID"         serial      PRIMARY KEY,
+    "Book_ID"    integer     NOT NULL REFERENCES "Books"("ID") ON DELETE CASCADE,
+    "User_ID"    integer     NOT NULL,
+    "Rating"     smallint    NOT NULL CHECK ("Rating" BETWEEN 1 AND 5),
+    "Title"      text        NOT NULL DEFAULT '',
+    "Body"       text        NOT NULL,
+    "Created_At" timestamptz NOT NULL DEFAULT now(),
+    "Updated_At" timestamptz NOT NULL DEFAULT now(),
+    UNIQUE ("Book_ID", "User_ID")
+);
+CREATE INDEX IF NOT EXISTS "Reviews_User_ID_idx" ON "Reviews"("User_ID");
+
+ALTER TABLE "Books" ADD COLUMN IF NOT EXISTS "Review_Count"   integer      NOT NULL DEFAULT 0;
+ALTER TABLE "Books" ADD COLUMN IF NOT EXISTS "Rating_Average" numeric(3,2) NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1,27 @@
+-- Reviews go through moderation before they are shown, and shoppers can report them.
+-- Only approved reviews count towards "Books"."Review_Count" and "Rating_Average".
+
+BEGIN;
+
+ALTER TABLE "Reviews" ADD COLUMN IF NOT EXISTS "Status" text NOT NULL DEFAULT 'pending'
+    CHECK ("Status" IN ('pending', 'approved', 'rejected'));
+ALTER TABLE "Reviews" ADD COLUMN IF NOT EXISTS "Moderation_Note" text NOT NULL DEFAULT '';
+ALTER TABLE "Reviews" ADD COLUMN IF NOT EXISTS "Moderated_At" timestamptz;
+CREATE INDEX IF NOT EXISTS "Reviews_Status_idx" ON "Reviews"("Status");
+
+-- Reviews written before moderation existed were already public.
+UPDATE "Reviews" SET "Status" = 'approved', "Moderated_At" = now() WHERE "Moderated_At" IS NULL;
+
+CREATE TABLE IF NOT EXISTS "Review_Reports" (
+    "ID"          serial      PRIMARY KEY,
+    "Review_ID"   integer     NOT NULL REFERENCES "Reviews"("ID") ON DELETE CASCADE,
+    "User_ID"     integer     NOT NULL,
+    "Reason"      text        NOT NULL,
+    "Created_At"  timestamptz NOT NULL DEFAULT now(),
+    "Resolved_At" timestamptz
+);
+CREATE INDEX IF NOT EXISTS "Review_Reports_Open_idx" ON "Review_Reports"("Review_ID") WHERE "Resolved_At" IS NULL;
+-- One open report per user; once it's resolved they can report the review again.
+CREATE UNIQUE INDEX IF NOT EXISTS "Review_Reports_Open_User_idx" ON "Review_Reports"("Review_ID", "User_ID") WHERE "Resolved_At" IS NULL;
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Precomputed "customers also bought" and similar-book recommendations.
+-- Rebuilt in full by recommendationHandler.Recompute; never edited by hand.
+
+CREATE TABLE IF NOT EXISTS "Book_Recommendations" (
+    "Book_ID"             integer          NOT NULL REFERENCES "Books"("ID") ON DELETE CASCADE,
+    "Recommended_Book_ID" integer          NOT NULL REFERENCES "Books"("ID") ON DELETE CASCADE,
+    "Score"               double precision NOT NULL,
+    "Reason"              text             NOT NULL,
+    "Computed_At"         timestamptz      NOT NULL DEFAULT now(),
+    PRIMARY KEY ("Book_ID", "Recommended_Book_ID")
+);
@@ -0,0 +1,23 @@
+-- Registered users. Usernames and email addresses are unique regardless of case.
+-- Passwords are stored as argon2id hashes in PHC string format.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "Users" (
+    "ID"            serial      PRIMARY KEY,
+    "Username"      text        NOT NULL,
+    "Email"         text        NOT NULL,
+    "Password_Hash" text        NOT NULL,
+    "Created_At"    timestamptz NOT NULL DEFAULT now(),
+    "Updated_At"    timestamptz NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "Users_Username_key" ON "Users"(lower("Username"));
+CREATE UNIQUE INDEX IF NOT EXISTS "Users_Email_key" ON "Users"(lower("Email"));
+
+-- Reviews and reports were written against user IDs before this table existed.
+ALTER TABLE "Reviews" ADD CONSTRAINT "Reviews_User_ID_fkey"
+    FOREIGN KEY ("User_ID") REFERENCES "Users"("ID") ON DELETE CASCADE;
+ALTER TABLE "Review_Reports" ADD CONSTRAINT "Review_Reports_User_ID_fkey"
+    FOREIGN KEY ("User_ID") REFERENCES "Users"("ID") ON DELETE CASCADE;
+
+COMMIT;
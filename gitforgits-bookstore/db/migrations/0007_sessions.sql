@@ -0,0 +1,13 @@
+-- Server-side login sessions. Only a SHA-256 hash of the session ID is stored.
+
+CREATE TABLE IF NOT EXISTS "Sessions" (
+    "ID_Hash"      bytea       PRIMARY KEY,
+    "User_ID"      integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Created_At"   timestamptz NOT NULL DEFAULT now(),
+    "Last_Seen_At" timestamptz NOT NULL DEFAULT now(),
+    "Expires_At"   timestamptz NOT NULL,
+    "User_Agent"   text        NOT NULL DEFAULT '',
+    "IP"           text        NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS "Sessions_User_ID_idx" ON "Sessions"("User_ID");
+CREATE INDEX IF NOT EXISTS "Sessions_Expires_At_idx" ON "Sessions"("Expires_At");
@@ -0,0 +1,16 @@
+-- Roles granted on top of the customer role every registered user has.
+-- Staff maintain the catalogue and moderate reviews; admins can also assign roles.
+-- There is no admin until one is granted by hand, e.g.:
+--   INSERT INTO "User_Roles"("User_ID","Role") SELECT "ID",'admin' FROM "Users" WHERE lower("Username")='alice';
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "User_Roles" (
+    "User_ID"    integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Role"       text        NOT NULL CHECK ("Role" IN ('staff', 'admin')),
+    "Granted_By" integer     REFERENCES "Users"("ID") ON DELETE SET NULL,
+    "Granted_At" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("User_ID", "Role")
+);
+
+COMMIT;
@@ -0,0 +1,17 @@
+-- Long-lived refresh tokens for API clients. Only a SHA-256 hash of the token is stored.
+-- Every refresh replaces the token; tokens descended from the same login share a Family_ID so
+-- that replaying a used token can revoke the whole chain.
+
+CREATE TABLE IF NOT EXISTS "Refresh_Tokens" (
+    "Token_Hash"   bytea       PRIMARY KEY,
+    "Family_ID"    bytea       NOT NULL,
+    "User_ID"      integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Created_At"   timestamptz NOT NULL DEFAULT now(),
+    "Expires_At"   timestamptz NOT NULL,
+    "Used_At"      timestamptz,
+    "Revoked_At"   timestamptz,
+    "User_Agent"   text        NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS "Refresh_Tokens_User_ID_idx" ON "Refresh_Tokens"("User_ID");
+CREATE INDEX IF NOT EXISTS "Refresh_Tokens_Family_ID_idx" ON "Refresh_Tokens"("Family_ID");
+CREATE INDEX IF NOT EXISTS "Refresh_Tokens_Expires_At_idx" ON "Refresh_Tokens"("Expires_At");
@@ -0,0 +1,16 @@
+-- Personal API keys for scripts and integrations. A key is shown to its owner once; only its
+-- SHA-256 hash is stored, next to a short prefix that lets the owner tell keys apart.
+
+CREATE TABLE IF NOT EXISTS "API_Keys" (
+    "ID"           serial      PRIMARY KEY,
+    "User_ID"      integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Name"         text        NOT NULL,
+    "Prefix"       text        NOT NULL UNIQUE,
+    "Key_Hash"     bytea       NOT NULL UNIQUE,
+    "Scopes"       text[]      NOT NULL,
+    "Created_At"   timestamptz NOT NULL DEFAULT now(),
+    "Expires_At"   timestamptz,
+    "Last_Used_At" timestamptz,
+    "Revoked_At"   timestamptz
+);
+CREATE INDEX IF NOT EXISTS "API_Keys_User_ID_idx" ON "API_Keys"("User_ID");
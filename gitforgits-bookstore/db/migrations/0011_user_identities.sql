@@ -0,0 +1,13 @@
+-- Accounts at external OpenID Connect providers linked to our users. A user may have several,
+-- and users created through a provider have no password until they set one.
+
+CREATE TABLE IF NOT EXISTS "User_Identities" (
+    "Provider"      text        NOT NULL,
+    "Subject"       text        NOT NULL,
+    "User_ID"       integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Email"         text        NOT NULL DEFAULT '',
+    "Created_At"    timestamptz NOT NULL DEFAULT now(),
+    "Last_Login_At" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("Provider", "Subject")
+);
+CREATE INDEX IF NOT EXISTS "User_Identities_User_ID_idx" ON "User_Identities"("User_ID");
@@ -0,0 +1,32 @@
+-- Two-factor authentication with time-based one-time passwords (RFC 6238).
+-- A secret without Confirmed_At belongs to a setup that hasn't been confirmed with a code yet.
+-- Last_Step is the time step of the last accepted code, so each code works only once.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "User_TOTP" (
+    "User_ID"      integer     PRIMARY KEY REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Secret"       text        NOT NULL,
+    "Created_At"   timestamptz NOT NULL DEFAULT now(),
+    "Confirmed_At" timestamptz,
+    "Last_Step"    bigint      NOT NULL DEFAULT 0
+);
+
+-- One-time recovery codes, stored as SHA-256 hashes.
+CREATE TABLE IF NOT EXISTS "User_Recovery_Codes" (
+    "User_ID"   integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Code_Hash" bytea       NOT NULL,
+    "Used_At"   timestamptz,
+    PRIMARY KEY ("User_ID", "Code_Hash")
+);
+
+-- Logins that passed the password check and wait for the second factor.
+CREATE TABLE IF NOT EXISTS "Login_Challenges" (
+    "ID_Hash"    bytea       PRIMARY KEY,
+    "User_ID"    integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Next"       text        NOT NULL DEFAULT '/',
+    "Expires_At" timestamptz NOT NULL,
+    "Attempts"   integer     NOT NULL DEFAULT 0
+);
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Users confirm their email address before they can log in with a password.
+-- Accounts that existed before this change count as confirmed.
+
+BEGIN;
+
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS "Email_Verified_At" timestamptz;
+UPDATE "Users" SET "Email_Verified_At"="Created_At" WHERE "Email_Verified_At" IS NULL;
+
+COMMIT;
@@ -0,0 +1,10 @@
+-- Failed password logins slow down and eventually lock the account for a while.
+-- Failures per client address are only kept in memory.
+
+BEGIN;
+
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS "Failed_Logins" integer NOT NULL DEFAULT 0;
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS "Last_Failed_Login_At" timestamptz;
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS "Locked_Until" timestamptz;
+
+COMMIT;
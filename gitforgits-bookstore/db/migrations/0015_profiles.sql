@@ -0,0 +1,30 @@
+-- Profiles: an optional display name, an email address waiting to be confirmed, and an
+-- address book with at most one default shipping and one default billing address per user.
+
+BEGIN;
+
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS "Display_Name" text;
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS "Pending_Email" text;
+
+CREATE TABLE IF NOT EXISTS "Addresses" (
+    "ID"               serial      PRIMARY KEY,
+    "User_ID"          integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Label"            text        NOT NULL DEFAULT '',
+    "Full_Name"        text        NOT NULL,
+    "Line1"            text        NOT NULL,
+    "Line2"            text        NOT NULL DEFAULT '',
+    "City"             text        NOT NULL,
+    "Region"           text        NOT NULL DEFAULT '',
+    "Postal_Code"      text        NOT NULL,
+    "Country"          char(2)     NOT NULL,
+    "Phone"            text        NOT NULL DEFAULT '',
+    "Default_Shipping" boolean     NOT NULL DEFAULT false,
+    "Default_Billing"  boolean     NOT NULL DEFAULT false,
+    "Created_At"       timestamptz NOT NULL DEFAULT now(),
+    "Updated_At"       timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "Addresses_User_ID_idx" ON "Addresses"("User_ID");
+CREATE UNIQUE INDEX IF NOT EXISTS "Addresses_Default_Shipping_key" ON "Addresses"("User_ID") WHERE "Default_Shipping";
+CREATE UNIQUE INDEX IF NOT EXISTS "Addresses_Default_Billing_key" ON "Addresses"("User_ID") WHERE "Default_Billing";
+
+COMMIT;
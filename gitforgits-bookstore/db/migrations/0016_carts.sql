@@ -0,0 +1,26 @@
+-- Shopping carts. A cart belongs to a user, or to a guest who holds the token whose hash is
+-- stored here. Each line remembers the price in cents when the book was added, so a later
+-- price change can be pointed out.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "Carts" (
+    "ID"         serial      PRIMARY KEY,
+    "User_ID"    integer     UNIQUE REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Token_Hash" text        UNIQUE,
+    "Created_At" timestamptz NOT NULL DEFAULT now(),
+    "Updated_At" timestamptz NOT NULL DEFAULT now(),
+    CHECK (("User_ID" IS NULL) <> ("Token_Hash" IS NULL))
+);
+CREATE INDEX IF NOT EXISTS "Carts_Guest_Updated_At_idx" ON "Carts"("Updated_At") WHERE "User_ID" IS NULL;
+
+CREATE TABLE IF NOT EXISTS "Cart_Items" (
+    "Cart_ID"          integer     NOT NULL REFERENCES "Carts"("ID") ON DELETE CASCADE,
+    "Book_ID"          integer     NOT NULL REFERENCES "Books"("ID") ON DELETE CASCADE,
+    "Quantity"         integer     NOT NULL CHECK ("Quantity" > 0),
+    "Unit_Price_Cents" bigint      NOT NULL,
+    "Added_At"         timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("Cart_ID", "Book_ID")
+);
+
+COMMIT;
@@ -0,0 +1,43 @@
+-- Orders. Books get a stock count, where NULL means stock isn't tracked for that book. A
+-- cart remembers the checkout choices made so far. An order keeps copies of its addresses
+-- and of each line's title and price, so later edits don't rewrite it. The idempotency key
+-- makes placing the same checkout twice return the first order.
+
+BEGIN;
+
+ALTER TABLE "Books" ADD COLUMN IF NOT EXISTS "Stock" integer CHECK ("Stock" >= 0);
+
+ALTER TABLE "Carts" ADD COLUMN IF NOT EXISTS "Shipping_Address_ID" integer REFERENCES "Addresses"("ID") ON DELETE SET NULL;
+ALTER TABLE "Carts" ADD COLUMN IF NOT EXISTS "Billing_Address_ID" integer REFERENCES "Addresses"("ID") ON DELETE SET NULL;
+ALTER TABLE "Carts" ADD COLUMN IF NOT EXISTS "Shipping_Method" text;
+
+CREATE TABLE IF NOT EXISTS "Orders" (
+    "ID"               serial      PRIMARY KEY,
+    "User_ID"          integer     NOT NULL REFERENCES "Users"("ID"),
+    "Idempotency_Key"  text        NOT NULL,
+    "Status"           text        NOT NULL DEFAULT 'pending_payment',
+    "Subtotal_Cents"   bigint      NOT NULL,
+    "Shipping_Cents"   bigint      NOT NULL,
+    "Total_Cents"      bigint      NOT NULL,
+    "Shipping_Method"  text        NOT NULL,
+    "Shipping_Address" jsonb       NOT NULL,
+    "Billing_Address"  jsonb       NOT NULL,
+    "Created_At"       timestamptz NOT NULL DEFAULT now(),
+    "Updated_At"       timestamptz NOT NULL DEFAULT now(),
+    UNIQUE ("User_ID", "Idempotency_Key")
+);
+CREATE INDEX IF NOT EXISTS "Orders_User_ID_Created_At_idx" ON "Orders"("User_ID", "Created_At" DESC);
+
+CREATE TABLE IF NOT EXISTS "Order_Items" (
+    "ID"               serial  PRIMARY KEY,
+    "Order_ID"         integer NOT NULL REFERENCES "Orders"("ID") ON DELETE CASCADE,
+    "Book_ID"          integer REFERENCES "Books"("ID") ON DELETE SET NULL,
+    "Title"            text    NOT NULL,
+    "Author"           text    NOT NULL DEFAULT '',
+    "Quantity"         integer NOT NULL CHECK ("Quantity" > 0),
+    "Unit_Price_Cents" bigint  NOT NULL
+);
+CREATE INDEX IF NOT EXISTS "Order_Items_Order_ID_idx" ON "Order_Items"("Order_ID");
+CREATE INDEX IF NOT EXISTS "Order_Items_Book_ID_idx" ON "Order_Items"("Book_ID");
+
+COMMIT;
@@ -0,0 +1,36 @@
+-- Payments. Each attempt to pay an order is a row; at most one attempt per order can be in
+-- flight or authorized at a time. Webhook event IDs are kept so a redelivered event is only
+-- applied once.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "Payments" (
+    "ID"                  serial      PRIMARY KEY,
+    "Order_ID"            integer     NOT NULL REFERENCES "Orders"("ID") ON DELETE CASCADE,
+    "Provider"            text        NOT NULL,
+    "Provider_Payment_ID" text,
+    "Status"              text        NOT NULL DEFAULT 'started'
+                                      CHECK ("Status" IN ('started','pending','requires_action','authorized','declined','failed','captured','voided','refunded')),
+    "Amount_Cents"        bigint      NOT NULL,
+    "Captured_Cents"      bigint      NOT NULL DEFAULT 0,
+    "Refunded_Cents"      bigint      NOT NULL DEFAULT 0,
+    "Action_URL"          text,
+    "Decline_Reason"      text,
+    "Created_At"          timestamptz NOT NULL DEFAULT now(),
+    "Updated_At"          timestamptz NOT NULL DEFAULT now(),
+    UNIQUE ("Provider", "Provider_Payment_ID")
+);
+CREATE INDEX IF NOT EXISTS "Payments_Order_ID_idx" ON "Payments"("Order_ID");
+CREATE UNIQUE INDEX IF NOT EXISTS "Payments_Active_Order_ID_key" ON "Payments"("Order_ID")
+    WHERE "Status" IN ('started','pending','requires_action','authorized');
+
+CREATE TABLE IF NOT EXISTS "Payment_Webhooks" (
+    "Provider"    text        NOT NULL,
+    "Event_ID"    text        NOT NULL,
+    "Event_Type"  text        NOT NULL,
+    "Payment_ID"  text        NOT NULL,
+    "Received_At" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("Provider", "Event_ID")
+);
+
+COMMIT;
@@ -0,0 +1,29 @@
+-- Order lifecycle. An order's status is one of a fixed set, and every change is kept in
+-- "Order_Events" with who made it and why. Orders placed before this get a single event
+-- recording the status they had.
+
+BEGIN;
+
+ALTER TABLE "Orders" DROP CONSTRAINT IF EXISTS "Orders_Status_check";
+ALTER TABLE "Orders" ADD CONSTRAINT "Orders_Status_check"
+    CHECK ("Status" IN ('pending_payment','paid','picking','shipped','delivered','cancelled','refunded'));
+CREATE INDEX IF NOT EXISTS "Orders_Status_idx" ON "Orders"("Status");
+
+CREATE TABLE IF NOT EXISTS "Order_Events" (
+    "ID"          serial      PRIMARY KEY,
+    "Order_ID"    integer     NOT NULL REFERENCES "Orders"("ID") ON DELETE CASCADE,
+    "From_Status" text,
+    "To_Status"   text        NOT NULL,
+    "Actor_ID"    integer     REFERENCES "Users"("ID") ON DELETE SET NULL,
+    "Actor"       text        NOT NULL,
+    "Reason"      text        NOT NULL DEFAULT '',
+    "Created_At"  timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "Order_Events_Order_ID_idx" ON "Order_Events"("Order_ID", "Created_At");
+
+INSERT INTO "Order_Events"("Order_ID","To_Status","Actor","Reason","Created_At")
+SELECT o."ID", o."Status", 'system', 'Recorded when order history began', o."Created_At"
+FROM "Orders" o
+WHERE NOT EXISTS (SELECT 1 FROM "Order_Events" e WHERE e."Order_ID"=o."ID");
+
+COMMIT;
@@ -0,0 +1,47 @@
+-- Returns and refunds. A customer asks to return some of a delivered order's items with a
+-- reason code; staff approve or reject it, receive the items back and refund the customer.
+-- Refunds are kept whether or not they belong to a return. Order events now also record
+-- steps that don't change the order's status, told apart by "Kind".
+
+BEGIN;
+
+ALTER TABLE "Order_Events" ADD COLUMN IF NOT EXISTS "Kind" text NOT NULL DEFAULT 'status';
+
+CREATE TABLE IF NOT EXISTS "Returns" (
+    "ID"           serial      PRIMARY KEY,
+    "Order_ID"     integer     NOT NULL REFERENCES "Orders"("ID") ON DELETE CASCADE,
+    "Status"       text        NOT NULL DEFAULT 'requested'
+                               CHECK ("Status" IN ('requested','approved','rejected','received','refunded')),
+    "Reason_Code"  text        NOT NULL
+                               CHECK ("Reason_Code" IN ('damaged','wrong_item','not_as_described','no_longer_needed','other')),
+    "Comment"      text        NOT NULL DEFAULT '',
+    "Refund_Cents" bigint      NOT NULL DEFAULT 0,
+    "Created_At"   timestamptz NOT NULL DEFAULT now(),
+    "Updated_At"   timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "Returns_Order_ID_idx" ON "Returns"("Order_ID");
+CREATE INDEX IF NOT EXISTS "Returns_Status_idx" ON "Returns"("Status");
+
+CREATE TABLE IF NOT EXISTS "Return_Items" (
+    "Return_ID"         integer NOT NULL REFERENCES "Returns"("ID") ON DELETE CASCADE,
+    "Order_Item_ID"     integer NOT NULL REFERENCES "Order_Items"("ID") ON DELETE CASCADE,
+    "Quantity"          integer NOT NULL CHECK ("Quantity" > 0),
+    "Received_Quantity" integer NOT NULL DEFAULT 0 CHECK ("Received_Quantity" BETWEEN 0 AND "Quantity"),
+    PRIMARY KEY ("Return_ID", "Order_Item_ID")
+);
+
+CREATE TABLE IF NOT EXISTS "Refunds" (
+    "ID"                 serial      PRIMARY KEY,
+    "Order_ID"           integer     NOT NULL REFERENCES "Orders"("ID") ON DELETE CASCADE,
+    "Payment_ID"         integer     NOT NULL REFERENCES "Payments"("ID") ON DELETE CASCADE,
+    "Return_ID"          integer     REFERENCES "Returns"("ID") ON DELETE SET NULL,
+    "Amount_Cents"       bigint      NOT NULL CHECK ("Amount_Cents" > 0),
+    "Provider_Refund_ID" text        NOT NULL,
+    "Actor_ID"           integer     REFERENCES "Users"("ID") ON DELETE SET NULL,
+    "Actor"              text        NOT NULL,
+    "Reason"             text        NOT NULL DEFAULT '',
+    "Created_At"         timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "Refunds_Order_ID_idx" ON "Refunds"("Order_ID");
+
+COMMIT;
@@ -0,0 +1,35 @@
+-- Promotions. Each promotion is a rule: conditions on the books, the cart and the customer,
+-- and an action that takes money off. They are priced into carts as they run, and the
+-- discounts an order got are kept per line with the promotion that gave them.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS "Promotions" (
+    "ID"         serial      PRIMARY KEY,
+    "Name"       text        NOT NULL CHECK ("Name" <> ''),
+    "Conditions" jsonb       NOT NULL DEFAULT '{}',
+    "Action"     jsonb       NOT NULL,
+    "Priority"   integer     NOT NULL DEFAULT 0,
+    "Active"     boolean     NOT NULL DEFAULT true,
+    "Starts_At"  timestamptz,
+    "Ends_At"    timestamptz,
+    "Created_At" timestamptz NOT NULL DEFAULT now(),
+    "Updated_At" timestamptz NOT NULL DEFAULT now(),
+    CHECK ("Ends_At" IS NULL OR "Starts_At" IS NULL OR "Ends_At" > "Starts_At")
+);
+CREATE INDEX IF NOT EXISTS "Promotions_Active_idx" ON "Promotions"("Active", "Ends_At");
+
+ALTER TABLE "Orders" ADD COLUMN IF NOT EXISTS "Discount_Cents" bigint NOT NULL DEFAULT 0;
+ALTER TABLE "Order_Items" ADD COLUMN IF NOT EXISTS "Discount_Cents" bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS "Order_Discounts" (
+    "ID"            serial  PRIMARY KEY,
+    "Order_ID"      integer NOT NULL REFERENCES "Orders"("ID") ON DELETE CASCADE,
+    "Order_Item_ID" integer NOT NULL REFERENCES "Order_Items"("ID") ON DELETE CASCADE,
+    "Promotion_ID"  integer REFERENCES "Promotions"("ID") ON DELETE SET NULL,
+    "Name"          text    NOT NULL,
+    "Amount_Cents"  bigint  NOT NULL CHECK ("Amount_Cents" > 0)
+);
+CREATE INDEX IF NOT EXISTS "Order_Discounts_Order_ID_idx" ON "Order_Discounts"("Order_ID");
+
+COMMIT;
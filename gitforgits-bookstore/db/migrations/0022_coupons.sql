@@ -0,0 +1,35 @@
+-- Coupons. A coupon code unlocks a coupon-only promotion for the cart it is entered in.
+-- "Redemptions" counts the orders placed with it; it is only raised by a guarded UPDATE, so
+-- concurrent orders can't take a coupon past "Max_Redemptions". Each redemption is kept per
+-- order, for per-customer limits and so a cancelled order can give its use back.
+
+BEGIN;
+
+ALTER TABLE "Promotions" ADD COLUMN IF NOT EXISTS "Coupon_Only" boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS "Coupons" (
+    "ID"                 serial      PRIMARY KEY,
+    "Code"               text        NOT NULL UNIQUE CHECK ("Code" <> '' AND "Code" = upper("Code")),
+    "Promotion_ID"       integer     NOT NULL REFERENCES "Promotions"("ID") ON DELETE CASCADE,
+    "Max_Redemptions"    integer     CHECK ("Max_Redemptions" > 0),
+    "Per_Customer_Limit" integer     CHECK ("Per_Customer_Limit" > 0),
+    "Min_Subtotal_Cents" bigint      NOT NULL DEFAULT 0 CHECK ("Min_Subtotal_Cents" >= 0),
+    "Expires_At"         timestamptz,
+    "Redemptions"        integer     NOT NULL DEFAULT 0,
+    "Created_At"         timestamptz NOT NULL DEFAULT now(),
+    CHECK ("Redemptions" >= 0 AND ("Max_Redemptions" IS NULL OR "Redemptions" <= "Max_Redemptions"))
+);
+CREATE INDEX IF NOT EXISTS "Coupons_Promotion_ID_idx" ON "Coupons"("Promotion_ID");
+
+CREATE TABLE IF NOT EXISTS "Coupon_Redemptions" (
+    "Order_ID"   integer     PRIMARY KEY REFERENCES "Orders"("ID") ON DELETE CASCADE,
+    "Coupon_ID"  integer     NOT NULL REFERENCES "Coupons"("ID") ON DELETE CASCADE,
+    "User_ID"    integer     NOT NULL REFERENCES "Users"("ID") ON DELETE CASCADE,
+    "Created_At" timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "Coupon_Redemptions_Coupon_ID_idx" ON "Coupon_Redemptions"("Coupon_ID", "User_ID");
+
+ALTER TABLE "Carts" ADD COLUMN IF NOT EXISTS "Coupon_ID" integer REFERENCES "Coupons"("ID") ON DELETE SET NULL;
+ALTER TABLE "Orders" ADD COLUMN IF NOT EXISTS "Coupon_Code" text;
+
+COMMIT;
@@ -0,0 +1,82 @@
+-- Gift cards and store credit. Both are accounts in a double-entry ledger: every change of a
+-- balance is an entry, and the entries of a transaction add up to zero, the other side being
+-- a system account. "Balance_Cents" is kept in step with the entries by the same statements,
+-- and customers' balances are checked here so they can never go negative. Entries are never
+-- changed or deleted; mistakes are put right by posting another transaction. A transaction's
+-- "Key" is unique, so the same spend can't be posted twice.
+--
+-- Gift cards are sold as books marked "Gift_Card", priced at the card's value, and issued
+-- when the order ships. Carts remember the gift cards entered at checkout and whether to use
+-- store credit; an order keeps what they paid as "Tender_Cents". Refunds can go to store
+-- credit instead of the payment.
+
+BEGIN;
+
+ALTER TABLE "Books" ADD COLUMN IF NOT EXISTS "Gift_Card" boolean NOT NULL DEFAULT false;
+ALTER TABLE "Order_Items" ADD COLUMN IF NOT EXISTS "Gift_Card" boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS "Ledger_Accounts" (
+    "ID"            serial      PRIMARY KEY,
+    "Kind"          text        NOT NULL CHECK ("Kind" IN ('system','gift_card','store_credit')),
+    "Name"          text        UNIQUE,
+    "User_ID"       integer     UNIQUE REFERENCES "Users"("ID") ON DELETE SET NULL,
+    "Balance_Cents" bigint      NOT NULL DEFAULT 0,
+    "Created_At"    timestamptz NOT NULL DEFAULT now(),
+    CHECK ("Kind" = 'system' OR "Balance_Cents" >= 0),
+    CHECK (("Kind" = 'system') = ("Name" IS NOT NULL)),
+    CHECK ("Kind" = 'store_credit' OR "User_ID" IS NULL)
+);
+
+INSERT INTO "Ledger_Accounts"("Kind","Name") VALUES
+    ('system','gift_cards_sold'),
+    ('system','order_tender'),
+    ('system','store_credit_issued')
+ON CONFLICT ("Name") DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS "Ledger_Transactions" (
+    "ID"         serial      PRIMARY KEY,
+    "Key"        text        NOT NULL UNIQUE,
+    "Kind"       text        NOT NULL,
+    "Order_ID"   integer     REFERENCES "Orders"("ID") ON DELETE RESTRICT,
+    "Actor_ID"   integer     REFERENCES "Users"("ID") ON DELETE SET NULL,
+    "Actor"      text        NOT NULL,
+    "Memo"       text        NOT NULL DEFAULT '',
+    "Created_At" timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "Ledger_Transactions_Order_ID_idx" ON "Ledger_Transactions"("Order_ID");
+
+CREATE TABLE IF NOT EXISTS "Ledger_Entries" (
+    "ID"             serial  PRIMARY KEY,
+    "Transaction_ID" integer NOT NULL REFERENCES "Ledger_Transactions"("ID") ON DELETE RESTRICT,
+    "Account_ID"     integer NOT NULL REFERENCES "Ledger_Accounts"("ID") ON DELETE RESTRICT,
+    "Amount_Cents"   bigint  NOT NULL CHECK ("Amount_Cents" <> 0),
+    UNIQUE ("Transaction_ID", "Account_ID")
+);
+CREATE INDEX IF NOT EXISTS "Ledger_Entries_Account_ID_idx" ON "Ledger_Entries"("Account_ID");
+
+CREATE TABLE IF NOT EXISTS "Gift_Cards" (
+    "ID"            serial      PRIMARY KEY,
+    "Code"          text        NOT NULL UNIQUE CHECK ("Code" <> '' AND "Code" = upper("Code")),
+    "Account_ID"    integer     NOT NULL UNIQUE REFERENCES "Ledger_Accounts"("ID") ON DELETE RESTRICT,
+    "Initial_Cents" bigint      NOT NULL CHECK ("Initial_Cents" > 0),
+    "Order_Item_ID" integer     REFERENCES "Order_Items"("ID") ON DELETE SET NULL,
+    "Created_At"    timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "Gift_Cards_Order_Item_ID_idx" ON "Gift_Cards"("Order_Item_ID");
+
+CREATE TABLE IF NOT EXISTS "Cart_Gift_Cards" (
+    "Cart_ID"      integer     NOT NULL REFERENCES "Carts"("ID") ON DELETE CASCADE,
+    "Gift_Card_ID" integer     NOT NULL REFERENCES "Gift_Cards"("ID") ON DELETE CASCADE,
+    "Added_At"     timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("Cart_ID", "Gift_Card_ID")
+);
+
+ALTER TABLE "Carts" ADD COLUMN IF NOT EXISTS "Use_Store_Credit" boolean NOT NULL DEFAULT false;
+ALTER TABLE "Orders" ADD COLUMN IF NOT EXISTS "Tender_Cents" bigint NOT NULL DEFAULT 0 CHECK ("Tender_Cents" >= 0);
+
+ALTER TABLE "Refunds" ALTER COLUMN "Payment_ID" DROP NOT NULL;
+ALTER TABLE "Refunds" ALTER COLUMN "Provider_Refund_ID" DROP NOT NULL;
+ALTER TABLE "Refunds" ADD COLUMN IF NOT EXISTS "Method" text NOT NULL DEFAULT 'payment' CHECK ("Method" IN ('payment','store_credit'));
+ALTER TABLE "Refunds" ADD COLUMN IF NOT EXISTS "Ledger_Transaction_ID" integer REFERENCES "Ledger_Transactions"("ID") ON DELETE RESTRICT;
+
+COMMIT;
@@ -0,0 +1,298 @@
+package bookHandler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/flintg/gitforgits-bookstore/fileStorage"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var CoverStorage fileStorage.Storage
+var MaxCoverBytes int64 = 5 << 20 // 5 MiB
+var MaxCoverPixels int = 40_000_000
+
+/*
+Thumbnail sizes generated for every uploaded cover, by name and width in pixels. Thumbnails
+are never upscaled, so a small upload produces thumbnails no wider than itself.
+*/
+var CoverSizes = []struct {
+	Name  string
+	Width int
+}{
+	{"small", 160},
+	{"medium", 320},
+	{"large", 640},
+}
+
+// Sniffed content types we accept, mapped to the extension the original is stored under.
+var coverTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+/*
+Returns the URL of a generated cover thumbnail ("small", "medium", "large") or of the
+"original" upload for b. Returns "" when the book has no cover.
+*/
+func (b Book) CoverURL(size string) string {
+	if b.CoverVersion == "" {
+		return ""
+	}
+	ext := ".jpg"
+	if size == "original" {
+		ext = b.CoverExt
+	}
+	return fmt.Sprintf("%v/%d/cover/%v/%v%v", BookPathPrefix, b.ID, b.CoverVersion, size, ext)
+}
+
+func validCoverSize(size string) bool {
+	if size == "original" {
+		return true
+	}
+	for _, s := range CoverSizes {
+		if s.Name == size {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Accepts a cover image for a book, either as the "cover" field of a multipart form or as the
+raw request body. The type is sniffed from the content rather than trusted from the client.
+
+Covers are stored under a version derived from their content hash, so every URL handed out
+is immutable and can be cached forever.
+*/
+func UploadBookCover(w http.ResponseWriter, r *http.Request) {
+	var (
+		bookID, _  = strconv.Atoi(mux.Vars(r)["id"])
+		src        io.Reader
+		oldVersion sql.NullString
+	)
+	if CoverStorage == nil {
+		log.Print("bookHandler.UploadBookCover; CoverStorage is nil.")
+		http.Error(w, "Cover uploads are not available right now.", http.StatusServiceUnavailable)
+		return
+	}
+	err := BookDB.QueryRow("SELECT \"Cover_Version\" FROM \"Books\" WHERE \"ID\"=$1", bookID).Scan(&oldVersion)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Book not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(fmt.Sprintf("bookHandler.UploadBookCover; BookDB.QueryRow failed. Error: %v", err))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxCoverBytes)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("cover")
+		if err != nil {
+			coverReadError(w, err)
+			return
+		}
+		defer file.Close()
+		src = file
+	} else {
+		src = r.Body
+	}
+	data, err := io.ReadAll(io.LimitReader(src, MaxCoverBytes+1))
+	if err != nil {
+		coverReadError(w, err)
+		return
+	}
+	if int64(len(data)) > MaxCoverBytes {
+		coverReadError(w, &http.MaxBytesError{Limit: MaxCoverBytes})
+		return
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := coverTypes[contentType]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported image type %v. Upload a JPEG, PNG or WebP.", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	// Check the dimensions before decoding, so a tiny file can't make us allocate a huge bitmap.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		http.Error(w, "The uploaded file is not a valid image.", http.StatusBadRequest)
+		return
+	}
+	if cfg.Width*cfg.Height > MaxCoverPixels {
+		http.Error(w, fmt.Sprintf("The image is too large (%dx%d).", cfg.Width, cfg.Height), http.StatusRequestEntityTooLarge)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "The uploaded file is not a valid image.", http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	book := Book{ID: bookID, CoverVersion: hex.EncodeToString(sum[:8]), CoverExt: ext}
+	prefix := fmt.Sprintf("covers/%d/%v", bookID, book.CoverVersion)
+	if err = CoverStorage.Put(prefix+"/original"+ext, bytes.NewReader(data)); err != nil {
+		log.Printf("bookHandler.UploadBookCover; storing original for book [%v] failed. Error: %v", bookID, err)
+		http.Error(w, "Could not store the cover.", http.StatusInternalServerError)
+		return
+	}
+	urls := map[string]string{"original": book.CoverURL("original")}
+	for _, size := range CoverSizes {
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, resizeCover(img, size.Width), &jpeg.Options{Quality: 85}); err == nil {
+			err = CoverStorage.Put(fmt.Sprintf("%v/%v.jpg", prefix, size.Name), &buf)
+		}
+		if err != nil {
+			log.Printf("bookHandler.UploadBookCover; storing %v thumbnail for book [%v] failed. Error: %v", size.Name, bookID, err)
+			http.Error(w, "Could not store the cover.", http.StatusInternalServerError)
+			return
+		}
+		urls[size.Name] = book.CoverURL(size.Name)
+	}
+	if _, err = BookDB.Exec("UPDATE \"Books\" SET \"Cover_Version\"=$1,\"Cover_Ext\"=$3 WHERE \"ID\"=$2", book.CoverVersion, bookID, ext); err != nil {
+		log.Printf("bookHandler.UploadBookCover; updating book [%v] failed. Error: %v", bookID, err)
+		http.Error(w, "Could not store the cover.", http.StatusInternalServerError)
+		return
+	}
+	if oldVersion.Valid && oldVersion.String != book.CoverVersion {
+		if err = CoverStorage.DeletePrefix(fmt.Sprintf("covers/%d/%v", bookID, oldVersion.String)); err != nil {
+			log.Printf("bookHandler.UploadBookCover; removing old cover [%v] for book [%v] failed. Error: %v", oldVersion.String, bookID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", book.CoverURL("medium"))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(urls)
+}
+
+/*
+Redirects to the current cover of a book. The size query parameter picks a thumbnail or the
+original and defaults to medium; any other size is a 400.
+*/
+func GetBookCover(w http.ResponseWriter, r *http.Request) {
+	var (
+		bookID, _ = strconv.Atoi(mux.Vars(r)["id"])
+		version   sql.NullString
+		ext       sql.NullString
+		size      = r.URL.Query().Get("size")
+	)
+	if size == "" {
+		size = "medium"
+	}
+	if !validCoverSize(size) {
+		http.Error(w, fmt.Sprintf("Unknown cover size %v.", size), http.StatusBadRequest)
+		return
+	}
+	err := BookDB.QueryRow("SELECT \"Cover_Version\",\"Cover_Ext\" FROM \"Books\" WHERE \"ID\"=$1", bookID).Scan(&version, &ext)
+	if err != nil && err != sql.ErrNoRows {
+		panic(fmt.Sprintf("bookHandler.GetBookCover; BookDB.QueryRow failed. Error: %v", err))
+	}
+	if !version.Valid {
+		http.Error(w, "This book has no cover.", http.StatusNotFound)
+		return
+	}
+	// The target changes whenever a new cover is uploaded, so this hop is only cached briefly.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	http.Redirect(w, r, Book{ID: bookID, CoverVersion: version.String, CoverExt: ext.String}.CoverURL(size), http.StatusFound)
+}
+
+/*
+Serves a stored cover or thumbnail. The URL embeds the content version, so responses are
+cacheable for a year.
+*/
+func ServeBookCover(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if CoverStorage == nil {
+		http.Error(w, "Cover not found.", http.StatusNotFound)
+		return
+	}
+	key := fmt.Sprintf("covers/%v/%v/%v", vars["id"], vars["version"], vars["file"])
+	obj, err := CoverStorage.Open(key)
+	if errors.Is(err, fileStorage.ErrNotFound) || errors.Is(err, fileStorage.ErrInvalidKey) {
+		http.Error(w, "Cover not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("bookHandler.ServeBookCover; opening [%v] failed. Error: %v", key, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, vars["file"], obj.ModTime(), obj)
+}
+
+/*
+Removes the cover from a book. Stored images are deleted along with it.
+*/
+func DeleteBookCover(w http.ResponseWriter, r *http.Request) {
+	var (
+		bookID, _ = strconv.Atoi(mux.Vars(r)["id"])
+		version   sql.NullString
+	)
+	err := BookDB.QueryRow("SELECT \"Cover_Version\" FROM \"Books\" WHERE \"ID\"=$1", bookID).Scan(&version)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Book not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(fmt.Sprintf("bookHandler.DeleteBookCover; BookDB.QueryRow failed. Error: %v", err))
+	}
+	if _, err = BookDB.Exec("UPDATE \"Books\" SET \"Cover_Version\"=NULL,\"Cover_Ext\"=NULL WHERE \"ID\"=$1", bookID); err != nil {
+		log.Printf("bookHandler.DeleteBookCover; updating book [%v] failed. Error: %v", bookID, err)
+		http.Error(w, "Unable to process the request.", http.StatusInternalServerError)
+		return
+	}
+	if version.Valid && CoverStorage != nil {
+		if err = CoverStorage.DeletePrefix(fmt.Sprintf("covers/%d/%v", bookID, version.String)); err != nil {
+			log.Printf("bookHandler.DeleteBookCover; removing cover [%v] for book [%v] failed. Error: %v", version.String, bookID, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Scales src down to width pixels wide, keeping its aspect ratio. Transparent areas are
+flattened onto white because thumbnails are encoded as JPEG.
+*/
+func resizeCover(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() < width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+/*
+Reports a failure reading an upload, distinguishing oversize bodies from malformed ones.
+*/
+func coverReadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Covers may be at most %d bytes.", MaxCoverBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Printf("bookHandler.UploadBookCover; reading upload failed. Error: %v", err)
+	http.Error(w, "Could not read the uploaded cover. Send it as the \"cover\" field of a multipart form or as the request body.", http.StatusBadRequest)
+}
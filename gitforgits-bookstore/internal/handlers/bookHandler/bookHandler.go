@@ -12,8 +12,13 @@ import (
 	"strings"
 
 	"github.com/flintg/gitforgits-bookstore/genreHandler"
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+	"github.com/flintg/gitforgits-bookstore/recommendationHandler"
+	"github.com/flintg/gitforgits-bookstore/reviewHandler"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 var BookPathPrefix string = "/book"
@@ -23,18 +28,36 @@ var templateCache *template.Template
 var BookDB *sql.DB
 
 type Book struct {
-	ID          int
-	Title       string
-	Author      string
-	Genre       int
-	Description string
-	ISBN        string
-	Pages       int
-	ImageURL    string
-	Price       string
-	//UserReview  string // this should be another struct or an array, probably
+	ID            int
+	Title         string
+	Author        string
+	Genres        []genreHandler.Genre
+	Tags          []string
+	Description   string
+	ISBN          string
+	Pages         int
+	ImageURL      string
+	CoverVersion  string
+	CoverExt      string // of the original upload
+	Price         string
+	GiftCard      bool // sold as a gift card worth its price, issued when the order ships
+	ReviewCount   int
+	RatingAverage float64
+	UserReviews   []reviewHandler.Review
+	AlsoBought    []recommendationHandler.Recommendation
+	Similar       []recommendationHandler.Recommendation
 }
 
+/*
+Selects a book along with the genres and tags attached to it. Genre IDs and names are
+aggregated in the same order so scanBook can zip them back together.
+*/
+const bookSelect = `SELECT b."ID",b."Title",b."Author",b."Description",b."ISBN",b."Price",COALESCE(b."Cover_Version",''),COALESCE(b."Cover_Ext",''),b."Gift_Card",b."Review_Count",b."Rating_Average",
+	COALESCE((SELECT array_agg(g."ID" ORDER BY g."Name") FROM "Book_Genres" bg JOIN "Genres" g ON g."ID"=bg."Genre_ID" WHERE bg."Book_ID"=b."ID"),'{}'),
+	COALESCE((SELECT array_agg(g."Name" ORDER BY g."Name") FROM "Book_Genres" bg JOIN "Genres" g ON g."ID"=bg."Genre_ID" WHERE bg."Book_ID"=b."ID"),'{}'),
+	COALESCE((SELECT array_agg(t."Tag" ORDER BY t."Tag") FROM "Book_Tags" t WHERE t."Book_ID"=b."ID"),'{}')
+	FROM "Books" b`
+
 type BookHandler struct {
 	Templates *template.Template //= template.New("").Delims("{{", "}}")
 }
@@ -48,16 +71,30 @@ Borrowed from StackOverflow answer https://stackoverflow.com/a/44391691, retriev
 func RegisterHandlers(r *mux.Router) {
 	sr := r.PathPrefix(BookPathPrefix).Subrouter()
 	sr.HandleFunc("/", GetBooks).Methods("GET")
-	sr.HandleFunc("/add", AddBook)
 	sr.HandleFunc("/{id:[0-9]+}", GetBookDetail).Methods("GET")
-	sr.HandleFunc("/{id:[0-9]+}/update", UpdateBookDetail).Methods("PUT")
-	sr.HandleFunc("/{id:[0-9]+}/delete", DeleteBook).Methods("DELETE")
-	sr.HandleFunc("/{id:[0-9]+}/reviews", GetBookReviews).Methods("GET")
+	sr.HandleFunc("/{id:[0-9]+}/cover", GetBookCover).Methods("GET")
+	sr.HandleFunc("/{id:[0-9]+}/cover/{version:[0-9a-f]+}/{file:[a-z]+\\.(?:jpg|png|webp)}", ServeBookCover).Methods("GET", "HEAD")
+	// Changes to the catalogue are for staff only.
+	adm := sr.NewRoute().Subrouter()
+	adm.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequirePermission(mAuthorize.PermCatalogueWrite))
+	adm.HandleFunc("/add", AddBook)
+	adm.HandleFunc("/{id:[0-9]+}/update", UpdateBookDetail).Methods("PUT")
+	adm.HandleFunc("/{id:[0-9]+}/gift-card", SetBookGiftCard).Methods("POST", "PUT")
+	adm.HandleFunc("/{id:[0-9]+}/delete", DeleteBook).Methods("DELETE")
+	adm.HandleFunc("/{id:[0-9]+}/cover", UploadBookCover).Methods("POST", "PUT")
+	adm.HandleFunc("/{id:[0-9]+}/cover", DeleteBookCover).Methods("DELETE")
+	reviewHandler.BookPathPrefix = BookPathPrefix
+	reviewHandler.RegisterHandlers(sr)
+	recommendationHandler.RegisterHandlers(sr)
 	sr.NotFoundHandler = http.HandlerFunc(GetBookNotFound)
 }
 
 /*
-Gets a list of books
+Gets a list of books. The list can be filtered with one or more genre and tag query
+parameters, e.g. /books/?genre=3&genre=7&tag=signed&tag=first-edition.
+
+A book matches when it belongs to ANY of the requested genres and carries ALL of the
+requested tags.
 */
 func GetBooks(w http.ResponseWriter, r *http.Request) {
 	//Handler logic to fetch and return book details
@@ -65,22 +102,36 @@ func GetBooks(w http.ResponseWriter, r *http.Request) {
 		fetchedBook  Book
 		fetchedBooks []Book
 		curQuery     string
-		curSelect    string
-		curWhere     string
+		curWhere     []string
+		curArgs      []interface{}
+		genreIDs     []int64
+		tags         []string
 	)
 	// Genre_ID is an integer, so expect an integer. Failure means it's not an integer (insert: Mr. Burns emoji here)
-	genre_id, err := strconv.Atoi(r.URL.Query().Get("genre"))
-	if err == nil {
-		//ToDo: Figure out a good way to handle "AND" and "OR" with multiple filter selections. But for now, we only expect one kind of filter, a genre.
-		curWhere = strings.Join([]string{curWhere, "\"Genre_ID\"=", strconv.Itoa(genre_id)}, " ")
+	for _, sGenre := range r.URL.Query()["genre"] {
+		genre_id, err := strconv.Atoi(sGenre)
+		if err != nil {
+			log.Printf("bookHandler.GetBooks; ignoring genre filter [%v], it is not an integer.", sGenre)
+			continue
+		}
+		genreIDs = append(genreIDs, int64(genre_id))
+	}
+	tags = normalizeTags(r.URL.Query()["tag"])
+	if len(genreIDs) > 0 {
+		curArgs = append(curArgs, pq.Array(genreIDs))
+		curWhere = append(curWhere, fmt.Sprintf("b.\"ID\" IN (SELECT \"Book_ID\" FROM \"Book_Genres\" WHERE \"Genre_ID\"=ANY($%d))", len(curArgs)))
+	}
+	if len(tags) > 0 {
+		curArgs = append(curArgs, pq.Array(tags), len(tags))
+		curWhere = append(curWhere, fmt.Sprintf("b.\"ID\" IN (SELECT \"Book_ID\" FROM \"Book_Tags\" WHERE \"Tag\"=ANY($%d) GROUP BY \"Book_ID\" HAVING COUNT(*)=$%d)", len(curArgs)-1, len(curArgs)))
 	}
-	curSelect = "SELECT \"ID\",\"Title\",\"Author\",\"Genre_ID\",\"Description\",\"ISBN\",\"Price\" FROM \"Books\""
-	if curWhere != "" {
-		curWhere = strings.Join([]string{"WHERE", curWhere}, " ")
+	curQuery = bookSelect
+	if len(curWhere) > 0 {
+		curQuery = strings.Join([]string{curQuery, "WHERE", strings.Join(curWhere, " AND ")}, " ")
 	}
-	curQuery = strings.Join([]string{curSelect, curWhere, ";"}, " ")
+	curQuery = strings.Join([]string{curQuery, "ORDER BY b.\"Title\";"}, " ")
 	log.Printf("bookHandler.GetBooks; curQuery=[%v]", curQuery)
-	rows, err := BookDB.Query(curQuery)
+	rows, err := BookDB.Query(curQuery, curArgs...)
 	if err != nil {
 		//log.Printf()
 		panic(fmt.Sprintf("bookHandler.GetBooks; BookDB.Query [%v] failed. Error: %v", curQuery, err))
@@ -97,15 +148,7 @@ func GetBooks(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "No books found.", http.StatusNotFound)
 				return
 			}
-			if err := rows.Scan(
-				&fetchedBook.ID,
-				&fetchedBook.Title,
-				&fetchedBook.Author,
-				&fetchedBook.Genre,
-				&fetchedBook.Description,
-				&fetchedBook.ISBN,
-				&fetchedBook.Price,
-			); err != nil {
+			if err := scanBook(rows, &fetchedBook); err != nil {
 				log.Printf("bookHandler.GetBooks; rows.Scan() on query [%v] failed. Error: %v", curQuery, err)
 				http.Error(w, "", http.StatusInternalServerError)
 				keepLooping = false
@@ -231,32 +274,29 @@ func AddBook(w http.ResponseWriter, r *http.Request) {
 			newBook.ISBN = r.FormValue("isbn")
 			newBook.Description = r.FormValue("description")
 			newBook.Price = r.FormValue("price")
-			var (
-				genre  int
-				sGenre string
-			)
-			sGenre = r.FormValue("genre")
-			log.Printf("New book to add: %v, %v, %v, %v, %v", newBook.Title, newBook.Author, newBook.ISBN, newBook.Description, sGenre)
-			if genre, err = strconv.Atoi(sGenre); err == nil {
-				newBook.Genre = genre
-			} else {
-				http.Error(w, "Genre must be an integer.", http.StatusBadRequest)
-				log.Printf("addBook: Bad request. Genre must be an integer, received %s. Error: %v", sGenre, err)
-				return
+			newBook.Tags = strings.Split(r.FormValue("tags"), ",")
+			newBook.GiftCard = r.FormValue("gift_card") != ""
+			log.Printf("New book to add: %v, %v, %v, %v, %v", newBook.Title, newBook.Author, newBook.ISBN, newBook.Description, r.Form["genre"])
+			for _, sGenre := range r.Form["genre"] {
+				genre, err := strconv.Atoi(sGenre)
+				if err != nil {
+					http.Error(w, "Genre must be an integer.", http.StatusBadRequest)
+					log.Printf("addBook: Bad request. Genre must be an integer, received %s. Error: %v", sGenre, err)
+					return
+				}
+				newBook.Genres = append(newBook.Genres, genreHandler.Genre{ID: genre})
 			}
 		} else {
 			http.Error(w, fmt.Sprintf("Unexpected Content-Type %s", rContentType), http.StatusBadRequest)
 			log.Printf("addBook: Bad request. Unexpected Content-Type, received %s", rContentType)
 			return
 		}
-		result, err := BookDB.Exec(
-			"INSERT INTO \"Books\"(\"Title\",\"Author\",\"ISBN\",\"Description\",\"Genre_ID\",\"Price\") VALUES($1,$2,$3,$4,$5,$6)",
-			newBook.Title, newBook.Author, newBook.ISBN, newBook.Description, newBook.Genre, 0)
-		if err != nil {
+		newBook.Tags = normalizeTags(newBook.Tags)
+		if err = insertBook(&newBook); err != nil {
 			http.Error(w, fmt.Sprintf("bookHandler.AddBook error: %v", err), http.StatusInternalServerError)
 		} else {
 			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(result)
+			json.NewEncoder(w).Encode(&newBook)
 		}
 		/*BookstoreDB.Create($newBook)
 		w.WriteHeader(http.StatusCreated)
@@ -279,7 +319,7 @@ func GetBookDetail(w http.ResponseWriter, r *http.Request) {
 		fetchedBook Book
 		curQuery    string
 	)
-	curQuery = fmt.Sprintf("SELECT \"Title\",\"Author\",\"Genre_ID\",\"Description\",\"ISBN\",0 FROM \"Books\" WHERE \"ID\"=%v", bookID)
+	curQuery = fmt.Sprintf("%v WHERE b.\"ID\"=%v", bookSelect, bookID)
 	rows, err := BookDB.Query(curQuery)
 	if err != nil {
 		//log.Printf()
@@ -288,11 +328,25 @@ func GetBookDetail(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 	if rows.Next() {
-		if err := rows.Scan(&fetchedBook.Title, &fetchedBook.Author, &fetchedBook.Genre, &fetchedBook.Description, &fetchedBook.ISBN, &fetchedBook.Pages); err != nil {
+		if err := scanBook(rows, &fetchedBook); err != nil {
 			log.Printf("bookHandler.GetBookDetail; rows.Scan() on query [%v] failed. Error: %v", curQuery, err)
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
+		if fetchedBook.UserReviews, err = reviewHandler.ListReviews(fetchedBook.ID); err != nil {
+			log.Printf("bookHandler.GetBookDetail; loading reviews for book [%v] failed. Error: %v", fetchedBook.ID, err)
+		}
+		if recommendations, err := recommendationHandler.ListRecommendations(fetchedBook.ID); err != nil {
+			log.Printf("bookHandler.GetBookDetail; loading recommendations for book [%v] failed. Error: %v", fetchedBook.ID, err)
+		} else {
+			for _, rec := range recommendations {
+				if rec.Reason == recommendationHandler.ReasonCoPurchase {
+					fetchedBook.AlsoBought = append(fetchedBook.AlsoBought, rec)
+				} else {
+					fetchedBook.Similar = append(fetchedBook.Similar, rec)
+				}
+			}
+		}
 		if templateCache == nil {
 			log.Print("bookHandler templateCache is nil.")
 			panic("bookHandler.template is nil!")
@@ -341,6 +395,42 @@ func UpdateBookDetail(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&updatedBook)
 }
 
+/*
+Marks a book as a gift card, or as an ordinary book again, from the gift_card field or
+{"GiftCard"}. Orders already placed keep what they were. Browsers go back to the book.
+*/
+func SetBookGiftCard(w http.ResponseWriter, r *http.Request) {
+	var (
+		bookID, _ = strconv.Atoi(mux.Vars(r)["id"])
+		req       struct{ GiftCard bool }
+		isJSON    = strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	)
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.GiftCard = r.FormValue("gift_card") != ""
+	}
+	result, err := BookDB.Exec("UPDATE \"Books\" SET \"Gift_Card\"=$2 WHERE \"ID\"=$1", bookID, req.GiftCard)
+	if err != nil {
+		log.Printf("bookHandler.SetBookGiftCard; updating book [%v] failed. Error: %v", bookID, err)
+		http.Error(w, "Unable to process the request.", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Book not found.", http.StatusNotFound)
+		return
+	}
+	if !isJSON {
+		http.Redirect(w, r, fmt.Sprintf("%v/%d", BookPathPrefix, bookID), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ID": bookID, "GiftCard": req.GiftCard})
+}
+
 func DeleteBook(w http.ResponseWriter, r *http.Request) {
 	var (
 		vars   = mux.Vars(r)
@@ -382,13 +472,86 @@ func DeleteBook(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-Gets the reviews of a single book
+Inserts a book together with its genre and tag rows in a single transaction. On success the
+new ID is written back into b.
 */
-func GetBookReviews(w http.ResponseWriter, r *http.Request) {
-	//Handler logic to fetch and return book reviews
-	vars := mux.Vars(r)
-	bookID := vars["id"]
-	http.Error(w, fmt.Sprintf("Oops, .getBookReviews isn't implemented, yet. id: [%v]", bookID), http.StatusNotImplemented)
+func insertBook(b *Book) error {
+	tx, err := BookDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		"INSERT INTO \"Books\"(\"Title\",\"Author\",\"ISBN\",\"Description\",\"Price\",\"Gift_Card\") VALUES($1,$2,$3,$4,$5,$6) RETURNING \"ID\"",
+		b.Title, b.Author, b.ISBN, b.Description, 0, b.GiftCard).Scan(&b.ID)
+	if err != nil {
+		return err
+	}
+	for _, genre := range b.Genres {
+		if _, err = tx.Exec("INSERT INTO \"Book_Genres\"(\"Book_ID\",\"Genre_ID\") VALUES($1,$2) ON CONFLICT DO NOTHING", b.ID, genre.ID); err != nil {
+			return err
+		}
+	}
+	for _, tag := range b.Tags {
+		if _, err = tx.Exec("INSERT INTO \"Book_Tags\"(\"Book_ID\",\"Tag\") VALUES($1,$2) ON CONFLICT DO NOTHING", b.ID, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+Scans a row produced by bookSelect into b.
+*/
+func scanBook(rows interface{ Scan(...interface{}) error }, b *Book) error {
+	var (
+		genreIDs   []int64
+		genreNames []string
+	)
+	b.Tags = nil
+	if err := rows.Scan(
+		&b.ID,
+		&b.Title,
+		&b.Author,
+		&b.Description,
+		&b.ISBN,
+		&b.Price,
+		&b.CoverVersion,
+		&b.CoverExt,
+		&b.GiftCard,
+		&b.ReviewCount,
+		&b.RatingAverage,
+		pq.Array(&genreIDs),
+		pq.Array(&genreNames),
+		pq.Array(&b.Tags),
+	); err != nil {
+		return err
+	}
+	b.ImageURL = b.CoverURL("medium")
+	b.Genres = make([]genreHandler.Genre, 0, len(genreIDs))
+	for i := range genreIDs {
+		b.Genres = append(b.Genres, genreHandler.Genre{ID: int(genreIDs[i]), Name: genreNames[i]})
+	}
+	return nil
+}
+
+/*
+Trims and lower-cases free-form tags, dropping blanks and duplicates.
+*/
+func normalizeTags(raw []string) []string {
+	var (
+		tags []string
+		seen = map[string]bool{}
+	)
+	for _, tag := range raw {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
 }
 
 /*
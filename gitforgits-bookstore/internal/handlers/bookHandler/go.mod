@@ -3,8 +3,28 @@ module golang-web-book/gitforgits-bookstore/internal/handlers/bookHandler
 go 1.22.4
 
 require (
+	github.com/flintg/gitforgits-bookstore/fileStorage v0.0.0-00010101000000-000000000000
 	github.com/flintg/gitforgits-bookstore/genreHandler v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/recommendationHandler v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/reviewHandler v0.0.0-00010101000000-000000000000
 	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+	golang.org/x/image v0.18.0
+)
+
+require (
+	github.com/flintg/gitforgits-bookstore/mAuthenticate v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/mAuthorize v0.0.0-00010101000000-000000000000
 )
 
 replace github.com/flintg/gitforgits-bookstore/genreHandler => ../genreHandler
+
+replace github.com/flintg/gitforgits-bookstore/fileStorage => ../../storage/fileStorage
+
+replace github.com/flintg/gitforgits-bookstore/reviewHandler => ../reviewHandler
+
+replace github.com/flintg/gitforgits-bookstore/recommendationHandler => ../recommendationHandler
+
+replace github.com/flintg/gitforgits-bookstore/mAuthenticate => ../../middleware/mAuthenticate
+
+replace github.com/flintg/gitforgits-bookstore/mAuthorize => ../../middleware/mAuthorize
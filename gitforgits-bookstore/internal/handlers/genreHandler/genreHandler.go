@@ -8,6 +8,9 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+
 	"github.com/gorilla/mux"
 )
 
@@ -33,10 +36,13 @@ Borrowed from StackOverflow answer https://stackoverflow.com/a/44391691, retriev
 func RegisterHandlers(r *mux.Router) {
 	sr := r.PathPrefix(GenrePathPrefix).Subrouter()
 	sr.HandleFunc("/", GetGenres).Methods("GET")
-	sr.HandleFunc("/add", AddGenre)
 	sr.HandleFunc("/{id:[0-9]+}", GetGenreDetail).Methods("GET")
-	sr.HandleFunc("/{id:[0-9]+}/update", UpdateGenreDetail).Methods("PUT")
-	sr.HandleFunc("/{id:[0-9]+}/delete", DeleteGenre).Methods("POST", "DELETE")
+	// Changes to the catalogue are for staff only.
+	adm := sr.NewRoute().Subrouter()
+	adm.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequirePermission(mAuthorize.PermCatalogueWrite))
+	adm.HandleFunc("/add", AddGenre)
+	adm.HandleFunc("/{id:[0-9]+}/update", UpdateGenreDetail).Methods("PUT")
+	adm.HandleFunc("/{id:[0-9]+}/delete", DeleteGenre).Methods("POST", "DELETE")
 	sr.NotFoundHandler = http.HandlerFunc(GetGenreNotFound)
 }
 
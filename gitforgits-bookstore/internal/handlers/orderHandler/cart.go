@@ -0,0 +1,563 @@
+package orderHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
+)
+
+/*
+Guests get a cart identified by a random token in this cookie. It is merged into their own
+cart when they log in.
+*/
+var (
+	CartCookieName   = "gfg_cart"
+	CartCookieSecure = true
+	GuestCartTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	MaxCartQuantity = 99
+	MaxCartLines    = 100
+)
+
+var (
+	errNotForSale = errors.New("book is not for sale")
+	errCartFull   = errors.New("cart is full")
+)
+
+/*
+A cart as shown to its owner. Prices are in cents; the string versions are formatted for
+display. Total is the subtotal less the promotions' discounts. Notices tell the user about
+prices that changed since the book was added, and about their coupon.
+*/
+type Cart struct {
+	Items         []CartItem
+	ItemCount     int
+	SubtotalCents int64
+	Subtotal      string
+	DiscountCents int64
+	Discount      string
+	TotalCents    int64
+	Total         string
+	Coupon        *CartCoupon `json:",omitempty"`
+	Notices       []string
+	id            int
+	couponID      int
+	couponDropped bool // the coupon couldn't be used any more and is left out
+}
+
+/*
+The part of the subtotal that promotions can discount, leaving out gift cards. Coupons'
+minimum subtotals are checked against it.
+*/
+func (c Cart) discountableCents() int64 {
+	var cents int64
+	for _, item := range c.Items {
+		if item.Available && !item.GiftCard {
+			cents += item.LineTotalCents
+		}
+	}
+	return cents
+}
+
+/*
+One book in a cart. UnitPriceCents is the price now, which is what the cart totals use;
+PreviousPriceCents is set when it differs from the price when the book was added. GiftCard
+marks a gift card, sold like a book and worth its price.
+*/
+type CartItem struct {
+	BookID             int
+	Title              string
+	Author             string
+	Quantity           int
+	UnitPriceCents     int64
+	UnitPrice          string
+	LineTotalCents     int64
+	LineTotal          string
+	PreviousPriceCents int64  `json:",omitempty"`
+	PreviousPrice      string `json:",omitempty"`
+	Available          bool
+	GiftCard           bool
+	DiscountCents      int64
+	Discount           string
+	Discounts          []LineDiscount `json:",omitempty"`
+}
+
+func registerCartHandlers(sr *mux.Router) {
+	sr.HandleFunc("", GetOrdersCart).Methods("GET")
+	sr.HandleFunc("/items", AddCartItem).Methods("POST")
+	sr.HandleFunc("/items/{bookID:[0-9]+}", UpdateCartItem).Methods("PUT")
+	sr.HandleFunc("/items/{bookID:[0-9]+}/update", UpdateCartItem).Methods("POST")
+	sr.HandleFunc("/items/{bookID:[0-9]+}", RemoveCartItem).Methods("DELETE")
+	sr.HandleFunc("/items/{bookID:[0-9]+}/delete", RemoveCartItem).Methods("POST")
+	registerCouponHandlers(sr)
+}
+
+/*
+Handles cart actions. Shows the cart of the signed in user, or of the guest cookie, as JSON
+or as the orderCart page.
+*/
+func GetOrdersCart(w http.ResponseWriter, r *http.Request) {
+	cartID, err := findCart(w, r, false)
+	cart := Cart{Items: []CartItem{}, Subtotal: formatCents(0), Discount: formatCents(0), Total: formatCents(0)}
+	if err == nil && cartID != 0 {
+		cart, err = loadCart(OrderDB, cartID)
+	}
+	if err != nil {
+		log.Printf("orderHandler.GetOrdersCart; loading cart failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	// After a reorder, books that couldn't be added
+	if n, _ := strconv.Atoi(r.URL.Query().Get("skipped")); n == 1 {
+		cart.Notices = append(cart.Notices, "One book from your order couldn't be added: it isn't for sale any more, or your cart is full.")
+	} else if n > 1 {
+		cart.Notices = append(cart.Notices, fmt.Sprintf("%d books from your order couldn't be added: they aren't for sale any more, or your cart is full.", n))
+	}
+	respondCart(w, r, http.StatusOK, cart)
+}
+
+/*
+Puts a book in the cart, or adds to its quantity if it's there already. Posted as book_id
+and quantity fields, or as {"BookID","Quantity"}; the quantity defaults to 1. The price is
+remembered so a later change can be pointed out.
+*/
+func AddCartItem(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		BookID   int
+		Quantity int
+	}
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.BookID, _ = strconv.Atoi(r.FormValue("book_id"))
+		req.Quantity, _ = strconv.Atoi(r.FormValue("quantity"))
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.BookID <= 0 || req.Quantity < 1 || req.Quantity > MaxCartQuantity {
+		http.Error(w, fmt.Sprintf("Send a book and a quantity from 1 to %d.", MaxCartQuantity), http.StatusBadRequest)
+		return
+	}
+	cartID, err := findCart(w, r, true)
+	if err == nil {
+		err = addToCart(cartID, req.BookID, req.Quantity)
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "No such book.", http.StatusNotFound)
+	case err == errNotForSale:
+		http.Error(w, "That book isn't for sale right now.", http.StatusConflict)
+	case err == errCartFull:
+		http.Error(w, fmt.Sprintf("A cart can hold up to %d different books.", MaxCartLines), http.StatusConflict)
+	case err != nil:
+		log.Printf("orderHandler.AddCartItem; adding book [%v] failed. Error: %v", req.BookID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+	default:
+		cartDone(w, r, cartID)
+	}
+}
+
+func addToCart(cartID int, bookID int, quantity int) error {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Locking the cart keeps concurrent adds from going over MaxCartLines.
+	var lines int
+	if err = tx.QueryRow("SELECT (SELECT count(*) FROM \"Cart_Items\" WHERE \"Cart_ID\"=c.\"ID\") FROM \"Carts\" c WHERE c.\"ID\"=$1 FOR UPDATE", cartID).Scan(&lines); err != nil {
+		return err
+	}
+	var price sql.NullInt64
+	if err = tx.QueryRow("SELECT "+priceCents+" FROM \"Books\" b WHERE b.\"ID\"=$1", bookID).Scan(&price); err != nil {
+		return err
+	}
+	if !price.Valid {
+		return errNotForSale
+	}
+	var inserted bool
+	err = tx.QueryRow(
+		"INSERT INTO \"Cart_Items\"(\"Cart_ID\",\"Book_ID\",\"Quantity\",\"Unit_Price_Cents\") VALUES($1,$2,$3,$4) "+
+			"ON CONFLICT (\"Cart_ID\",\"Book_ID\") DO UPDATE SET \"Quantity\"=LEAST(\"Cart_Items\".\"Quantity\"+EXCLUDED.\"Quantity\",$5) RETURNING (xmax=0)",
+		cartID, bookID, quantity, price.Int64, MaxCartQuantity).Scan(&inserted)
+	if err != nil {
+		return err
+	}
+	if inserted && lines >= MaxCartLines {
+		return errCartFull
+	}
+	if _, err = tx.Exec("UPDATE \"Carts\" SET \"Updated_At\"=now() WHERE \"ID\"=$1", cartID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Sets the quantity of a book in the cart, posted as the quantity field or as {"Quantity"}.
+A quantity of 0 removes it.
+*/
+func UpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Quantity *int }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else if q, err := strconv.Atoi(r.FormValue("quantity")); err == nil {
+		req.Quantity = &q
+	}
+	if req.Quantity == nil || *req.Quantity < 0 || *req.Quantity > MaxCartQuantity {
+		http.Error(w, fmt.Sprintf("Send a quantity from 0 to %d.", MaxCartQuantity), http.StatusBadRequest)
+		return
+	}
+	cartID, err := findCart(w, r, false)
+	if err == nil && cartID == 0 {
+		http.Error(w, "That book isn't in your cart.", http.StatusNotFound)
+		return
+	}
+	var result sql.Result
+	if err == nil && *req.Quantity == 0 {
+		result, err = OrderDB.Exec("DELETE FROM \"Cart_Items\" WHERE \"Cart_ID\"=$1 AND \"Book_ID\"=$2", cartID, mux.Vars(r)["bookID"])
+	} else if err == nil {
+		result, err = OrderDB.Exec("UPDATE \"Cart_Items\" SET \"Quantity\"=$3 WHERE \"Cart_ID\"=$1 AND \"Book_ID\"=$2", cartID, mux.Vars(r)["bookID"], *req.Quantity)
+	}
+	cartChanged(w, r, cartID, result, err, "orderHandler.UpdateCartItem")
+}
+
+/*
+Takes a book out of the cart.
+*/
+func RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	cartID, err := findCart(w, r, false)
+	if err == nil && cartID == 0 {
+		http.Error(w, "That book isn't in your cart.", http.StatusNotFound)
+		return
+	}
+	var result sql.Result
+	if err == nil {
+		result, err = OrderDB.Exec("DELETE FROM \"Cart_Items\" WHERE \"Cart_ID\"=$1 AND \"Book_ID\"=$2", cartID, mux.Vars(r)["bookID"])
+	}
+	cartChanged(w, r, cartID, result, err, "orderHandler.RemoveCartItem")
+}
+
+func cartChanged(w http.ResponseWriter, r *http.Request, cartID int, result sql.Result, err error, caller string) {
+	if err != nil {
+		log.Printf("%v; changing cart [%v] failed. Error: %v", caller, cartID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "That book isn't in your cart.", http.StatusNotFound)
+		return
+	}
+	OrderDB.Exec("UPDATE \"Carts\" SET \"Updated_At\"=now() WHERE \"ID\"=$1", cartID)
+	cartDone(w, r, cartID)
+}
+
+/*
+Finds the cart of the signed in user, or of the guest cookie. With create, a cart (and for
+guests the cookie) is made if there isn't one yet; otherwise 0 means there is no cart.
+*/
+func findCart(w http.ResponseWriter, r *http.Request, create bool) (int, error) {
+	var cartID int
+	if user, ok := mAuthenticate.UserFromContext(r.Context()); ok {
+		err := OrderDB.QueryRow("SELECT \"ID\" FROM \"Carts\" WHERE \"User_ID\"=$1", user.ID).Scan(&cartID)
+		if err == sql.ErrNoRows && create {
+			err = OrderDB.QueryRow(
+				"INSERT INTO \"Carts\"(\"User_ID\") VALUES($1) ON CONFLICT (\"User_ID\") DO UPDATE SET \"Updated_At\"=now() RETURNING \"ID\"",
+				user.ID).Scan(&cartID)
+		}
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return cartID, err
+	}
+	cartID, err := guestCart(r)
+	if err != nil || cartID != 0 || !create {
+		return cartID, err
+	}
+	token, err := sessionStore.NewID()
+	if err != nil {
+		return 0, err
+	}
+	if err = OrderDB.QueryRow("INSERT INTO \"Carts\"(\"Token_Hash\") VALUES($1) RETURNING \"ID\"", sessionStore.HashID(token)).Scan(&cartID); err != nil {
+		return 0, err
+	}
+	setCartCookie(w, token, time.Now().Add(GuestCartTTL))
+	return cartID, nil
+}
+
+/*
+The guest cart named by the request's cookie, or 0.
+*/
+func guestCart(r *http.Request) (int, error) {
+	c, err := r.Cookie(CartCookieName)
+	if err != nil || c.Value == "" {
+		return 0, nil
+	}
+	var cartID int
+	err = OrderDB.QueryRow("SELECT \"ID\" FROM \"Carts\" WHERE \"Token_Hash\"=$1 AND \"User_ID\" IS NULL", sessionStore.HashID(c.Value)).Scan(&cartID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return cartID, err
+}
+
+func setCartCookie(w http.ResponseWriter, value string, expires time.Time) {
+	c := &http.Cookie{
+		Name:     CartCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   CartCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+/*
+Moves the books of the guest cart on the request into the cart of userID, adding up the
+quantities of books that are in both. Meant to run when a guest logs in.
+*/
+func MergeGuestCart(w http.ResponseWriter, r *http.Request, userID int) {
+	guestID, err := guestCart(r)
+	if err != nil || guestID == 0 {
+		if err != nil {
+			log.Printf("orderHandler.MergeGuestCart; finding guest cart failed. Error: %v", err)
+		}
+		return
+	}
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		log.Printf("orderHandler.MergeGuestCart; starting transaction failed. Error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	var cartID int
+	err = tx.QueryRow(
+		"INSERT INTO \"Carts\"(\"User_ID\") VALUES($1) ON CONFLICT (\"User_ID\") DO UPDATE SET \"Updated_At\"=now() RETURNING \"ID\"",
+		userID).Scan(&cartID)
+	if err == nil {
+		// The user's own price snapshot wins, so a notice they haven't seen yet isn't lost.
+		_, err = tx.Exec(
+			"INSERT INTO \"Cart_Items\"(\"Cart_ID\",\"Book_ID\",\"Quantity\",\"Unit_Price_Cents\",\"Added_At\") "+
+				"SELECT $1,\"Book_ID\",\"Quantity\",\"Unit_Price_Cents\",\"Added_At\" FROM \"Cart_Items\" WHERE \"Cart_ID\"=$2 "+
+				"ON CONFLICT (\"Cart_ID\",\"Book_ID\") DO UPDATE SET \"Quantity\"=LEAST(\"Cart_Items\".\"Quantity\"+EXCLUDED.\"Quantity\",$3)",
+			cartID, guestID, MaxCartQuantity)
+	}
+	if err == nil {
+		// A coupon entered as a guest is kept, unless the user has one already.
+		_, err = tx.Exec(
+			"UPDATE \"Carts\" SET \"Coupon_ID\"=COALESCE(\"Coupon_ID\",(SELECT \"Coupon_ID\" FROM \"Carts\" WHERE \"ID\"=$2)) WHERE \"ID\"=$1",
+			cartID, guestID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM \"Carts\" WHERE \"ID\"=$1", guestID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("orderHandler.MergeGuestCart; merging guest cart [%v] into the cart of user [%v] failed. Error: %v", guestID, userID, err)
+		return
+	}
+	setCartCookie(w, "", time.Unix(0, 0))
+	log.Printf("orderHandler.MergeGuestCart; merged guest cart [%v] into the cart of user [%v].", guestID, userID)
+}
+
+// The current price of b."Price" in cents, NULL when the book has no price.
+const priceCents = "round(b.\"Price\"::numeric*100)::bigint"
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+/*
+Loads a cart priced at today's prices and promotions. Lines whose price changed since they
+were added get a notice. Nothing is written, so showing a cart changes nothing; settleCart
+saves what the notices told, on the next change to the cart.
+*/
+func loadCart(db queryer, cartID int) (Cart, error) {
+	cart := Cart{Items: []CartItem{}, id: cartID}
+	rows, err := db.Query(
+		"SELECT ci.\"Book_ID\",b.\"Title\",b.\"Author\",b.\"Gift_Card\",ci.\"Quantity\",ci.\"Unit_Price_Cents\","+priceCents+
+			" FROM \"Cart_Items\" ci JOIN \"Books\" b ON b.\"ID\"=ci.\"Book_ID\" WHERE ci.\"Cart_ID\"=$1 ORDER BY ci.\"Added_At\",ci.\"Book_ID\"",
+		cartID)
+	if err != nil {
+		return cart, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			item     CartItem
+			snapshot int64
+			current  sql.NullInt64
+		)
+		if err := rows.Scan(&item.BookID, &item.Title, &item.Author, &item.GiftCard, &item.Quantity, &snapshot, &current); err != nil {
+			return cart, err
+		}
+		item.Available = current.Valid
+		item.UnitPriceCents = snapshot
+		if !item.Available {
+			cart.Notices = append(cart.Notices, fmt.Sprintf("%v isn't for sale right now and won't be included in your order.", item.Title))
+		} else if current.Int64 != snapshot {
+			item.UnitPriceCents, item.PreviousPriceCents, item.PreviousPrice = current.Int64, snapshot, formatCents(snapshot)
+			cart.Notices = append(cart.Notices, fmt.Sprintf("The price of %v changed from %v to %v.", item.Title, formatCents(snapshot), formatCents(current.Int64)))
+		}
+		item.UnitPrice = formatCents(item.UnitPriceCents)
+		if item.Available {
+			item.LineTotalCents = item.UnitPriceCents * int64(item.Quantity)
+			cart.ItemCount += item.Quantity
+			cart.SubtotalCents += item.LineTotalCents
+		}
+		item.LineTotal = formatCents(item.LineTotalCents)
+		cart.Items = append(cart.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return cart, err
+	}
+	cart.Subtotal = formatCents(cart.SubtotalCents)
+	return cart, priceCart(db, cartID, &cart, time.Now())
+}
+
+/*
+Saves what loading cart found: price snapshots move to the current prices, so their notices
+are shown once, and a coupon that can no longer be used is taken out. Only called when the
+customer changes their cart.
+*/
+func settleCart(db queryer, cart Cart) error {
+	for _, item := range cart.Items {
+		if item.PreviousPrice != "" {
+			_, err := db.Exec(
+				"UPDATE \"Cart_Items\" SET \"Unit_Price_Cents\"=$3 WHERE \"Cart_ID\"=$1 AND \"Book_ID\"=$2 AND \"Unit_Price_Cents\"=$4",
+				cart.id, item.BookID, item.UnitPriceCents, item.PreviousPriceCents)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if cart.couponDropped {
+		if _, err := db.Exec("UPDATE \"Carts\" SET \"Coupon_ID\"=NULL WHERE \"ID\"=$1 AND \"Coupon_ID\"=$2", cart.id, cart.couponID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Removes guest carts nobody has touched for GuestCartTTL, every interval. Call the returned
+function to stop.
+*/
+func StartCartCleanup(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if _, err := OrderDB.Exec("DELETE FROM \"Carts\" WHERE \"User_ID\" IS NULL AND \"Updated_At\"<$1", time.Now().Add(-GuestCartTTL)); err != nil {
+				log.Printf("orderHandler.StartCartCleanup; deleting old guest carts failed. Error: %v", err)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+/*
+Settles the cart after a change. Browsers go to the cart page, or are shown it straight away
+when there are notices, since the changes they tell of are settled by now; JSON clients get
+the cart.
+*/
+func cartDone(w http.ResponseWriter, r *http.Request, cartID int) {
+	cart, err := loadCart(OrderDB, cartID)
+	if err == nil {
+		err = settleCart(OrderDB, cart)
+	}
+	if err != nil {
+		log.Printf("orderHandler.cartDone; loading cart [%v] failed. Error: %v", cartID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !isJSONRequest(r) && len(cart.Notices) == 0 {
+		http.Redirect(w, r, OrderPathPrefix+"/cart", http.StatusSeeOther)
+		return
+	}
+	respondCart(w, r, http.StatusOK, cart)
+}
+
+func respondCart(w http.ResponseWriter, r *http.Request, status int, cart Cart) {
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(cart)
+		return
+	}
+	renderOrderPage(w, status, "orderCart", cart)
+}
+
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+/*
+Reads an amount such as "12.5" or "12.50" into cents. An empty amount is 0.
+*/
+func parseCents(amount string) (int64, bool) {
+	amount = strings.TrimSpace(amount)
+	if amount == "" {
+		return 0, true
+	}
+	whole, frac, _ := strings.Cut(amount, ".")
+	if len(frac) > 2 || (whole == "" && frac == "") {
+		return 0, false
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	cents, err := strconv.ParseInt(whole+frac, 10, 64)
+	return cents, err == nil
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || isJSONRequest(r) || templateCache == nil
+}
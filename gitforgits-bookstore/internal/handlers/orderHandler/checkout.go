@@ -0,0 +1,816 @@
+package orderHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/payments"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
+)
+
+/*
+A way of shipping an order. Orders with a subtotal of at least FreeOverCents ship for free,
+unless that is 0.
+*/
+type ShippingMethod struct {
+	Code          string
+	Name          string
+	PriceCents    int64
+	FreeOverCents int64
+}
+
+var ShippingMethods = []ShippingMethod{
+	{Code: "standard", Name: "Standard (3 to 5 working days)", PriceCents: 399, FreeOverCents: 3000},
+	{Code: "express", Name: "Express (next working day)", PriceCents: 999},
+}
+
+func (m ShippingMethod) cost(subtotalCents int64) int64 {
+	if m.FreeOverCents > 0 && subtotalCents >= m.FreeOverCents {
+		return 0
+	}
+	return m.PriceCents
+}
+
+func findShippingMethod(code string) (ShippingMethod, bool) {
+	for _, m := range ShippingMethods {
+		if m.Code == code {
+			return m, true
+		}
+	}
+	return ShippingMethod{}, false
+}
+
+/*
+An address from the user's address book, as copied onto an order.
+*/
+type Address struct {
+	ID         int `json:",omitempty"`
+	Label      string
+	FullName   string
+	Line1      string
+	Line2      string
+	City       string
+	Region     string
+	PostalCode string
+	Country    string
+	Phone      string
+}
+
+/*
+A shipping method with its cost for the cart at hand.
+*/
+type ShippingOption struct {
+	ShippingMethod
+	CostCents int64
+	Cost      string
+}
+
+/*
+Where a user is in checkout. Step is "address", "shipping" or "review", the first one that
+still needs an answer unless the user went back to an earlier one. Tenders are the gift cards
+and store credit paying towards Total; DueCents is what is left to pay.
+*/
+type Checkout struct {
+	Step              string
+	Cart              Cart
+	Addresses         []Address
+	ShippingAddressID int
+	BillingAddressID  int
+	ShippingOptions   []ShippingOption
+	ShippingMethod    string
+	ShippingCents     int64
+	Shipping          string
+	TotalCents        int64
+	Total             string
+	Tenders           []Tender
+	StoreCreditCents  int64
+	StoreCredit       string
+	UseStoreCredit    bool
+	TenderCents       int64
+	Tender            string
+	DueCents          int64
+	Due               string
+	IdempotencyKey    string
+	PaymentMethods    []payments.TestCard
+	Errors            []string
+}
+
+var (
+	errEmptyCart    = errors.New("cart is empty")
+	errCartChanged  = errors.New("cart changed since it was reviewed")
+	errOutOfStock   = errors.New("not enough stock")
+	errCheckoutStep = errors.New("checkout is incomplete")
+)
+
+func registerCheckoutHandlers(sr *mux.Router) {
+	sr.HandleFunc("", GetOrdersCheckout).Methods("GET")
+	sr.HandleFunc("/address", SetCheckoutAddress).Methods("POST")
+	sr.HandleFunc("/shipping", SetCheckoutShipping).Methods("POST")
+	sr.HandleFunc("/place", PlaceOrder).Methods("POST")
+	registerTenderHandlers(sr)
+}
+
+/*
+Handles checkout actions. Shows the current checkout step, or the one in ?step=, as JSON or
+as the orderCheckout page. The review step carries a fresh idempotency key for placing the
+order.
+*/
+func GetOrdersCheckout(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	checkout, err := loadCheckout(user.ID, r.URL.Query().Get("step"))
+	if err != nil {
+		log.Printf("orderHandler.GetOrdersCheckout; loading checkout of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respondCheckout(w, r, http.StatusOK, checkout)
+}
+
+/*
+Step one: where to ship and bill, posted as shipping_address_id and billing_address_id
+fields or as {"ShippingAddressID","BillingAddressID"}. Both are IDs from the user's address
+book; billing defaults to the shipping address.
+*/
+func SetCheckoutAddress(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ShippingAddressID int
+		BillingAddressID  int
+	}
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.ShippingAddressID, _ = strconv.Atoi(r.FormValue("shipping_address_id"))
+		req.BillingAddressID, _ = strconv.Atoi(r.FormValue("billing_address_id"))
+	}
+	if req.BillingAddressID == 0 {
+		req.BillingAddressID = req.ShippingAddressID
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	cartID, err := findCart(w, r, true)
+	var result sql.Result
+	if err == nil {
+		// Only the user's own addresses can be chosen.
+		result, err = OrderDB.Exec(
+			"UPDATE \"Carts\" SET \"Shipping_Address_ID\"=$2,\"Billing_Address_ID\"=$3,\"Updated_At\"=now() WHERE \"ID\"=$1 "+
+				"AND (SELECT count(*) FROM \"Addresses\" WHERE \"User_ID\"=$4 AND \"ID\" IN ($2,$3))=CASE WHEN $2=$3 THEN 1 ELSE 2 END",
+			cartID, req.ShippingAddressID, req.BillingAddressID, user.ID)
+	}
+	if err != nil {
+		log.Printf("orderHandler.SetCheckoutAddress; saving addresses of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		checkoutFailed(w, r, user.ID, "address", http.StatusBadRequest, "Choose addresses from your address book.")
+		return
+	}
+	checkoutDone(w, r, user.ID, "shipping")
+}
+
+/*
+Step two: how to ship, posted as the shipping_method field or as {"ShippingMethod"}.
+*/
+func SetCheckoutShipping(w http.ResponseWriter, r *http.Request) {
+	var req struct{ ShippingMethod string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.ShippingMethod = r.FormValue("shipping_method")
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	if _, ok := findShippingMethod(req.ShippingMethod); !ok {
+		checkoutFailed(w, r, user.ID, "shipping", http.StatusBadRequest, "Choose one of the shipping methods.")
+		return
+	}
+	cartID, err := findCart(w, r, true)
+	if err == nil {
+		_, err = OrderDB.Exec("UPDATE \"Carts\" SET \"Shipping_Method\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", cartID, req.ShippingMethod)
+	}
+	if err != nil {
+		log.Printf("orderHandler.SetCheckoutShipping; saving shipping method of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	checkoutDone(w, r, user.ID, "review")
+}
+
+/*
+The last step: turns the cart into an order and reserves the stock, all in one transaction.
+The idempotency key, sent as the Idempotency-Key header, the idempotency_key field or
+{"IdempotencyKey"}, makes a repeated submission return the order the first one placed. If a
+price changed or a book ran out since the review, nothing is placed and the review is shown
+again. Gift cards and store credit chosen at checkout pay first, and an order they cover in
+full is paid at once. With a payment_method field or {"PaymentMethod"} the rest is paid right
+away; a failed payment leaves the order placed and waiting for payment. The total the
+customer reviewed, sent as the reviewed_total field or {"ReviewedTotalCents"}, must still be
+the total, or the review is shown again; promotions may have started or ended meanwhile.
+*/
+func PlaceOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IdempotencyKey, PaymentMethod string
+		ReviewedTotalCents            *int64
+	}
+	if isJSONRequest(r) {
+		json.NewDecoder(r.Body).Decode(&req)
+	} else {
+		req.IdempotencyKey = r.FormValue("idempotency_key")
+		req.PaymentMethod = r.FormValue("payment_method")
+		if reviewed, err := strconv.ParseInt(r.FormValue("reviewed_total"), 10, 64); err == nil {
+			req.ReviewedTotalCents = &reviewed
+		}
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		req.IdempotencyKey = key
+	}
+	req.IdempotencyKey = strings.TrimSpace(req.IdempotencyKey)
+	if req.IdempotencyKey == "" || len(req.IdempotencyKey) > 255 {
+		http.Error(w, "An Idempotency-Key of up to 255 characters is required.", http.StatusBadRequest)
+		return
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	orderID, created, err := placeOrder(userActor(user), req.IdempotencyKey, req.ReviewedTotalCents)
+	var (
+		stock   *stockError
+		changed *cartChangedError
+	)
+	switch {
+	case err == errEmptyCart:
+		checkoutFailed(w, r, user.ID, "review", http.StatusConflict, "Your cart is empty.")
+		return
+	case err == errCheckoutStep:
+		checkoutFailed(w, r, user.ID, "", http.StatusConflict, "Choose your addresses and a shipping method first.")
+		return
+	case errors.Is(err, errCartChanged):
+		var notices []string
+		if errors.As(err, &changed) {
+			notices = changed.Notices
+		}
+		checkoutFailed(w, r, user.ID, "review", http.StatusConflict, "Your cart changed. Please check it again before placing your order.", notices...)
+		return
+	case err == errCouponUnavailable:
+		checkoutFailed(w, r, user.ID, "review", http.StatusConflict, "Sorry, your coupon was used up while you were checking out. Please check your order again.")
+		return
+	case errors.As(err, &stock):
+		checkoutFailed(w, r, user.ID, "review", http.StatusConflict, stock.Error())
+		return
+	case err != nil:
+		log.Printf("orderHandler.PlaceOrder; placing order for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if created {
+		log.Printf("orderHandler.PlaceOrder; [%v] placed order [%v].", user.Username, orderID)
+	}
+	order, err := loadOrder(OrderDB, orderID)
+	if err != nil {
+		log.Printf("orderHandler.PlaceOrder; loading order [%v] failed. Error: %v", orderID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if req.PaymentMethod != "" && order.Status == "pending_payment" && Payments != nil {
+		payment, err := startPayment(r.Context(), order, req.PaymentMethod)
+		if err != nil && err != errNotPayable {
+			log.Printf("orderHandler.PlaceOrder; paying order [%v] failed. Error: %v", orderID, err)
+		}
+		if !wantsJSON(r) {
+			paymentStarted(w, r, orderID, payment, nil)
+			return
+		}
+		if order, err = loadOrder(OrderDB, orderID); err != nil {
+			log.Printf("orderHandler.PlaceOrder; reloading order [%v] failed. Error: %v", orderID, err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !wantsJSON(r) {
+		http.Redirect(w, r, OrderPathPrefix+"/"+strconv.Itoa(orderID), http.StatusSeeOther)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	respondOrder(w, r, status, order)
+}
+
+/*
+Lists the books that didn't have enough stock.
+*/
+type stockError struct {
+	Titles []string
+}
+
+func (e *stockError) Error() string {
+	them := "it"
+	if len(e.Titles) > 1 {
+		them = "them"
+	}
+	return "Sorry, we don't have enough copies of " + strings.Join(e.Titles, ", ") + " left. Lower the quantity or remove " + them + " from your cart."
+}
+
+func (e *stockError) Unwrap() error {
+	return errOutOfStock
+}
+
+/*
+Carries the cart's notices when the order wasn't placed. What they tell of was settled, so the
+cart won't show them again.
+*/
+type cartChangedError struct {
+	Notices []string
+}
+
+func (e *cartChangedError) Error() string {
+	return errCartChanged.Error()
+}
+
+func (e *cartChangedError) Unwrap() error {
+	return errCartChanged
+}
+
+/*
+Places the user's cart as an order. Returns the existing order, and false, if one was
+already placed with the same idempotency key. When reviewedTotal isn't nil and the total
+is no longer that, errCartChanged is returned.
+*/
+func placeOrder(by actor, key string, reviewedTotal *int64) (int, bool, error) {
+	userID := by.ID
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	// Locking the cart first makes a second submission wait for the first, then find its order.
+	var (
+		cartID                              int
+		shippingAddressID, billingAddressID sql.NullInt64
+		shippingMethod                      sql.NullString
+	)
+	err = tx.QueryRow(
+		"SELECT \"ID\",\"Shipping_Address_ID\",\"Billing_Address_ID\",\"Shipping_Method\" FROM \"Carts\" WHERE \"User_ID\"=$1 FOR UPDATE",
+		userID).Scan(&cartID, &shippingAddressID, &billingAddressID, &shippingMethod)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+	var orderID int
+	err = tx.QueryRow("SELECT \"ID\" FROM \"Orders\" WHERE \"User_ID\"=$1 AND \"Idempotency_Key\"=$2", userID, key).Scan(&orderID)
+	if err == nil {
+		return orderID, false, nil
+	} else if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+	if cartID == 0 {
+		return 0, false, errEmptyCart
+	}
+	cart, err := loadCart(tx, cartID)
+	if err != nil {
+		return 0, false, err
+	}
+	// Books that are no longer for sale stay in the cart but aren't ordered.
+	var items []CartItem
+	repriced := false
+	for _, item := range cart.Items {
+		if item.Available {
+			items = append(items, item)
+		}
+		repriced = repriced || item.PreviousPrice != ""
+	}
+	if len(items) == 0 {
+		return 0, false, errEmptyCart
+	}
+	if repriced || cart.couponDropped {
+		// Keep the moved price snapshots and dropped coupon, so the next review is clean.
+		if err = settleCart(tx, cart); err != nil {
+			return 0, false, err
+		}
+		return 0, false, commitOr(tx, &cartChangedError{Notices: cart.Notices})
+	}
+	method, ok := findShippingMethod(shippingMethod.String)
+	if !shippingAddressID.Valid || !billingAddressID.Valid || !ok {
+		return 0, false, errCheckoutStep
+	}
+	shipping := method.cost(cart.TotalCents)
+	if reviewedTotal != nil && *reviewedTotal != cart.TotalCents+shipping {
+		// A promotion started or ended since the review.
+		return 0, false, commitOr(tx, errCartChanged)
+	}
+	shipTo, err := findAddress(tx, userID, int(shippingAddressID.Int64))
+	var billTo Address
+	if err == nil {
+		billTo, err = findAddress(tx, userID, int(billingAddressID.Int64))
+	}
+	if err == sql.ErrNoRows {
+		return 0, false, errCheckoutStep
+	} else if err != nil {
+		return 0, false, err
+	}
+	couponCode := ""
+	if cart.Coupon != nil && cart.Coupon.Applied {
+		if err = redeemCoupon(tx, cart.couponID); err == errCouponUnavailable {
+			// Used up by another order since the cart was priced
+			if _, err = tx.Exec("UPDATE \"Carts\" SET \"Coupon_ID\"=NULL WHERE \"ID\"=$1", cartID); err != nil {
+				return 0, false, err
+			}
+			return 0, false, commitOr(tx, errCouponUnavailable)
+		} else if err != nil {
+			return 0, false, err
+		}
+		couponCode = cart.Coupon.Code
+	}
+	if err = reserveStock(tx, items); err != nil {
+		return 0, false, err
+	}
+	// Accounts after books, the order releaseTender follows too
+	tenders, _, err := cartTenders(tx, cartID, userID)
+	if err == nil {
+		err = lockTenders(tx, tenders)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	tendered := planTender(tenders, cart.TotalCents+shipping)
+	shipJSON, _ := json.Marshal(shipTo)
+	billJSON, _ := json.Marshal(billTo)
+	err = tx.QueryRow(
+		"INSERT INTO \"Orders\"(\"User_ID\",\"Idempotency_Key\",\"Subtotal_Cents\",\"Discount_Cents\",\"Shipping_Cents\",\"Total_Cents\",\"Shipping_Method\",\"Shipping_Address\",\"Billing_Address\",\"Coupon_Code\",\"Tender_Cents\") "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,NULLIF($10,''),$11) RETURNING \"ID\"",
+		userID, key, cart.SubtotalCents, cart.DiscountCents, shipping, cart.TotalCents+shipping, method.Code, string(shipJSON), string(billJSON), couponCode, tendered).Scan(&orderID)
+	if err == nil {
+		err = recordOrderEvent(tx, orderID, "", StatusPendingPayment, by, "Order placed")
+	}
+	if err == nil && tendered > 0 {
+		err = spendTenders(tx, orderID, tenders, by)
+	}
+	if err == nil && tendered > 0 && tendered == cart.TotalCents+shipping {
+		err = transitionOrder(tx, orderID, StatusPendingPayment, StatusPaid, by, "Paid in full with gift cards and store credit")
+	}
+	if err == nil && couponCode != "" {
+		_, err = tx.Exec("INSERT INTO \"Coupon_Redemptions\"(\"Order_ID\",\"Coupon_ID\",\"User_ID\") VALUES($1,$2,$3)", orderID, cart.couponID, userID)
+		if err == nil {
+			_, err = tx.Exec("UPDATE \"Carts\" SET \"Coupon_ID\"=NULL WHERE \"ID\"=$1", cartID)
+		}
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	for _, item := range items {
+		var itemID int
+		if err = tx.QueryRow(
+			"INSERT INTO \"Order_Items\"(\"Order_ID\",\"Book_ID\",\"Title\",\"Author\",\"Quantity\",\"Unit_Price_Cents\",\"Discount_Cents\",\"Gift_Card\") VALUES($1,$2,$3,$4,$5,$6,$7,$8) RETURNING \"ID\"",
+			orderID, item.BookID, item.Title, item.Author, item.Quantity, item.UnitPriceCents, item.DiscountCents, item.GiftCard).Scan(&itemID); err != nil {
+			return 0, false, err
+		}
+		for _, d := range item.Discounts {
+			if _, err = tx.Exec(
+				"INSERT INTO \"Order_Discounts\"(\"Order_ID\",\"Order_Item_ID\",\"Promotion_ID\",\"Name\",\"Amount_Cents\") VALUES($1,$2,NULLIF($3,0),$4,$5)",
+				orderID, itemID, d.PromotionID, d.Name, d.AmountCents); err != nil {
+				return 0, false, err
+			}
+		}
+		if _, err = tx.Exec("DELETE FROM \"Cart_Items\" WHERE \"Cart_ID\"=$1 AND \"Book_ID\"=$2", cartID, item.BookID); err != nil {
+			return 0, false, err
+		}
+	}
+	if _, err = tx.Exec("DELETE FROM \"Cart_Gift_Cards\" WHERE \"Cart_ID\"=$1", cartID); err != nil {
+		return 0, false, err
+	}
+	if _, err = tx.Exec("UPDATE \"Carts\" SET \"Shipping_Method\"=NULL,\"Use_Store_Credit\"=false,\"Updated_At\"=now() WHERE \"ID\"=$1", cartID); err != nil {
+		return 0, false, err
+	}
+	return orderID, true, tx.Commit()
+}
+
+/*
+Takes the ordered copies out of stock. Books whose "Stock" is NULL aren't counted. Books are
+updated in ID order so two orders for the same books can't deadlock.
+*/
+func reserveStock(tx *sql.Tx, items []CartItem) error {
+	sorted := append([]CartItem(nil), items...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].BookID < sorted[j].BookID })
+	var short []string
+	for _, item := range sorted {
+		result, err := tx.Exec(
+			"UPDATE \"Books\" SET \"Stock\"=\"Stock\"-$2 WHERE \"ID\"=$1 AND (\"Stock\" IS NULL OR \"Stock\">=$2)",
+			item.BookID, item.Quantity)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			short = append(short, item.Title)
+		}
+	}
+	if len(short) > 0 {
+		return &stockError{Titles: short}
+	}
+	return nil
+}
+
+func commitOr(tx *sql.Tx, err error) error {
+	if commitErr := tx.Commit(); commitErr != nil {
+		return commitErr
+	}
+	return err
+}
+
+/*
+Gathers the cart, address book and choices made so far.
+*/
+func loadCheckout(userID int, step string) (Checkout, error) {
+	checkout := Checkout{Cart: Cart{Items: []CartItem{}, Subtotal: formatCents(0), Discount: formatCents(0), Total: formatCents(0)}}
+	var (
+		cartID                              int
+		shippingAddressID, billingAddressID sql.NullInt64
+		shippingMethod                      sql.NullString
+	)
+	err := OrderDB.QueryRow(
+		"SELECT \"ID\",\"Shipping_Address_ID\",\"Billing_Address_ID\",\"Shipping_Method\" FROM \"Carts\" WHERE \"User_ID\"=$1",
+		userID).Scan(&cartID, &shippingAddressID, &billingAddressID, &shippingMethod)
+	if err == nil {
+		checkout.Cart, err = loadCart(OrderDB, cartID)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return checkout, err
+	}
+	checkout.ShippingAddressID, checkout.BillingAddressID = int(shippingAddressID.Int64), int(billingAddressID.Int64)
+	if checkout.Addresses, err = listAddresses(userID); err != nil {
+		return checkout, err
+	}
+	for _, m := range ShippingMethods {
+		cost := m.cost(checkout.Cart.TotalCents)
+		checkout.ShippingOptions = append(checkout.ShippingOptions, ShippingOption{ShippingMethod: m, CostCents: cost, Cost: formatCents(cost)})
+		if m.Code == shippingMethod.String {
+			checkout.ShippingMethod, checkout.ShippingCents = m.Code, cost
+		}
+	}
+	checkout.Shipping = formatCents(checkout.ShippingCents)
+	checkout.TotalCents = checkout.Cart.TotalCents + checkout.ShippingCents
+	checkout.Total = formatCents(checkout.TotalCents)
+	if checkout.Tenders, checkout.StoreCreditCents, err = cartTenders(OrderDB, cartID, userID); err != nil {
+		return checkout, err
+	}
+	for _, t := range checkout.Tenders {
+		checkout.UseStoreCredit = checkout.UseStoreCredit || t.Kind == TenderStoreCredit
+	}
+	checkout.TenderCents = planTender(checkout.Tenders, checkout.TotalCents)
+	checkout.DueCents = checkout.TotalCents - checkout.TenderCents
+	checkout.StoreCredit, checkout.Tender, checkout.Due = formatCents(checkout.StoreCreditCents), formatCents(checkout.TenderCents), formatCents(checkout.DueCents)
+
+	firstOpen := "review"
+	if checkout.ShippingAddressID == 0 || checkout.BillingAddressID == 0 {
+		firstOpen = "address"
+	} else if checkout.ShippingMethod == "" {
+		firstOpen = "shipping"
+	}
+	checkout.Step = firstOpen
+	if (step == "address") || (step == "shipping" && firstOpen == "review") {
+		checkout.Step = step
+	}
+	if checkout.Step == "review" {
+		if checkout.IdempotencyKey, err = sessionStore.NewID(); err != nil {
+			return checkout, err
+		}
+		checkout.PaymentMethods = TestCards
+	}
+	return checkout, nil
+}
+
+func listAddresses(userID int) ([]Address, error) {
+	rows, err := OrderDB.Query(
+		"SELECT \"ID\",\"Label\",\"Full_Name\",\"Line1\",\"Line2\",\"City\",\"Region\",\"Postal_Code\",\"Country\",\"Phone\" FROM \"Addresses\" WHERE \"User_ID\"=$1 ORDER BY \"Default_Shipping\" DESC,\"ID\"",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	addresses := []Address{}
+	for rows.Next() {
+		var a Address
+		if err := rows.Scan(&a.ID, &a.Label, &a.FullName, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, rows.Err()
+}
+
+func findAddress(tx *sql.Tx, userID int, addressID int) (Address, error) {
+	var a Address
+	err := tx.QueryRow(
+		"SELECT \"ID\",\"Label\",\"Full_Name\",\"Line1\",\"Line2\",\"City\",\"Region\",\"Postal_Code\",\"Country\",\"Phone\" FROM \"Addresses\" WHERE \"ID\"=$1 AND \"User_ID\"=$2",
+		addressID, userID).Scan(&a.ID, &a.Label, &a.FullName, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone)
+	// The order keeps its own copy; the address book entry may change or go.
+	a.ID = 0
+	return a, err
+}
+
+func respondCheckout(w http.ResponseWriter, r *http.Request, status int, checkout Checkout) {
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(checkout)
+		return
+	}
+	renderOrderPage(w, status, "orderCheckout", checkout)
+}
+
+/*
+Shows the checkout again at step with a problem, and any notices the cart no longer carries.
+*/
+func checkoutFailed(w http.ResponseWriter, r *http.Request, userID int, step string, status int, problem string, notices ...string) {
+	checkout, err := loadCheckout(userID, step)
+	if err != nil {
+		log.Printf("orderHandler.checkoutFailed; loading checkout of user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	checkout.Errors = append(checkout.Errors, problem)
+	checkout.Cart.Notices = append(notices, checkout.Cart.Notices...)
+	respondCheckout(w, r, status, checkout)
+}
+
+/*
+Settles the cart after a change. Browsers go on to the next step, or are shown it straight
+away when there are notices, since the changes they tell of are settled by now; JSON clients
+get the checkout.
+*/
+func checkoutDone(w http.ResponseWriter, r *http.Request, userID int, next string) {
+	step := ""
+	if !isJSONRequest(r) {
+		step = next
+	}
+	checkout, err := loadCheckout(userID, step)
+	if err == nil {
+		err = settleCart(OrderDB, checkout.Cart)
+	}
+	if err == nil && !isJSONRequest(r) && len(checkout.Cart.Notices) == 0 {
+		http.Redirect(w, r, OrderPathPrefix+"/checkout?step="+next, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("orderHandler.checkoutDone; loading checkout of user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respondCheckout(w, r, http.StatusOK, checkout)
+}
+
+/*
+An order as shown to its customer.
+*/
+type Order struct {
+	ID              int
+	UserID          int `json:"-"`
+	Status          string
+	StatusLabel     string
+	Items           []OrderItem
+	SubtotalCents   int64
+	Subtotal        string
+	DiscountCents   int64
+	Discount        string
+	CouponCode      string `json:",omitempty"`
+	ShippingMethod  string
+	ShippingCents   int64
+	Shipping        string
+	TotalCents      int64
+	Total           string
+	TenderCents     int64
+	Tender          string
+	DueCents        int64
+	Due             string
+	Tenders         []Tender
+	ShippingAddress Address
+	BillingAddress  Address
+	CreatedAt       time.Time
+	Payment         *Payment `json:",omitempty"`
+	Events          []OrderEvent
+	Returns         []Return
+	Refunds         []Refund
+	RefundableCents int64
+	Refundable      string
+	GiftCards       []IssuedGiftCard
+}
+
+/*
+One line of an order. Returnable is how many of it aren't already being returned.
+*/
+type OrderItem struct {
+	ID             int
+	BookID         int
+	Title          string
+	Author         string
+	Quantity       int
+	UnitPriceCents int64
+	UnitPrice      string
+	LineTotalCents int64
+	LineTotal      string
+	DiscountCents  int64
+	Discount       string
+	Discounts      []LineDiscount `json:",omitempty"`
+	GiftCard       bool
+	Returnable     int
+}
+
+func loadOrder(db queryer, orderID int) (Order, error) {
+	order := Order{ID: orderID, Items: []OrderItem{}}
+	var shipJSON, billJSON []byte
+	rows, err := db.Query(
+		"SELECT \"User_ID\",\"Status\",\"Subtotal_Cents\",\"Discount_Cents\",COALESCE(\"Coupon_Code\",''),\"Shipping_Method\",\"Shipping_Cents\",\"Total_Cents\",\"Tender_Cents\",\"Shipping_Address\",\"Billing_Address\",\"Created_At\" FROM \"Orders\" WHERE \"ID\"=$1",
+		orderID)
+	if err != nil {
+		return order, err
+	}
+	if !rows.Next() {
+		rows.Close()
+		if err = rows.Err(); err == nil {
+			err = sql.ErrNoRows
+		}
+		return order, err
+	}
+	err = rows.Scan(&order.UserID, &order.Status, &order.SubtotalCents, &order.DiscountCents, &order.CouponCode, &order.ShippingMethod, &order.ShippingCents, &order.TotalCents, &order.TenderCents, &shipJSON, &billJSON, &order.CreatedAt)
+	rows.Close()
+	if err != nil {
+		return order, err
+	}
+	if err = json.Unmarshal(shipJSON, &order.ShippingAddress); err == nil {
+		err = json.Unmarshal(billJSON, &order.BillingAddress)
+	}
+	if err != nil {
+		return order, fmt.Errorf("order [%v] has a broken address: %w", orderID, err)
+	}
+	order.StatusLabel = statusLabels[order.Status]
+	order.Subtotal, order.Discount = formatCents(order.SubtotalCents), formatCents(order.DiscountCents)
+	order.Shipping, order.Total = formatCents(order.ShippingCents), formatCents(order.TotalCents)
+	order.DueCents = order.TotalCents - order.TenderCents
+	order.Tender, order.Due = formatCents(order.TenderCents), formatCents(order.DueCents)
+	if m, ok := findShippingMethod(order.ShippingMethod); ok {
+		order.ShippingMethod = m.Name
+	}
+	rows, err = db.Query(
+		"SELECT \"ID\",COALESCE(\"Book_ID\",0),\"Title\",\"Author\",\"Quantity\",\"Unit_Price_Cents\",\"Discount_Cents\",\"Gift_Card\" FROM \"Order_Items\" WHERE \"Order_ID\"=$1 ORDER BY \"ID\"",
+		orderID)
+	if err != nil {
+		return order, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &item.BookID, &item.Title, &item.Author, &item.Quantity, &item.UnitPriceCents, &item.DiscountCents, &item.GiftCard); err != nil {
+			return order, err
+		}
+		if !item.GiftCard {
+			// Gift cards can't be sent back once they're issued
+			item.Returnable = item.Quantity
+		}
+		item.Discount = formatCents(item.DiscountCents)
+		item.LineTotalCents = item.UnitPriceCents * int64(item.Quantity)
+		item.UnitPrice, item.LineTotal = formatCents(item.UnitPriceCents), formatCents(item.LineTotalCents)
+		order.Items = append(order.Items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return order, err
+	}
+	rows.Close()
+	discounts, err := loadOrderDiscounts(db, orderID)
+	if err != nil {
+		return order, err
+	}
+	for i := range order.Items {
+		order.Items[i].Discounts = discounts[order.Items[i].ID]
+	}
+	if order.Events, err = loadOrderEvents(db, orderID); err != nil {
+		return order, err
+	}
+	if err = loadReturns(db, &order); err != nil {
+		return order, err
+	}
+	if err = loadRefunds(db, &order); err != nil {
+		return order, err
+	}
+	if err = loadOrderTenders(db, &order); err != nil {
+		return order, err
+	}
+	payment, err := latestPayment(db, orderID, "")
+	if err == sql.ErrNoRows {
+		return order, nil
+	}
+	order.Payment = &payment
+	return order, err
+}
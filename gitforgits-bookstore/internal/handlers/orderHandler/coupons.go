@@ -0,0 +1,403 @@
+package orderHandler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+)
+
+/*
+Generated codes use letters and digits that can't be mistaken for each other.
+*/
+const couponAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var (
+	CouponCodeLength = 10
+	MaxCouponBatch   = 10000
+)
+
+var (
+	errCouponUnavailable = errors.New("coupon can't be redeemed any more")
+	errCouponTaken       = errors.New("coupon code is taken")
+)
+
+/*
+A code that unlocks a coupon-only promotion. MaxRedemptions of 1 makes it single use;
+MaxRedemptions and PerCustomerLimit of 0 are unlimited.
+*/
+type Coupon struct {
+	ID               int
+	Code             string
+	PromotionID      int
+	MaxRedemptions   int        `json:",omitempty"`
+	PerCustomerLimit int        `json:",omitempty"`
+	MinSubtotalCents int64      `json:",omitempty"`
+	ExpiresAt        *time.Time `json:",omitempty"`
+	Redemptions      int
+	promotion        string
+	running          bool
+}
+
+/*
+The coupon entered in a cart. Applied is false when its promotion takes nothing off the
+books in the cart.
+*/
+type CartCoupon struct {
+	Code      string
+	Promotion string
+	Applied   bool
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func registerCouponHandlers(sr *mux.Router) {
+	sr.HandleFunc("/coupon", ApplyCoupon).Methods("POST", "PUT")
+	sr.HandleFunc("/coupon", RemoveCoupon).Methods("DELETE")
+	sr.HandleFunc("/coupon/delete", RemoveCoupon).Methods("POST")
+}
+
+/*
+Enters a coupon in the cart, posted as the code field or {"Code"}. It replaces any coupon
+already there. The coupon is checked now and again whenever the cart is priced.
+*/
+func ApplyCoupon(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Code string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Code = r.FormValue("code")
+	}
+	code := normalizeCouponCode(req.Code)
+	if code == "" {
+		http.Error(w, "Enter a coupon code.", http.StatusBadRequest)
+		return
+	}
+	cartID, err := findCart(w, r, false)
+	if err == nil && cartID == 0 {
+		http.Error(w, "Your cart is empty.", http.StatusConflict)
+		return
+	}
+	var (
+		coupons []Coupon
+		cart    Cart
+		problem string
+	)
+	if err == nil {
+		coupons, err = loadCoupons(OrderDB, "WHERE c.\"Code\"=$1", code)
+	}
+	if err == nil && len(coupons) == 0 {
+		http.Error(w, fmt.Sprintf("There's no coupon %v.", code), http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		cart, err = loadCart(OrderDB, cartID)
+	}
+	userID := 0
+	if user, ok := mAuthenticate.UserFromContext(r.Context()); ok {
+		userID = user.ID
+	}
+	if err == nil {
+		problem, err = couponProblem(OrderDB, coupons[0], userID, cart.discountableCents(), time.Now())
+	}
+	if err == nil && problem != "" {
+		http.Error(w, problem, http.StatusConflict)
+		return
+	}
+	if err == nil {
+		_, err = OrderDB.Exec("UPDATE \"Carts\" SET \"Coupon_ID\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", cartID, coupons[0].ID)
+	}
+	if err != nil {
+		log.Printf("orderHandler.ApplyCoupon; applying coupon [%v] to cart [%v] failed. Error: %v", code, cartID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	cartDone(w, r, cartID)
+}
+
+/*
+Takes the coupon out of the cart.
+*/
+func RemoveCoupon(w http.ResponseWriter, r *http.Request) {
+	cartID, err := findCart(w, r, false)
+	if err == nil && cartID == 0 {
+		http.Error(w, "Your cart is empty.", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		_, err = OrderDB.Exec("UPDATE \"Carts\" SET \"Coupon_ID\"=NULL,\"Updated_At\"=now() WHERE \"ID\"=$1", cartID)
+	}
+	if err != nil {
+		log.Printf("orderHandler.RemoveCoupon; removing the coupon from cart [%v] failed. Error: %v", cartID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	cartDone(w, r, cartID)
+}
+
+/*
+Says why a coupon can't be used by userID (0 for guests) on a cart with subtotal at now, or
+returns "" if it can. Per-customer limits are checked for signed in users only; guests are
+checked once they sign in to check out.
+*/
+func couponProblem(db queryer, c Coupon, userID int, subtotal int64, now time.Time) (string, error) {
+	switch {
+	case !c.running:
+		return fmt.Sprintf("Coupon %v isn't valid right now.", c.Code), nil
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return fmt.Sprintf("Coupon %v has expired.", c.Code), nil
+	case c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions:
+		return fmt.Sprintf("Coupon %v has been used up.", c.Code), nil
+	case subtotal < c.MinSubtotalCents:
+		return fmt.Sprintf("Coupon %v needs a subtotal of at least %v.", c.Code, formatCents(c.MinSubtotalCents)), nil
+	case userID == 0 || c.PerCustomerLimit == 0:
+		return "", nil
+	}
+	rows, err := db.Query("SELECT count(*) FROM \"Coupon_Redemptions\" WHERE \"Coupon_ID\"=$1 AND \"User_ID\"=$2", c.ID, userID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	used := 0
+	if rows.Next() {
+		err = rows.Scan(&used)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil && used >= c.PerCustomerLimit {
+		return fmt.Sprintf("You've already used coupon %v.", c.Code), nil
+	}
+	return "", err
+}
+
+/*
+The coupon entered in a cart, if any, and the cart's owner, 0 for guests.
+*/
+func cartCoupon(db queryer, cartID int) (*Coupon, int, error) {
+	coupons, err := loadCoupons(db, "JOIN \"Carts\" ct ON ct.\"Coupon_ID\"=c.\"ID\" WHERE ct.\"ID\"=$1", cartID)
+	if err != nil || len(coupons) == 0 {
+		return nil, 0, err
+	}
+	rows, err := db.Query("SELECT COALESCE(\"User_ID\",0) FROM \"Carts\" WHERE \"ID\"=$1", cartID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	userID := 0
+	if rows.Next() {
+		err = rows.Scan(&userID)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	return &coupons[0], userID, err
+}
+
+/*
+Counts a redemption of couponID. The guarded UPDATE is what keeps concurrent orders from
+redeeming more than MaxRedemptions: the second one waits for the first's row lock and then
+finds the coupon used up. Per-customer limits hold because a customer's orders are placed
+one at a time, under the lock on their cart.
+*/
+func redeemCoupon(tx *sql.Tx, couponID int) error {
+	result, err := tx.Exec(
+		"UPDATE \"Coupons\" SET \"Redemptions\"=\"Redemptions\"+1 WHERE \"ID\"=$1 "+
+			"AND (\"Max_Redemptions\" IS NULL OR \"Redemptions\"<\"Max_Redemptions\") AND (\"Expires_At\" IS NULL OR \"Expires_At\">now())",
+		couponID)
+	if n, _ := rowsAffected(result, err); err == nil && n == 0 {
+		return errCouponUnavailable
+	}
+	return err
+}
+
+/*
+Gives back the coupon use of a cancelled order.
+*/
+func releaseCoupon(tx *sql.Tx, orderID int) error {
+	_, err := tx.Exec(
+		"WITH r AS (DELETE FROM \"Coupon_Redemptions\" WHERE \"Order_ID\"=$1 RETURNING \"Coupon_ID\") "+
+			"UPDATE \"Coupons\" c SET \"Redemptions\"=c.\"Redemptions\"-1 FROM r WHERE c.\"ID\"=r.\"Coupon_ID\"",
+		orderID)
+	return err
+}
+
+/*
+Lists the coupons of a promotion.
+*/
+func ListCoupons(w http.ResponseWriter, r *http.Request) {
+	promotionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	coupons, err := loadCoupons(OrderDB, "WHERE c.\"Promotion_ID\"=$1", promotionID)
+	if err != nil {
+		log.Printf("orderHandler.ListCoupons; loading coupons of promotion [%v] failed. Error: %v", promotionID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, coupons)
+}
+
+/*
+Makes coupons for a coupon-only promotion from
+{"Code"|"Count","Prefix","MaxRedemptions","PerCustomerLimit","MinSubtotalCents","ExpiresAt"}.
+With Code, that one coupon is made, e.g. SUMMER20; otherwise Count coupons with random codes
+after Prefix, up to MaxCouponBatch at a time. Answers with the coupons made.
+*/
+func GenerateCoupons(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code, Prefix     string
+		Count            int
+		MaxRedemptions   int
+		PerCustomerLimit int
+		MinSubtotalCents int64
+		ExpiresAt        *time.Time
+	}
+	if !isJSONRequest(r) {
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+		return
+	}
+	req.Code, req.Prefix = normalizeCouponCode(req.Code), normalizeCouponCode(req.Prefix)
+	switch {
+	case req.Code == "" && (req.Count < 1 || req.Count > MaxCouponBatch):
+		http.Error(w, fmt.Sprintf("Send a Code, or a Count from 1 to %d.", MaxCouponBatch), http.StatusBadRequest)
+		return
+	case req.Code != "" && req.Count > 1:
+		http.Error(w, "A Code makes one coupon; leave out Count, or the Code to make several.", http.StatusBadRequest)
+		return
+	case req.MaxRedemptions < 0 || req.PerCustomerLimit < 0 || req.MinSubtotalCents < 0:
+		http.Error(w, "Limits and the minimum subtotal can't be negative.", http.StatusBadRequest)
+		return
+	case req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()):
+		http.Error(w, "ExpiresAt is in the past.", http.StatusBadRequest)
+		return
+	}
+	promotionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	list, err := loadPromotions(OrderDB, "WHERE \"ID\"=$1", promotionID)
+	if err == nil && len(list) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if err == nil && !list[0].CouponOnly {
+		http.Error(w, "Make the promotion CouponOnly first, or it applies without a coupon.", http.StatusConflict)
+		return
+	}
+	var coupons []Coupon
+	if err == nil {
+		base := Coupon{PromotionID: promotionID, MaxRedemptions: req.MaxRedemptions, PerCustomerLimit: req.PerCustomerLimit, MinSubtotalCents: req.MinSubtotalCents, ExpiresAt: req.ExpiresAt}
+		coupons, err = createCoupons(base, req.Code, req.Prefix, req.Count)
+	}
+	if err == errCouponTaken {
+		http.Error(w, fmt.Sprintf("Coupon %v already exists.", req.Code), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("orderHandler.GenerateCoupons; making coupons for promotion [%v] failed. Error: %v", promotionID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("orderHandler.GenerateCoupons; [%v] made %v coupon(s) for promotion [%v].", user.Username, len(coupons), promotionID)
+	writeJSON(w, http.StatusCreated, coupons)
+}
+
+/*
+Inserts code, once, or count random codes, in one transaction. A random code that is taken is
+drawn again; a chosen code that is taken is errCouponTaken.
+*/
+func createCoupons(base Coupon, code string, prefix string, count int) ([]Coupon, error) {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if code != "" || count < 1 {
+		count = 1
+	}
+	coupons := []Coupon{}
+	for attempts := 0; len(coupons) < count; attempts++ {
+		if attempts > 2*count+10 {
+			return nil, errors.New("too many coupon codes were taken; use a longer CouponCodeLength or another prefix")
+		}
+		c := base
+		if c.Code = code; code == "" {
+			if c.Code, err = randomCouponCode(prefix); err != nil {
+				return nil, err
+			}
+		}
+		err = tx.QueryRow(
+			"INSERT INTO \"Coupons\"(\"Code\",\"Promotion_ID\",\"Max_Redemptions\",\"Per_Customer_Limit\",\"Min_Subtotal_Cents\",\"Expires_At\") "+
+				"VALUES($1,$2,NULLIF($3,0),NULLIF($4,0),$5,$6) ON CONFLICT (\"Code\") DO NOTHING RETURNING \"ID\"",
+			c.Code, c.PromotionID, c.MaxRedemptions, c.PerCustomerLimit, c.MinSubtotalCents, c.ExpiresAt).Scan(&c.ID)
+		if err == sql.ErrNoRows && code != "" {
+			return nil, errCouponTaken
+		} else if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, c)
+	}
+	return coupons, tx.Commit()
+}
+
+func randomCouponCode(prefix string) (string, error) {
+	return randomCode(prefix, CouponCodeLength)
+}
+
+func randomCode(prefix string, length int) (string, error) {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(couponAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(couponAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+func loadCoupons(db queryer, where string, args ...interface{}) ([]Coupon, error) {
+	rows, err := db.Query(
+		"SELECT c.\"ID\",c.\"Code\",c.\"Promotion_ID\",COALESCE(c.\"Max_Redemptions\",0),COALESCE(c.\"Per_Customer_Limit\",0),c.\"Min_Subtotal_Cents\",c.\"Expires_At\",c.\"Redemptions\","+
+			"p.\"Name\",p.\"Active\" AND (p.\"Starts_At\" IS NULL OR p.\"Starts_At\"<=now()) AND (p.\"Ends_At\" IS NULL OR p.\"Ends_At\">now()) "+
+			"FROM \"Coupons\" c JOIN \"Promotions\" p ON p.\"ID\"=c.\"Promotion_ID\" "+where+" ORDER BY c.\"ID\"",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	coupons := []Coupon{}
+	for rows.Next() {
+		var (
+			c         Coupon
+			expiresAt sql.NullTime
+		)
+		if err := rows.Scan(&c.ID, &c.Code, &c.PromotionID, &c.MaxRedemptions, &c.PerCustomerLimit, &c.MinSubtotalCents, &expiresAt, &c.Redemptions, &c.promotion, &c.running); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			c.ExpiresAt = &expiresAt.Time
+		}
+		coupons = append(coupons, c)
+	}
+	return coupons, rows.Err()
+}
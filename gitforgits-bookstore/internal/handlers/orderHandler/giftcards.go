@@ -0,0 +1,508 @@
+package orderHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/ledger"
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+)
+
+var GiftCardCodeLength = 16
+
+const (
+	TenderGiftCard    = "gift_card"
+	TenderStoreCredit = "store_credit"
+)
+
+/*
+A gift card or the customer's store credit, paying towards their order. At checkout
+AmountCents is what it would pay of the current total; on an order, what it paid. Code is
+only the gift card's last four characters.
+*/
+type Tender struct {
+	Kind         string
+	GiftCardID   int    `json:",omitempty"`
+	Code         string `json:",omitempty"`
+	BalanceCents int64  `json:",omitempty"`
+	Balance      string `json:",omitempty"`
+	AmountCents  int64
+	Amount       string
+	accountID    int
+}
+
+/*
+A gift card bought with an order. Only its buyer sees the whole code.
+*/
+type IssuedGiftCard struct {
+	Code         string
+	InitialCents int64
+	Initial      string
+	BalanceCents int64
+	Balance      string
+}
+
+/*
+Codes are entered with or without the dashes they are shown with.
+*/
+func normalizeGiftCardCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+/*
+Shows a code in groups of four, e.g. ABCD-EFGH-JKLM-NPQR.
+*/
+func formatGiftCardCode(code string) string {
+	var groups []string
+	for len(code) > 4 {
+		groups, code = append(groups, code[:4]), code[4:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+func lastFour(code string) string {
+	if len(code) > 4 {
+		return code[len(code)-4:]
+	}
+	return code
+}
+
+func registerTenderHandlers(sr *mux.Router) {
+	sr.HandleFunc("/gift-cards", ApplyGiftCard).Methods("POST")
+	sr.HandleFunc("/gift-cards/{giftCardID:[0-9]+}", RemoveGiftCard).Methods("DELETE")
+	sr.HandleFunc("/gift-cards/{giftCardID:[0-9]+}/delete", RemoveGiftCard).Methods("POST")
+	sr.HandleFunc("/store-credit", SetStoreCredit).Methods("POST", "PUT")
+}
+
+/*
+Adds a gift card to pay with, posted as the code field or {"Code"}. Cards pay in the order
+they were added, before store credit. The balance is only taken when the order is placed.
+*/
+func ApplyGiftCard(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Code string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Code = r.FormValue("code")
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	code := normalizeGiftCardCode(req.Code)
+	if code == "" {
+		checkoutFailed(w, r, user.ID, "review", http.StatusBadRequest, "Enter a gift card code.")
+		return
+	}
+	var (
+		giftCardID int
+		balance    int64
+	)
+	err := OrderDB.QueryRow(
+		"SELECT g.\"ID\",a.\"Balance_Cents\" FROM \"Gift_Cards\" g JOIN \"Ledger_Accounts\" a ON a.\"ID\"=g.\"Account_ID\" WHERE g.\"Code\"=$1",
+		code).Scan(&giftCardID, &balance)
+	if err == sql.ErrNoRows {
+		checkoutFailed(w, r, user.ID, "review", http.StatusNotFound, "We don't know that gift card. Check the code and try again.")
+		return
+	}
+	if err == nil && balance == 0 {
+		checkoutFailed(w, r, user.ID, "review", http.StatusConflict, "That gift card has been spent.")
+		return
+	}
+	var cartID int
+	if err == nil {
+		cartID, err = findCart(w, r, true)
+	}
+	if err == nil {
+		_, err = OrderDB.Exec(
+			"INSERT INTO \"Cart_Gift_Cards\"(\"Cart_ID\",\"Gift_Card_ID\") VALUES($1,$2) ON CONFLICT DO NOTHING",
+			cartID, giftCardID)
+	}
+	if err != nil {
+		log.Printf("orderHandler.ApplyGiftCard; adding a gift card for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	checkoutDone(w, r, user.ID, "review")
+}
+
+/*
+Stops paying with a gift card.
+*/
+func RemoveGiftCard(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	cartID, err := findCart(w, r, false)
+	if err == nil && cartID != 0 {
+		_, err = OrderDB.Exec("DELETE FROM \"Cart_Gift_Cards\" WHERE \"Cart_ID\"=$1 AND \"Gift_Card_ID\"=$2", cartID, mux.Vars(r)["giftCardID"])
+	}
+	if err != nil {
+		log.Printf("orderHandler.RemoveGiftCard; removing a gift card for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	checkoutDone(w, r, user.ID, "review")
+}
+
+/*
+Turns paying with store credit on or off, posted as the use field ("1" or empty) or {"Use"}.
+*/
+func SetStoreCredit(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Use bool }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Use, _ = strconv.ParseBool(r.FormValue("use"))
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	cartID, err := findCart(w, r, true)
+	if err == nil {
+		_, err = OrderDB.Exec("UPDATE \"Carts\" SET \"Use_Store_Credit\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", cartID, req.Use)
+	}
+	if err != nil {
+		log.Printf("orderHandler.SetStoreCredit; saving the store credit choice of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	checkoutDone(w, r, user.ID, "review")
+}
+
+/*
+The tenders chosen for a cart, gift cards in the order they were added and then store
+credit, with their balances; and the user's store credit balance, whether it is used or not.
+*/
+func cartTenders(db queryer, cartID int, userID int) ([]Tender, int64, error) {
+	tenders := []Tender{}
+	rows, err := db.Query(
+		"SELECT g.\"ID\",g.\"Code\",a.\"ID\",a.\"Balance_Cents\" FROM \"Cart_Gift_Cards\" cg "+
+			"JOIN \"Gift_Cards\" g ON g.\"ID\"=cg.\"Gift_Card_ID\" JOIN \"Ledger_Accounts\" a ON a.\"ID\"=g.\"Account_ID\" "+
+			"WHERE cg.\"Cart_ID\"=$1 ORDER BY cg.\"Added_At\",g.\"ID\"",
+		cartID)
+	if err != nil {
+		return nil, 0, err
+	}
+	for rows.Next() {
+		t := Tender{Kind: TenderGiftCard}
+		if err := rows.Scan(&t.GiftCardID, &t.Code, &t.accountID, &t.BalanceCents); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		t.Code = lastFour(t.Code)
+		tenders = append(tenders, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows, err = db.Query(
+		"SELECT a.\"ID\",a.\"Balance_Cents\",COALESCE(c.\"Use_Store_Credit\",false) FROM \"Ledger_Accounts\" a "+
+			"LEFT JOIN \"Carts\" c ON c.\"ID\"=$2 AND c.\"User_ID\"=a.\"User_ID\" WHERE a.\"User_ID\"=$1",
+		userID, cartID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var credit int64
+	if rows.Next() {
+		t := Tender{Kind: TenderStoreCredit}
+		var use bool
+		if err := rows.Scan(&t.accountID, &t.BalanceCents, &use); err != nil {
+			return nil, 0, err
+		}
+		if credit = t.BalanceCents; use && credit > 0 {
+			tenders = append(tenders, t)
+		}
+	}
+	return tenders, credit, rows.Err()
+}
+
+/*
+Works out what each tender pays of totalCents, in turn, and returns what they pay together.
+*/
+func planTender(tenders []Tender, totalCents int64) int64 {
+	var paid int64
+	for i := range tenders {
+		t := &tenders[i]
+		t.AmountCents = min(t.BalanceCents, totalCents-paid)
+		paid += t.AmountCents
+		t.Balance, t.Amount = formatCents(t.BalanceCents), formatCents(t.AmountCents)
+	}
+	return paid
+}
+
+/*
+Locks the tenders' accounts, with the system account they pay into, in ID order as
+ledger.Post would, and reads their balances again.
+*/
+func lockTenders(tx *sql.Tx, tenders []Tender) error {
+	if len(tenders) == 0 {
+		return nil
+	}
+	system, err := ledger.System(tx, ledger.OrderTender)
+	if err != nil {
+		return err
+	}
+	accounts := []int{system}
+	for _, t := range tenders {
+		accounts = append(accounts, t.accountID)
+	}
+	sort.Ints(accounts)
+	balances := map[int]int64{}
+	for _, id := range accounts {
+		var balance int64
+		if err = tx.QueryRow("SELECT \"Balance_Cents\" FROM \"Ledger_Accounts\" WHERE \"ID\"=$1 FOR UPDATE", id).Scan(&balance); err != nil {
+			return err
+		}
+		balances[id] = balance
+	}
+	for i := range tenders {
+		tenders[i].BalanceCents = balances[tenders[i].accountID]
+	}
+	return nil
+}
+
+func tenderKey(orderID int) string {
+	return fmt.Sprintf("order-%v-tender", orderID)
+}
+
+/*
+Takes what the planned tenders pay off their balances, for a new order.
+*/
+func spendTenders(tx *sql.Tx, orderID int, tenders []Tender, by actor) error {
+	system, err := ledger.System(tx, ledger.OrderTender)
+	if err != nil {
+		return err
+	}
+	var (
+		entries []ledger.Entry
+		total   int64
+	)
+	for _, t := range tenders {
+		if t.AmountCents > 0 {
+			entries = append(entries, ledger.Entry{AccountID: t.accountID, AmountCents: -t.AmountCents})
+			total += t.AmountCents
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	entries = append(entries, ledger.Entry{AccountID: system, AmountCents: total})
+	_, err = ledger.Post(tx, ledger.Transaction{
+		Key: tenderKey(orderID), Kind: "tender", OrderID: orderID, ActorID: by.ID, Actor: by.Name,
+		Memo: fmt.Sprintf("Paid towards order #%v", orderID), Entries: entries,
+	})
+	return err
+}
+
+/*
+Gives a cancelled order's gift cards and store credit back what they paid, by posting the
+reverse of what was spent.
+*/
+func releaseTender(tx *sql.Tx, orderID int, by actor) error {
+	rows, err := tx.Query(
+		"SELECT e.\"Account_ID\",e.\"Amount_Cents\" FROM \"Ledger_Entries\" e JOIN \"Ledger_Transactions\" t ON t.\"ID\"=e.\"Transaction_ID\" WHERE t.\"Key\"=$1",
+		tenderKey(orderID))
+	if err != nil {
+		return err
+	}
+	var entries []ledger.Entry
+	for rows.Next() {
+		var e ledger.Entry
+		if err := rows.Scan(&e.AccountID, &e.AmountCents); err != nil {
+			rows.Close()
+			return err
+		}
+		e.AmountCents = -e.AmountCents
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(entries) == 0 {
+		return err
+	}
+	_, err = ledger.Post(tx, ledger.Transaction{
+		Key: tenderKey(orderID) + "-release", Kind: "tender_release", OrderID: orderID, ActorID: by.ID, Actor: by.Name,
+		Memo: fmt.Sprintf("Order #%v cancelled", orderID), Entries: entries,
+	})
+	return err
+}
+
+/*
+Issues the gift cards bought with an order as it ships, one per copy, each worth what the
+copy cost. Returns how many were issued.
+*/
+func issueGiftCards(tx *sql.Tx, orderID int, by actor) (int, error) {
+	rows, err := tx.Query("SELECT \"ID\",\"Quantity\",\"Unit_Price_Cents\" FROM \"Order_Items\" WHERE \"Order_ID\"=$1 AND \"Gift_Card\" ORDER BY \"ID\"", orderID)
+	if err != nil {
+		return 0, err
+	}
+	type line struct {
+		itemID, quantity int
+		price            int64
+	}
+	var lines []line
+	for rows.Next() {
+		var l line
+		if err := rows.Scan(&l.itemID, &l.quantity, &l.price); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if l.price > 0 {
+			lines = append(lines, l)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(lines) == 0 {
+		return 0, err
+	}
+	sold, err := ledger.System(tx, ledger.GiftCardsSold)
+	if err != nil {
+		return 0, err
+	}
+	issued := 0
+	for _, l := range lines {
+		for n := 0; n < l.quantity; n++ {
+			account, err := ledger.OpenGiftCard(tx)
+			if err != nil {
+				return issued, err
+			}
+			var giftCardID int
+			for attempts := 0; giftCardID == 0; attempts++ {
+				if attempts == 10 {
+					return issued, errors.New("too many gift card codes were taken; use a longer GiftCardCodeLength")
+				}
+				code, err := randomCode("", GiftCardCodeLength)
+				if err != nil {
+					return issued, err
+				}
+				err = tx.QueryRow(
+					"INSERT INTO \"Gift_Cards\"(\"Code\",\"Account_ID\",\"Initial_Cents\",\"Order_Item_ID\") VALUES($1,$2,$3,$4) ON CONFLICT (\"Code\") DO NOTHING RETURNING \"ID\"",
+					code, account, l.price, l.itemID).Scan(&giftCardID)
+				if err != nil && err != sql.ErrNoRows {
+					return issued, err
+				}
+			}
+			_, err = ledger.Post(tx, ledger.Transaction{
+				Key: fmt.Sprintf("gift-card-%v-issue", giftCardID), Kind: "gift_card_issue", OrderID: orderID, ActorID: by.ID, Actor: by.Name,
+				Memo:    fmt.Sprintf("Bought with order #%v", orderID),
+				Entries: []ledger.Entry{{AccountID: account, AmountCents: l.price}, {AccountID: sold, AmountCents: -l.price}},
+			})
+			if err != nil {
+				return issued, err
+			}
+			issued++
+		}
+	}
+	return issued, nil
+}
+
+/*
+Gives amount to the store credit of the order's customer, as a refund.
+*/
+func refundToStoreCredit(tx *sql.Tx, orderID int, userID int, amount int64, left int64, by actor, reason string) (int, error) {
+	issued, err := ledger.System(tx, ledger.StoreCreditIssued)
+	if err != nil {
+		return 0, err
+	}
+	account, err := ledger.StoreCredit(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	memo := fmt.Sprintf("Refund for order #%v", orderID)
+	if reason != "" {
+		memo += ": " + reason
+	}
+	// What was left to refund only goes down, so it tells refunds of the same order apart.
+	return ledger.Post(tx, ledger.Transaction{
+		Key: fmt.Sprintf("order-%v-refund-%v", orderID, left), Kind: "refund", OrderID: orderID, ActorID: by.ID, Actor: by.Name,
+		Memo: memo, Entries: []ledger.Entry{{AccountID: account, AmountCents: amount}, {AccountID: issued, AmountCents: -amount}},
+	})
+}
+
+/*
+What is left to refund of an order: its captured payments less their refunds, and what
+gift cards and store credit paid for a shipped order, less the refunds given as store
+credit. Gift cards the order bought are not refundable once issued, as the customer keeps
+them, so their value is taken off too.
+*/
+func refundLeft(db queryer, orderID int) (int64, error) {
+	rows, err := db.Query(
+		"SELECT GREATEST(CASE WHEN o.\"Status\" IN ('shipped','delivered','refunded') THEN o.\"Tender_Cents\" ELSE 0 END"+
+			"+COALESCE((SELECT SUM(p.\"Captured_Cents\"-p.\"Refunded_Cents\") FROM \"Payments\" p WHERE p.\"Order_ID\"=o.\"ID\" AND p.\"Status\" IN ('captured','refunded')),0)"+
+			"-COALESCE((SELECT SUM(f.\"Amount_Cents\") FROM \"Refunds\" f WHERE f.\"Order_ID\"=o.\"ID\" AND f.\"Method\"='store_credit'),0)"+
+			"-COALESCE((SELECT SUM(g.\"Initial_Cents\") FROM \"Gift_Cards\" g JOIN \"Order_Items\" i ON i.\"ID\"=g.\"Order_Item_ID\" WHERE i.\"Order_ID\"=o.\"ID\"),0),0) "+
+			"FROM \"Orders\" o WHERE o.\"ID\"=$1",
+		orderID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var left int64
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = sql.ErrNoRows
+		}
+		return 0, err
+	}
+	if err = rows.Scan(&left); err != nil {
+		return 0, err
+	}
+	return left, rows.Err()
+}
+
+/*
+Loads what gift cards and store credit paid for an order, and the gift cards bought with it.
+*/
+func loadOrderTenders(db queryer, order *Order) error {
+	order.Tenders, order.GiftCards = []Tender{}, []IssuedGiftCard{}
+	rows, err := db.Query(
+		"SELECT a.\"Kind\",COALESCE(g.\"Code\",''),-e.\"Amount_Cents\" FROM \"Ledger_Entries\" e "+
+			"JOIN \"Ledger_Transactions\" t ON t.\"ID\"=e.\"Transaction_ID\" JOIN \"Ledger_Accounts\" a ON a.\"ID\"=e.\"Account_ID\" "+
+			"LEFT JOIN \"Gift_Cards\" g ON g.\"Account_ID\"=a.\"ID\" WHERE t.\"Key\"=$1 AND a.\"Kind\"<>'system' ORDER BY e.\"ID\"",
+		tenderKey(order.ID))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var t Tender
+		if err := rows.Scan(&t.Kind, &t.Code, &t.AmountCents); err != nil {
+			rows.Close()
+			return err
+		}
+		t.Code, t.Amount = lastFour(t.Code), formatCents(t.AmountCents)
+		order.Tenders = append(order.Tenders, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows, err = db.Query(
+		"SELECT g.\"Code\",g.\"Initial_Cents\",a.\"Balance_Cents\" FROM \"Gift_Cards\" g "+
+			"JOIN \"Order_Items\" oi ON oi.\"ID\"=g.\"Order_Item_ID\" JOIN \"Ledger_Accounts\" a ON a.\"ID\"=g.\"Account_ID\" "+
+			"WHERE oi.\"Order_ID\"=$1 ORDER BY g.\"ID\"",
+		order.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g IssuedGiftCard
+		if err := rows.Scan(&g.Code, &g.InitialCents, &g.BalanceCents); err != nil {
+			return err
+		}
+		g.Code = formatGiftCardCode(g.Code)
+		g.Initial, g.Balance = formatCents(g.InitialCents), formatCents(g.BalanceCents)
+		order.GiftCards = append(order.GiftCards, g)
+	}
+	return rows.Err()
+}
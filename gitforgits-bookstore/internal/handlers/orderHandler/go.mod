@@ -3,8 +3,23 @@ module golang-web-book/gitforgits-bookstore/internal/handlers/orderHandler
 go 1.22.4
 
 require (
+	github.com/flintg/gitforgits-bookstore/ledger v0.0.0-00010101000000-000000000000
 	github.com/flintg/gitforgits-bookstore/mAuthenticate v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/mAuthorize v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/payments v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/promotions v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/sessionStore v0.0.0-00010101000000-000000000000
 	github.com/gorilla/mux v1.8.1
 )
 
 replace github.com/flintg/gitforgits-bookstore/mAuthenticate => ../../middleware/mAuthenticate
+
+replace github.com/flintg/gitforgits-bookstore/mAuthorize => ../../middleware/mAuthorize
+
+replace github.com/flintg/gitforgits-bookstore/sessionStore => ../../storage/sessionStore
+
+replace github.com/flintg/gitforgits-bookstore/payments => ../../payments
+
+replace github.com/flintg/gitforgits-bookstore/promotions => ../../promotions
+
+replace github.com/flintg/gitforgits-bookstore/ledger => ../../ledger
@@ -0,0 +1,237 @@
+package orderHandler
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	HistoryPageSize    = 20
+	MaxHistoryPageSize = 100
+)
+
+/*
+One line of the order history.
+*/
+type OrderSummary struct {
+	ID          int
+	Status      string
+	StatusLabel string
+	ItemCount   int
+	TotalCents  int64
+	Total       string
+	CreatedAt   time.Time
+}
+
+/*
+A page of a user's orders and the filters that chose them. From and To are dates,
+"2006-01-02", and both are included.
+*/
+type OrderHistory struct {
+	Orders   []OrderSummary
+	Page     int
+	PerPage  int
+	Total    int
+	Pages    int
+	Status   []string
+	From     string
+	To       string
+	PrevURL  string         `json:",omitempty"`
+	NextURL  string         `json:",omitempty"`
+	Statuses []statusOption `json:"-"`
+	Errors   []string       `json:"-"`
+
+	from, to time.Time
+}
+
+type statusOption struct {
+	Status   string
+	Label    string
+	Selected bool
+}
+
+/*
+Reads the filters and page from the query. Problems are collected in Errors.
+*/
+func parseHistoryQuery(q url.Values) OrderHistory {
+	h := OrderHistory{Orders: []OrderSummary{}, Page: 1, PerPage: HistoryPageSize}
+	if v := q.Get("page"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 {
+			h.Page = n
+		} else {
+			h.Errors = append(h.Errors, "The page must be a number from 1.")
+		}
+	}
+	if v := q.Get("per_page"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= MaxHistoryPageSize {
+			h.PerPage = n
+		} else {
+			h.Errors = append(h.Errors, fmt.Sprintf("Show from 1 to %d orders per page.", MaxHistoryPageSize))
+		}
+	}
+	for _, v := range q["status"] {
+		for _, status := range strings.Split(v, ",") {
+			if status = strings.TrimSpace(status); status == "" {
+				continue
+			}
+			if _, ok := statusLabels[status]; !ok {
+				h.Errors = append(h.Errors, fmt.Sprintf("There's no order status %q.", status))
+				continue
+			}
+			h.Status = append(h.Status, status)
+		}
+	}
+	var err error
+	if h.From = q.Get("from"); h.From != "" {
+		if h.from, err = time.Parse(time.DateOnly, h.From); err != nil {
+			h.Errors = append(h.Errors, "The from date must look like 2024-01-31.")
+		}
+	}
+	if h.To = q.Get("to"); h.To != "" {
+		if h.to, err = time.Parse(time.DateOnly, h.To); err != nil {
+			h.Errors = append(h.Errors, "The to date must look like 2024-01-31.")
+		}
+	}
+	if !h.from.IsZero() && !h.to.IsZero() && h.to.Before(h.from) {
+		h.Errors = append(h.Errors, "The to date is before the from date.")
+	}
+	for _, status := range []string{StatusPendingPayment, StatusPaid, StatusPicking, StatusShipped, StatusDelivered, StatusCancelled, StatusRefunded} {
+		option := statusOption{Status: status, Label: statusLabels[status]}
+		for _, s := range h.Status {
+			option.Selected = option.Selected || s == status
+		}
+		h.Statuses = append(h.Statuses, option)
+	}
+	return h
+}
+
+/*
+Fills in h with the page of userID's orders it asks for.
+*/
+func listOrders(userID int, h *OrderHistory) error {
+	where := []string{"o.\"User_ID\"=$1"}
+	args := []interface{}{userID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if len(h.Status) > 0 {
+		in := make([]string, len(h.Status))
+		for i, status := range h.Status {
+			in[i] = arg(status)
+		}
+		where = append(where, "o.\"Status\" IN ("+strings.Join(in, ",")+")")
+	}
+	if !h.from.IsZero() {
+		where = append(where, "o.\"Created_At\">="+arg(h.from))
+	}
+	if !h.to.IsZero() {
+		where = append(where, "o.\"Created_At\"<"+arg(h.to.AddDate(0, 0, 1)))
+	}
+	filter := strings.Join(where, " AND ")
+	if err := OrderDB.QueryRow("SELECT count(*) FROM \"Orders\" o WHERE "+filter, args...).Scan(&h.Total); err != nil {
+		return err
+	}
+	h.Pages = (h.Total + h.PerPage - 1) / h.PerPage
+	rows, err := OrderDB.Query(
+		"SELECT o.\"ID\",o.\"Status\",COALESCE((SELECT sum(oi.\"Quantity\") FROM \"Order_Items\" oi WHERE oi.\"Order_ID\"=o.\"ID\"),0),o.\"Total_Cents\",o.\"Created_At\" "+
+			"FROM \"Orders\" o WHERE "+filter+" ORDER BY o.\"Created_At\" DESC,o.\"ID\" DESC LIMIT "+arg(h.PerPage)+" OFFSET "+arg((h.Page-1)*h.PerPage),
+		args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o OrderSummary
+		if err := rows.Scan(&o.ID, &o.Status, &o.ItemCount, &o.TotalCents, &o.CreatedAt); err != nil {
+			return err
+		}
+		o.StatusLabel, o.Total = statusLabels[o.Status], formatCents(o.TotalCents)
+		h.Orders = append(h.Orders, o)
+	}
+	if h.Page > 1 {
+		// Past the last page, the way back is to the last one.
+		h.PrevURL = h.pageURL(max(min(h.Page-1, h.Pages), 1))
+	}
+	if h.Page < h.Pages {
+		h.NextURL = h.pageURL(h.Page + 1)
+	}
+	return rows.Err()
+}
+
+func (h *OrderHistory) pageURL(page int) string {
+	q := url.Values{"page": {strconv.Itoa(page)}}
+	if h.PerPage != HistoryPageSize {
+		q.Set("per_page", strconv.Itoa(h.PerPage))
+	}
+	if len(h.Status) > 0 {
+		q["status"] = h.Status
+	}
+	if h.From != "" {
+		q.Set("from", h.From)
+	}
+	if h.To != "" {
+		q.Set("to", h.To)
+	}
+	return OrderPathPrefix + "/history?" + q.Encode()
+}
+
+/*
+Puts the books of one of the user's orders back in their cart, at today's prices. Books that
+aren't for sale any more, or don't fit in the cart, are left out. Browsers go to the cart;
+JSON clients get it, with a notice for each book left out.
+*/
+func ReorderOrder(w http.ResponseWriter, r *http.Request) {
+	order, ok := ownOrder(w, r, false)
+	if !ok {
+		return
+	}
+	cartID, err := findCart(w, r, true)
+	var skipped []string
+	for _, item := range order.Items {
+		if err != nil {
+			break
+		}
+		if item.BookID == 0 {
+			skipped = append(skipped, item.Title)
+			continue
+		}
+		quantity := item.Quantity
+		if quantity > MaxCartQuantity {
+			quantity = MaxCartQuantity
+		}
+		err = addToCart(cartID, item.BookID, quantity)
+		if err == sql.ErrNoRows || err == errNotForSale || err == errCartFull {
+			skipped, err = append(skipped, item.Title), nil
+		}
+	}
+	if err != nil {
+		log.Printf("orderHandler.ReorderOrder; copying order [%v] into cart [%v] failed. Error: %v", order.ID, cartID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !wantsJSON(r) {
+		target := OrderPathPrefix + "/cart"
+		if len(skipped) > 0 {
+			target += "?skipped=" + strconv.Itoa(len(skipped))
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+	cart, err := loadCart(OrderDB, cartID)
+	if err != nil {
+		log.Printf("orderHandler.ReorderOrder; loading cart [%v] failed. Error: %v", cartID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	for _, title := range skipped {
+		cart.Notices = append(cart.Notices, fmt.Sprintf("%v couldn't be added: it isn't for sale any more, or your cart is full.", title))
+	}
+	respondCart(w, r, http.StatusOK, cart)
+}
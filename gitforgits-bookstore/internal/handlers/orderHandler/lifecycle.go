@@ -0,0 +1,394 @@
+package orderHandler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+)
+
+const (
+	StatusPendingPayment = "pending_payment"
+	StatusPaid           = "paid"
+	StatusPicking        = "picking"
+	StatusShipped        = "shipped"
+	StatusDelivered      = "delivered"
+	StatusCancelled      = "cancelled"
+	StatusRefunded       = "refunded"
+)
+
+/*
+Where an order may go from each state. Cancelled and refunded are final. Payment is only
+authorized until the order ships, so orders that haven't shipped are cancelled rather than
+refunded.
+*/
+var Transitions = map[string][]string{
+	StatusPendingPayment: {StatusPaid, StatusCancelled},
+	StatusPaid:           {StatusPicking, StatusCancelled},
+	StatusPicking:        {StatusShipped, StatusCancelled},
+	StatusShipped:        {StatusDelivered, StatusRefunded},
+	StatusDelivered:      {StatusRefunded},
+	StatusCancelled:      {},
+	StatusRefunded:       {},
+}
+
+var statusLabels = map[string]string{
+	StatusPendingPayment: "Awaiting payment",
+	StatusPaid:           "Paid",
+	StatusPicking:        "Being picked",
+	StatusShipped:        "Shipped",
+	StatusDelivered:      "Delivered",
+	StatusCancelled:      "Cancelled",
+	StatusRefunded:       "Refunded",
+}
+
+/*
+Reports whether an order that is from may become to.
+*/
+func CanTransition(from, to string) bool {
+	for _, next := range Transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+type transitionError struct {
+	From, To string
+}
+
+func (e *transitionError) Error() string {
+	return fmt.Sprintf("an order that is %v can't become %v", statusLabels[e.From], statusLabels[e.To])
+}
+
+var errNotCapturable = errors.New("the order's payment isn't authorized")
+
+/*
+Who changed an order: a user, or the system, e.g. "payment provider". ID is 0 for the system.
+*/
+type actor struct {
+	ID   int
+	Name string
+}
+
+func userActor(user *mAuthenticate.User) actor {
+	return actor{ID: user.ID, Name: user.Username}
+}
+
+var paymentActor = actor{Name: "payment provider"}
+
+/*
+One step in an order's history. Kind is "status" for a change of status; From is empty for
+the event that placed it. Other kinds, e.g. "return_requested", leave the status as it was.
+*/
+type OrderEvent struct {
+	Kind      string
+	From      string `json:",omitempty"`
+	To        string
+	Label     string
+	Actor     string
+	Reason    string
+	CreatedAt time.Time
+}
+
+/*
+Moves a locked order on to status to, and records who did it and why. Callers lock the order
+with FOR UPDATE first and pass the status they read.
+*/
+func transitionOrder(tx *sql.Tx, orderID int, from string, to string, by actor, reason string) error {
+	if !CanTransition(from, to) {
+		return &transitionError{From: from, To: to}
+	}
+	_, err := tx.Exec("UPDATE \"Orders\" SET \"Status\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", orderID, to)
+	if err == nil {
+		err = recordOrderEvent(tx, orderID, from, to, by, reason)
+	}
+	return err
+}
+
+func recordOrderEvent(tx *sql.Tx, orderID int, from string, to string, by actor, reason string) error {
+	_, err := tx.Exec(
+		"INSERT INTO \"Order_Events\"(\"Order_ID\",\"From_Status\",\"To_Status\",\"Actor_ID\",\"Actor\",\"Reason\") VALUES($1,NULLIF($2,''),$3,NULLIF($4,0),$5,$6)",
+		orderID, from, to, by.ID, by.Name, reason)
+	return err
+}
+
+/*
+Records a step that doesn't change the order's status, such as a return being approved.
+*/
+func recordOrderNote(tx *sql.Tx, orderID int, status string, kind string, by actor, reason string) error {
+	_, err := tx.Exec(
+		"INSERT INTO \"Order_Events\"(\"Order_ID\",\"Kind\",\"From_Status\",\"To_Status\",\"Actor_ID\",\"Actor\",\"Reason\") VALUES($1,$2,$3,$3,NULLIF($4,0),$5,$6)",
+		orderID, kind, status, by.ID, by.Name, reason)
+	return err
+}
+
+func lockOrder(tx *sql.Tx, orderID int) (string, error) {
+	var status string
+	err := tx.QueryRow("SELECT \"Status\" FROM \"Orders\" WHERE \"ID\"=$1 FOR UPDATE", orderID).Scan(&status)
+	return status, err
+}
+
+func registerLifecycleHandlers(shop *mux.Router, sr *mux.Router) {
+	shop.HandleFunc("/{id:[0-9]+}/cancel", CancelOrder).Methods("POST")
+	mgr := sr.NewRoute().Subrouter()
+	mgr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequirePermission(mAuthorize.PermOrdersManage))
+	mgr.HandleFunc("/{id:[0-9]+}/status", SetOrderStatus).Methods("POST", "PUT")
+	registerReturnHandlers(shop, mgr)
+}
+
+/*
+Staff move an order along, with the status and reason fields or {"Status","Reason"}.
+Shipping captures the payment and issues the gift cards bought with the order; cancelling
+releases the hold on the payment, puts the books back in stock, and gives back the coupon,
+gift cards and store credit it used. Refunds go through RefundOrder, and the order becomes
+refunded once they cover what was paid.
+*/
+func SetOrderStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Status, Reason string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Status, req.Reason = r.FormValue("status"), r.FormValue("reason")
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	orderID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if req.Status == StatusRefunded {
+		http.Error(w, "Refund the payment instead; the order follows.", http.StatusBadRequest)
+		return
+	}
+	if _, ok := statusLabels[req.Status]; !ok {
+		http.Error(w, "Unknown status.", http.StatusBadRequest)
+		return
+	}
+	err := changeOrderStatus(r.Context(), orderID, req.Status, userActor(user), req.Reason)
+	if err != nil {
+		orderChangeFailed(w, r, err, "orderHandler.SetOrderStatus", orderID)
+		return
+	}
+	log.Printf("orderHandler.SetOrderStatus; [%v] moved order [%v] to %v.", user.Username, orderID, req.Status)
+	orderChanged(w, r, orderID)
+}
+
+/*
+Customers cancel their own orders until they ship, with an optional reason field or
+{"Reason"}. The payment is released, the books go back in stock, and gift cards and store
+credit get back what they paid.
+*/
+func CancelOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Reason string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Reason = r.FormValue("reason")
+	}
+	order, ok := ownOrder(w, r, false)
+	if !ok {
+		return
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	reason := "Cancelled by the customer"
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+	err := changeOrderStatus(r.Context(), order.ID, StatusCancelled, userActor(user), reason)
+	if err != nil {
+		orderChangeFailed(w, r, err, "orderHandler.CancelOrder", order.ID)
+		return
+	}
+	log.Printf("orderHandler.CancelOrder; [%v] cancelled order [%v].", user.Username, order.ID)
+	orderChanged(w, r, order.ID)
+}
+
+/*
+Answers a change to an order that went wrong. Errors we don't expect are logged as caller's.
+*/
+func orderChangeFailed(w http.ResponseWriter, r *http.Request, err error, caller string, orderID int) {
+	var bad *transitionError
+	var invalid *returnError
+	switch {
+	case err == sql.ErrNoRows:
+		OrderNotFound(w, r)
+	case errors.As(err, &bad):
+		http.Error(w, "Sorry, "+bad.Error()+".", http.StatusConflict)
+	case errors.As(err, &invalid):
+		http.Error(w, "Sorry, "+invalid.Error()+".", invalid.Status)
+	case err == errNotCapturable:
+		http.Error(w, "This order can't ship: its payment isn't authorized.", http.StatusConflict)
+	case errors.Is(err, errRefundFailed):
+		log.Printf("%v; refunding order [%v] failed. Error: %v", caller, orderID, err)
+		http.Error(w, "The payment provider couldn't make the refund. Please try again.", http.StatusBadGateway)
+	default:
+		log.Printf("%v; changing order [%v] failed. Error: %v", caller, orderID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+/*
+Browsers go back to the order; JSON clients get it as it is now.
+*/
+func orderChanged(w http.ResponseWriter, r *http.Request, orderID int) {
+	if !wantsJSON(r) {
+		http.Redirect(w, r, OrderPathPrefix+"/"+strconv.Itoa(orderID), http.StatusSeeOther)
+		return
+	}
+	order, err := loadOrder(OrderDB, orderID)
+	if err != nil {
+		log.Printf("orderHandler.orderChanged; loading order [%v] failed. Error: %v", orderID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respondOrder(w, r, http.StatusOK, order)
+}
+
+/*
+Moves an order to status to, with what that takes. The provider is called while the order
+is locked, so nobody else changes it in between; if the commit then fails, the provider's
+webhook still brings the payment up to date.
+*/
+func changeOrderStatus(ctx context.Context, orderID int, to string, by actor, reason string) error {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	from, err := lockOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if !CanTransition(from, to) {
+		return &transitionError{From: from, To: to}
+	}
+	switch to {
+	case StatusShipped:
+		issued := 0
+		if err = capturePayment(ctx, tx, orderID); err == nil {
+			issued, err = issueGiftCards(tx, orderID, by)
+		}
+		if err == nil && issued > 0 {
+			err = recordOrderNote(tx, orderID, from, "gift_cards_issued", by, fmt.Sprintf("%v gift card(s)", issued))
+		}
+	case StatusCancelled:
+		// Coupon, books, then accounts: the order placeOrder locks them in
+		if err = releaseCoupon(tx, orderID); err == nil {
+			err = releaseStock(tx, orderID)
+		}
+		if err == nil {
+			err = releaseTender(tx, orderID, by)
+		}
+		if err == nil {
+			err = voidPayment(ctx, tx, orderID)
+		}
+	}
+	if err == nil {
+		err = transitionOrder(tx, orderID, from, to, by, reason)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Puts a cancelled order's books back in stock.
+*/
+func releaseStock(tx *sql.Tx, orderID int) error {
+	_, err := tx.Exec(
+		"UPDATE \"Books\" b SET \"Stock\"=b.\"Stock\"+oi.\"Quantity\" FROM \"Order_Items\" oi "+
+			"WHERE oi.\"Order_ID\"=$1 AND b.\"ID\"=oi.\"Book_ID\" AND b.\"Stock\" IS NOT NULL",
+		orderID)
+	return err
+}
+
+func capturePayment(ctx context.Context, tx *sql.Tx, orderID int) error {
+	var (
+		paymentID  int
+		providerID string
+		amount     int64
+	)
+	err := tx.QueryRow(
+		"SELECT \"ID\",\"Provider_Payment_ID\",\"Amount_Cents\" FROM \"Payments\" WHERE \"Order_ID\"=$1 AND \"Status\"='authorized' FOR UPDATE",
+		orderID).Scan(&paymentID, &providerID, &amount)
+	if err == sql.ErrNoRows {
+		// Nothing to capture when gift cards and store credit paid it all
+		var due int64
+		if err = tx.QueryRow("SELECT \"Total_Cents\"-\"Tender_Cents\" FROM \"Orders\" WHERE \"ID\"=$1", orderID).Scan(&due); err != nil || due == 0 {
+			return err
+		}
+		return errNotCapturable
+	} else if err != nil {
+		return err
+	} else if Payments == nil {
+		return errNotCapturable
+	}
+	if err = Payments.Capture(ctx, providerID, amount); err != nil {
+		return fmt.Errorf("capturing payment [%v]: %w", providerID, err)
+	}
+	_, err = tx.Exec("UPDATE \"Payments\" SET \"Status\"='captured',\"Captured_Cents\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", paymentID, amount)
+	return err
+}
+
+/*
+Releases a payment that was authorized, or is still in flight, for an order being cancelled.
+*/
+func voidPayment(ctx context.Context, tx *sql.Tx, orderID int) error {
+	var (
+		paymentID  int
+		providerID sql.NullString
+	)
+	err := tx.QueryRow(
+		"SELECT \"ID\",\"Provider_Payment_ID\" FROM \"Payments\" WHERE \"Order_ID\"=$1 AND \"Status\" IN ('started','pending','requires_action','authorized') FOR UPDATE",
+		orderID).Scan(&paymentID, &providerID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if providerID.Valid && Payments != nil {
+		if err = Payments.Void(ctx, providerID.String); err != nil {
+			return fmt.Errorf("voiding payment [%v]: %w", providerID.String, err)
+		}
+	}
+	_, err = tx.Exec("UPDATE \"Payments\" SET \"Status\"='voided',\"Updated_At\"=now() WHERE \"ID\"=$1", paymentID)
+	return err
+}
+
+func loadOrderEvents(db queryer, orderID int) ([]OrderEvent, error) {
+	rows, err := db.Query(
+		"SELECT \"Kind\",COALESCE(\"From_Status\",''),\"To_Status\",\"Actor\",\"Reason\",\"Created_At\" FROM \"Order_Events\" WHERE \"Order_ID\"=$1 ORDER BY \"Created_At\",\"ID\"",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []OrderEvent{}
+	for rows.Next() {
+		var e OrderEvent
+		if err := rows.Scan(&e.Kind, &e.From, &e.To, &e.Actor, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Label = statusLabels[e.To]
+		if e.Kind != "status" {
+			e.Label = noteLabels[e.Kind]
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
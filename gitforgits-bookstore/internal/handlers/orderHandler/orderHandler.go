@@ -1,55 +1,81 @@
 package orderHandler
 
 import (
-	"fmt"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
 
 	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
 )
 
 var OrderPathPrefix string = "/order"
+var OrderDB *sql.DB
+var templateCache *template.Template
 
 func RegisterHandlers(r *mux.Router) {
 	sr := r.PathPrefix(OrderPathPrefix).Subrouter()
-	sr.HandleFunc("/{id:[0-9]+}", GetOrderDetail)
-	sr.HandleFunc("/cart", GetOrdersCart)
-	sr.HandleFunc("/checkout", GetOrdersCheckout)
-	sr.HandleFunc("/history", GetOrdersHistory)
+	// Guests can fill a cart; it is merged into theirs when they log in
+	cart := sr.PathPrefix("/cart").Subrouter()
+	cart.Use(mAuthorize.RequireInteractive)
+	registerCartHandlers(cart)
+	// API keys may read orders with the orders:read scope, but not shop
+	rd := sr.NewRoute().Subrouter()
+	rd.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequireScope(mAuthorize.ScopeOrdersRead))
+	rd.HandleFunc("/{id:[0-9]+}", GetOrderDetail)
+	rd.HandleFunc("/history", GetOrdersHistory)
+	shop := sr.NewRoute().Subrouter()
+	shop.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequireInteractive)
+	shop.HandleFunc("/{id:[0-9]+}/reorder", ReorderOrder).Methods("POST")
+	registerCheckoutHandlers(shop.PathPrefix("/checkout").Subrouter())
+	registerPaymentHandlers(shop, sr)
+	registerLifecycleHandlers(shop, sr)
 	sr.NotFoundHandler = http.HandlerFunc(OrderNotFound)
-	sr.Use(mAuthenticate.AuthenticationMiddleware)
 }
 
 /*
-Gets the detail of a single order
+Gets the detail of a single order: its items, payment, current state and timeline. Customers
+see their own orders, staff see everyone's and can move them along.
 */
 func GetOrderDetail(w http.ResponseWriter, r *http.Request) {
-	//Handler logic to fetch and return book details
-	vars := mux.Vars(r)
-	orderID := vars["id"]
-	http.Error(w, fmt.Sprintf("Oops, GetOrdersDetail isn't implemented, yet. id: [%v]", orderID), http.StatusNotImplemented)
+	order, ok := ownOrder(w, r, true)
+	if ok {
+		respondOrder(w, r, http.StatusOK, order)
+	}
 }
 
 /*
-Handles cart actions
-*/
-func GetOrdersCart(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Oops, GetOrdersCart isn't implemented, yet.", http.StatusNotImplemented)
-}
-
-/*
-Handles checkout actions
-*/
-func GetOrdersCheckout(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Oops, GetOrdersCheckout isn't implemented, yet.", http.StatusNotImplemented)
-}
-
-/*
-Handles order history actions
+Handles order history actions: the signed in user's orders, newest first, a page at a time.
+Filter with ?status= (repeatable), ?from= and ?to= (dates, inclusive); page with ?page= and
+?per_page=.
 */
 func GetOrdersHistory(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Oops, GetOrdersHistory isn't implemented, yet.", http.StatusNotImplemented)
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	history := parseHistoryQuery(r.URL.Query())
+	status := http.StatusOK
+	if len(history.Errors) > 0 {
+		status = http.StatusBadRequest
+	} else if err := listOrders(user.ID, &history); err != nil {
+		log.Printf("orderHandler.GetOrdersHistory; listing orders of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			json.NewEncoder(w).Encode(map[string][]string{"errors": history.Errors})
+			return
+		}
+		json.NewEncoder(w).Encode(history)
+		return
+	}
+	renderOrderPage(w, status, "orderHistory", history)
 }
 
 /*
@@ -59,3 +85,19 @@ func OrderNotFound(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte("That's not in our Rolodex."))
 }
+
+func SetTemplateCache(t *template.Template) {
+	templateCache = t
+}
+
+func renderOrderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	if templateCache == nil {
+		log.Print("orderHandler templateCache is nil.")
+		panic("orderHandler.template is nil!")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templateCache.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("orderHandler.renderOrderPage(%v) error: %v", name, err)
+	}
+}
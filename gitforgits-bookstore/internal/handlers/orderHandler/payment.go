@@ -0,0 +1,504 @@
+package orderHandler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+	"github.com/flintg/gitforgits-bookstore/payments"
+)
+
+/*
+Takes the payments. Orders can be placed without one, but stay pending_payment.
+*/
+var Payments payments.PaymentProvider
+
+/*
+Test cards offered on the payment form, when the provider is the fake one. Other providers
+need the payment method tokenized in the browser.
+*/
+var TestCards []payments.TestCard
+
+var Currency = "USD"
+
+/*
+Prefixed to return URLs handed to the provider, e.g. https://shop.example.com.
+*/
+var PublicURL string
+
+var errNotPayable = errors.New("order is not waiting for payment")
+
+/*
+A payment attempt, as shown to the customer.
+*/
+type Payment struct {
+	Status        string
+	AmountCents   int64
+	Amount        string
+	ActionURL     string `json:",omitempty"`
+	DeclineReason string `json:",omitempty"`
+	Message       string
+}
+
+var paymentMessages = map[string]string{
+	"started":         "We're processing your payment.",
+	"pending":         "We're waiting for your bank to confirm the payment. Refresh this page in a moment to see it.",
+	"requires_action": "Your bank needs you to confirm this payment.",
+	"authorized":      "Payment received. Thank you!",
+	"captured":        "Payment received. Thank you!",
+	"failed":          "We couldn't reach our payment processor. Please try again.",
+	"voided":          "The payment was cancelled.",
+	"refunded":        "The payment was refunded.",
+}
+
+var declineMessages = map[string]string{
+	"card_declined":         "Your card was declined.",
+	"insufficient_funds":    "Your card was declined for insufficient funds.",
+	"authentication_failed": "Your bank couldn't confirm it was you.",
+}
+
+func (p *Payment) describe() {
+	p.Amount = formatCents(p.AmountCents)
+	p.Message = paymentMessages[p.Status]
+	if p.Status == "declined" {
+		p.Message = declineMessages[p.DeclineReason]
+		if p.Message == "" {
+			p.Message = "Your payment was declined."
+		}
+		p.Message += " Please try another payment method."
+	}
+}
+
+/*
+The order page: an order and, while it waits for payment, a way to pay.
+*/
+type orderPage struct {
+	Order
+	Mine           bool // the viewer placed it
+	Staff          bool // the viewer manages orders
+	PaymentMethods []payments.TestCard
+	NextStatuses   []OrderStatus  // for staff
+	ReturnReasons  []ReturnReason // while the viewer can return items
+	Errors         []string
+}
+
+type OrderStatus struct {
+	Status string
+	Label  string
+}
+
+func registerPaymentHandlers(shop *mux.Router, public *mux.Router) {
+	shop.HandleFunc("/{id:[0-9]+}/pay", PayOrder).Methods("POST")
+	public.HandleFunc("/payments/webhook", PaymentWebhook).Methods("POST")
+}
+
+/*
+Pays an order that waits for payment, with the payment_method field or {"PaymentMethod"}.
+Only the customer can pay. Browsers are sent to the provider's challenge if there is one,
+and back to the order page otherwise.
+*/
+func PayOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct{ PaymentMethod string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.PaymentMethod = r.FormValue("payment_method")
+	}
+	order, ok := ownOrder(w, r, false)
+	if !ok {
+		return
+	}
+	if req.PaymentMethod == "" {
+		page := orderPage{Order: order, Mine: true, PaymentMethods: TestCards, Errors: []string{"Choose a payment method."}}
+		respondOrderPage(w, r, http.StatusBadRequest, page)
+		return
+	}
+	payment, err := startPayment(r.Context(), order, req.PaymentMethod)
+	if !paymentStarted(w, r, order.ID, payment, err) {
+		return
+	}
+	if order, err = loadOrder(OrderDB, order.ID); err != nil {
+		log.Printf("orderHandler.PayOrder; reloading order [%v] failed. Error: %v", order.ID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respondOrder(w, r, http.StatusOK, order)
+}
+
+/*
+Sends browsers on after a payment was started, to the challenge or the order page, and
+answers errors. Returns true when a JSON client still needs its answer.
+*/
+func paymentStarted(w http.ResponseWriter, r *http.Request, orderID int, payment Payment, err error) bool {
+	switch {
+	case err == errNotPayable:
+		http.Error(w, "This order isn't waiting for payment.", http.StatusConflict)
+		return false
+	case err != nil:
+		log.Printf("orderHandler.paymentStarted; paying order [%v] failed. Error: %v", orderID, err)
+		http.Error(w, "", http.StatusBadGateway)
+		return false
+	case wantsJSON(r):
+		return true
+	case payment.Status == "requires_action" && payment.ActionURL != "":
+		http.Redirect(w, r, payment.ActionURL, http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, OrderPathPrefix+"/"+strconv.Itoa(orderID), http.StatusSeeOther)
+	}
+	return false
+}
+
+/*
+Asks the provider to authorize what gift cards and store credit left due of the order. An
+attempt that is still in flight or already authorized is returned instead of starting
+another. The attempt is recorded before the provider is asked, so a crash in between leaves a
+trace rather than a lost payment.
+*/
+func startPayment(ctx context.Context, order Order, method string) (Payment, error) {
+	if Payments == nil {
+		return Payment{}, errors.New("no payment provider is configured")
+	}
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return Payment{}, err
+	}
+	defer tx.Rollback()
+	var status string
+	if err = tx.QueryRow("SELECT \"Status\" FROM \"Orders\" WHERE \"ID\"=$1 FOR UPDATE", order.ID).Scan(&status); err != nil {
+		return Payment{}, err
+	}
+	if status != "pending_payment" {
+		return Payment{}, errNotPayable
+	}
+	if p, err := activePayment(tx, order.ID); err != sql.ErrNoRows {
+		return p, err
+	}
+	var paymentID int
+	err = tx.QueryRow(
+		"INSERT INTO \"Payments\"(\"Order_ID\",\"Provider\",\"Amount_Cents\") VALUES($1,$2,$3) RETURNING \"ID\"",
+		order.ID, Payments.Name(), order.DueCents).Scan(&paymentID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return Payment{}, err
+	}
+	auth, err := Payments.Authorize(ctx, payments.AuthorizeRequest{
+		AmountCents:    order.DueCents,
+		Currency:       Currency,
+		PaymentMethod:  method,
+		Reference:      "order-" + strconv.Itoa(order.ID),
+		ReturnURL:      PublicURL + OrderPathPrefix + "/" + strconv.Itoa(order.ID),
+		IdempotencyKey: "payment-" + strconv.Itoa(paymentID),
+	})
+	if err != nil {
+		OrderDB.Exec("UPDATE \"Payments\" SET \"Status\"='failed',\"Decline_Reason\"='provider_error',\"Updated_At\"=now() WHERE \"ID\"=$1", paymentID)
+		return Payment{}, err
+	}
+	payment := Payment{Status: string(auth.Status), AmountCents: order.DueCents, ActionURL: auth.ActionURL, DeclineReason: auth.DeclineReason}
+	if err = updatePayment(ctx, paymentID, order.ID, auth); err != nil {
+		return Payment{}, err
+	}
+	payment.describe()
+	return payment, nil
+}
+
+/*
+Records the provider's answer. An authorized payment makes the order paid. When the order was
+cancelled while the provider was still answering, the attempt was voided without a provider ID
+to void; the hold is released now and the ID kept, and errNotPayable is returned.
+*/
+func updatePayment(ctx context.Context, paymentID int, orderID int, auth payments.Authorization) error {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Orders are locked before their payments, everywhere.
+	status, err := lockOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	late := status == StatusCancelled
+	if !late {
+		result, err := tx.Exec(
+			"UPDATE \"Payments\" SET \"Provider_Payment_ID\"=$2,\"Status\"=$3,\"Action_URL\"=NULLIF($4,''),\"Decline_Reason\"=NULLIF($5,''),\"Updated_At\"=now() "+
+				"WHERE \"ID\"=$1 AND \"Status\"='started'",
+			paymentID, auth.PaymentID, string(auth.Status), auth.ActionURL, auth.DeclineReason)
+		if err != nil {
+			return err
+		}
+		n, _ := result.RowsAffected()
+		late = n == 0
+	}
+	if late {
+		err = voidLatePayment(ctx, tx, paymentID, auth)
+	} else if auth.Status == payments.StatusAuthorized {
+		err = markPaid(tx, orderID, status)
+	}
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err == nil && late {
+		return errNotPayable
+	}
+	return err
+}
+
+/*
+Voids an attempt that the provider answered after the order moved on, keeping the provider's
+ID on it so later webhooks still find it. Holds the provider may have put on the card are
+released.
+*/
+func voidLatePayment(ctx context.Context, tx *sql.Tx, paymentID int, auth payments.Authorization) error {
+	if auth.PaymentID == "" {
+		return nil
+	}
+	switch auth.Status {
+	case payments.StatusAuthorized, payments.StatusPending, payments.StatusRequiresAction:
+		if err := Payments.Void(ctx, auth.PaymentID); err != nil {
+			return fmt.Errorf("voiding late payment [%v]: %w", auth.PaymentID, err)
+		}
+	}
+	_, err := tx.Exec(
+		"UPDATE \"Payments\" SET \"Provider_Payment_ID\"=$2,\"Status\"='voided',\"Updated_At\"=now() WHERE \"ID\"=$1 AND \"Provider_Payment_ID\" IS NULL",
+		paymentID, auth.PaymentID)
+	return err
+}
+
+/*
+Moves a locked order that waits for payment to paid. Paying twice is not an error.
+*/
+func markPaid(tx *sql.Tx, orderID int, status string) error {
+	if status != StatusPendingPayment {
+		return nil
+	}
+	return transitionOrder(tx, orderID, status, StatusPaid, paymentActor, "Payment authorized")
+}
+
+func activePayment(db queryer, orderID int) (Payment, error) {
+	return latestPayment(db, orderID, "AND \"Status\" IN ('started','pending','requires_action','authorized')")
+}
+
+func latestPayment(db queryer, orderID int, filter string) (Payment, error) {
+	var p Payment
+	rows, err := db.Query(
+		"SELECT \"Status\",\"Amount_Cents\",COALESCE(\"Action_URL\",''),COALESCE(\"Decline_Reason\",'') FROM \"Payments\" WHERE \"Order_ID\"=$1 "+filter+" ORDER BY \"ID\" DESC LIMIT 1",
+		orderID)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = sql.ErrNoRows
+		}
+		return p, err
+	}
+	if err = rows.Scan(&p.Status, &p.AmountCents, &p.ActionURL, &p.DeclineReason); err != nil {
+		return p, err
+	}
+	if p.Status != "requires_action" {
+		p.ActionURL = ""
+	}
+	p.describe()
+	return p, nil
+}
+
+/*
+Receives the provider's webhooks. Each event is applied once; redeliveries are acknowledged
+and ignored. Events for a payment we haven't recorded yet are refused, so the provider tries
+again once the authorize call has finished.
+*/
+func PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if Payments == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	event, err := Payments.VerifyWebhook(r.Header, body)
+	if err != nil {
+		log.Printf("orderHandler.PaymentWebhook; refused a webhook from [%v]. Error: %v", r.RemoteAddr, err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if event.Type == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	voidLate, err := applyPaymentEvent(event)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown payment.", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("orderHandler.PaymentWebhook; applying %v [%v] failed. Error: %v", event.Type, event.ID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if voidLate {
+		// Authorized after the customer moved on, e.g. paid with another card.
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := Payments.Void(ctx, event.PaymentID); err != nil {
+			log.Printf("orderHandler.PaymentWebhook; voiding late authorization [%v] failed, release it by hand. Error: %v", event.PaymentID, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Applies a webhook event in one transaction. Returns true if the event authorized a payment
+that is no longer wanted and should be voided.
+*/
+func applyPaymentEvent(event payments.Event) (bool, error) {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(
+		"INSERT INTO \"Payment_Webhooks\"(\"Provider\",\"Event_ID\",\"Event_Type\",\"Payment_ID\") VALUES($1,$2,$3,$4) ON CONFLICT DO NOTHING",
+		Payments.Name(), event.ID, string(event.Type), event.PaymentID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	var (
+		paymentID, orderID  int
+		status, orderStatus string
+	)
+	err = tx.QueryRow("SELECT \"Order_ID\" FROM \"Payments\" WHERE \"Provider\"=$1 AND \"Provider_Payment_ID\"=$2", Payments.Name(), event.PaymentID).Scan(&orderID)
+	if err == nil {
+		orderStatus, err = lockOrder(tx, orderID)
+	}
+	if err == nil {
+		err = tx.QueryRow("SELECT \"ID\",\"Status\" FROM \"Payments\" WHERE \"Provider\"=$1 AND \"Provider_Payment_ID\"=$2 FOR UPDATE",
+			Payments.Name(), event.PaymentID).Scan(&paymentID, &status)
+	}
+	if err != nil {
+		return false, err
+	}
+	waiting := status == "started" || status == "pending" || status == "requires_action"
+	voidLate := false
+	switch event.Type {
+	case payments.EventAuthorized:
+		if waiting && orderStatus == StatusPendingPayment {
+			_, err = tx.Exec("UPDATE \"Payments\" SET \"Status\"='authorized',\"Updated_At\"=now() WHERE \"ID\"=$1", paymentID)
+			if err == nil {
+				err = markPaid(tx, orderID, orderStatus)
+			}
+		} else {
+			// Too late: the order was cancelled, or paid another way.
+			voidLate = status != "authorized" && status != "captured"
+		}
+	case payments.EventDeclined:
+		if waiting {
+			_, err = tx.Exec("UPDATE \"Payments\" SET \"Status\"='declined',\"Decline_Reason\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", paymentID, event.DeclineReason)
+		}
+	case payments.EventCaptured:
+		_, err = tx.Exec("UPDATE \"Payments\" SET \"Status\"='captured',\"Captured_Cents\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", paymentID, event.AmountCents)
+	case payments.EventVoided:
+		_, err = tx.Exec("UPDATE \"Payments\" SET \"Status\"='voided',\"Updated_At\"=now() WHERE \"ID\"=$1", paymentID)
+	case payments.EventRefunded:
+		_, err = tx.Exec(
+			"UPDATE \"Payments\" SET \"Refunded_Cents\"=GREATEST(\"Refunded_Cents\",$2),"+
+				"\"Status\"=CASE WHEN GREATEST(\"Refunded_Cents\",$2)>=\"Captured_Cents\" THEN 'refunded' ELSE \"Status\" END,\"Updated_At\"=now() WHERE \"ID\"=$1",
+			paymentID, event.AmountCents)
+		var left int64
+		if err == nil {
+			left, err = refundLeft(tx, orderID)
+		}
+		if err == nil && left == 0 && CanTransition(orderStatus, StatusRefunded) {
+			err = transitionOrder(tx, orderID, orderStatus, StatusRefunded, paymentActor, "Refunded in full")
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Printf("orderHandler.applyPaymentEvent; %v for order [%v] payment [%v].", event.Type, orderID, event.PaymentID)
+	return voidLate, tx.Commit()
+}
+
+/*
+Loads the order in the URL, if it belongs to the user asking, or if staff is true and they
+manage orders. Anyone else gets a 404.
+*/
+func ownOrder(w http.ResponseWriter, r *http.Request, staff bool) (Order, bool) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	orderID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	order, err := loadOrder(OrderDB, orderID)
+	if err == nil && order.UserID != user.ID && !(staff && mAuthorize.Can(user, mAuthorize.PermOrdersManage)) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		OrderNotFound(w, r)
+		return order, false
+	} else if err != nil {
+		log.Printf("orderHandler.ownOrder; loading order [%v] failed. Error: %v", orderID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return order, false
+	}
+	return order, true
+}
+
+func respondOrder(w http.ResponseWriter, r *http.Request, status int, order Order) {
+	page := orderPage{Order: order}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	page.Mine = user != nil && user.ID == order.UserID
+	if !page.Mine {
+		// Gift card codes are as good as money; only their buyer sees them whole.
+		for i := range order.GiftCards {
+			order.GiftCards[i].Code = lastFour(order.GiftCards[i].Code)
+		}
+		page.Order = order
+	}
+	if page.Mine && order.Status == StatusPendingPayment {
+		page.PaymentMethods = TestCards
+	}
+	if page.Mine && order.returnable(time.Now()) {
+		page.ReturnReasons = ReturnReasons
+	}
+	if page.Staff = mAuthorize.Can(user, mAuthorize.PermOrdersManage); page.Staff {
+		for _, next := range Transitions[order.Status] {
+			if next != StatusRefunded {
+				page.NextStatuses = append(page.NextStatuses, OrderStatus{Status: next, Label: statusLabels[next]})
+			}
+		}
+	}
+	respondOrderPage(w, r, status, page)
+}
+
+func respondOrderPage(w http.ResponseWriter, r *http.Request, status int, page orderPage) {
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if len(page.Errors) > 0 {
+			json.NewEncoder(w).Encode(map[string][]string{"errors": page.Errors})
+			return
+		}
+		json.NewEncoder(w).Encode(page.Order)
+		return
+	}
+	renderOrderPage(w, status, "orderDetail", page)
+}
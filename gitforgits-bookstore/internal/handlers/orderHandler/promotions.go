@@ -0,0 +1,371 @@
+package orderHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+	"github.com/flintg/gitforgits-bookstore/promotions"
+)
+
+var PromotionPathPrefix string = "/admin/promotions"
+
+/*
+Money a promotion took off a cart or order line.
+*/
+type LineDiscount struct {
+	PromotionID int `json:",omitempty"`
+	Name        string
+	AmountCents int64
+	Amount      string
+}
+
+/*
+Registers the promotion administration routes. Only users with the promotions:manage
+permission get in.
+*/
+func RegisterAdminHandlers(r *mux.Router) {
+	sr := r.PathPrefix(PromotionPathPrefix).Subrouter()
+	sr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequirePermission(mAuthorize.PermPromotionsManage))
+	sr.HandleFunc("", ListPromotions).Methods("GET")
+	sr.HandleFunc("", SavePromotion).Methods("POST")
+	sr.HandleFunc("/{id:[0-9]+}", GetPromotion).Methods("GET")
+	sr.HandleFunc("/{id:[0-9]+}", SavePromotion).Methods("PUT")
+	sr.HandleFunc("/{id:[0-9]+}", DeletePromotion).Methods("DELETE")
+	sr.HandleFunc("/{id:[0-9]+}/coupons", ListCoupons).Methods("GET")
+	sr.HandleFunc("/{id:[0-9]+}/coupons", GenerateCoupons).Methods("POST")
+}
+
+/*
+Lists every promotion, running or not, highest priority first.
+*/
+func ListPromotions(w http.ResponseWriter, r *http.Request) {
+	list, err := loadPromotions(OrderDB, "")
+	if err != nil {
+		log.Printf("orderHandler.ListPromotions; loading promotions failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func GetPromotion(w http.ResponseWriter, r *http.Request) {
+	promotionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	list, err := loadPromotions(OrderDB, "WHERE \"ID\"=$1", promotionID)
+	if err != nil {
+		log.Printf("orderHandler.GetPromotion; loading promotion [%v] failed. Error: %v", promotionID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if len(list) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, list[0])
+}
+
+/*
+Creates a promotion (POST) or replaces one (PUT) from a JSON promotion, e.g.
+{"Name":"20% off Fantasy","Conditions":{"GenreIDs":[3]},"Action":{"Type":"percent_off","Percent":20},"Active":true}.
+Segments are "guest", "new", "returning" or a role. CouponOnly promotions need a coupon,
+see GenerateCoupons. Changes show in carts straight away; orders already placed keep the
+discounts they got.
+*/
+func SavePromotion(w http.ResponseWriter, r *http.Request) {
+	if !isJSONRequest(r) {
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+	var p promotions.Promotion
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+		return
+	}
+	err := p.Validate()
+	for _, segment := range p.Conditions.Segments {
+		if err == nil && segment != promotions.SegmentGuest && segment != promotions.SegmentNew && segment != promotions.SegmentReturning && !mAuthorize.ValidRole(segment) {
+			err = fmt.Errorf("%w: unknown segment %q", promotions.ErrInvalid, segment)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	conditions, _ := json.Marshal(p.Conditions)
+	action, _ := json.Marshal(p.Action)
+	status := http.StatusOK
+	if id, ok := mux.Vars(r)["id"]; ok {
+		p.ID, _ = strconv.Atoi(id)
+		var result sql.Result
+		result, err = OrderDB.Exec(
+			"UPDATE \"Promotions\" SET \"Name\"=$2,\"Conditions\"=$3,\"Action\"=$4,\"Priority\"=$5,\"Active\"=$6,\"Coupon_Only\"=$7,\"Starts_At\"=$8,\"Ends_At\"=$9,\"Updated_At\"=now() WHERE \"ID\"=$1",
+			p.ID, p.Name, string(conditions), string(action), p.Priority, p.Active, p.CouponOnly, p.StartsAt, p.EndsAt)
+		if n, _ := rowsAffected(result, err); err == nil && n == 0 {
+			http.NotFound(w, r)
+			return
+		}
+	} else {
+		status = http.StatusCreated
+		err = OrderDB.QueryRow(
+			"INSERT INTO \"Promotions\"(\"Name\",\"Conditions\",\"Action\",\"Priority\",\"Active\",\"Coupon_Only\",\"Starts_At\",\"Ends_At\") VALUES($1,$2,$3,$4,$5,$6,$7,$8) RETURNING \"ID\"",
+			p.Name, string(conditions), string(action), p.Priority, p.Active, p.CouponOnly, p.StartsAt, p.EndsAt).Scan(&p.ID)
+	}
+	if err != nil {
+		log.Printf("orderHandler.SavePromotion; saving promotion [%v] failed. Error: %v", p.Name, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("orderHandler.SavePromotion; [%v] saved promotion [%v] %q.", user.Username, p.ID, p.Name)
+	writeJSON(w, status, p)
+}
+
+/*
+Deletes a promotion. Orders keep the discounts it gave them, under its name.
+*/
+func DeletePromotion(w http.ResponseWriter, r *http.Request) {
+	promotionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	n, err := rowsAffected(OrderDB.Exec("DELETE FROM \"Promotions\" WHERE \"ID\"=$1", promotionID))
+	if err != nil {
+		log.Printf("orderHandler.DeletePromotion; deleting promotion [%v] failed. Error: %v", promotionID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("orderHandler.DeletePromotion; [%v] deleted promotion [%v].", user.Username, promotionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func rowsAffected(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func loadPromotions(db queryer, where string, args ...interface{}) ([]promotions.Promotion, error) {
+	rows, err := db.Query(
+		"SELECT \"ID\",\"Name\",\"Conditions\",\"Action\",\"Priority\",\"Active\",\"Coupon_Only\",\"Starts_At\",\"Ends_At\" FROM \"Promotions\" "+where+" ORDER BY \"Priority\" DESC,\"ID\"",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []promotions.Promotion{}
+	for rows.Next() {
+		var (
+			p                  promotions.Promotion
+			conditions, action []byte
+			startsAt, endsAt   sql.NullTime
+		)
+		if err := rows.Scan(&p.ID, &p.Name, &conditions, &action, &p.Priority, &p.Active, &p.CouponOnly, &startsAt, &endsAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(conditions, &p.Conditions); err != nil {
+			return nil, fmt.Errorf("promotion [%v] has broken conditions: %w", p.ID, err)
+		}
+		if err := json.Unmarshal(action, &p.Action); err != nil {
+			return nil, fmt.Errorf("promotion [%v] has a broken action: %w", p.ID, err)
+		}
+		if startsAt.Valid {
+			p.StartsAt = &startsAt.Time
+		}
+		if endsAt.Valid {
+			p.EndsAt = &endsAt.Time
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+/*
+The segments a cart's owner is in: guest, or new or returning and their roles.
+*/
+func customerSegments(db queryer, cartID int) ([]string, error) {
+	rows, err := db.Query(
+		"SELECT c.\"User_ID\",EXISTS(SELECT 1 FROM \"Orders\" o WHERE o.\"User_ID\"=c.\"User_ID\" AND o.\"Status\"<>'cancelled') FROM \"Carts\" c WHERE c.\"ID\"=$1",
+		cartID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		userID  sql.NullInt64
+		ordered bool
+	)
+	if rows.Next() {
+		err = rows.Scan(&userID, &ordered)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil || !userID.Valid {
+		return []string{promotions.SegmentGuest}, err
+	}
+	segments := []string{promotions.SegmentNew, mAuthorize.RoleCustomer}
+	if ordered {
+		segments[0] = promotions.SegmentReturning
+	}
+	rows, err = db.Query("SELECT \"Role\" FROM \"User_Roles\" WHERE \"User_ID\"=$1", userID.Int64)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		segments = append(segments, role)
+	}
+	return segments, rows.Err()
+}
+
+/*
+Applies the promotions running at now to the available lines of a cart, and sets the
+discounts on each line and the cart's total. Coupon-only promotions apply if the cart's
+coupon is for them; a coupon that can no longer be used is left out with a notice, and
+settleCart takes it out.
+*/
+func priceCart(db queryer, cartID int, cart *Cart, now time.Time) error {
+	cart.Total, cart.Discount = formatCents(cart.SubtotalCents), formatCents(0)
+	cart.TotalCents = cart.SubtotalCents
+	coupon, userID, err := cartCoupon(db, cartID)
+	if err != nil {
+		return err
+	}
+	if coupon != nil {
+		problem, err := couponProblem(db, *coupon, userID, cart.discountableCents(), now)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			cart.Notices = append(cart.Notices, problem+" It was taken out of your cart.")
+			cart.couponDropped, cart.couponID, coupon = true, coupon.ID, nil
+		} else {
+			cart.Coupon, cart.couponID = &CartCoupon{Code: coupon.Code, Promotion: coupon.promotion}, coupon.ID
+		}
+	}
+	all, err := loadPromotions(db, "WHERE \"Active\" AND (\"Ends_At\" IS NULL OR \"Ends_At\">$1)", now)
+	if err != nil {
+		return err
+	}
+	var running []promotions.Promotion
+	for _, p := range all {
+		if !p.CouponOnly || (coupon != nil && coupon.PromotionID == p.ID) {
+			running = append(running, p)
+		}
+	}
+	defer func() {
+		if cart.Coupon != nil && !cart.Coupon.Applied {
+			cart.Notices = append(cart.Notices, fmt.Sprintf("Coupon %v doesn't take anything off the books in your cart.", cart.Coupon.Code))
+		}
+	}()
+	if len(running) == 0 {
+		return nil
+	}
+	var (
+		needGenres, needSegments bool
+		segments                 []string
+	)
+	for _, p := range running {
+		needGenres = needGenres || len(p.Conditions.GenreIDs) > 0
+		needSegments = needSegments || len(p.Conditions.Segments) > 0
+	}
+	genres := map[int][]int{}
+	if needGenres {
+		rows, err := db.Query(
+			"SELECT bg.\"Book_ID\",bg.\"Genre_ID\" FROM \"Book_Genres\" bg JOIN \"Cart_Items\" ci ON ci.\"Book_ID\"=bg.\"Book_ID\" WHERE ci.\"Cart_ID\"=$1",
+			cartID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var bookID, genreID int
+			if err := rows.Scan(&bookID, &genreID); err != nil {
+				rows.Close()
+				return err
+			}
+			genres[bookID] = append(genres[bookID], genreID)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	if needSegments {
+		if segments, err = customerSegments(db, cartID); err != nil {
+			return err
+		}
+	}
+	var (
+		lines []promotions.Line
+		index []int // cart item of each line
+	)
+	for i, item := range cart.Items {
+		// Gift cards are worth what they cost, so promotions leave them alone.
+		if item.Available && !item.GiftCard {
+			lines = append(lines, promotions.Line{Author: item.Author, GenreIDs: genres[item.BookID], Quantity: item.Quantity, UnitPriceCents: item.UnitPriceCents})
+			index = append(index, i)
+		}
+	}
+	for _, d := range promotions.Apply(running, lines, segments, now) {
+		item := &cart.Items[index[d.Line]]
+		item.Discounts = append(item.Discounts, LineDiscount{PromotionID: d.PromotionID, Name: d.Name, AmountCents: d.AmountCents, Amount: formatCents(d.AmountCents)})
+		item.DiscountCents += d.AmountCents
+		cart.DiscountCents += d.AmountCents
+		if coupon != nil && d.PromotionID == coupon.PromotionID {
+			cart.Coupon.Applied = true
+		}
+	}
+	for i := range cart.Items {
+		cart.Items[i].Discount = formatCents(cart.Items[i].DiscountCents)
+	}
+	cart.TotalCents = cart.SubtotalCents - cart.DiscountCents
+	cart.Total, cart.Discount = formatCents(cart.TotalCents), formatCents(cart.DiscountCents)
+	return nil
+}
+
+/*
+Loads the discounts of an order's lines, by order item ID.
+*/
+func loadOrderDiscounts(db queryer, orderID int) (map[int][]LineDiscount, error) {
+	rows, err := db.Query(
+		"SELECT \"Order_Item_ID\",COALESCE(\"Promotion_ID\",0),\"Name\",\"Amount_Cents\" FROM \"Order_Discounts\" WHERE \"Order_ID\"=$1 ORDER BY \"ID\"",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	discounts := map[int][]LineDiscount{}
+	for rows.Next() {
+		var (
+			itemID int
+			d      LineDiscount
+		)
+		if err := rows.Scan(&itemID, &d.PromotionID, &d.Name, &d.AmountCents); err != nil {
+			return nil, err
+		}
+		d.Amount = formatCents(d.AmountCents)
+		discounts[itemID] = append(discounts[itemID], d)
+	}
+	return discounts, rows.Err()
+}
@@ -0,0 +1,766 @@
+package orderHandler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+)
+
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunded  = "refunded"
+)
+
+/*
+How long after delivery customers can ask to return items.
+*/
+var ReturnWindow = 30 * 24 * time.Hour
+
+type ReturnReason struct {
+	Code  string
+	Label string
+}
+
+var ReturnReasons = []ReturnReason{
+	{"damaged", "Arrived damaged"},
+	{"wrong_item", "Wrong item sent"},
+	{"not_as_described", "Not as described"},
+	{"no_longer_needed", "No longer needed"},
+	{"other", "Other"},
+}
+
+var returnStatusLabels = map[string]string{
+	ReturnRequested: "Requested",
+	ReturnApproved:  "Approved, waiting for the items",
+	ReturnRejected:  "Rejected",
+	ReturnReceived:  "Items received",
+	ReturnRefunded:  "Refunded",
+}
+
+/*
+Labels for the order events that don't change its status.
+*/
+var noteLabels = map[string]string{
+	"return_requested":  "Return requested",
+	"return_approved":   "Return approved",
+	"return_rejected":   "Return rejected",
+	"return_received":   "Returned items received",
+	"refund":            "Refund issued",
+	"gift_cards_issued": "Gift cards issued",
+}
+
+/*
+A return or refund that can't be made as asked. Status is the HTTP status to answer with.
+*/
+type returnError struct {
+	Status  int
+	Message string
+}
+
+func (e *returnError) Error() string {
+	return e.Message
+}
+
+var errRefundFailed = errors.New("the payment provider refused the refund")
+
+/*
+A request to send back some of an order's items. ValueCents is what the items cost after
+discounts, which is what gets refunded unless staff say otherwise.
+*/
+type Return struct {
+	ID          int
+	Status      string
+	StatusLabel string
+	ReasonCode  string
+	Reason      string
+	Comment     string
+	Items       []ReturnItem
+	ValueCents  int64
+	Value       string
+	RefundCents int64
+	Refund      string
+	CreatedAt   time.Time
+}
+
+type ReturnItem struct {
+	OrderItemID      int
+	Title            string
+	Quantity         int
+	ReceivedQuantity int
+}
+
+/*
+Where a refund went: back to the payment, or to the customer's store credit.
+*/
+const (
+	RefundToPayment     = "payment"
+	RefundToStoreCredit = "store_credit"
+)
+
+type Refund struct {
+	ReturnID    int `json:",omitempty"`
+	Method      string
+	AmountCents int64
+	Amount      string
+	Reason      string
+	CreatedAt   time.Time
+}
+
+func reasonLabel(code string) (string, bool) {
+	for _, reason := range ReturnReasons {
+		if reason.Code == code {
+			return reason.Label, true
+		}
+	}
+	return "", false
+}
+
+func registerReturnHandlers(shop *mux.Router, mgr *mux.Router) {
+	shop.HandleFunc("/{id:[0-9]+}/returns", RequestReturn).Methods("POST")
+	mgr.HandleFunc("/{id:[0-9]+}/returns/{returnID:[0-9]+}/approve", ApproveReturn).Methods("POST")
+	mgr.HandleFunc("/{id:[0-9]+}/returns/{returnID:[0-9]+}/reject", RejectReturn).Methods("POST")
+	mgr.HandleFunc("/{id:[0-9]+}/returns/{returnID:[0-9]+}/receive", ReceiveReturn).Methods("POST")
+	mgr.HandleFunc("/{id:[0-9]+}/refunds", RefundOrder).Methods("POST")
+}
+
+/*
+Items and how many of each, by order item ID: {"Items":[{"OrderItemID","Quantity"}]} in
+JSON, or one prefix+ID field per order item in forms, e.g. quantity_12=1.
+*/
+type returnLine struct {
+	OrderItemID int
+	Quantity    int
+}
+
+func formReturnLines(r *http.Request, prefix string) ([]returnLine, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	var lines []returnLine
+	for field, values := range r.PostForm {
+		if !strings.HasPrefix(field, prefix) || len(values) == 0 || values[0] == "" {
+			continue
+		}
+		itemID, err := strconv.Atoi(strings.TrimPrefix(field, prefix))
+		if err != nil {
+			continue
+		}
+		quantity, err := strconv.Atoi(values[0])
+		if err != nil {
+			return nil, &returnError{http.StatusBadRequest, "quantities must be whole numbers"}
+		}
+		lines = append(lines, returnLine{itemID, quantity})
+	}
+	return lines, nil
+}
+
+/*
+Customers ask to return items of a delivered order, within ReturnWindow of delivery, with
+the reason_code and comment fields and a quantity_<item> field per item, or
+{"ReasonCode","Comment","Items"}. Items already being returned can't be asked for twice.
+*/
+func RequestReturn(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ReasonCode, Comment string
+		Items               []returnLine
+	}
+	var err error
+	if isJSONRequest(r) {
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.ReasonCode, req.Comment = r.FormValue("reason_code"), strings.TrimSpace(r.FormValue("comment"))
+		req.Items, err = formReturnLines(r, "quantity_")
+	}
+	order, ok := ownOrder(w, r, false)
+	if !ok {
+		return
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	if err == nil {
+		err = requestReturn(order.ID, req.ReasonCode, req.Comment, req.Items, userActor(user))
+	}
+	var invalid *returnError
+	if errors.As(err, &invalid) && invalid.Status == http.StatusBadRequest {
+		page := orderPage{Order: order, Mine: true, ReturnReasons: ReturnReasons, Errors: []string{"Sorry, " + invalid.Error() + "."}}
+		respondOrderPage(w, r, http.StatusBadRequest, page)
+		return
+	} else if err != nil {
+		orderChangeFailed(w, r, err, "orderHandler.RequestReturn", order.ID)
+		return
+	}
+	log.Printf("orderHandler.RequestReturn; [%v] asked to return items of order [%v] (%v).", user.Username, order.ID, req.ReasonCode)
+	orderChanged(w, r, order.ID)
+}
+
+func requestReturn(orderID int, reasonCode string, comment string, lines []returnLine, by actor) error {
+	label, ok := reasonLabel(reasonCode)
+	if !ok {
+		return &returnError{http.StatusBadRequest, "choose why you're returning the items"}
+	}
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status, err := lockOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	order, err := loadOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if status != StatusDelivered {
+		return &returnError{http.StatusConflict, "only delivered orders can be returned"}
+	}
+	if !order.returnable(time.Now()) {
+		return &returnError{http.StatusConflict, "the return window for this order has closed"}
+	}
+	returnable := make(map[int]int, len(order.Items))
+	for _, item := range order.Items {
+		returnable[item.ID] = item.Returnable
+	}
+	// The same item may be sent on several lines; they are returned together.
+	quantities := map[int]int{}
+	var itemIDs []int
+	for _, line := range lines {
+		if _, ok := returnable[line.OrderItemID]; !ok {
+			return &returnError{http.StatusBadRequest, "that item isn't part of this order"}
+		}
+		if line.Quantity < 0 {
+			return &returnError{http.StatusBadRequest, "quantities can't be negative"}
+		}
+		if _, seen := quantities[line.OrderItemID]; !seen {
+			itemIDs = append(itemIDs, line.OrderItemID)
+		}
+		quantities[line.OrderItemID] += line.Quantity
+	}
+	count := 0
+	for _, itemID := range itemIDs {
+		if left := returnable[itemID]; quantities[itemID] > left {
+			return &returnError{http.StatusBadRequest, fmt.Sprintf("you can return at most %v of one of the items", left)}
+		}
+		count += quantities[itemID]
+	}
+	if count == 0 {
+		return &returnError{http.StatusBadRequest, "choose the items you want to return"}
+	}
+	var returnID int
+	err = tx.QueryRow(
+		"INSERT INTO \"Returns\"(\"Order_ID\",\"Reason_Code\",\"Comment\") VALUES($1,$2,$3) RETURNING \"ID\"",
+		orderID, reasonCode, comment).Scan(&returnID)
+	if err != nil {
+		return err
+	}
+	for _, itemID := range itemIDs {
+		if quantities[itemID] == 0 {
+			continue
+		}
+		_, err = tx.Exec("INSERT INTO \"Return_Items\"(\"Return_ID\",\"Order_Item_ID\",\"Quantity\") VALUES($1,$2,$3)", returnID, itemID, quantities[itemID])
+		if err != nil {
+			return err
+		}
+	}
+	note := fmt.Sprintf("Return #%v, %v item(s): %v", returnID, count, label)
+	if comment != "" {
+		note += ". " + comment
+	}
+	if err = recordOrderNote(tx, orderID, status, "return_requested", by, note); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Reports whether a delivered order's items can still be sent back at now.
+*/
+func (o Order) returnable(now time.Time) bool {
+	if o.Status != StatusDelivered {
+		return false
+	}
+	for i := len(o.Events) - 1; i >= 0; i-- {
+		if e := o.Events[i]; e.Kind == "status" && e.To == StatusDelivered {
+			return now.Before(e.CreatedAt.Add(ReturnWindow))
+		}
+	}
+	return false
+}
+
+/*
+Staff accept a requested return, with an optional reason field or {"Reason"}. The customer
+can then send the items back.
+*/
+func ApproveReturn(w http.ResponseWriter, r *http.Request) {
+	reviewReturnHandler(w, r, ReturnApproved, "orderHandler.ApproveReturn")
+}
+
+/*
+Staff turn down a requested return, with a reason field or {"Reason"}, which the customer sees.
+*/
+func RejectReturn(w http.ResponseWriter, r *http.Request) {
+	reviewReturnHandler(w, r, ReturnRejected, "orderHandler.RejectReturn")
+}
+
+func reviewReturnHandler(w http.ResponseWriter, r *http.Request, to string, caller string) {
+	var req struct{ Reason string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Reason = strings.TrimSpace(r.FormValue("reason"))
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	orderID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	returnID, _ := strconv.Atoi(mux.Vars(r)["returnID"])
+	if err := reviewReturn(orderID, returnID, to, userActor(user), req.Reason); err != nil {
+		orderChangeFailed(w, r, err, caller, orderID)
+		return
+	}
+	log.Printf("%v; [%v] %v return [%v] of order [%v].", caller, user.Username, to, returnID, orderID)
+	orderChanged(w, r, orderID)
+}
+
+func reviewReturn(orderID int, returnID int, to string, by actor, reason string) error {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status, err := lockOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	current, err := lockReturn(tx, orderID, returnID)
+	if err != nil {
+		return err
+	}
+	if current != ReturnRequested {
+		return &returnError{http.StatusConflict, "this return has already been " + strings.ToLower(returnStatusLabels[current])}
+	}
+	if err = setReturnStatus(tx, returnID, to); err != nil {
+		return err
+	}
+	note := fmt.Sprintf("Return #%v", returnID)
+	if reason != "" {
+		note += ": " + reason
+	}
+	if err = recordOrderNote(tx, orderID, status, "return_"+to, by, note); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Staff record an approved return's items as back, with a received_<item> field per item or
+{"Items"}; items left out count as all received. Received books go back in stock, so damaged
+ones should be entered as 0.
+*/
+func ReceiveReturn(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Items  []returnLine
+		Reason string
+	}
+	var err error
+	if isJSONRequest(r) {
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Reason = strings.TrimSpace(r.FormValue("reason"))
+		req.Items, err = formReturnLines(r, "received_")
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	orderID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	returnID, _ := strconv.Atoi(mux.Vars(r)["returnID"])
+	if err == nil {
+		err = receiveReturn(orderID, returnID, req.Items, userActor(user), req.Reason)
+	}
+	if err != nil {
+		orderChangeFailed(w, r, err, "orderHandler.ReceiveReturn", orderID)
+		return
+	}
+	log.Printf("orderHandler.ReceiveReturn; [%v] received return [%v] of order [%v].", user.Username, returnID, orderID)
+	orderChanged(w, r, orderID)
+}
+
+func receiveReturn(orderID int, returnID int, lines []returnLine, by actor, reason string) error {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status, err := lockOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	current, err := lockReturn(tx, orderID, returnID)
+	if err != nil {
+		return err
+	}
+	if current != ReturnApproved {
+		return &returnError{http.StatusConflict, "only approved returns can be received"}
+	}
+	rows, err := tx.Query("SELECT \"Order_Item_ID\",\"Quantity\" FROM \"Return_Items\" WHERE \"Return_ID\"=$1", returnID)
+	if err != nil {
+		return err
+	}
+	received := map[int]int{}
+	for rows.Next() {
+		var itemID, quantity int
+		if err := rows.Scan(&itemID, &quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		received[itemID] = quantity
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		expected, ok := received[line.OrderItemID]
+		if !ok {
+			return &returnError{http.StatusBadRequest, "that item isn't part of this return"}
+		}
+		if line.Quantity < 0 || line.Quantity > expected {
+			return &returnError{http.StatusBadRequest, fmt.Sprintf("at most %v of one of the items can be received", expected)}
+		}
+		received[line.OrderItemID] = line.Quantity
+	}
+	count, expected := 0, 0
+	for itemID, quantity := range received {
+		_, err = tx.Exec("UPDATE \"Return_Items\" SET \"Received_Quantity\"=$3 WHERE \"Return_ID\"=$1 AND \"Order_Item_ID\"=$2", returnID, itemID, quantity)
+		if err != nil {
+			return err
+		}
+		count += quantity
+	}
+	if err = tx.QueryRow("SELECT COALESCE(SUM(\"Quantity\"),0) FROM \"Return_Items\" WHERE \"Return_ID\"=$1", returnID).Scan(&expected); err != nil {
+		return err
+	}
+	// One statement, like releaseStock, so books are locked in the same order as checkout's.
+	_, err = tx.Exec(
+		"UPDATE \"Books\" b SET \"Stock\"=b.\"Stock\"+ri.\"Received_Quantity\" FROM \"Return_Items\" ri "+
+			"JOIN \"Order_Items\" oi ON oi.\"ID\"=ri.\"Order_Item_ID\" "+
+			"WHERE ri.\"Return_ID\"=$1 AND ri.\"Received_Quantity\">0 AND b.\"ID\"=oi.\"Book_ID\" AND b.\"Stock\" IS NOT NULL",
+		returnID)
+	if err == nil {
+		err = setReturnStatus(tx, returnID, ReturnReceived)
+	}
+	if err != nil {
+		return err
+	}
+	note := fmt.Sprintf("Return #%v: %v of %v item(s) back in stock", returnID, count, expected)
+	if reason != "" {
+		note += ". " + reason
+	}
+	if err = recordOrderNote(tx, orderID, status, "return_received", by, note); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Staff refund an order, with the amount, return_id, to and reason fields or
+{"AmountCents","ReturnID","To","Reason"}. To is "payment", which goes back through the
+provider, or "store_credit"; it defaults to the payment while there is some of it left. What
+gift cards and store credit paid can only go to store credit. Without an amount, a return's
+items are refunded at what they cost after discounts, and otherwise whatever is left. The
+order becomes refunded once everything paid has been given back.
+*/
+func RefundOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AmountCents int64
+		ReturnID    int
+		To          string
+		Reason      string
+	}
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		var ok bool
+		if req.AmountCents, ok = parseCents(r.FormValue("amount")); !ok {
+			http.Error(w, "Enter the amount as e.g. 12.50.", http.StatusBadRequest)
+			return
+		}
+		req.ReturnID, _ = strconv.Atoi(r.FormValue("return_id"))
+		req.To = r.FormValue("to")
+		req.Reason = strings.TrimSpace(r.FormValue("reason"))
+	}
+	if req.To != "" && req.To != RefundToPayment && req.To != RefundToStoreCredit {
+		http.Error(w, "Refund to the payment or to store credit.", http.StatusBadRequest)
+		return
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	orderID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	amount, err := refundOrder(r.Context(), orderID, req.ReturnID, req.AmountCents, req.To, userActor(user), req.Reason)
+	if err != nil {
+		orderChangeFailed(w, r, err, "orderHandler.RefundOrder", orderID)
+		return
+	}
+	log.Printf("orderHandler.RefundOrder; [%v] refunded %v of order [%v].", user.Username, formatCents(amount), orderID)
+	orderChanged(w, r, orderID)
+}
+
+/*
+Refunds amount to to, or the defaults described at RefundOrder, and returns what was
+refunded. The provider is called with the order and payment locked, so two refunds can't
+both spend the same money. The idempotency key is the payment and what it had refunded, so
+retrying a refund whose commit failed doesn't pay out twice.
+*/
+func refundOrder(ctx context.Context, orderID int, returnID int, amount int64, to string, by actor, reason string) (int64, error) {
+	tx, err := OrderDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	status, err := lockOrder(tx, orderID)
+	if err != nil {
+		return 0, err
+	}
+	if returnID != 0 {
+		current, err := lockReturn(tx, orderID, returnID)
+		if err != nil {
+			return 0, err
+		}
+		if current != ReturnApproved && current != ReturnReceived {
+			return 0, &returnError{http.StatusConflict, "only approved returns can be refunded"}
+		}
+		if amount == 0 {
+			err = tx.QueryRow(
+				"SELECT COALESCE(SUM(ri.\"Quantity\"*oi.\"Unit_Price_Cents\"-oi.\"Discount_Cents\"*ri.\"Quantity\"/oi.\"Quantity\"),0) FROM \"Return_Items\" ri "+
+					"JOIN \"Order_Items\" oi ON oi.\"ID\"=ri.\"Order_Item_ID\" WHERE ri.\"Return_ID\"=$1",
+				returnID).Scan(&amount)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	var (
+		paymentID            int
+		providerID           string
+		captured, refundedSo int64
+	)
+	err = tx.QueryRow(
+		"SELECT \"ID\",\"Provider_Payment_ID\",\"Captured_Cents\",\"Refunded_Cents\" FROM \"Payments\" WHERE \"Order_ID\"=$1 AND \"Status\"='captured' FOR UPDATE",
+		orderID).Scan(&paymentID, &providerID, &captured, &refundedSo)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	left, err := refundLeft(tx, orderID)
+	if err != nil {
+		return 0, err
+	}
+	// Store credit refunds may have given back some of what the payment paid.
+	paymentLeft := min(captured-refundedSo, left)
+	if to == "" {
+		to = RefundToStoreCredit
+		if paymentLeft > 0 && Payments != nil {
+			to = RefundToPayment
+		}
+	}
+	limit := left
+	if to == RefundToPayment {
+		if paymentLeft <= 0 || Payments == nil {
+			return 0, &returnError{http.StatusConflict, "this order has no payment left to refund; refund it to store credit instead"}
+		}
+		limit = paymentLeft
+	} else if !CanTransition(status, StatusRefunded) {
+		return 0, &returnError{http.StatusConflict, "only shipped or delivered orders can be refunded"}
+	}
+	if amount == 0 {
+		amount = limit
+	}
+	if amount <= 0 || amount > limit {
+		return 0, &returnError{http.StatusBadRequest, "at most " + formatCents(limit) + " can be refunded"}
+	}
+	if to == RefundToPayment {
+		key := "refund-" + strconv.Itoa(paymentID) + "-" + strconv.FormatInt(refundedSo, 10)
+		refundID, err := Payments.Refund(ctx, providerID, amount, key)
+		if err != nil {
+			return 0, fmt.Errorf("%w: payment [%v]: %v", errRefundFailed, providerID, err)
+		}
+		_, err = tx.Exec(
+			"UPDATE \"Payments\" SET \"Refunded_Cents\"=\"Refunded_Cents\"+$2,"+
+				"\"Status\"=CASE WHEN \"Refunded_Cents\"+$2>=\"Captured_Cents\" THEN 'refunded' ELSE \"Status\" END,\"Updated_At\"=now() WHERE \"ID\"=$1",
+			paymentID, amount)
+		if err == nil {
+			_, err = tx.Exec(
+				"INSERT INTO \"Refunds\"(\"Order_ID\",\"Payment_ID\",\"Return_ID\",\"Amount_Cents\",\"Provider_Refund_ID\",\"Actor_ID\",\"Actor\",\"Reason\") "+
+					"VALUES($1,$2,NULLIF($3,0),$4,$5,NULLIF($6,0),$7,$8)",
+				orderID, paymentID, returnID, amount, refundID, by.ID, by.Name, reason)
+		}
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		var userID, transactionID int
+		err = tx.QueryRow("SELECT \"User_ID\" FROM \"Orders\" WHERE \"ID\"=$1", orderID).Scan(&userID)
+		if err == nil {
+			transactionID, err = refundToStoreCredit(tx, orderID, userID, amount, left, by, reason)
+		}
+		if err == nil {
+			_, err = tx.Exec(
+				"INSERT INTO \"Refunds\"(\"Order_ID\",\"Method\",\"Ledger_Transaction_ID\",\"Return_ID\",\"Amount_Cents\",\"Actor_ID\",\"Actor\",\"Reason\") "+
+					"VALUES($1,'store_credit',$2,NULLIF($3,0),$4,NULLIF($5,0),$6,$7)",
+				orderID, transactionID, returnID, amount, by.ID, by.Name, reason)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if returnID != 0 {
+		if _, err = tx.Exec("UPDATE \"Returns\" SET \"Status\"='refunded',\"Refund_Cents\"=\"Refund_Cents\"+$2,\"Updated_At\"=now() WHERE \"ID\"=$1", returnID, amount); err != nil {
+			return 0, err
+		}
+	}
+	note := formatCents(amount) + " " + Currency
+	if to == RefundToStoreCredit {
+		note += " to store credit"
+	}
+	if returnID != 0 {
+		note += fmt.Sprintf(" for return #%v", returnID)
+	}
+	if reason != "" {
+		note += ": " + reason
+	}
+	if err = recordOrderNote(tx, orderID, status, "refund", by, note); err != nil {
+		return 0, err
+	}
+	if amount == left && CanTransition(status, StatusRefunded) {
+		if err = transitionOrder(tx, orderID, status, StatusRefunded, by, "Refunded in full"); err != nil {
+			return 0, err
+		}
+	}
+	return amount, tx.Commit()
+}
+
+/*
+Locks one of an order's returns. Returns of other orders are sql.ErrNoRows.
+*/
+func lockReturn(tx *sql.Tx, orderID int, returnID int) (string, error) {
+	var status string
+	err := tx.QueryRow("SELECT \"Status\" FROM \"Returns\" WHERE \"ID\"=$1 AND \"Order_ID\"=$2 FOR UPDATE", returnID, orderID).Scan(&status)
+	return status, err
+}
+
+func setReturnStatus(tx *sql.Tx, returnID int, status string) error {
+	_, err := tx.Exec("UPDATE \"Returns\" SET \"Status\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", returnID, status)
+	return err
+}
+
+/*
+Loads an order's returns, and sets how many of each item can still be returned.
+*/
+func loadReturns(db queryer, order *Order) error {
+	rows, err := db.Query(
+		"SELECT \"ID\",\"Status\",\"Reason_Code\",\"Comment\",\"Refund_Cents\",\"Created_At\" FROM \"Returns\" WHERE \"Order_ID\"=$1 ORDER BY \"ID\"",
+		order.ID)
+	if err != nil {
+		return err
+	}
+	order.Returns = []Return{}
+	index := map[int]int{}
+	for rows.Next() {
+		ret := Return{Items: []ReturnItem{}}
+		if err := rows.Scan(&ret.ID, &ret.Status, &ret.ReasonCode, &ret.Comment, &ret.RefundCents, &ret.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		ret.StatusLabel = returnStatusLabels[ret.Status]
+		ret.Reason, _ = reasonLabel(ret.ReasonCode)
+		ret.Refund = formatCents(ret.RefundCents)
+		index[ret.ID] = len(order.Returns)
+		order.Returns = append(order.Returns, ret)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(order.Returns) == 0 {
+		return err
+	}
+	rows, err = db.Query(
+		"SELECT ri.\"Return_ID\",ri.\"Order_Item_ID\",oi.\"Title\",ri.\"Quantity\",ri.\"Received_Quantity\",oi.\"Unit_Price_Cents\",oi.\"Discount_Cents\",oi.\"Quantity\" FROM \"Return_Items\" ri "+
+			"JOIN \"Returns\" rt ON rt.\"ID\"=ri.\"Return_ID\" JOIN \"Order_Items\" oi ON oi.\"ID\"=ri.\"Order_Item_ID\" "+
+			"WHERE rt.\"Order_ID\"=$1 ORDER BY ri.\"Return_ID\",oi.\"ID\"",
+		order.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	pending := map[int]int{}
+	for rows.Next() {
+		var (
+			returnID, ordered int
+			item              ReturnItem
+			price, discount   int64
+		)
+		if err := rows.Scan(&returnID, &item.OrderItemID, &item.Title, &item.Quantity, &item.ReceivedQuantity, &price, &discount, &ordered); err != nil {
+			return err
+		}
+		ret := &order.Returns[index[returnID]]
+		ret.Items = append(ret.Items, item)
+		// Less the item's share of the line's discount, as refundOrder works it out
+		ret.ValueCents += price*int64(item.Quantity) - discount*int64(item.Quantity)/int64(ordered)
+		if ret.Status != ReturnRejected {
+			pending[item.OrderItemID] += item.Quantity
+		}
+	}
+	for i := range order.Returns {
+		order.Returns[i].Value = formatCents(order.Returns[i].ValueCents)
+	}
+	for i := range order.Items {
+		order.Items[i].Returnable -= pending[order.Items[i].ID]
+	}
+	return rows.Err()
+}
+
+/*
+Loads an order's refunds, and sets what is left of it to refund.
+*/
+func loadRefunds(db queryer, order *Order) error {
+	rows, err := db.Query(
+		"SELECT COALESCE(\"Return_ID\",0),\"Method\",\"Amount_Cents\",\"Reason\",\"Created_At\" FROM \"Refunds\" WHERE \"Order_ID\"=$1 ORDER BY \"ID\"",
+		order.ID)
+	if err != nil {
+		return err
+	}
+	order.Refunds = []Refund{}
+	for rows.Next() {
+		var refund Refund
+		if err := rows.Scan(&refund.ReturnID, &refund.Method, &refund.AmountCents, &refund.Reason, &refund.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		refund.Amount = formatCents(refund.AmountCents)
+		order.Refunds = append(order.Refunds, refund)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	order.RefundableCents, err = refundLeft(db, order.ID)
+	order.Refundable = formatCents(order.RefundableCents)
+	return err
+}
@@ -0,0 +1,5 @@
+module golang-web-book/gitforgits-bookstore/internal/handlers/recommendationHandler
+
+go 1.22.4
+
+require github.com/gorilla/mux v1.8.1
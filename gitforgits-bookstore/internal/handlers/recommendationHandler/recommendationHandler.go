@@ -0,0 +1,201 @@
+package recommendationHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var RecommendationDB *sql.DB
+var Limit int = 8          // recommendations kept per book
+var MinCoPurchases int = 2 // orders two books must share before they count as bought together
+
+const (
+	ReasonCoPurchase = "co-purchase"
+	ReasonAuthor     = "same-author"
+	ReasonGenre      = "same-genre"
+	ReasonTags       = "shared-tags"
+)
+
+type Recommendation struct {
+	BookID int
+	Title  string
+	Author string
+	Score  float64
+	Reason string
+}
+
+// Arbitrary constant that keeps two app instances from recomputing at the same time.
+const recomputeLockID = 72_030
+
+/*
+Candidate pairs and their weights. Co-purchases dominate: a pair bought together in at least
+MinCoPurchases orders outweighs any amount of catalogue similarity, which only fills the
+remaining slots. Only orders that were paid for and not cancelled or refunded count, and gift
+cards are left out, as they are bought alongside anything.
+*/
+const coPurchaseCandidates = `
+	SELECT a."Book_ID" AS book, b."Book_ID" AS rec, 100.0*COUNT(DISTINCT a."Order_ID") AS score, 'co-purchase' AS reason
+	FROM "Order_Items" a JOIN "Order_Items" b ON b."Order_ID"=a."Order_ID" AND b."Book_ID"<>a."Book_ID"
+	JOIN "Orders" o ON o."ID"=a."Order_ID"
+	WHERE o."Status" IN ('paid','picking','shipped','delivered') AND NOT a."Gift_Card" AND NOT b."Gift_Card"
+	GROUP BY 1,2 HAVING COUNT(DISTINCT a."Order_ID")>=$2
+	UNION ALL`
+
+// Catalogue candidates pair books x and y that are both for sale and not gift cards.
+const catalogueForSale = `x."Price" IS NOT NULL AND y."Price" IS NOT NULL AND NOT x."Gift_Card" AND NOT y."Gift_Card"`
+
+const catalogueCandidates = `
+	SELECT x."ID" AS book, y."ID" AS rec, 3.0 AS score, 'same-author' AS reason
+	FROM "Books" x JOIN "Books" y ON lower(y."Author")=lower(x."Author") AND y."ID"<>x."ID"
+	WHERE x."Author"<>'' AND ` + catalogueForSale + `
+	UNION ALL
+	SELECT a."Book_ID", b."Book_ID", 2.0*COUNT(*), 'same-genre'
+	FROM "Book_Genres" a JOIN "Book_Genres" b ON b."Genre_ID"=a."Genre_ID" AND b."Book_ID"<>a."Book_ID"
+	JOIN "Books" x ON x."ID"=a."Book_ID" JOIN "Books" y ON y."ID"=b."Book_ID"
+	WHERE ` + catalogueForSale + `
+	GROUP BY 1,2
+	UNION ALL
+	SELECT a."Book_ID", b."Book_ID", 1.0*COUNT(*), 'shared-tags'
+	FROM "Book_Tags" a JOIN "Book_Tags" b ON b."Tag"=a."Tag" AND b."Book_ID"<>a."Book_ID"
+	JOIN "Books" x ON x."ID"=a."Book_ID" JOIN "Books" y ON y."ID"=b."Book_ID"
+	WHERE ` + catalogueForSale + `
+	GROUP BY 1,2`
+
+const storeRecommendations = `
+	INSERT INTO "Book_Recommendations"("Book_ID","Recommended_Book_ID","Score","Reason","Computed_At")
+	SELECT book, rec, score, reason, now() FROM (
+		SELECT book, rec, score, reason, ROW_NUMBER() OVER (PARTITION BY book ORDER BY score DESC, rec) AS rank
+		FROM (
+			SELECT book, rec, SUM(score) AS score, (array_agg(reason ORDER BY score DESC))[1] AS reason
+			FROM (%v) candidates
+			GROUP BY book, rec
+		) scored
+	) ranked
+	WHERE rank<=$1`
+
+/*
+Registers the recommendation routes on the subrouter of the book package.
+*/
+func RegisterHandlers(sr *mux.Router) {
+	sr.HandleFunc("/{id:[0-9]+}/recommendations", GetBookRecommendations).Methods("GET")
+}
+
+/*
+Gets the precomputed recommendations for a single book
+*/
+func GetBookRecommendations(w http.ResponseWriter, r *http.Request) {
+	bookID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	recommendations, err := ListRecommendations(bookID)
+	if err != nil {
+		log.Printf("recommendationHandler.GetBookRecommendations; ListRecommendations(%v) failed. Error: %v", bookID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if recommendations == nil {
+		recommendations = []Recommendation{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recommendations)
+}
+
+/*
+Lists the stored recommendations for a book, best first. Used by bookHandler to render the
+details page.
+*/
+func ListRecommendations(bookID int) ([]Recommendation, error) {
+	var recommendations []Recommendation
+	rows, err := RecommendationDB.Query(
+		"SELECT b.\"ID\",b.\"Title\",b.\"Author\",r.\"Score\",r.\"Reason\" FROM \"Book_Recommendations\" r JOIN \"Books\" b ON b.\"ID\"=r.\"Recommended_Book_ID\" WHERE r.\"Book_ID\"=$1 ORDER BY r.\"Score\" DESC, b.\"ID\"",
+		bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec Recommendation
+		if err = rows.Scan(&rec.BookID, &rec.Title, &rec.Author, &rec.Score, &rec.Reason); err != nil {
+			return nil, err
+		}
+		recommendations = append(recommendations, rec)
+	}
+	return recommendations, rows.Err()
+}
+
+/*
+Rebuilds the Book_Recommendations table from order history and the catalogue. The old rows
+are replaced in one transaction, so readers never see a half-built table. If another instance
+is already recomputing, this one skips the run.
+*/
+func Recompute() error {
+	started := time.Now()
+	tx, err := RecommendationDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var locked bool
+	if err = tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", recomputeLockID).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		log.Print("recommendationHandler.Recompute; another instance is recomputing, skipping.")
+		return nil
+	}
+	// Until the migrations adding the columns co-purchases are read from have run, recommend from
+	// the catalogue alone.
+	var hasOrders bool
+	err = tx.QueryRow(
+		"SELECT COUNT(*)=3 FROM information_schema.columns WHERE table_schema=current_schema() AND (table_name,column_name) IN (('Order_Items','Book_ID'),('Order_Items','Gift_Card'),('Orders','Status'))").Scan(&hasOrders)
+	if err != nil {
+		return err
+	}
+	candidates := catalogueCandidates
+	args := []interface{}{Limit}
+	if hasOrders {
+		candidates = coPurchaseCandidates + candidates
+		args = append(args, MinCoPurchases)
+	}
+	if _, err = tx.Exec("DELETE FROM \"Book_Recommendations\""); err != nil {
+		return err
+	}
+	result, err := tx.Exec(fmt.Sprintf(storeRecommendations, candidates), args...)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	stored, _ := result.RowsAffected()
+	log.Printf("recommendationHandler.Recompute; stored %v recommendations in %v (co-purchase data: %v).", stored, time.Since(started).Round(time.Millisecond), hasOrders)
+	return nil
+}
+
+/*
+Runs Recompute now and then every interval in the background. Call the returned function to
+stop the job.
+*/
+func StartJob(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := Recompute(); err != nil {
+				log.Printf("recommendationHandler.StartJob; Recompute failed. Error: %v", err)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
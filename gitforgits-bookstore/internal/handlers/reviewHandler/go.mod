@@ -0,0 +1,14 @@
+module golang-web-book/gitforgits-bookstore/internal/handlers/reviewHandler
+
+go 1.22.4
+
+require (
+	github.com/flintg/gitforgits-bookstore/mAuthenticate v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/mAuthorize v0.0.0-00010101000000-000000000000
+	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+)
+
+replace github.com/flintg/gitforgits-bookstore/mAuthenticate => ../../middleware/mAuthenticate
+
+replace github.com/flintg/gitforgits-bookstore/mAuthorize => ../../middleware/mAuthorize
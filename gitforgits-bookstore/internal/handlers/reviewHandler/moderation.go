@@ -0,0 +1,370 @@
+package reviewHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var ModerationPathPrefix string = "/reviews/moderation"
+var templateCache *template.Template
+
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+)
+
+/*
+Controls which reviews are published without waiting for a moderator.
+*/
+type ModerationRules struct {
+	AutoApprove          bool     // publish reviews that pass every check below straight away
+	TrustedAfterApproved int      // ...but only for authors with at least this many approved reviews
+	MaxLinks             int      // reviews with more links than this always wait for a moderator
+	ReportThreshold      int      // open reports that pull an approved review back into the queue
+	BlockedTerms         []string // reviews containing any of these always wait for a moderator
+}
+
+var Rules = ModerationRules{
+	AutoApprove:     true,
+	MaxLinks:        0,
+	ReportThreshold: 3,
+}
+
+var ReportReasons = []string{"spam", "offensive", "off-topic", "spoiler", "other"}
+
+/*
+A review waiting in the moderation queue, along with why it is there.
+*/
+type FlaggedReview struct {
+	Review
+	OpenReports   int
+	ReportReasons []string
+}
+
+var linkPattern = regexp.MustCompile(`(?i)https?://|www\.`)
+
+/*
+Registers the moderator routes. These sit outside the book subrouter because the queue spans
+every book.
+*/
+func RegisterModerationHandlers(r *mux.Router) {
+	sr := r.PathPrefix(ModerationPathPrefix).Subrouter()
+	sr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequirePermission(mAuthorize.PermReviewsModerate))
+	sr.HandleFunc("", GetModerationQueue).Methods("GET")
+	sr.HandleFunc("/", GetModerationQueue).Methods("GET")
+	sr.HandleFunc("/", ModerateReviews).Methods("POST")
+}
+
+/*
+Decides the initial status of a new or edited review. The note explains why a review was held
+back and is shown to moderators.
+*/
+func (rules ModerationRules) Evaluate(db queryRower, review Review) (status string, note string, err error) {
+	text := review.Title + " " + review.Body
+	if terms := matchBlockedTerms(text, rules.BlockedTerms); len(terms) > 0 {
+		return StatusPending, fmt.Sprintf("Contains blocked terms: %v", strings.Join(terms, ", ")), nil
+	}
+	if links := len(linkPattern.FindAllStringIndex(text, -1)); links > rules.MaxLinks {
+		return StatusPending, fmt.Sprintf("Contains %d links", links), nil
+	}
+	if !rules.AutoApprove {
+		return StatusPending, "", nil
+	}
+	if rules.TrustedAfterApproved > 0 {
+		var approved int
+		if err = db.QueryRow(
+			"SELECT COUNT(*) FROM \"Reviews\" WHERE \"User_ID\"=$1 AND \"Status\"=$2 AND \"ID\"<>$3",
+			review.UserID, StatusApproved, review.ID).Scan(&approved); err != nil {
+			return StatusPending, "", err
+		}
+		if approved < rules.TrustedAfterApproved {
+			return StatusPending, "New reviewer", nil
+		}
+	}
+	return StatusApproved, "", nil
+}
+
+/*
+Returns the blocked terms that appear in text. Matching is case-insensitive and on whole words,
+so "class" doesn't trip over "ass". Terms may span several words.
+*/
+func matchBlockedTerms(text string, terms []string) []string {
+	var matched []string
+	words := " " + strings.Join(strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	}), " ") + " "
+	for _, term := range terms {
+		term = strings.Join(strings.FieldsFunc(strings.ToLower(term), func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+		}), " ")
+		if term != "" && strings.Contains(words, " "+term+" ") {
+			matched = append(matched, term)
+		}
+	}
+	return matched
+}
+
+/*
+Reports a review for moderation. A signed in user can report a review once. When a published
+review collects Rules.ReportThreshold open reports it is hidden until a moderator looks at it.
+*/
+func ReportReview(w http.ResponseWriter, r *http.Request) {
+	var (
+		vars        = mux.Vars(r)
+		bookID, _   = strconv.Atoi(vars["id"])
+		reviewID, _ = strconv.Atoi(vars["reviewID"])
+		report      struct{ Reason string }
+		isForm      bool
+	)
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Sign in to report a review.", http.StatusUnauthorized)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			http.Error(w, "Invalid report data.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		isForm = true
+		report.Reason = r.FormValue("reason")
+	}
+	report.Reason = strings.ToLower(strings.TrimSpace(report.Reason))
+	if !validReason(report.Reason) {
+		http.Error(w, fmt.Sprintf("Reason must be one of: %v.", strings.Join(ReportReasons, ", ")), http.StatusBadRequest)
+		return
+	}
+	err := inTx(bookID, func(tx *sql.Tx) error {
+		review, err := getReview(tx, bookID, reviewID)
+		if err != nil {
+			return err
+		}
+		if review.Status != StatusApproved {
+			return errReviewNotFound
+		}
+		if _, err = tx.Exec(
+			"INSERT INTO \"Review_Reports\"(\"Review_ID\",\"User_ID\",\"Reason\") VALUES($1,$2,$3)",
+			review.ID, userID, report.Reason); err != nil {
+			return err
+		}
+		if Rules.ReportThreshold <= 0 {
+			return nil
+		}
+		_, err = tx.Exec(
+			"UPDATE \"Reviews\" SET \"Status\"=$1,\"Moderation_Note\"='Reported by shoppers' WHERE \"ID\"=$2 AND (SELECT COUNT(*) FROM \"Review_Reports\" WHERE \"Review_ID\"=$2 AND \"Resolved_At\" IS NULL)>=$3",
+			StatusPending, review.ID, Rules.ReportThreshold)
+		return err
+	})
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		http.Error(w, "You have already reported this review.", http.StatusConflict)
+		return
+	} else if !reviewError(w, err, "reviewHandler.ReportReview") {
+		return
+	}
+	if isForm {
+		http.Redirect(w, r, fmt.Sprintf("%v/%d#reviews", BookPathPrefix, bookID), http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/*
+Lists the reviews that need a moderator: everything pending, plus published reviews with open
+reports. Oldest first, so nothing waits forever.
+*/
+func GetModerationQueue(w http.ResponseWriter, r *http.Request) {
+	queue, err := listFlaggedReviews()
+	if err != nil {
+		log.Printf("reviewHandler.GetModerationQueue; listFlaggedReviews failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") || templateCache == nil {
+		if queue == nil {
+			queue = []FlaggedReview{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(queue)
+		return
+	}
+	if err = templateCache.ExecuteTemplate(w, "reviewModeration", queue); err != nil {
+		log.Printf("reviewHandler.GetModerationQueue(w,r) error: %v", err)
+	}
+}
+
+/*
+Approves or rejects reviews in bulk. Accepts a form with repeated "id" fields and an "action",
+or JSON like {"IDs":[1,2],"Action":"approve","Note":"..."}. Open reports on the reviews are
+resolved either way.
+*/
+func ModerateReviews(w http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			IDs    []int
+			Action string
+			Note   string
+		}
+		isForm bool
+		status string
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid moderation data.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		isForm = true
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data.", http.StatusBadRequest)
+			return
+		}
+		for _, sID := range r.Form["id"] {
+			id, err := strconv.Atoi(sID)
+			if err != nil {
+				http.Error(w, "Review IDs must be integers.", http.StatusBadRequest)
+				return
+			}
+			req.IDs = append(req.IDs, id)
+		}
+		req.Action = r.FormValue("action")
+		req.Note = r.FormValue("note")
+	}
+	switch req.Action {
+	case "approve":
+		status = StatusApproved
+	case "reject":
+		status = StatusRejected
+	default:
+		http.Error(w, "Action must be approve or reject.", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		http.Error(w, "Select at least one review.", http.StatusBadRequest)
+		return
+	}
+	updated, err := moderate(req.IDs, status, req.Note)
+	if err != nil {
+		log.Printf("reviewHandler.ModerateReviews; moderating %v failed. Error: %v", req.IDs, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("reviewHandler.ModerateReviews; %v reviews %v: %v", status, len(updated), updated)
+	if isForm {
+		http.Redirect(w, r, ModerationPathPrefix+"/", http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"Status": status, "Updated": updated})
+}
+
+/*
+Sets the status of the given reviews and refreshes the aggregates of every book touched, all
+in one transaction. Books are locked first, in ID order, as inTx does, so moderation can't
+deadlock with a review being written. Returns the IDs that were actually found.
+*/
+func moderate(ids []int, status string, note string) ([]int, error) {
+	tx, err := ReviewDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	bookIDs, err := scanIDs(tx,
+		"SELECT \"ID\" FROM \"Books\" WHERE \"ID\" IN (SELECT \"Book_ID\" FROM \"Reviews\" WHERE \"ID\"=ANY($1)) ORDER BY \"ID\" FOR UPDATE",
+		pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	updated, err := scanIDs(tx,
+		"UPDATE \"Reviews\" SET \"Status\"=$1,\"Moderation_Note\"=$2,\"Moderated_At\"=now() WHERE \"ID\"=ANY($3) RETURNING \"ID\"",
+		status, note, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("UPDATE \"Review_Reports\" SET \"Resolved_At\"=now() WHERE \"Review_ID\"=ANY($1) AND \"Resolved_At\" IS NULL", pq.Array(updated)); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(recomputeAggregates+" WHERE \"ID\"=ANY($1)", pq.Array(bookIDs)); err != nil {
+		return nil, err
+	}
+	return updated, tx.Commit()
+}
+
+func scanIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func listFlaggedReviews() ([]FlaggedReview, error) {
+	var queue []FlaggedReview
+	rows, err := ReviewDB.Query(
+		"SELECT "+reviewColumns+",COUNT(rr.\"ID\"),COALESCE(array_agg(DISTINCT rr.\"Reason\") FILTER (WHERE rr.\"ID\" IS NOT NULL),'{}') "+
+			"FROM \"Reviews\" r LEFT JOIN \"Review_Reports\" rr ON rr.\"Review_ID\"=r.\"ID\" AND rr.\"Resolved_At\" IS NULL "+
+			"WHERE r.\"Status\"=$1 OR rr.\"ID\" IS NOT NULL GROUP BY r.\"ID\" ORDER BY r.\"Created_At\"",
+		StatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var flagged FlaggedReview
+		if err = rows.Scan(append(reviewFields(&flagged.Review), &flagged.OpenReports, pq.Array(&flagged.ReportReasons))...); err != nil {
+			return nil, err
+		}
+		queue = append(queue, flagged)
+	}
+	return queue, rows.Err()
+}
+
+func validReason(reason string) bool {
+	for _, valid := range ReportReasons {
+		if reason == valid {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Used by the moderation template to show how long a review has been waiting.
+*/
+func (f FlaggedReview) Waiting() string {
+	return time.Since(f.CreatedAt).Round(time.Minute).String()
+}
+
+func SetTemplateCache(t *template.Template) {
+	templateCache = t
+}
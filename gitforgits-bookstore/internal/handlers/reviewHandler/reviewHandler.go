@@ -0,0 +1,383 @@
+package reviewHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var BookPathPrefix string = "/book" // set by bookHandler when it mounts these routes
+var ReviewDB *sql.DB
+
+const MaxTitleLength = 150
+const MaxBodyLength = 10000
+
+type Review struct {
+	ID             int
+	BookID         int
+	UserID         int
+	Rating         int
+	Title          string
+	Body           string
+	Status         string
+	ModerationNote string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+const reviewColumns = `r."ID",r."Book_ID",r."User_ID",r."Rating",r."Title",r."Body",r."Status",r."Moderation_Note",r."Created_At",r."Updated_At"`
+
+// Only approved reviews count towards a book's aggregates.
+const recomputeAggregates = `UPDATE "Books" SET "Review_Count"=(SELECT COUNT(*) FROM "Reviews" WHERE "Book_ID"="Books"."ID" AND "Status"='approved'),
+	"Rating_Average"=(SELECT COALESCE(AVG("Rating"),0) FROM "Reviews" WHERE "Book_ID"="Books"."ID" AND "Status"='approved')`
+
+func reviewFields(review *Review) []interface{} {
+	return []interface{}{&review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Title, &review.Body, &review.Status, &review.ModerationNote, &review.CreatedAt, &review.UpdatedAt}
+}
+
+var errReviewNotFound = errors.New("review not found")
+var errNotReviewAuthor = errors.New("only the author may change a review")
+
+/*
+Registers the review routes on the subrouter of the book package, so every route here lives
+below /books/{id}/reviews. Anything that writes needs a signed in user.
+*/
+func RegisterHandlers(sr *mux.Router) {
+	sr.HandleFunc("/{id:[0-9]+}/reviews", GetBookReviews).Methods("GET")
+	sr.HandleFunc("/{id:[0-9]+}/reviews/{reviewID:[0-9]+}", GetReview).Methods("GET")
+	wr := sr.NewRoute().Subrouter()
+	wr.HandleFunc("/{id:[0-9]+}/reviews", AddReview).Methods("POST")
+	wr.HandleFunc("/{id:[0-9]+}/reviews/{reviewID:[0-9]+}/update", UpdateReview).Methods("POST", "PUT")
+	wr.HandleFunc("/{id:[0-9]+}/reviews/{reviewID:[0-9]+}/delete", DeleteReview).Methods("POST", "DELETE")
+	wr.HandleFunc("/{id:[0-9]+}/reviews/{reviewID:[0-9]+}/report", ReportReview).Methods("POST")
+	wr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequireInteractive)
+}
+
+/*
+Returns the ID of the signed in user, if the authentication middleware found one.
+*/
+func currentUserID(r *http.Request) (int, bool) {
+	user, ok := mAuthenticate.UserFromContext(r.Context())
+	if !ok {
+		return 0, false
+	}
+	return user.ID, true
+}
+
+/*
+Reports whether the signed in user may moderate reviews, which lets them see and delete
+reviews that are not their own.
+*/
+func canModerate(r *http.Request) bool {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	return mAuthorize.Can(user, mAuthorize.PermReviewsModerate)
+}
+
+/*
+Gets the published reviews of a single book, newest first
+*/
+func GetBookReviews(w http.ResponseWriter, r *http.Request) {
+	bookID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	reviews, err := ListReviews(bookID)
+	if err != nil {
+		log.Printf("reviewHandler.GetBookReviews; ListReviews(%v) failed. Error: %v", bookID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if reviews == nil {
+		reviews = []Review{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+/*
+Gets a single review. Reviews that aren't published are only visible to their author.
+*/
+func GetReview(w http.ResponseWriter, r *http.Request) {
+	var (
+		vars        = mux.Vars(r)
+		bookID, _   = strconv.Atoi(vars["id"])
+		reviewID, _ = strconv.Atoi(vars["reviewID"])
+	)
+	review, err := getReview(ReviewDB, bookID, reviewID)
+	if userID, _ := currentUserID(r); err == nil && review.Status != StatusApproved && review.UserID != userID && !canModerate(r) {
+		err = errReviewNotFound
+	}
+	if err == errReviewNotFound {
+		http.Error(w, "Review not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("reviewHandler.GetReview; getReview(%v, %v) failed. Error: %v", bookID, reviewID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+/*
+Adds a review to a book. Each user can review a book once; further changes go through
+UpdateReview. Depending on Rules the review is published straight away or waits for a
+moderator.
+*/
+func AddReview(w http.ResponseWriter, r *http.Request) {
+	bookID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Sign in to write a review.", http.StatusUnauthorized)
+		return
+	}
+	review, isForm, err := decodeReview(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review.BookID = bookID
+	review.UserID = userID
+	err = inTx(bookID, func(tx *sql.Tx) error {
+		if review.Status, review.ModerationNote, err = Rules.Evaluate(tx, review); err != nil {
+			return err
+		}
+		return tx.QueryRow(
+			"INSERT INTO \"Reviews\"(\"Book_ID\",\"User_ID\",\"Rating\",\"Title\",\"Body\",\"Status\",\"Moderation_Note\",\"Moderated_At\") VALUES($1,$2,$3,$4,$5,$6,$7,CASE WHEN $6='approved' THEN now() END) RETURNING \"ID\",\"Created_At\",\"Updated_At\"",
+			review.BookID, review.UserID, review.Rating, review.Title, review.Body, review.Status, review.ModerationNote,
+		).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt)
+	})
+	var pqErr *pq.Error
+	if err == sql.ErrNoRows {
+		http.Error(w, "Book not found.", http.StatusNotFound)
+		return
+	} else if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		http.Error(w, "You have already reviewed this book.", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("reviewHandler.AddReview; inserting review for book [%v] failed. Error: %v", bookID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respond(w, r, isForm, http.StatusCreated, review)
+}
+
+/*
+Updates the rating, title and body of a review. Only the author may do this. The edited
+review goes through moderation again.
+*/
+func UpdateReview(w http.ResponseWriter, r *http.Request) {
+	var (
+		vars        = mux.Vars(r)
+		bookID, _   = strconv.Atoi(vars["id"])
+		reviewID, _ = strconv.Atoi(vars["reviewID"])
+	)
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Sign in to edit your review.", http.StatusUnauthorized)
+		return
+	}
+	update, isForm, err := decodeReview(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review Review
+	err = inTx(bookID, func(tx *sql.Tx) error {
+		if review, err = getReview(tx, bookID, reviewID); err != nil {
+			return err
+		}
+		if review.UserID != userID {
+			return errNotReviewAuthor
+		}
+		review.Rating, review.Title, review.Body = update.Rating, update.Title, update.Body
+		if review.Status, review.ModerationNote, err = Rules.Evaluate(tx, review); err != nil {
+			return err
+		}
+		return tx.QueryRow(
+			"UPDATE \"Reviews\" SET \"Rating\"=$1,\"Title\"=$2,\"Body\"=$3,\"Status\"=$4,\"Moderation_Note\"=$5,\"Moderated_At\"=CASE WHEN $4='approved' THEN now() END,\"Updated_At\"=now() WHERE \"ID\"=$6 RETURNING \"Updated_At\"",
+			review.Rating, review.Title, review.Body, review.Status, review.ModerationNote, review.ID,
+		).Scan(&review.UpdatedAt)
+	})
+	if !reviewError(w, err, "reviewHandler.UpdateReview") {
+		return
+	}
+	respond(w, r, isForm, http.StatusOK, review)
+}
+
+/*
+Deletes a review. Only the author or a moderator may do this.
+*/
+func DeleteReview(w http.ResponseWriter, r *http.Request) {
+	var (
+		vars        = mux.Vars(r)
+		bookID, _   = strconv.Atoi(vars["id"])
+		reviewID, _ = strconv.Atoi(vars["reviewID"])
+	)
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Sign in to delete your review.", http.StatusUnauthorized)
+		return
+	}
+	err := inTx(bookID, func(tx *sql.Tx) error {
+		review, err := getReview(tx, bookID, reviewID)
+		if err != nil {
+			return err
+		}
+		if review.UserID != userID && !canModerate(r) {
+			return errNotReviewAuthor
+		}
+		_, err = tx.Exec("DELETE FROM \"Reviews\" WHERE \"ID\"=$1", review.ID)
+		return err
+	})
+	if !reviewError(w, err, "reviewHandler.DeleteReview") {
+		return
+	}
+	if r.Method == "POST" {
+		http.Redirect(w, r, fmt.Sprintf("%v/%d#reviews", BookPathPrefix, bookID), http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Lists the published reviews of a book, newest first. Used by bookHandler to render the
+details page.
+*/
+func ListReviews(bookID int) ([]Review, error) {
+	var reviews []Review
+	rows, err := ReviewDB.Query(
+		"SELECT "+reviewColumns+" FROM \"Reviews\" r WHERE r.\"Book_ID\"=$1 AND r.\"Status\"=$2 ORDER BY r.\"Created_At\" DESC",
+		bookID, StatusApproved)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var review Review
+		if err = rows.Scan(reviewFields(&review)...); err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getReview(db queryRower, bookID int, reviewID int) (Review, error) {
+	var review Review
+	err := db.QueryRow(
+		"SELECT "+reviewColumns+" FROM \"Reviews\" r WHERE r.\"ID\"=$1 AND r.\"Book_ID\"=$2",
+		reviewID, bookID,
+	).Scan(reviewFields(&review)...)
+	if err == sql.ErrNoRows {
+		return review, errReviewNotFound
+	}
+	return review, err
+}
+
+/*
+Runs fn in a transaction that holds the book row lock, then recomputes the book's review
+count and average rating before committing. Returns sql.ErrNoRows if the book doesn't exist.
+
+Recomputing from the Reviews table (rather than adjusting the stored values) keeps the
+aggregates correct even if they were ever out of step.
+*/
+func inTx(bookID int, fn func(tx *sql.Tx) error) error {
+	tx, err := ReviewDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var lockedID int
+	if err = tx.QueryRow("SELECT \"ID\" FROM \"Books\" WHERE \"ID\"=$1 FOR UPDATE", bookID).Scan(&lockedID); err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(recomputeAggregates+" WHERE \"ID\"=$1", bookID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Reads a review from a JSON body or a submitted form and validates it. isForm reports whether
+the caller is a browser form, which gets a redirect instead of JSON.
+*/
+func decodeReview(r *http.Request) (review Review, isForm bool, err error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err = json.NewDecoder(r.Body).Decode(&review); err != nil {
+			return review, false, errors.New("Invalid review data.")
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		isForm = true
+		if review.Rating, err = strconv.Atoi(r.FormValue("rating")); err != nil {
+			return review, isForm, errors.New("Rating must be a number from 1 to 5.")
+		}
+		review.Title = r.FormValue("title")
+		review.Body = r.FormValue("body")
+	default:
+		return review, false, fmt.Errorf("Unexpected Content-Type %s", mediaType)
+	}
+	review.Title = strings.TrimSpace(review.Title)
+	review.Body = strings.TrimSpace(review.Body)
+	switch {
+	case review.Rating < 1 || review.Rating > 5:
+		err = errors.New("Rating must be a number from 1 to 5.")
+	case len(review.Title) > MaxTitleLength:
+		err = fmt.Errorf("Title may be at most %d characters.", MaxTitleLength)
+	case review.Body == "":
+		err = errors.New("Review text is required.")
+	case len(review.Body) > MaxBodyLength:
+		err = fmt.Errorf("Review text may be at most %d characters.", MaxBodyLength)
+	}
+	return review, isForm, err
+}
+
+/*
+Maps the errors shared by update and delete onto responses. Returns true when err is nil and
+the handler should carry on.
+*/
+func reviewError(w http.ResponseWriter, err error, where string) bool {
+	switch {
+	case err == nil:
+		return true
+	case err == sql.ErrNoRows:
+		http.Error(w, "Book not found.", http.StatusNotFound)
+	case err == errReviewNotFound:
+		http.Error(w, "Review not found.", http.StatusNotFound)
+	case err == errNotReviewAuthor:
+		http.Error(w, "You can only change your own reviews.", http.StatusForbidden)
+	default:
+		log.Printf("%v; Error: %v", where, err)
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+	return false
+}
+
+func respond(w http.ResponseWriter, r *http.Request, isForm bool, status int, review Review) {
+	if isForm {
+		http.Redirect(w, r, fmt.Sprintf("%v/%d#reviews", BookPathPrefix, review.BookID), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(review)
+}
@@ -0,0 +1,409 @@
+package userHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/gorilla/mux"
+)
+
+var MaxAddressesPerUser = 20
+
+const maxAddressFieldLength = 200
+
+/*
+An entry in a user's address book. At most one address of a user is the default for
+shipping, and one for billing; they may be the same.
+*/
+type Address struct {
+	ID              int
+	Label           string
+	FullName        string
+	Line1           string
+	Line2           string
+	City            string
+	Region          string
+	PostalCode      string
+	Country         string // ISO 3166-1 alpha-2, e.g. "GB"
+	Phone           string
+	DefaultShipping bool
+	DefaultBilling  bool
+}
+
+/*
+Data for the userAddress template, which adds (ID 0) or edits an address.
+*/
+type addressPage struct {
+	Address
+	Errors FieldErrors
+}
+
+func registerAddressHandlers(pr *mux.Router) {
+	pr.HandleFunc("/addresses", ListAddresses).Methods("GET")
+	pr.HandleFunc("/addresses", AddAddress).Methods("POST")
+	pr.HandleFunc("/addresses/new", NewAddressForm).Methods("GET")
+	pr.HandleFunc("/addresses/{id:[0-9]+}", GetAddress).Methods("GET")
+	pr.HandleFunc("/addresses/{id:[0-9]+}", UpdateAddress).Methods("PUT")
+	pr.HandleFunc("/addresses/{id:[0-9]+}/update", UpdateAddress).Methods("POST")
+	pr.HandleFunc("/addresses/{id:[0-9]+}", DeleteAddress).Methods("DELETE")
+	pr.HandleFunc("/addresses/{id:[0-9]+}/delete", DeleteAddress).Methods("POST")
+	pr.HandleFunc("/addresses/{id:[0-9]+}/default", SetDefaultAddress).Methods("POST")
+}
+
+/*
+Lists the address book as JSON. Browsers see it on the profile page.
+*/
+func ListAddresses(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	if !wantsJSON(r) {
+		http.Redirect(w, r, UserPathPrefix+"/profile", http.StatusSeeOther)
+		return
+	}
+	addresses, err := listAddresses(user.ID)
+	if err != nil {
+		log.Printf("userHandler.ListAddresses; listing addresses of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(addresses)
+}
+
+/*
+Shows the form for a new address.
+*/
+func NewAddressForm(w http.ResponseWriter, r *http.Request) {
+	renderUserPage(w, http.StatusOK, "userAddress", addressPage{})
+}
+
+/*
+Returns one address as JSON, or the form to edit it.
+*/
+func GetAddress(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	address, err := findAddress(user.ID, mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No such address.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("userHandler.GetAddress; loading address [%v] of [%v] failed. Error: %v", mux.Vars(r)["id"], user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !wantsJSON(r) {
+		renderUserPage(w, http.StatusOK, "userAddress", addressPage{Address: address})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(address)
+}
+
+/*
+Adds an address to the address book. The first address becomes the default for both
+shipping and billing.
+*/
+func AddAddress(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	address, ok := readAddress(w, r)
+	if !ok {
+		return
+	}
+	page := addressPage{Address: address, Errors: address.check()}
+	if len(page.Errors) > 0 {
+		addressFailed(w, r, http.StatusBadRequest, page)
+		return
+	}
+	tx, err := UserDB.Begin()
+	if err != nil {
+		log.Printf("userHandler.AddAddress; starting transaction failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var count int
+	// Locking the user row keeps two concurrent adds from both passing the limit.
+	_, err = tx.Exec("SELECT 1 FROM \"Users\" WHERE \"ID\"=$1 FOR UPDATE", user.ID)
+	if err == nil {
+		err = tx.QueryRow("SELECT count(*) FROM \"Addresses\" WHERE \"User_ID\"=$1", user.ID).Scan(&count)
+	}
+	if err == nil && count >= MaxAddressesPerUser {
+		page.Errors = FieldErrors{"address": {"Your address book is full. Delete an address you no longer need first."}}
+		addressFailed(w, r, http.StatusConflict, page)
+		return
+	}
+	if err == nil {
+		err = tx.QueryRow(
+			"INSERT INTO \"Addresses\"(\"User_ID\",\"Label\",\"Full_Name\",\"Line1\",\"Line2\",\"City\",\"Region\",\"Postal_Code\",\"Country\",\"Phone\") VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) RETURNING \"ID\"",
+			user.ID, address.Label, address.FullName, address.Line1, address.Line2, address.City, address.Region, address.PostalCode, address.Country, address.Phone).Scan(&address.ID)
+	}
+	if err == nil {
+		err = setDefaultAddress(tx, user.ID, address.ID, address.DefaultShipping || count == 0, address.DefaultBilling || count == 0)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("userHandler.AddAddress; adding address for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	addressDone(w, r, user.ID, address.ID, http.StatusCreated, "address")
+}
+
+/*
+Replaces an address. Sending DefaultShipping or DefaultBilling makes it the default; leaving
+them out doesn't take that away, use another address as the default instead.
+*/
+func UpdateAddress(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	address, ok := readAddress(w, r)
+	if !ok {
+		return
+	}
+	address.ID, _ = strconv.Atoi(mux.Vars(r)["id"])
+	page := addressPage{Address: address, Errors: address.check()}
+	if len(page.Errors) > 0 {
+		addressFailed(w, r, http.StatusBadRequest, page)
+		return
+	}
+	tx, err := UserDB.Begin()
+	if err != nil {
+		log.Printf("userHandler.UpdateAddress; starting transaction failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(
+		"UPDATE \"Addresses\" SET \"Label\"=$3,\"Full_Name\"=$4,\"Line1\"=$5,\"Line2\"=$6,\"City\"=$7,\"Region\"=$8,\"Postal_Code\"=$9,\"Country\"=$10,\"Phone\"=$11,\"Updated_At\"=now() WHERE \"ID\"=$1 AND \"User_ID\"=$2",
+		address.ID, user.ID, address.Label, address.FullName, address.Line1, address.Line2, address.City, address.Region, address.PostalCode, address.Country, address.Phone)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "No such address.", http.StatusNotFound)
+			return
+		}
+		err = setDefaultAddress(tx, user.ID, address.ID, address.DefaultShipping, address.DefaultBilling)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("userHandler.UpdateAddress; updating address [%v] of [%v] failed. Error: %v", address.ID, user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	addressDone(w, r, user.ID, address.ID, http.StatusOK, "address")
+}
+
+/*
+Removes an address from the address book.
+*/
+func DeleteAddress(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	result, err := UserDB.Exec("DELETE FROM \"Addresses\" WHERE \"ID\"=$1 AND \"User_ID\"=$2", mux.Vars(r)["id"], user.ID)
+	if err != nil {
+		log.Printf("userHandler.DeleteAddress; deleting address [%v] of [%v] failed. Error: %v", mux.Vars(r)["id"], user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "No such address.", http.StatusNotFound)
+		return
+	}
+	if isJSONRequest(r) || r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, UserPathPrefix+"/profile?done=deleted", http.StatusSeeOther)
+}
+
+/*
+Makes an address the default for shipping, billing or both, posted as the kind field or as
+{"Kind"}.
+*/
+func SetDefaultAddress(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Kind string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Kind = r.FormValue("kind")
+	}
+	shipping, billing := req.Kind == "shipping" || req.Kind == "both", req.Kind == "billing" || req.Kind == "both"
+	if !shipping && !billing {
+		http.Error(w, "Kind must be shipping, billing or both.", http.StatusBadRequest)
+		return
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	address, err := findAddress(user.ID, mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No such address.", http.StatusNotFound)
+		return
+	}
+	var tx *sql.Tx
+	if err == nil {
+		tx, err = UserDB.Begin()
+	}
+	if err == nil {
+		defer tx.Rollback()
+		err = setDefaultAddress(tx, user.ID, address.ID, shipping, billing)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("userHandler.SetDefaultAddress; setting default address of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	addressDone(w, r, user.ID, address.ID, http.StatusOK, "default")
+}
+
+/*
+Moves the shipping and/or billing default to addressID. Clearing the old default first keeps
+the unique indexes happy.
+*/
+func setDefaultAddress(tx *sql.Tx, userID int, addressID int, shipping bool, billing bool) error {
+	for column, set := range map[string]bool{"Default_Shipping": shipping, "Default_Billing": billing} {
+		if !set {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE \"Addresses\" SET \""+column+"\"=false WHERE \"User_ID\"=$1 AND \"ID\"<>$2 AND \""+column+"\"", userID, addressID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE \"Addresses\" SET \""+column+"\"=true WHERE \"User_ID\"=$1 AND \"ID\"=$2", userID, addressID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listAddresses(userID int) ([]Address, error) {
+	rows, err := UserDB.Query(
+		"SELECT \"ID\",\"Label\",\"Full_Name\",\"Line1\",\"Line2\",\"City\",\"Region\",\"Postal_Code\",\"Country\",\"Phone\",\"Default_Shipping\",\"Default_Billing\" FROM \"Addresses\" WHERE \"User_ID\"=$1 ORDER BY \"Default_Shipping\" DESC,\"Default_Billing\" DESC,\"ID\"",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	addresses := []Address{}
+	for rows.Next() {
+		var a Address
+		if err := rows.Scan(&a.ID, &a.Label, &a.FullName, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone, &a.DefaultShipping, &a.DefaultBilling); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, rows.Err()
+}
+
+func findAddress(userID int, id string) (Address, error) {
+	var a Address
+	err := UserDB.QueryRow(
+		"SELECT \"ID\",\"Label\",\"Full_Name\",\"Line1\",\"Line2\",\"City\",\"Region\",\"Postal_Code\",\"Country\",\"Phone\",\"Default_Shipping\",\"Default_Billing\" FROM \"Addresses\" WHERE \"ID\"=$1 AND \"User_ID\"=$2",
+		id, userID).Scan(&a.ID, &a.Label, &a.FullName, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone, &a.DefaultShipping, &a.DefaultBilling)
+	return a, err
+}
+
+/*
+Reads an address posted as JSON or as the fields of the userAddress form.
+*/
+func readAddress(w http.ResponseWriter, r *http.Request) (Address, bool) {
+	var a Address
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return a, false
+		}
+	} else {
+		a = Address{
+			Label:           r.FormValue("label"),
+			FullName:        r.FormValue("full_name"),
+			Line1:           r.FormValue("line1"),
+			Line2:           r.FormValue("line2"),
+			City:            r.FormValue("city"),
+			Region:          r.FormValue("region"),
+			PostalCode:      r.FormValue("postal_code"),
+			Country:         r.FormValue("country"),
+			Phone:           r.FormValue("phone"),
+			DefaultShipping: r.FormValue("default_shipping") != "",
+			DefaultBilling:  r.FormValue("default_billing") != "",
+		}
+	}
+	for _, field := range []*string{&a.Label, &a.FullName, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone} {
+		*field = strings.TrimSpace(*field)
+	}
+	a.Country = strings.ToUpper(a.Country)
+	return a, true
+}
+
+/*
+Checks an address, keyed by form field name like FieldErrors elsewhere.
+*/
+func (a Address) check() FieldErrors {
+	problems := FieldErrors{}
+	required := map[string]string{"full_name": a.FullName, "line1": a.Line1, "city": a.City, "postal_code": a.PostalCode}
+	for field, value := range required {
+		if value == "" {
+			problems.Add(field, "This field is required.")
+		}
+	}
+	fields := map[string]string{"label": a.Label, "full_name": a.FullName, "line1": a.Line1, "line2": a.Line2, "city": a.City, "region": a.Region, "postal_code": a.PostalCode, "phone": a.Phone}
+	for field, value := range fields {
+		if len([]rune(value)) > maxAddressFieldLength {
+			problems.Add(field, "This is too long.")
+		}
+		for _, c := range value {
+			if unicode.IsControl(c) {
+				problems.Add(field, "This can't contain control characters.")
+				break
+			}
+		}
+	}
+	if len(a.Country) != 2 || strings.Trim(a.Country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		problems.Add("country", "Enter a two-letter country code, like GB or US.")
+	}
+	return problems
+}
+
+func addressFailed(w http.ResponseWriter, r *http.Request, status int, page addressPage) {
+	if isJSONRequest(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]FieldErrors{"errors": page.Errors})
+		return
+	}
+	renderUserPage(w, status, "userAddress", page)
+}
+
+/*
+Browsers go back to the profile page, JSON clients get the saved address.
+*/
+func addressDone(w http.ResponseWriter, r *http.Request, userID int, addressID int, status int, done string) {
+	if !isJSONRequest(r) {
+		http.Redirect(w, r, UserPathPrefix+"/profile?done="+done, http.StatusSeeOther)
+		return
+	}
+	address, err := findAddress(userID, strconv.Itoa(addressID))
+	if err != nil {
+		log.Printf("userHandler.addressDone; loading address [%v] failed. Error: %v", addressID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(address)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || isJSONRequest(r) || templateCache == nil
+}
@@ -0,0 +1,252 @@
+package userHandler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+/*
+API keys look like "gfg_<prefix>.<secret>". The single dot keeps them apart from session
+tokens, which have none, and JWTs, which have two.
+*/
+const apiKeyPrefix = "gfg_"
+
+var MaxAPIKeysPerUser int = 20
+
+type APIKey struct {
+	ID         int
+	Name       string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	Key        string `json:",omitempty"` // only filled in when the key is created
+}
+
+/*
+Registers the routes where users manage their own API keys. Keys can't be used to make
+more keys.
+*/
+func registerAPIKeyHandlers(sr *mux.Router) {
+	kr := sr.PathPrefix("/keys").Subrouter()
+	kr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequireInteractive)
+	kr.HandleFunc("", ListAPIKeys).Methods("GET")
+	kr.HandleFunc("", CreateAPIKey).Methods("POST")
+	kr.HandleFunc("/{id:[0-9]+}", RevokeAPIKey).Methods("DELETE")
+	kr.HandleFunc("/{id:[0-9]+}/revoke", RevokeAPIKey).Methods("POST")
+}
+
+/*
+Lists the signed in user's keys that haven't been revoked, without the keys themselves.
+*/
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	rows, err := UserDB.Query(
+		"SELECT \"ID\",\"Name\",\"Prefix\",\"Scopes\",\"Created_At\",\"Expires_At\",\"Last_Used_At\" FROM \"API_Keys\" WHERE \"User_ID\"=$1 AND \"Revoked_At\" IS NULL ORDER BY \"Created_At\" DESC",
+		user.ID)
+	if err != nil {
+		log.Printf("userHandler.ListAPIKeys; listing keys of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt); err != nil {
+			log.Printf("userHandler.ListAPIKeys; scanning key failed. Error: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+/*
+Creates a key from {"Name", "Scopes", "ExpiresAt"}; ExpiresAt may be left out for a key that
+doesn't expire. The answer is the only time the key itself is shown.
+*/
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			Name      string
+			Scopes    []string
+			ExpiresAt *time.Time
+		}
+		key    APIKey
+		errs   = FieldErrors{}
+		active int
+	)
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, fmt.Sprintf("Unexpected Content-Type %s", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+		return
+	}
+	key.Name = strings.TrimSpace(req.Name)
+	if key.Name == "" || len(key.Name) > 100 {
+		errs.Add("name", "Give the key a name of up to 100 characters.")
+	}
+	if len(req.Scopes) == 0 {
+		errs.Add("scopes", "Choose at least one scope.")
+	}
+	for _, scope := range req.Scopes {
+		if !mAuthorize.ValidScope(scope) {
+			errs.Add("scopes", fmt.Sprintf("Unknown scope %q.", scope))
+			continue
+		}
+		for _, permission := range mAuthorize.ScopePermissions[scope] {
+			if !mAuthorize.Can(user, permission) {
+				errs.Add("scopes", fmt.Sprintf("You aren't allowed to use the %q scope.", scope))
+			}
+		}
+		key.Scopes = appendUnique(key.Scopes, scope)
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		errs.Add("expiresAt", "The expiry must be in the future.")
+	}
+	if len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]FieldErrors{"errors": errs})
+		return
+	}
+	err := UserDB.QueryRow(
+		"SELECT COUNT(*) FROM \"API_Keys\" WHERE \"User_ID\"=$1 AND \"Revoked_At\" IS NULL AND (\"Expires_At\" IS NULL OR \"Expires_At\">now())",
+		user.ID).Scan(&active)
+	if err == nil && active >= MaxAPIKeysPerUser {
+		http.Error(w, fmt.Sprintf("You already have %d API keys. Revoke one first.", active), http.StatusConflict)
+		return
+	}
+	var secret string
+	if err == nil {
+		key.Prefix, secret, err = newAPIKey()
+	}
+	if err == nil {
+		key.Key = apiKeyPrefix + key.Prefix + "." + secret
+		key.ExpiresAt = req.ExpiresAt
+		err = UserDB.QueryRow(
+			"INSERT INTO \"API_Keys\"(\"User_ID\",\"Name\",\"Prefix\",\"Key_Hash\",\"Scopes\",\"Expires_At\") VALUES($1,$2,$3,$4,$5,$6) RETURNING \"ID\",\"Created_At\"",
+			user.ID, key.Name, key.Prefix, sessionStore.HashID(key.Key), pq.Array(key.Scopes), key.ExpiresAt).Scan(&key.ID, &key.CreatedAt)
+	}
+	if err != nil {
+		log.Printf("userHandler.CreateAPIKey; creating key for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.CreateAPIKey; [%v] created API key [%v] with scopes %v.", user.Username, key.Prefix, key.Scopes)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&key)
+}
+
+/*
+Revokes one of the signed in user's keys. It stops working straight away.
+*/
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	keyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	result, err := UserDB.Exec(
+		"UPDATE \"API_Keys\" SET \"Revoked_At\"=now() WHERE \"ID\"=$1 AND \"User_ID\"=$2 AND \"Revoked_At\" IS NULL",
+		keyID, user.ID)
+	if err != nil {
+		log.Printf("userHandler.RevokeAPIKey; revoking key [%v] of [%v] failed. Error: %v", keyID, user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "API key not found.", http.StatusNotFound)
+		return
+	}
+	log.Printf("userHandler.RevokeAPIKey; [%v] revoked API key [%v].", user.Username, keyID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newAPIKey() (prefix string, secret string, err error) {
+	b := make([]byte, 4+32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:4]), base64.RawURLEncoding.EncodeToString(b[4:]), nil
+}
+
+func appendUnique(list []string, item string) []string {
+	for _, existing := range list {
+		if existing == item {
+			return list
+		}
+	}
+	return append(list, item)
+}
+
+/*
+Identifies scripts by an API key, sent as "Authorization: Bearer gfg_..." or in an
+X-API-Key header. The user gets the key's scopes, which limit what the key can do.
+*/
+type APIKeyAuthenticator struct{}
+
+func (APIKeyAuthenticator) Authenticate(r *http.Request) (*mAuthenticate.User, error) {
+	var (
+		keyID     int
+		userID    int
+		scopes    []string
+		expiresAt sql.NullTime
+	)
+	token := r.Header.Get("X-API-Key")
+	if bearer, ok := mAuthenticate.BearerToken(r); ok && strings.HasPrefix(bearer, apiKeyPrefix) {
+		token = bearer
+	}
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, mAuthenticate.ErrNoCredentials
+	}
+	err := UserDB.QueryRow(
+		"SELECT \"ID\",\"User_ID\",\"Scopes\",\"Expires_At\" FROM \"API_Keys\" WHERE \"Key_Hash\"=$1 AND \"Revoked_At\" IS NULL",
+		sessionStore.HashID(token)).Scan(&keyID, &userID, pq.Array(&scopes), &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, mAuthenticate.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid && !time.Now().Before(expiresAt.Time) {
+		return nil, mAuthenticate.ErrInvalidCredentials
+	}
+	// Only write when the recorded time is stale, so busy scripts don't write on every request.
+	if _, err := UserDB.Exec(
+		"UPDATE \"API_Keys\" SET \"Last_Used_At\"=now() WHERE \"ID\"=$1 AND (\"Last_Used_At\" IS NULL OR \"Last_Used_At\"<now()-interval '1 minute')",
+		keyID); err != nil {
+		log.Printf("userHandler.APIKeyAuthenticator; recording use of key [%v] failed. Error: %v", keyID, err)
+	}
+	user, err := loadAuthUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+	user.Scopes = scopes
+	return user, nil
+}
@@ -0,0 +1,65 @@
+package userHandler
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
+)
+
+/*
+Identifies users by their login session, carried either in the session cookie or, for API
+clients, as "Authorization: Bearer <session token>".
+*/
+type SessionAuthenticator struct{}
+
+func (SessionAuthenticator) Authenticate(r *http.Request) (*mAuthenticate.User, error) {
+	var (
+		session sessionStore.Session
+		err     error
+	)
+	if Sessions == nil {
+		return nil, mAuthenticate.ErrNoCredentials
+	}
+	if token, ok := mAuthenticate.BearerToken(r); ok {
+		session, err = Sessions.LoadID(token)
+	} else if _, cookieErr := r.Cookie(Sessions.CookieName); cookieErr == nil {
+		session, err = Sessions.Load(r)
+	} else {
+		return nil, mAuthenticate.ErrNoCredentials
+	}
+	if sessionStore.IsNotFound(err) {
+		return nil, mAuthenticate.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	return loadAuthUser(session.UserID)
+}
+
+/*
+Loads the user the middleware puts into the request context. Roles that require two-factor
+authentication only count once the user has set it up.
+*/
+func loadAuthUser(userID int) (*mAuthenticate.User, error) {
+	var twoFactor bool
+	user := mAuthenticate.User{ID: userID}
+	err := UserDB.QueryRow(
+		"SELECT \"Username\",\"Email\",EXISTS (SELECT 1 FROM \"User_TOTP\" t WHERE t.\"User_ID\"=u.\"ID\" AND t.\"Confirmed_At\" IS NOT NULL) FROM \"Users\" u WHERE \"ID\"=$1",
+		userID).Scan(&user.Username, &user.Email, &twoFactor)
+	if err == sql.ErrNoRows {
+		return nil, mAuthenticate.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	if user.Roles, err = userRoles(UserDB, userID); err != nil {
+		return nil, err
+	}
+	if requiresTwoFactor(user.Roles) && !twoFactor {
+		// Staff powers wait until two-factor authentication is set up
+		user.Roles = []string{mAuthorize.RoleCustomer}
+		user.NeedsTwoFactor = true
+	}
+	return &user, nil
+}
@@ -0,0 +1,93 @@
+package userHandler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+/*
+Signs the tokens in verification and password reset links. Set up by main; every instance
+must use the same secret.
+*/
+var TokenSecret []byte
+
+var (
+	VerifyEmailTTL   time.Duration = 48 * time.Hour
+	PasswordResetTTL time.Duration = time.Hour
+)
+
+const (
+	purposeVerifyEmail   = "verify-email"
+	purposeResetPassword = "reset-password"
+	purposeChangeEmail   = "change-email"
+)
+
+var errBadEmailToken = errors.New("invalid or expired link")
+
+/*
+The contents of an emailed link token. Bind is a fingerprint of the account state the token
+is for: the email address for verification, the password hash for a reset, the new address
+for an email change. Once that state changes the token stops working, which makes each token
+single-use without storing it.
+*/
+type emailToken struct {
+	Purpose string `json:"p"`
+	UserID  int    `json:"u"`
+	Expires int64  `json:"e"`
+	Bind    string `json:"b"`
+}
+
+func signEmailToken(purpose string, userID int, ttl time.Duration, bind string) (string, error) {
+	if len(TokenSecret) == 0 {
+		return "", errors.New("userHandler: TokenSecret is not set")
+	}
+	payload, err := json.Marshal(emailToken{Purpose: purpose, UserID: userID, Expires: time.Now().Add(ttl).Unix(), Bind: bind})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(encoded)), nil
+}
+
+/*
+Checks the signature, purpose and expiry of a token. The caller still has to compare Bind
+with the account.
+*/
+func parseEmailToken(token string, purpose string) (emailToken, error) {
+	var t emailToken
+	encoded, sig, found := strings.Cut(token, ".")
+	if !found || len(TokenSecret) == 0 {
+		return t, errBadEmailToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, tokenMAC(encoded)) {
+		return t, errBadEmailToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &t) != nil {
+		return t, errBadEmailToken
+	}
+	if t.Purpose != purpose || time.Now().Unix() >= t.Expires {
+		return t, errBadEmailToken
+	}
+	return t, nil
+}
+
+func tokenMAC(encoded string) []byte {
+	mac := hmac.New(sha256.New, TokenSecret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+/*
+A short, one-way fingerprint of account state for emailToken.Bind.
+*/
+func fingerprint(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
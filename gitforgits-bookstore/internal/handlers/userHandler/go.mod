@@ -2,4 +2,34 @@ module golang-web-book/gitforgits-bookstore/internal/handlers/userHandler
 
 go 1.22.4
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/flintg/gitforgits-bookstore/jwtToken v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/mAuthorize v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/oidcClient v0.0.0-00010101000000-000000000000
+	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.26.0
+)
+
+require (
+	github.com/flintg/gitforgits-bookstore/mailer v0.0.0-00010101000000-000000000000
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+)
+
+require (
+	github.com/flintg/gitforgits-bookstore/mAuthenticate v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/sessionStore v0.0.0-00010101000000-000000000000
+	golang.org/x/sys v0.23.0 // indirect
+)
+
+replace github.com/flintg/gitforgits-bookstore/sessionStore => ../../storage/sessionStore
+
+replace github.com/flintg/gitforgits-bookstore/mAuthenticate => ../../middleware/mAuthenticate
+
+replace github.com/flintg/gitforgits-bookstore/mAuthorize => ../../middleware/mAuthorize
+
+replace github.com/flintg/gitforgits-bookstore/jwtToken => ../../security/jwtToken
+
+replace github.com/flintg/gitforgits-bookstore/oidcClient => ../../security/oidcClient
+
+replace github.com/flintg/gitforgits-bookstore/mailer => ../../mailer
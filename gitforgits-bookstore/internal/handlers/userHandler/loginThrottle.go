@@ -0,0 +1,254 @@
+package userHandler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+How failed logins slow down further attempts. After FreeAttempts failures every attempt has
+to wait BaseDelay, doubling with each further failure up to MaxDelay. LockoutThreshold
+failures lock the account for LockoutDuration and the owner gets an email. The IP limits work
+the same way across all accounts tried from one address, which catches password spraying.
+Failures older than FailureWindow are forgotten. Configured from the environment in main.
+*/
+type LoginThrottle struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	IPFreeAttempts   int
+	FailureWindow    time.Duration
+}
+
+var Throttle = LoginThrottle{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  30 * time.Minute,
+	IPFreeAttempts:   20,
+	FailureWindow:    24 * time.Hour,
+}
+
+/*
+Returned instead of checking a password while an account or address has to wait.
+*/
+type throttledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *throttledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("account locked for another %v", e.RetryAfter)
+	}
+	return fmt.Sprintf("too many failed logins, retry in %v", e.RetryAfter)
+}
+
+/*
+How long to wait after the given number of failures.
+*/
+func (t LoginThrottle) delay(failures int, free int) time.Duration {
+	if failures < free || t.BaseDelay <= 0 {
+		return 0
+	}
+	d := t.BaseDelay
+	for i := free; i < failures && d < t.MaxDelay; i++ {
+		d *= 2
+	}
+	if t.MaxDelay > 0 && d > t.MaxDelay {
+		d = t.MaxDelay
+	}
+	return d
+}
+
+/*
+How long the account has to wait before its password may be tried again.
+*/
+func (t LoginThrottle) accountWait(user User, now time.Time) *throttledError {
+	if user.LockedUntil != nil && now.Before(*user.LockedUntil) {
+		return &throttledError{RetryAfter: user.LockedUntil.Sub(now), Locked: true}
+	}
+	if user.LastFailedLoginAt == nil || now.Sub(*user.LastFailedLoginAt) > t.FailureWindow {
+		return nil
+	}
+	if wait := user.LastFailedLoginAt.Add(t.delay(user.FailedLogins, t.FreeAttempts)).Sub(now); wait > 0 {
+		return &throttledError{RetryAfter: wait}
+	}
+	return nil
+}
+
+/*
+Failed logins per client address, kept in memory. Unlike the limiter in main, every address
+gets its own count.
+*/
+type failureCounter struct {
+	mu      sync.Mutex
+	entries map[string]*failureEntry
+}
+
+type failureEntry struct {
+	failures int
+	last     time.Time
+}
+
+var ipFailures = &failureCounter{entries: map[string]*failureEntry{}}
+
+func (c *failureCounter) wait(key string, now time.Time) *throttledError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.Sub(e.last) > Throttle.FailureWindow {
+		return nil
+	}
+	if wait := e.last.Add(Throttle.delay(e.failures, Throttle.IPFreeAttempts)).Sub(now); wait > 0 {
+		return &throttledError{RetryAfter: wait}
+	}
+	return nil
+}
+
+func (c *failureCounter) fail(key string, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.Sub(e.last) > Throttle.FailureWindow {
+		e = &failureEntry{}
+		c.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	return e.failures
+}
+
+/*
+Forgets addresses that haven't failed within the window.
+*/
+func (c *failureCounter) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if now.Sub(e.last) > Throttle.FailureWindow {
+			delete(c.entries, key)
+		}
+	}
+}
+
+/*
+Checks whether a login for user (zero if the name is unknown) from ip may go ahead.
+*/
+func checkLoginThrottle(user User, ip string) error {
+	now := time.Now()
+	if err := ipFailures.wait(ip, now); err != nil {
+		log.Printf("userHandler.checkLoginThrottle; brute force? [%v] is throttled for %v.", ip, err.RetryAfter.Round(time.Second))
+		return err
+	}
+	if user.ID == 0 {
+		return nil
+	}
+	if err := Throttle.accountWait(user, now); err != nil {
+		log.Printf("userHandler.checkLoginThrottle; brute force? login for [%v] from [%v] refused: %v.", user.Username, ip, err)
+		return err
+	}
+	return nil
+}
+
+/*
+Counts a failed password or two-factor code against the address and, if it's known, the
+account. Reaching the threshold locks the account and tells its owner.
+*/
+func recordLoginFailure(userID int, ip string) {
+	if n := ipFailures.fail(ip, time.Now()); n >= Throttle.IPFreeAttempts {
+		log.Printf("userHandler.recordLoginFailure; brute force? [%v] has %d failed logins.", ip, n)
+	}
+	if userID == 0 {
+		return
+	}
+	var (
+		user     = User{ID: userID}
+		failures int
+	)
+	err := UserDB.QueryRow(
+		"UPDATE \"Users\" SET \"Failed_Logins\"=CASE WHEN \"Last_Failed_Login_At\">now()-$2*interval '1 second' THEN \"Failed_Logins\"+1 ELSE 1 END,\"Last_Failed_Login_At\"=now() WHERE \"ID\"=$1 RETURNING \"Failed_Logins\",\"Username\",\"Email\"",
+		userID, Throttle.FailureWindow.Seconds()).Scan(&failures, &user.Username, &user.Email)
+	if err != nil {
+		log.Printf("userHandler.recordLoginFailure; counting failed login of user [%v] failed. Error: %v", userID, err)
+		return
+	}
+	if failures > Throttle.FreeAttempts {
+		log.Printf("userHandler.recordLoginFailure; brute force? [%v] has %d failed logins, the last from [%v].", user.Username, failures, ip)
+	}
+	if Throttle.LockoutThreshold <= 0 || failures < Throttle.LockoutThreshold {
+		return
+	}
+	// Start counting afresh, so the owner gets a few tries once the lock runs out.
+	if _, err := UserDB.Exec(
+		"UPDATE \"Users\" SET \"Locked_Until\"=now()+$2*interval '1 second',\"Failed_Logins\"=0 WHERE \"ID\"=$1",
+		userID, Throttle.LockoutDuration.Seconds()); err != nil {
+		log.Printf("userHandler.recordLoginFailure; locking [%v] failed. Error: %v", user.Username, err)
+		return
+	}
+	log.Printf("userHandler.recordLoginFailure; brute force? locked [%v] for %v after %d failed logins, the last from [%v].", user.Username, Throttle.LockoutDuration, failures, ip)
+	err = sendUserMail(user, "Your GitforGits Bookstore account was locked", "emailAccountLocked", emailData{
+		Username:  user.Username,
+		Link:      PublicURL + UserPathPrefix + "/password/forgot",
+		ExpiresIn: humanDuration(Throttle.LockoutDuration),
+	})
+	if err != nil {
+		log.Printf("userHandler.recordLoginFailure; telling [%v] about the lock failed. Error: %v", user.Username, err)
+	}
+}
+
+/*
+Clears the failure count once a user has fully logged in.
+*/
+func resetLoginFailures(userID int) {
+	if _, err := UserDB.Exec(
+		"UPDATE \"Users\" SET \"Failed_Logins\"=0,\"Last_Failed_Login_At\"=NULL,\"Locked_Until\"=NULL WHERE \"ID\"=$1 AND (\"Failed_Logins\">0 OR \"Locked_Until\" IS NOT NULL)",
+		userID); err != nil {
+		log.Printf("userHandler.resetLoginFailures; clearing failed logins of user [%v] failed. Error: %v", userID, err)
+	}
+}
+
+/*
+Tells a throttled client how long to wait. Browsers go back to the login page.
+*/
+func respondThrottled(w http.ResponseWriter, r *http.Request, err *throttledError, next string, isJSON bool) {
+	w.Header().Set("Retry-After", retryAfter(err.RetryAfter))
+	if !isJSON {
+		code := "throttled"
+		if err.Locked {
+			code = "locked"
+		}
+		http.Redirect(w, r, "/login.html?error="+code+"&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+	http.Error(w, throttledMessage(err), http.StatusTooManyRequests)
+}
+
+func throttledMessage(err *throttledError) string {
+	if err.Locked {
+		return "This account is locked after too many failed logins. Try again in " + humanDuration(err.RetryAfter+time.Minute-1) + " or reset your password."
+	}
+	return "Too many failed logins. Try again in " + retryAfter(err.RetryAfter) + " seconds."
+}
+
+// Whole seconds, rounded up, for the Retry-After header.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
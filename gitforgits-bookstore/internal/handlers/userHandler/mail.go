@@ -0,0 +1,82 @@
+package userHandler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/flintg/gitforgits-bookstore/mailer"
+)
+
+/*
+Sends account emails. Set up by main.
+*/
+var Mail mailer.Mailer
+
+/*
+The address the site is reached at, for links in emails, e.g. https://books.example.com
+*/
+var PublicURL string = "http://localhost:8080"
+
+var emailTemplates *texttemplate.Template
+
+/*
+Sets the plain text email templates. The HTML versions come from the page template cache
+under the same names.
+*/
+func SetEmailTemplates(t *texttemplate.Template) {
+	emailTemplates = t
+}
+
+/*
+Data every account email gets.
+*/
+type emailData struct {
+	Username  string
+	Link      string
+	ExpiresIn string
+}
+
+/*
+Renders the email template name for user and sends it. A missing HTML template only means
+the email goes out as plain text.
+*/
+func sendUserMail(user User, subject string, name string, data emailData) error {
+	if Mail == nil || emailTemplates == nil {
+		return fmt.Errorf("userHandler: mail is not set up")
+	}
+	var text, html bytes.Buffer
+	if err := emailTemplates.ExecuteTemplate(&text, name, data); err != nil {
+		return err
+	}
+	if templateCache != nil && templateCache.Lookup(name) != nil {
+		if err := templateCache.ExecuteTemplate(&html, name, data); err != nil {
+			log.Printf("userHandler.sendUserMail; rendering HTML for [%v] failed, sending text only. Error: %v", name, err)
+			html.Reset()
+		}
+	}
+	return Mail.Send(mailer.Message{To: user.Email, Subject: subject, Text: text.String(), HTML: html.String()})
+}
+
+/*
+An absolute link to path on this site carrying token.
+*/
+func tokenLink(path string, token string) string {
+	return PublicURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func humanDuration(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+	if d >= 2*time.Hour {
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	if d < 2*time.Minute {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", int(d.Minutes()))
+}
@@ -0,0 +1,255 @@
+package userHandler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/oidcClient"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+/*
+External identity providers people can sign in with, keyed by name. Set up by main.
+*/
+var Providers = map[string]*oidcClient.Provider{}
+
+const oidcCookieName = "gfg_oidc"
+
+var errEmailInUse = errors.New("an account with this email address already exists")
+
+var usernameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+/*
+What we remember in a short-lived cookie between sending the browser to the provider and it
+coming back.
+*/
+type oidcFlow struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+	Next     string
+}
+
+/*
+Lists the configured providers so the login page can offer them.
+*/
+func UserLoginProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	type provider struct {
+		Name        string
+		DisplayName string
+		LoginURL    string
+	}
+	list := []provider{}
+	for name, p := range Providers {
+		list = append(list, provider{Name: name, DisplayName: p.DisplayName, LoginURL: UserPathPrefix + "/login?provider=" + url.QueryEscape(name)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DisplayName < list[j].DisplayName })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+/*
+Sends the browser to the provider's login page, with a PKCE challenge, a state value and a
+nonce that the callback checks.
+*/
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, name string) {
+	provider, ok := Providers[name]
+	if !ok {
+		http.Error(w, "Unknown login provider.", http.StatusNotFound)
+		return
+	}
+	flow := oidcFlow{Provider: name, Next: safeNext(r.URL.Query().Get("next"))}
+	var err error
+	for _, v := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		if *v, err = oidcClient.NewVerifier(); err != nil {
+			break
+		}
+	}
+	var target string
+	if err == nil {
+		target, err = provider.AuthCodeURL(r.Context(), flow.State, flow.Nonce, flow.Verifier)
+	}
+	if err != nil {
+		log.Printf("userHandler.startOIDCLogin; starting login with [%v] failed. Error: %v", name, err)
+		http.Error(w, "That login provider isn't available right now.", http.StatusBadGateway)
+		return
+	}
+	value, _ := json.Marshal(flow)
+	setOIDCCookie(w, base64.RawURLEncoding.EncodeToString(value), 10*time.Minute)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func setOIDCCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     UserPathPrefix + "/login",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   Sessions.Secure,
+		SameSite: http.SameSiteLaxMode, // the provider sends the browser back with a cross-site GET
+	}
+	if maxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+/*
+Where the provider sends the browser back to. The code is exchanged for a verified ID token,
+the identity is linked to a user (creating one if needed), and a session is started.
+*/
+func UserLoginCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	var flow oidcFlow
+	name := mux.Vars(r)["provider"]
+	provider, ok := Providers[name]
+	if !ok || Sessions == nil {
+		http.Error(w, "Unknown login provider.", http.StatusNotFound)
+		return
+	}
+	cookie, err := r.Cookie(oidcCookieName)
+	if err == nil {
+		var raw []byte
+		if raw, err = base64.RawURLEncoding.DecodeString(cookie.Value); err == nil {
+			err = json.Unmarshal(raw, &flow)
+		}
+	}
+	setOIDCCookie(w, "", 0)
+	q := r.URL.Query()
+	if err != nil || flow.Provider != name || flow.State == "" || q.Get("state") != flow.State {
+		log.Printf("userHandler.UserLoginCallbackHandler; [%v] callback without a matching login in progress.", name)
+		http.Redirect(w, r, "/login.html?error=provider", http.StatusSeeOther)
+		return
+	}
+	if q.Get("error") != "" {
+		log.Printf("userHandler.UserLoginCallbackHandler; [%v] returned error [%v] %v", name, q.Get("error"), q.Get("error_description"))
+		http.Redirect(w, r, "/login.html?error=provider&next="+url.QueryEscape(flow.Next), http.StatusSeeOther)
+		return
+	}
+	claims, err := provider.Exchange(r.Context(), q.Get("code"), flow.Verifier, flow.Nonce)
+	if err != nil {
+		log.Printf("userHandler.UserLoginCallbackHandler; [%v] code exchange failed. Error: %v", name, err)
+		http.Redirect(w, r, "/login.html?error=provider&next="+url.QueryEscape(flow.Next), http.StatusSeeOther)
+		return
+	}
+	current, _ := mAuthenticate.UserFromContext(r.Context())
+	user, err := linkIdentity(name, claims, current)
+	if err == errEmailInUse {
+		http.Redirect(w, r, "/login.html?error=linkaccount&next="+url.QueryEscape(flow.Next), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Printf("userHandler.UserLoginCallbackHandler; linking [%v] identity failed. Error: %v", name, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.UserLoginCallbackHandler; [%v] logged in with [%v] from [%v].", user.Username, name, r.RemoteAddr)
+	beginLogin(w, r, user, flow.Next, false)
+}
+
+/*
+Finds the user behind an external identity. An identity seen before maps to its user. A new
+one is linked to the signed in user, or else to the user with the same email address if both
+the provider and that user have verified it, or else a new user is created. Otherwise an email
+that belongs to an existing account is refused and the user has to sign in to link it, so
+nobody can take over an account by claiming its address, or by registering it first.
+*/
+func linkIdentity(provider string, claims oidcClient.Claims, current *mAuthenticate.User) (User, error) {
+	var user User
+	tx, err := UserDB.Begin()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		"UPDATE \"User_Identities\" SET \"Last_Login_At\"=now(),\"Email\"=$3 WHERE \"Provider\"=$1 AND \"Subject\"=$2 RETURNING \"User_ID\"",
+		provider, claims.Subject, claims.Email).Scan(&user.ID)
+	switch {
+	case err == nil:
+	case err != sql.ErrNoRows:
+		return user, err
+	case current != nil:
+		user.ID = current.ID
+	default:
+		if claims.Email == "" {
+			return user, fmt.Errorf("%v gave no email address for subject %v", provider, claims.Subject)
+		}
+		var localVerified bool
+		err = tx.QueryRow("SELECT \"ID\",\"Email_Verified_At\" IS NOT NULL FROM \"Users\" WHERE lower(\"Email\")=lower($1)", claims.Email).Scan(&user.ID, &localVerified)
+		if err == nil && !(claims.EmailVerified && localVerified) {
+			return user, errEmailInUse
+		} else if err == sql.ErrNoRows {
+			user.ID, err = createExternalUser(tx, claims)
+		}
+		if err != nil {
+			return user, err
+		}
+	}
+	if _, err = tx.Exec(
+		"INSERT INTO \"User_Identities\"(\"Provider\",\"Subject\",\"User_ID\",\"Email\") VALUES($1,$2,$3,$4) ON CONFLICT DO NOTHING",
+		provider, claims.Subject, user.ID, claims.Email); err != nil {
+		return user, err
+	}
+	err = tx.QueryRow("SELECT \"Username\",\"Email\",\"Created_At\" FROM \"Users\" WHERE \"ID\"=$1", user.ID).Scan(&user.Username, &user.Email, &user.CreatedAt)
+	if err != nil {
+		return user, err
+	}
+	return user, tx.Commit()
+}
+
+/*
+Creates a user without a password for an external identity. The username comes from the
+provider's preferred username or the email address, with digits added until it is free.
+*/
+func createExternalUser(tx *sql.Tx, claims oidcClient.Claims) (int, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.Trim(usernameUnsafe.ReplaceAllString(base, ""), ".-")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+	username := base
+	for attempt := 0; attempt < 5; attempt++ {
+		var userID int
+		if _, err := tx.Exec("SAVEPOINT new_user"); err != nil {
+			return 0, err
+		}
+		err := tx.QueryRow(
+			"INSERT INTO \"Users\"(\"Username\",\"Email\",\"Password_Hash\",\"Email_Verified_At\") VALUES($1,$2,'',CASE WHEN $3 THEN now() END) RETURNING \"ID\"",
+			username, claims.Email, claims.EmailVerified).Scan(&userID)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" && strings.Contains(pqErr.Constraint, "Username") {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT new_user"); err != nil {
+				return 0, err
+			}
+			suffix := make([]byte, 2)
+			rand.Read(suffix)
+			username = fmt.Sprintf("%v%d", base, int(suffix[0])<<8|int(suffix[1]))
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		log.Printf("userHandler.createExternalUser; created user [%v] with ID [%v].", username, userID)
+		return userID, nil
+	}
+	return 0, fmt.Errorf("no free username like %q", base)
+}
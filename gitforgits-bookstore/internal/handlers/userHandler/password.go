@@ -0,0 +1,143 @@
+package userHandler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+Rules a new password has to satisfy. Configured from the environment in main.
+*/
+type PasswordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+var Policy = PasswordPolicy{
+	MinLength: 10,
+	MaxLength: 128,
+}
+
+/*
+Argon2id cost parameters. These follow the second recommended option of RFC 9106 (64 MiB of
+memory, 3 passes) with a parallelism of 2.
+*/
+type Argon2Params struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+var HashParams = Argon2Params{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 2,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+var errMalformedHash = errors.New("userHandler: malformed password hash")
+
+/*
+Checks password against the policy. The returned messages are meant for the user.
+*/
+func (p PasswordPolicy) Check(password string, username string, email string) []string {
+	var (
+		problems                             []string
+		hasUpper, hasLower, hasDigit, hasSym bool
+		length                               = len([]rune(password))
+	)
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSym = true
+		}
+	}
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Password must be at least %d characters long.", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("Password may be at most %d characters long.", p.MaxLength))
+	}
+	if p.RequireMixedCase && !(hasUpper && hasLower) {
+		problems = append(problems, "Password must contain both upper and lower case letters.")
+	}
+	if p.RequireDigit && !hasDigit {
+		problems = append(problems, "Password must contain a digit.")
+	}
+	if p.RequireSymbol && !hasSym {
+		problems = append(problems, "Password must contain a symbol.")
+	}
+	lowered := strings.ToLower(password)
+	if username != "" && strings.Contains(lowered, strings.ToLower(username)) {
+		problems = append(problems, "Password must not contain your username.")
+	} else if local, _, _ := strings.Cut(strings.ToLower(email), "@"); len(local) >= 3 && strings.Contains(lowered, local) {
+		problems = append(problems, "Password must not contain your email address.")
+	}
+	return problems
+}
+
+/*
+Hashes a password with argon2id and returns it in the PHC string format, e.g.
+$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>, so the parameters travel with the hash and can
+be raised later without invalidating existing passwords.
+*/
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, HashParams.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, HashParams.Time, HashParams.Memory, HashParams.Threads, HashParams.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, HashParams.Memory, HashParams.Time, HashParams.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+/*
+Reports whether password matches an encoded hash from HashPassword. The comparison takes
+constant time.
+*/
+func VerifyPassword(password string, encoded string) (bool, error) {
+	var (
+		version int
+		params  Argon2Params
+	)
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return false, errMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errMalformedHash
+	}
+	candidate := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, candidate) == 1, nil
+}
@@ -0,0 +1,164 @@
+package userHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var forgotPage = emailFormPage{
+	Title:  "Forgot your password?",
+	Intro:  "Enter the email address of your account and we'll send you a link to choose a new password.",
+	Action: "/user/password/forgot",
+	Button: "Send link",
+}
+
+/*
+Data for the userResetPassword template.
+*/
+type resetPage struct {
+	Token  string
+	Errors []string
+}
+
+/*
+Emails a link for choosing a new password. The link stops working once the password has
+changed, so it can only be used once.
+*/
+func sendPasswordResetEmail(user User) error {
+	token, err := signEmailToken(purposeResetPassword, user.ID, PasswordResetTTL, fingerprint(user.PasswordHash, strings.ToLower(user.Email)))
+	if err != nil {
+		return err
+	}
+	return sendUserMail(user, "Reset your password", "emailPasswordReset", emailData{
+		Username:  user.Username,
+		Link:      tokenLink(UserPathPrefix+"/password/reset", token),
+		ExpiresIn: humanDuration(PasswordResetTTL),
+	})
+}
+
+/*
+Asks for the email address to send a reset link to. Like ResendVerificationHandler it answers
+the same way whether or not there is such an account.
+*/
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		renderUserPage(w, http.StatusOK, "userEmailForm", forgotPage)
+		return
+	}
+	email, isJSON := postedEmail(r)
+	user, err := findUser(email)
+	if err == nil && strings.EqualFold(user.Email, email) {
+		err = sendPasswordResetEmail(user)
+		log.Printf("userHandler.ForgotPasswordHandler; password reset requested for [%v] from [%v].", user.Username, r.RemoteAddr)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("userHandler.ForgotPasswordHandler; sending reset link to [%v] failed. Error: %v", email, err)
+	}
+	page := forgotPage
+	page.Message = "If that address belongs to an account, a link to reset the password is on its way."
+	emailFormDone(w, isJSON, page)
+}
+
+/*
+Follows the link from the reset email: GET shows the form, POST sets the new password. Setting
+it also confirms the email address, ends every session and revokes every refresh token.
+JSON clients post {"Token","Password"}.
+*/
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			Token    string
+			Password string
+		}
+		isJSON = isJSONRequest(r)
+	)
+	if r.Method == "GET" {
+		req.Token = r.URL.Query().Get("token")
+	} else if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Token, req.Password = r.FormValue("token"), r.FormValue("password")
+	}
+	user, err := resetTokenUser(req.Token)
+	if err == errBadEmailToken {
+		if isJSON {
+			http.Error(w, "This reset link is invalid or has expired.", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/login.html?error=resetlink", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Printf("userHandler.ResetPasswordHandler; checking reset token failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "GET" {
+		renderUserPage(w, http.StatusOK, "userResetPassword", resetPage{Token: req.Token})
+		return
+	}
+	if problems := Policy.Check(req.Password, user.Username, user.Email); len(problems) > 0 {
+		if isJSON {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]FieldErrors{"errors": {"password": problems}})
+			return
+		}
+		renderUserPage(w, http.StatusBadRequest, "userResetPassword", resetPage{Token: req.Token, Errors: problems})
+		return
+	}
+	hash, err := HashPassword(req.Password)
+	if err == nil {
+		// Matching the old hash makes a second use of the same link fail.
+		var result sql.Result
+		result, err = UserDB.Exec(
+			"UPDATE \"Users\" SET \"Password_Hash\"=$1,\"Email_Verified_At\"=COALESCE(\"Email_Verified_At\",now()),\"Failed_Logins\"=0,\"Last_Failed_Login_At\"=NULL,\"Locked_Until\"=NULL,\"Updated_At\"=now() WHERE \"ID\"=$2 AND \"Password_Hash\"=$3",
+			hash, user.ID, user.PasswordHash)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				err = errBadEmailToken
+			}
+		}
+	}
+	if err == nil {
+		err = revokeRefreshTokens(user.ID)
+	}
+	if err == nil && Sessions != nil {
+		err = Sessions.Store.DeleteUser(user.ID)
+	}
+	if err == errBadEmailToken {
+		http.Redirect(w, r, "/login.html?error=resetlink", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Printf("userHandler.ResetPasswordHandler; resetting password of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.ResetPasswordHandler; [%v] reset their password from [%v].", user.Username, r.RemoteAddr)
+	if isJSON {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/login.html?reset=1", http.StatusSeeOther)
+}
+
+/*
+Finds the user a reset token was made for, if the token still matches their account.
+*/
+func resetTokenUser(raw string) (User, error) {
+	token, err := parseEmailToken(raw, purposeResetPassword)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{ID: token.UserID}
+	err = UserDB.QueryRow("SELECT \"Username\",\"Email\",\"Password_Hash\" FROM \"Users\" WHERE \"ID\"=$1", token.UserID).Scan(&user.Username, &user.Email, &user.PasswordHash)
+	if err == sql.ErrNoRows || (err == nil && fingerprint(user.PasswordHash, strings.ToLower(user.Email)) != token.Bind) {
+		return User{}, errBadEmailToken
+	}
+	return user, err
+}
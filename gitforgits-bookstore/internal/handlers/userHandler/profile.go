@@ -0,0 +1,394 @@
+package userHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const maxDisplayNameLength = 64
+
+/*
+What users see and edit about their own account. PendingEmail is a new address waiting for
+its confirmation link to be opened; until then Email stays in use.
+*/
+type Profile struct {
+	ID              int
+	Username        string
+	DisplayName     string
+	Email           string
+	PendingEmail    string
+	EmailVerifiedAt *time.Time
+	HasPassword     bool
+	CreatedAt       time.Time
+	Addresses       []Address
+}
+
+/*
+Data for the userProfile template.
+*/
+type profilePage struct {
+	Profile
+	Errors  FieldErrors
+	Message string
+}
+
+// Shown after a browser is redirected back to the profile with ?done=
+var profileMessages = map[string]string{
+	"name":         "Your display name is saved.",
+	"email":        "We sent a confirmation link to your new address. The change takes effect once you open it.",
+	"emailchanged": "Your email address is changed.",
+	"password":     "Your password is changed and you've been logged out on your other devices.",
+	"address":      "The address is saved.",
+	"deleted":      "The address is deleted.",
+	"default":      "Your default address is updated.",
+}
+
+// Shown after a browser is redirected back to the profile with ?error=
+var profileErrors = map[string]string{
+	"emaillink":  "That confirmation link is invalid, has expired or was already used.",
+	"emailtaken": "Another account started using that email address in the meantime.",
+}
+
+func registerProfileHandlers(sr *mux.Router) {
+	sr.HandleFunc("/email/confirm", ConfirmEmailChangeHandler).Methods("GET")
+	pr := sr.PathPrefix("/profile").Subrouter()
+	pr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequireInteractive)
+	pr.HandleFunc("", UserProfileHandler).Methods("GET", "POST", "PUT")
+	pr.HandleFunc("/email", ChangeEmail).Methods("POST")
+	pr.HandleFunc("/password", ChangePassword).Methods("POST")
+	registerAddressHandlers(pr)
+}
+
+/*
+Handles user profile actions. GET shows the profile with the address book; POST or PUT
+changes the display name, posted as the display_name field or as {"DisplayName"}.
+*/
+func UserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	profile, err := loadProfile(user.ID)
+	if err != nil {
+		log.Printf("userHandler.UserProfileHandler; loading profile of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	page := profilePage{Profile: profile, Errors: FieldErrors{}}
+	if r.Method == "GET" {
+		page.Message = profileMessages[r.URL.Query().Get("done")]
+		if problem, ok := profileErrors[r.URL.Query().Get("error")]; ok {
+			page.Errors.Add("email", problem)
+		}
+		respondProfile(w, r, http.StatusOK, page)
+		return
+	}
+	var req struct{ DisplayName string }
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.DisplayName = r.FormValue("display_name")
+	}
+	name := strings.TrimSpace(req.DisplayName)
+	if problem := checkDisplayName(name); problem != "" {
+		page.Errors.Add("display_name", problem)
+		respondProfile(w, r, http.StatusBadRequest, page)
+		return
+	}
+	if _, err := UserDB.Exec("UPDATE \"Users\" SET \"Display_Name\"=NULLIF($2,''),\"Updated_At\"=now() WHERE \"ID\"=$1", user.ID, name); err != nil {
+		log.Printf("userHandler.UserProfileHandler; saving display name of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	profileDone(w, r, user.ID, "name")
+}
+
+/*
+Starts changing the email address. The new address gets a confirmation link and only
+replaces the old one once it is opened. Posted as email and password fields, or as
+{"Email","Password"}; the current password is needed unless the account has none.
+*/
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string
+		Password string
+	}
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Email, req.Password = r.FormValue("email"), r.FormValue("password")
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	profile, err := loadProfile(user.ID)
+	if err != nil {
+		log.Printf("userHandler.ChangeEmail; loading profile of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	page := profilePage{Profile: profile, Errors: FieldErrors{}}
+	email := strings.TrimSpace(req.Email)
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		page.Errors.Add("email", "Enter a valid email address, like reader@example.com.")
+	} else if strings.EqualFold(email, profile.Email) {
+		page.Errors.Add("email", "That is already your email address.")
+	}
+	if len(page.Errors) > 0 {
+		respondProfile(w, r, http.StatusBadRequest, page)
+		return
+	}
+	if !checkCurrentPassword(w, r, user.ID, req.Password, page) {
+		return
+	}
+	var taken bool
+	err = UserDB.QueryRow("SELECT EXISTS(SELECT 1 FROM \"Users\" WHERE lower(\"Email\")=lower($1) AND \"ID\"<>$2)", email, user.ID).Scan(&taken)
+	if err == nil && taken {
+		page.Errors.Add("email", "An account with that email address already exists.")
+		respondProfile(w, r, http.StatusConflict, page)
+		return
+	}
+	if err == nil {
+		_, err = UserDB.Exec("UPDATE \"Users\" SET \"Pending_Email\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", user.ID, email)
+	}
+	if err == nil {
+		err = sendEmailChangeLink(User{ID: user.ID, Username: user.Username}, email)
+	}
+	if err != nil {
+		log.Printf("userHandler.ChangeEmail; starting email change for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.ChangeEmail; [%v] asked to change their email address.", user.Username)
+	profileDone(w, r, user.ID, "email")
+}
+
+/*
+Emails the confirmation link for an email change to the new address.
+*/
+func sendEmailChangeLink(user User, newEmail string) error {
+	token, err := signEmailToken(purposeChangeEmail, user.ID, VerifyEmailTTL, fingerprint(strings.ToLower(newEmail)))
+	if err != nil {
+		return err
+	}
+	user.Email = newEmail
+	return sendUserMail(user, "Confirm your new email address", "emailChange", emailData{
+		Username:  user.Username,
+		Link:      tokenLink(UserPathPrefix+"/email/confirm", token),
+		ExpiresIn: humanDuration(VerifyEmailTTL),
+	})
+}
+
+/*
+Follows the link from an email change. The link only works for the address it was sent to,
+and only while that is still the pending address. The old address is told about the change.
+*/
+func ConfirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    User
+		pending sql.NullString
+	)
+	token, err := parseEmailToken(r.URL.Query().Get("token"), purposeChangeEmail)
+	if err == nil {
+		user.ID = token.UserID
+		err = UserDB.QueryRow("SELECT \"Username\",\"Email\",\"Pending_Email\" FROM \"Users\" WHERE \"ID\"=$1", token.UserID).Scan(&user.Username, &user.Email, &pending)
+		if err == sql.ErrNoRows || (err == nil && (!pending.Valid || fingerprint(strings.ToLower(pending.String)) != token.Bind)) {
+			err = errBadEmailToken
+		}
+	}
+	if err == nil {
+		_, err = UserDB.Exec(
+			"UPDATE \"Users\" SET \"Email\"=\"Pending_Email\",\"Pending_Email\"=NULL,\"Email_Verified_At\"=now(),\"Updated_At\"=now() WHERE \"ID\"=$1 AND \"Pending_Email\"=$2",
+			user.ID, pending.String)
+	}
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		http.Redirect(w, r, UserPathPrefix+"/profile?error=emailtaken", http.StatusSeeOther)
+	case err == errBadEmailToken:
+		http.Redirect(w, r, UserPathPrefix+"/profile?error=emaillink", http.StatusSeeOther)
+	case err != nil:
+		log.Printf("userHandler.ConfirmEmailChangeHandler; changing email of user [%v] failed. Error: %v", token.UserID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+	default:
+		log.Printf("userHandler.ConfirmEmailChangeHandler; [%v] changed their email address.", user.Username)
+		if err := sendUserMail(user, "Your email address was changed", "emailChanged", emailData{Username: user.Username}); err != nil {
+			log.Printf("userHandler.ConfirmEmailChangeHandler; telling the old address of [%v] failed. Error: %v", user.Username, err)
+		}
+		http.Redirect(w, r, UserPathPrefix+"/profile?done=emailchanged", http.StatusSeeOther)
+	}
+}
+
+/*
+Changes the password. Posted as current_password and new_password fields, or as
+{"CurrentPassword","NewPassword"}. Every other session and refresh token is ended; a browser
+gets a fresh session so it stays logged in.
+*/
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CurrentPassword string
+		NewPassword     string
+	}
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.CurrentPassword, req.NewPassword = r.FormValue("current_password"), r.FormValue("new_password")
+	}
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	profile, err := loadProfile(user.ID)
+	if err != nil {
+		log.Printf("userHandler.ChangePassword; loading profile of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	page := profilePage{Profile: profile, Errors: FieldErrors{}}
+	if problems := Policy.Check(req.NewPassword, profile.Username, profile.Email); len(problems) > 0 {
+		page.Errors.Add("new_password", problems...)
+		respondProfile(w, r, http.StatusBadRequest, page)
+		return
+	}
+	if !checkCurrentPassword(w, r, user.ID, req.CurrentPassword, page) {
+		return
+	}
+	hash, err := HashPassword(req.NewPassword)
+	if err == nil {
+		_, err = UserDB.Exec("UPDATE \"Users\" SET \"Password_Hash\"=$2,\"Updated_At\"=now() WHERE \"ID\"=$1", user.ID, hash)
+	}
+	if err == nil {
+		err = revokeRefreshTokens(user.ID)
+	}
+	if err == nil && Sessions != nil {
+		_, cookieErr := r.Cookie(Sessions.CookieName)
+		if err = Sessions.Store.DeleteUser(user.ID); err == nil && cookieErr == nil {
+			_, err = Sessions.Start(w, r, user.ID)
+		}
+	}
+	if err != nil {
+		log.Printf("userHandler.ChangePassword; changing password of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.ChangePassword; [%v] changed their password from [%v].", user.Username, r.RemoteAddr)
+	profileDone(w, r, user.ID, "password")
+}
+
+/*
+Checks the current password before a sensitive change, counting wrong ones like failed
+logins. Accounts without a password (signed up through a login provider) pass. Reports
+whether to go on; if not, the answer has been written.
+*/
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, userID int, password string, page profilePage) bool {
+	user := User{ID: userID}
+	err := UserDB.QueryRow(
+		"SELECT \"Username\",\"Password_Hash\",\"Failed_Logins\",\"Last_Failed_Login_At\",\"Locked_Until\" FROM \"Users\" WHERE \"ID\"=$1",
+		userID).Scan(&user.Username, &user.PasswordHash, &user.FailedLogins, &user.LastFailedLoginAt, &user.LockedUntil)
+	if err == nil && user.PasswordHash == "" {
+		return true
+	}
+	var throttled *throttledError
+	if err == nil && errors.As(checkLoginThrottle(user, clientIP(r)), &throttled) {
+		w.Header().Set("Retry-After", retryAfter(throttled.RetryAfter))
+		page.Errors.Add("password", throttledMessage(throttled))
+		respondProfile(w, r, http.StatusTooManyRequests, page)
+		return false
+	}
+	var ok bool
+	if err == nil {
+		ok, err = VerifyPassword(password, user.PasswordHash)
+	}
+	if err != nil {
+		log.Printf("userHandler.checkCurrentPassword; checking password of user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		log.Printf("userHandler.checkCurrentPassword; wrong current password for [%v] from [%v].", user.Username, r.RemoteAddr)
+		recordLoginFailure(userID, clientIP(r))
+		page.Errors.Add("password", "Your current password is incorrect.")
+		respondProfile(w, r, http.StatusForbidden, page)
+		return false
+	}
+	return true
+}
+
+func checkDisplayName(name string) string {
+	if len([]rune(name)) > maxDisplayNameLength {
+		return "Display names can be up to 64 characters long."
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return "Display names can't contain control characters."
+		}
+	}
+	return ""
+}
+
+func loadProfile(userID int) (Profile, error) {
+	var (
+		profile              = Profile{ID: userID}
+		displayName, pending sql.NullString
+		hash                 string
+	)
+	err := UserDB.QueryRow(
+		"SELECT \"Username\",\"Display_Name\",\"Email\",\"Pending_Email\",\"Email_Verified_At\",\"Password_Hash\",\"Created_At\" FROM \"Users\" WHERE \"ID\"=$1",
+		userID).Scan(&profile.Username, &displayName, &profile.Email, &pending, &profile.EmailVerifiedAt, &hash, &profile.CreatedAt)
+	if err != nil {
+		return profile, err
+	}
+	profile.DisplayName, profile.PendingEmail, profile.HasPassword = displayName.String, pending.String, hash != ""
+	profile.Addresses, err = listAddresses(userID)
+	return profile, err
+}
+
+/*
+Answers with the profile as JSON, or as the userProfile page for browsers. Problems go to
+JSON clients as {"errors":{...}} like on registration.
+*/
+func respondProfile(w http.ResponseWriter, r *http.Request, status int, page profilePage) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if len(page.Errors) > 0 {
+			json.NewEncoder(w).Encode(map[string]FieldErrors{"errors": page.Errors})
+			return
+		}
+		json.NewEncoder(w).Encode(page.Profile)
+		return
+	}
+	renderUserPage(w, status, "userProfile", page)
+}
+
+/*
+Finishes a successful change: browsers go back to the profile page, JSON clients get the
+updated profile.
+*/
+func profileDone(w http.ResponseWriter, r *http.Request, userID int, done string) {
+	if !isJSONRequest(r) {
+		http.Redirect(w, r, UserPathPrefix+"/profile?done="+done, http.StatusSeeOther)
+		return
+	}
+	profile, err := loadProfile(userID)
+	if err != nil {
+		log.Printf("userHandler.profileDone; loading profile of user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respondProfile(w, r, http.StatusOK, profilePage{Profile: profile})
+}
@@ -0,0 +1,156 @@
+package userHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var AdminPathPrefix string = "/admin/users"
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+/*
+Gets the roles of a user. Every user is a customer; staff and admin are granted in "User_Roles".
+*/
+func userRoles(db queryer, userID int) ([]string, error) {
+	roles := []string{mAuthorize.RoleCustomer}
+	rows, err := db.Query("SELECT \"Role\" FROM \"User_Roles\" WHERE \"User_ID\"=$1 ORDER BY \"Role\"", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+/*
+Registers the role administration routes. Only users with the users:manage permission get in.
+*/
+func RegisterAdminHandlers(r *mux.Router) {
+	sr := r.PathPrefix(AdminPathPrefix).Subrouter()
+	sr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequirePermission(mAuthorize.PermUsersManage))
+	sr.HandleFunc("/{id:[0-9]+}/roles", GetUserRoles).Methods("GET")
+	sr.HandleFunc("/{id:[0-9]+}/roles", SetUserRoles).Methods("PUT", "POST")
+}
+
+/*
+Gets the roles of a user as {"UserID", "Roles"}.
+*/
+func GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if !userExists(w, userID, "userHandler.GetUserRoles") {
+		return
+	}
+	roles, err := userRoles(UserDB, userID)
+	if err != nil {
+		log.Printf("userHandler.GetUserRoles; loading roles of user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeRoles(w, userID, roles)
+}
+
+/*
+Replaces the roles of a user. JSON clients send {"Roles": ["staff"]}, forms send one role
+field per role. The customer role cannot be taken away, and admins cannot remove their own
+admin role so the shop is never left without one by accident.
+*/
+func SetUserRoles(w http.ResponseWriter, r *http.Request) {
+	var (
+		userID, _ = strconv.Atoi(mux.Vars(r)["id"])
+		req       struct{ Roles []string }
+		granted   []string
+	)
+	admin, _ := mAuthenticate.UserFromContext(r.Context())
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		r.ParseForm()
+		req.Roles = r.Form["role"]
+	default:
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+	seen := map[string]bool{}
+	for _, role := range req.Roles {
+		if !mAuthorize.ValidRole(role) {
+			http.Error(w, fmt.Sprintf("Unknown role %q.", role), http.StatusBadRequest)
+			return
+		}
+		if role != mAuthorize.RoleCustomer && !seen[role] {
+			seen[role] = true
+			granted = append(granted, role)
+		}
+	}
+	sort.Strings(granted)
+	if admin.ID == userID && !seen[mAuthorize.RoleAdmin] {
+		http.Error(w, "You can't remove your own admin role.", http.StatusConflict)
+		return
+	}
+	if !userExists(w, userID, "userHandler.SetUserRoles") {
+		return
+	}
+	tx, err := UserDB.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec("DELETE FROM \"User_Roles\" WHERE \"User_ID\"=$1 AND NOT (\"Role\"=ANY($2))", userID, pq.Array(granted))
+	}
+	if err == nil {
+		_, err = tx.Exec(
+			"INSERT INTO \"User_Roles\"(\"User_ID\",\"Role\",\"Granted_By\") SELECT $1,unnest($2::text[]),$3 ON CONFLICT DO NOTHING",
+			userID, pq.Array(granted), admin.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("userHandler.SetUserRoles; saving roles %v of user [%v] failed. Error: %v", granted, userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.SetUserRoles; [%v] set roles of user [%v] to %v", admin.Username, userID, granted)
+	writeRoles(w, userID, append([]string{mAuthorize.RoleCustomer}, granted...))
+}
+
+func userExists(w http.ResponseWriter, userID int, where string) bool {
+	var exists bool
+	if err := UserDB.QueryRow("SELECT EXISTS (SELECT 1 FROM \"Users\" WHERE \"ID\"=$1)", userID).Scan(&exists); err != nil {
+		log.Printf("%v; looking up user [%v] failed. Error: %v", where, userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "User not found.", http.StatusNotFound)
+	}
+	return exists
+}
+
+func writeRoles(w http.ResponseWriter, userID int, roles []string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"UserID": userID, "Roles": roles})
+}
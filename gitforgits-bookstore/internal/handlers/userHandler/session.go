@@ -0,0 +1,255 @@
+package userHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
+)
+
+var Sessions *sessionStore.Manager
+
+/*
+Run once a user has fully logged in, before the response is written, e.g. to merge the cart
+they filled as a guest. Set up by main.
+*/
+var LoginHooks []func(w http.ResponseWriter, r *http.Request, userID int)
+
+// A hash to verify against when the username doesn't exist, so both failures take as long.
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+/*
+Handles user logins. Browsers post the login form and are redirected to the page in "next";
+JSON clients post {"Username","Password"} and get the user back. Either way a new session
+cookie is issued and any previous session on the request is ended. GET with ?provider=<name>
+signs in with an external provider instead.
+*/
+func UserLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			Username string
+			Password string
+			Next     string
+		}
+		isJSON bool
+	)
+	if Sessions == nil {
+		log.Print("userHandler.UserLoginHandler; Sessions is nil.")
+		http.Error(w, "Logging in isn't available right now.", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == "GET" {
+		if provider := r.URL.Query().Get("provider"); provider != "" {
+			startOIDCLogin(w, r, provider)
+			return
+		}
+		if _, err := Sessions.Load(r); err == nil {
+			http.Redirect(w, r, safeNext(r.URL.Query().Get("next")), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/login.html?"+r.URL.RawQuery, http.StatusSeeOther)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		isJSON = true
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid login data.", http.StatusBadRequest)
+			return
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		req.Username = r.FormValue("username")
+		req.Password = r.FormValue("password")
+		req.Next = r.FormValue("next")
+	default:
+		http.Error(w, fmt.Sprintf("Unexpected Content-Type %s", mediaType), http.StatusBadRequest)
+		return
+	}
+	next := safeNext(req.Next)
+
+	user, err := authenticatePassword(req.Username, req.Password, clientIP(r))
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		respondThrottled(w, r, throttled, next, isJSON)
+		return
+	} else if err == errBadCredentials {
+		log.Printf("userHandler.UserLoginHandler; failed login for [%v] from [%v].", req.Username, r.RemoteAddr)
+		if isJSON {
+			http.Error(w, "Incorrect username or password.", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, "/login.html?error=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Printf("userHandler.UserLoginHandler; authenticating [%v] failed. Error: %v", req.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if user.EmailVerifiedAt == nil {
+		log.Printf("userHandler.UserLoginHandler; [%v] hasn't confirmed their email address yet.", user.Username)
+		if isJSON {
+			http.Error(w, "Confirm your email address first. We sent you a link when you registered.", http.StatusForbidden)
+			return
+		}
+		http.Redirect(w, r, "/login.html?error=unverified&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+	log.Printf("userHandler.UserLoginHandler; [%v] logged in from [%v].", user.Username, r.RemoteAddr)
+	beginLogin(w, r, user, next, isJSON)
+}
+
+/*
+Starts the session once a user has proven who they are, and sends them on. Browsers go to next,
+or to two-factor setup if their role requires it and they have none. JSON clients get the user
+and the session token.
+*/
+func finishLogin(w http.ResponseWriter, r *http.Request, user User, next string, isJSON bool) {
+	session, err := Sessions.Start(w, r, user.ID)
+	if err != nil {
+		log.Printf("userHandler.finishLogin; starting session for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	resetLoginFailures(user.ID)
+	for _, hook := range LoginHooks {
+		hook(w, r, user.ID)
+	}
+	setupRequired, err := twoFactorSetupRequired(user.ID)
+	if err != nil {
+		log.Printf("userHandler.finishLogin; checking two-factor policy for [%v] failed. Error: %v", user.Username, err)
+	}
+	if !isJSON {
+		if setupRequired {
+			next = UserPathPrefix + "/2fa?required=1"
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// API clients can't read the HttpOnly cookie, so they get the token to send as a bearer token.
+	json.NewEncoder(w).Encode(map[string]interface{}{"User": user, "Token": session.ID, "ExpiresAt": session.ExpiresAt, "TwoFactorSetupRequired": setupRequired})
+}
+
+/*
+Ends the current session
+*/
+func UserLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if Sessions == nil {
+		http.Error(w, "Logging out isn't available right now.", http.StatusServiceUnavailable)
+		return
+	}
+	if err := Sessions.End(w, r); err != nil {
+		log.Printf("userHandler.UserLogoutHandler; ending session failed. Error: %v", err)
+	}
+	logoutDone(w, r)
+}
+
+/*
+Ends every session of the current user, on every device, and revokes their refresh tokens
+*/
+func UserLogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if Sessions == nil {
+		http.Error(w, "Logging out isn't available right now.", http.StatusServiceUnavailable)
+		return
+	}
+	user, ok := mAuthenticate.UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "You are not logged in.", http.StatusUnauthorized)
+		return
+	}
+	if err := revokeRefreshTokens(user.ID); err != nil {
+		log.Printf("userHandler.UserLogoutAllHandler; revoking refresh tokens of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	err := Sessions.EndAll(w, r)
+	if sessionStore.IsNotFound(err) {
+		// Signed in with a bearer token rather than the session cookie.
+		err = Sessions.Store.DeleteUser(user.ID)
+	}
+	if err != nil {
+		log.Printf("userHandler.UserLogoutAllHandler; ending sessions failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	logoutDone(w, r)
+}
+
+func logoutDone(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/login.html?loggedout=1", http.StatusSeeOther)
+}
+
+var errBadCredentials = errors.New("incorrect username or password")
+
+/*
+Looks a user up by username or email and checks the password. Unknown users and wrong
+passwords both return errBadCredentials, after the same amount of hashing work. While the
+account or the client address ip is throttled the password isn't checked at all and a
+*throttledError comes back instead.
+*/
+func authenticatePassword(login string, password string, ip string) (User, error) {
+	user, err := findUser(strings.TrimSpace(login))
+	if err == nil && user.PasswordHash == "" {
+		// Signed up through a login provider and never set a password
+		err = sql.ErrNoRows
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return User{}, err
+	}
+	if throttleErr := checkLoginThrottle(user, ip); throttleErr != nil {
+		return User{}, throttleErr
+	}
+	if err == sql.ErrNoRows {
+		dummyHashOnce.Do(func() { dummyHash, _ = HashPassword("not a real password") })
+		VerifyPassword(password, dummyHash)
+		recordLoginFailure(0, ip)
+		return User{}, errBadCredentials
+	}
+	ok, err := VerifyPassword(password, user.PasswordHash)
+	if err != nil {
+		return User{}, err
+	}
+	if !ok {
+		recordLoginFailure(user.ID, ip)
+		return User{}, errBadCredentials
+	}
+	return user, nil
+}
+
+/*
+Finds a user by username or email address, ignoring case.
+*/
+func findUser(login string) (User, error) {
+	var user User
+	err := UserDB.QueryRow(
+		"SELECT \"ID\",\"Username\",\"Email\",\"Password_Hash\",\"Email_Verified_At\",\"Failed_Logins\",\"Last_Failed_Login_At\",\"Locked_Until\",\"Created_At\" FROM \"Users\" WHERE lower(\"Username\")=lower($1) OR lower(\"Email\")=lower($1)",
+		login).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt, &user.FailedLogins, &user.LastFailedLoginAt, &user.LockedUntil, &user.CreatedAt)
+	return user, err
+}
+
+/*
+Only allows redirects to paths on this site, so "next" can't bounce users somewhere else.
+*/
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
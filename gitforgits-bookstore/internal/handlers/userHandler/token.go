@@ -0,0 +1,314 @@
+package userHandler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flintg/gitforgits-bookstore/jwtToken"
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
+)
+
+/*
+Signs the short-lived access tokens handed to API clients. Nil turns the token endpoint off.
+*/
+var Tokens *jwtToken.Signer
+
+var RefreshTTL time.Duration = 30 * 24 * time.Hour
+
+var (
+	errInvalidGrant    = errors.New("invalid grant")
+	errEmailUnverified = errors.New("email address not confirmed")
+)
+
+/*
+The token endpoint, shaped after OAuth 2.0 (RFC 6749) so standard client libraries work.
+Clients post either grant_type=password with username and password (and otp, the current
+two-factor code, if the user has two-factor authentication), or
+grant_type=refresh_token with refresh_token, as a form or as JSON. The answer carries a new
+access token and a new refresh token; a refresh token can only be used once.
+*/
+func UserTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		GrantType    string `json:"grant_type"`
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		RefreshToken string `json:"refresh_token"`
+		OTP          string `json:"otp"`
+	}
+	if Tokens == nil {
+		log.Print("userHandler.UserTokenHandler; Tokens is nil.")
+		http.Error(w, "Tokens aren't available right now.", http.StatusServiceUnavailable)
+		return
+	}
+	if !decodeTokenRequest(w, r, &req, map[string]*string{
+		"grant_type": &req.GrantType, "username": &req.Username, "password": &req.Password, "refresh_token": &req.RefreshToken, "otp": &req.OTP,
+	}) {
+		return
+	}
+	var (
+		userID  int
+		refresh string // the rotated token, for the refresh_token grant
+		err     error
+	)
+	switch req.GrantType {
+	case "password":
+		var user User
+		user, err = authenticatePassword(req.Username, req.Password, clientIP(r))
+		if err == errBadCredentials {
+			log.Printf("userHandler.UserTokenHandler; failed login for [%v] from [%v].", req.Username, r.RemoteAddr)
+			err = errInvalidGrant
+		}
+		if err == nil && user.EmailVerifiedAt == nil {
+			err = errEmailUnverified
+		}
+		if err == nil {
+			err = checkTokenSecondFactor(user, req.OTP)
+			if err == errSecondFactor {
+				recordLoginFailure(user.ID, clientIP(r))
+			}
+		}
+		if err == nil {
+			resetLoginFailures(user.ID)
+		}
+		userID = user.ID
+	case "refresh_token":
+		userID, refresh, err = useRefreshToken(req.RefreshToken, r.UserAgent())
+	default:
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", retryAfter(throttled.RetryAfter))
+		tokenError(w, http.StatusTooManyRequests, "invalid_grant", throttledMessage(throttled))
+		return
+	} else if err == errInvalidGrant {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	} else if err == errEmailUnverified {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "Confirm your email address first.")
+		return
+	} else if err == errSecondFactor {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "A valid two-factor code is required in otp.")
+		return
+	} else if err != nil {
+		log.Printf("userHandler.UserTokenHandler; %v grant failed. Error: %v", req.GrantType, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	access, expires, err := Tokens.Issue(strconv.Itoa(userID))
+	if err != nil {
+		log.Printf("userHandler.UserTokenHandler; signing access token for user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if refresh == "" {
+		refresh, err = createRefreshToken(UserDB, userID, nil, r.UserAgent())
+	}
+	if err != nil {
+		log.Printf("userHandler.UserTokenHandler; storing refresh token for user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Until(expires).Seconds()),
+		"refresh_token": refresh,
+	})
+}
+
+/*
+Revokes a refresh token, and every token refreshed from the same login, as in RFC 7009.
+Unknown tokens are not an error, so the answer says nothing about which tokens exist.
+*/
+func UserTokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if !decodeTokenRequest(w, r, &req, map[string]*string{"token": &req.Token}) {
+		return
+	}
+	_, err := UserDB.Exec(
+		"UPDATE \"Refresh_Tokens\" SET \"Revoked_At\"=now() WHERE \"Revoked_At\" IS NULL AND \"Family_ID\"=(SELECT \"Family_ID\" FROM \"Refresh_Tokens\" WHERE \"Token_Hash\"=$1)",
+		sessionStore.HashID(req.Token))
+	if err != nil {
+		log.Printf("userHandler.UserTokenRevokeHandler; revoking failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func decodeTokenRequest(w http.ResponseWriter, r *http.Request, req interface{}, fields map[string]*string) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			tokenError(w, http.StatusBadRequest, "invalid_request", "")
+			return false
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		for name, field := range fields {
+			*field = r.PostFormValue(name)
+		}
+	default:
+		tokenError(w, http.StatusBadRequest, "invalid_request", "")
+		return false
+	}
+	return true
+}
+
+func tokenError(w http.ResponseWriter, status int, code string, description string) {
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+/*
+Stores a new refresh token for userID and returns it. A nil family starts a new one.
+*/
+func createRefreshToken(db execer, userID int, family []byte, userAgent string) (string, error) {
+	if family == nil {
+		family = make([]byte, 16)
+		if _, err := rand.Read(family); err != nil {
+			return "", err
+		}
+	}
+	token, err := sessionStore.NewID()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO \"Refresh_Tokens\"(\"Token_Hash\",\"Family_ID\",\"User_ID\",\"Expires_At\",\"User_Agent\") VALUES($1,$2,$3,$4,$5)",
+		sessionStore.HashID(token), family, userID, time.Now().Add(RefreshTTL), userAgent)
+	return token, err
+}
+
+/*
+Marks a refresh token as used and returns its user and the token that replaces it, stored in
+the same transaction so a failure can't leave the login without one. Presenting a token that
+was already used or revoked means it has leaked, so the whole family is revoked.
+*/
+func useRefreshToken(token string, userAgent string) (int, string, error) {
+	var (
+		userID    int
+		family    []byte
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+	)
+	tx, err := UserDB.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		"SELECT \"User_ID\",\"Family_ID\",\"Expires_At\",\"Used_At\",\"Revoked_At\" FROM \"Refresh_Tokens\" WHERE \"Token_Hash\"=$1 FOR UPDATE",
+		sessionStore.HashID(token)).Scan(&userID, &family, &expiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", errInvalidGrant
+	} else if err != nil {
+		return 0, "", err
+	}
+	if usedAt.Valid || revokedAt.Valid {
+		if !revokedAt.Valid {
+			log.Printf("userHandler.useRefreshToken; refresh token of user [%v] was used twice, revoking its family.", userID)
+		}
+		if _, err := tx.Exec("UPDATE \"Refresh_Tokens\" SET \"Revoked_At\"=now() WHERE \"Family_ID\"=$1 AND \"Revoked_At\" IS NULL", family); err != nil {
+			return 0, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return 0, "", errInvalidGrant
+	}
+	if !time.Now().Before(expiresAt) {
+		return 0, "", errInvalidGrant
+	}
+	if _, err := tx.Exec("UPDATE \"Refresh_Tokens\" SET \"Used_At\"=now() WHERE \"Token_Hash\"=$1", sessionStore.HashID(token)); err != nil {
+		return 0, "", err
+	}
+	next, err := createRefreshToken(tx, userID, family, userAgent)
+	if err != nil {
+		return 0, "", err
+	}
+	return userID, next, tx.Commit()
+}
+
+/*
+Revokes every refresh token of a user, e.g. when they log out everywhere.
+*/
+func revokeRefreshTokens(userID int) error {
+	_, err := UserDB.Exec("UPDATE \"Refresh_Tokens\" SET \"Revoked_At\"=now() WHERE \"User_ID\"=$1 AND \"Revoked_At\" IS NULL", userID)
+	return err
+}
+
+/*
+Deletes expired refresh tokens and two-factor login challenges every interval until stop is
+called. Revoked tokens are kept until they expire so a replayed token is still recognised.
+*/
+func StartTokenCleanup(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if _, err := UserDB.Exec("DELETE FROM \"Refresh_Tokens\" WHERE \"Expires_At\"<now()"); err != nil {
+				log.Printf("userHandler.StartTokenCleanup; deleting expired refresh tokens failed. Error: %v", err)
+			}
+			if _, err := UserDB.Exec("DELETE FROM \"Login_Challenges\" WHERE \"Expires_At\"<now()"); err != nil {
+				log.Printf("userHandler.StartTokenCleanup; deleting expired login challenges failed. Error: %v", err)
+			}
+			ipFailures.prune(time.Now())
+		}
+	}()
+	return func() { close(done) }
+}
+
+/*
+Identifies API clients by a signed access token in "Authorization: Bearer <jwt>". Bearer
+tokens that aren't JWTs are left to the SessionAuthenticator.
+*/
+type JWTAuthenticator struct{}
+
+func (JWTAuthenticator) Authenticate(r *http.Request) (*mAuthenticate.User, error) {
+	token, ok := mAuthenticate.BearerToken(r)
+	if !ok || Tokens == nil || !jwtToken.LooksLikeJWT(token) {
+		return nil, mAuthenticate.ErrNoCredentials
+	}
+	claims, err := Tokens.Parse(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", mAuthenticate.ErrInvalidCredentials, err)
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, mAuthenticate.ErrInvalidCredentials
+	}
+	return loadAuthUser(userID)
+}
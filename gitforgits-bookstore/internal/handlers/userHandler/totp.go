@@ -0,0 +1,132 @@
+package userHandler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+Time-based one-time passwords as in RFC 6238, with the parameters every authenticator app
+understands: SHA-1, 6 digits, 30 second steps.
+*/
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1 // steps either side of now we accept, for clocks that drift
+)
+
+var TwoFactorIssuer string = "GitforGits Bookstore"
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/*
+Makes a new random secret, base32 encoded the way authenticator apps expect.
+*/
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPad.EncodeToString(b), nil
+}
+
+/*
+The otpauth:// URI an authenticator app scans from the QR code.
+*/
+func totpURI(secret string, account string) string {
+	label := url.PathEscape(TwoFactorIssuer + ":" + account)
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {TwoFactorIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	// Some authenticator apps show a "+" literally, so spaces are encoded as %20
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+/*
+The code for secret at a time step (RFC 4226 HOTP with the step as counter).
+*/
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+/*
+Checks code against secret around now. It returns the matching step, which must be later than
+lastStep so a code can't be used twice.
+*/
+func verifyTOTP(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+/*
+Makes n recovery codes like "k7rq-2mxa-9fw3". Each one works once, for when the phone is lost.
+*/
+func newRecoveryCodes(n int) ([]string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz023456789" // 32 letters, no i, l, o or 1
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		var sb strings.Builder
+		for j, c := range b {
+			if j > 0 && j%4 == 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteByte(alphabet[int(c)%len(alphabet)])
+		}
+		codes[i] = sb.String()
+	}
+	return codes, nil
+}
+
+/*
+Recovery codes are stored hashed. Case, spaces and dashes don't matter when typing them in.
+*/
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(normalized))
+	return sum[:]
+}
@@ -0,0 +1,646 @@
+package userHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mAuthorize"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/skip2/go-qrcode"
+)
+
+/*
+Roles that must use two-factor authentication. Until someone with one of these roles has set
+it up they are treated as a customer.
+*/
+var TwoFactorRoles = []string{mAuthorize.RoleStaff, mAuthorize.RoleAdmin}
+
+var RecoveryCodeCount int = 10
+var LoginChallengeTTL time.Duration = 5 * time.Minute
+
+const (
+	twoFactorCookieName  = "gfg_2fa"
+	maxChallengeAttempts = 5
+)
+
+var errSecondFactor = errors.New("a valid two-factor code is required")
+
+/*
+Data for the userTwoFactor template.
+*/
+type twoFactorPage struct {
+	Enabled           bool
+	Pending           bool // a secret has been made but not confirmed with a code yet
+	Required          bool
+	URI               string
+	Secret            string
+	RecoveryCodes     []string // only right after they were made
+	RecoveryCodesLeft int
+	Error             string
+}
+
+func registerTwoFactorHandlers(sr *mux.Router) {
+	sr.HandleFunc("/login/2fa", UserLoginTwoFactorHandler).Methods("GET", "POST")
+	tr := sr.PathPrefix("/2fa").Subrouter()
+	tr.Use(mAuthenticate.AuthenticationMiddleware, mAuthorize.RequireInteractive)
+	tr.HandleFunc("", GetTwoFactor).Methods("GET")
+	tr.HandleFunc("/setup", SetupTwoFactor).Methods("POST")
+	tr.HandleFunc("/qr.png", GetTwoFactorQRCode).Methods("GET")
+	tr.HandleFunc("/confirm", ConfirmTwoFactor).Methods("POST")
+	tr.HandleFunc("/recovery-codes", RegenerateRecoveryCodes).Methods("POST")
+	tr.HandleFunc("/disable", DisableTwoFactor).Methods("POST")
+}
+
+func requiresTwoFactor(roles []string) bool {
+	for _, role := range roles {
+		for _, required := range TwoFactorRoles {
+			if role == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Reports whether the user has confirmed two-factor authentication, and returns the secret of
+an enrollment that is waiting for its first code.
+*/
+func twoFactorState(userID int) (enabled bool, pendingSecret string, err error) {
+	var (
+		secret    string
+		confirmed sql.NullTime
+	)
+	err = UserDB.QueryRow("SELECT \"Secret\",\"Confirmed_At\" FROM \"User_TOTP\" WHERE \"User_ID\"=$1", userID).Scan(&secret, &confirmed)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+	if confirmed.Valid {
+		return true, "", nil
+	}
+	return false, secret, nil
+}
+
+/*
+Reports whether the user's roles require two-factor authentication they haven't set up.
+*/
+func twoFactorSetupRequired(userID int) (bool, error) {
+	roles, err := userRoles(UserDB, userID)
+	if err != nil || !requiresTwoFactor(roles) {
+		return false, err
+	}
+	enabled, _, err := twoFactorState(userID)
+	return !enabled, err
+}
+
+/*
+Checks a code from the authenticator app, or failing that a recovery code, which is then used
+up. Authenticator codes can't be used twice either.
+*/
+func verifySecondFactor(userID int, code string) (bool, error) {
+	var (
+		secret   string
+		lastStep int64
+	)
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	tx, err := UserDB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		"SELECT \"Secret\",\"Last_Step\" FROM \"User_TOTP\" WHERE \"User_ID\"=$1 AND \"Confirmed_At\" IS NOT NULL FOR UPDATE",
+		userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if step, ok := verifyTOTP(secret, code, time.Now(), lastStep); ok {
+		if _, err := tx.Exec("UPDATE \"User_TOTP\" SET \"Last_Step\"=$1 WHERE \"User_ID\"=$2", step, userID); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+	result, err := tx.Exec(
+		"UPDATE \"User_Recovery_Codes\" SET \"Used_At\"=now() WHERE \"User_ID\"=$1 AND \"Code_Hash\"=$2 AND \"Used_At\" IS NULL",
+		userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	log.Printf("userHandler.verifySecondFactor; user [%v] used a recovery code.", userID)
+	return true, tx.Commit()
+}
+
+/*
+For the token endpoint: users with two-factor authentication must send a code with their
+password.
+*/
+func checkTokenSecondFactor(user User, code string) error {
+	enabled, _, err := twoFactorState(user.ID)
+	if err != nil || !enabled {
+		return err
+	}
+	ok, err := verifySecondFactor(user.ID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errSecondFactor
+	}
+	return nil
+}
+
+/*
+Continues a login after the password (or external provider) has checked out. Users with
+two-factor authentication get a short-lived challenge to answer with a code first; everyone
+else is logged in straight away.
+*/
+func beginLogin(w http.ResponseWriter, r *http.Request, user User, next string, isJSON bool) {
+	enabled, _, err := twoFactorState(user.ID)
+	if err != nil {
+		log.Printf("userHandler.beginLogin; checking two-factor state of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		finishLogin(w, r, user, next, isJSON)
+		return
+	}
+	challenge, err := sessionStore.NewID()
+	expires := time.Now().Add(LoginChallengeTTL)
+	if err == nil {
+		_, err = UserDB.Exec(
+			"INSERT INTO \"Login_Challenges\"(\"ID_Hash\",\"User_ID\",\"Next\",\"Expires_At\") VALUES($1,$2,$3,$4)",
+			sessionStore.HashID(challenge), user.ID, next, expires)
+	}
+	if err != nil {
+		log.Printf("userHandler.beginLogin; creating login challenge for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"TwoFactorRequired": true, "Challenge": challenge, "ExpiresAt": expires})
+		return
+	}
+	setTwoFactorCookie(w, challenge, LoginChallengeTTL)
+	http.Redirect(w, r, UserPathPrefix+"/login/2fa", http.StatusSeeOther)
+}
+
+func setTwoFactorCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     twoFactorCookieName,
+		Value:    value,
+		Path:     UserPathPrefix + "/login",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   Sessions.Secure,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if maxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+/*
+The second login step. Browsers get a form for the code; the challenge travels in a cookie.
+JSON clients post {"Challenge","Code"} with the challenge from the login answer. The code can
+be from the authenticator app or a recovery code.
+*/
+func UserLoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			Challenge string
+			Code      string
+		}
+		isJSON   bool
+		userID   int
+		next     string
+		attempts int
+	)
+	if Sessions == nil {
+		http.Error(w, "Logging in isn't available right now.", http.StatusServiceUnavailable)
+		return
+	}
+	if cookie, err := r.Cookie(twoFactorCookieName); err == nil {
+		req.Challenge = cookie.Value
+	}
+	if r.Method == "GET" {
+		if req.Challenge == "" {
+			http.Redirect(w, r, "/login.html", http.StatusSeeOther)
+			return
+		}
+		renderTwoFactorLogin(w, http.StatusOK, "")
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		isJSON = true
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Request body is not valid JSON.", http.StatusBadRequest)
+			return
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		req.Code = r.FormValue("code")
+	default:
+		http.Error(w, fmt.Sprintf("Unexpected Content-Type %s", mediaType), http.StatusBadRequest)
+		return
+	}
+	err := UserDB.QueryRow(
+		"UPDATE \"Login_Challenges\" SET \"Attempts\"=\"Attempts\"+1 WHERE \"ID_Hash\"=$1 AND \"Expires_At\">now() RETURNING \"User_ID\",\"Next\",\"Attempts\"",
+		sessionStore.HashID(req.Challenge)).Scan(&userID, &next, &attempts)
+	if err == sql.ErrNoRows || (err == nil && attempts > maxChallengeAttempts) {
+		UserDB.Exec("DELETE FROM \"Login_Challenges\" WHERE \"ID_Hash\"=$1", sessionStore.HashID(req.Challenge))
+		if isJSON {
+			http.Error(w, "The login has expired. Log in again.", http.StatusUnauthorized)
+			return
+		}
+		setTwoFactorCookie(w, "", 0)
+		http.Redirect(w, r, "/login.html?error=expired&next="+url.QueryEscape(safeNext(next)), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Printf("userHandler.UserLoginTwoFactorHandler; loading challenge failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	// The account may have been locked since the password was checked.
+	user, err := findUserByID(userID)
+	if err != nil {
+		log.Printf("userHandler.UserLoginTwoFactorHandler; loading user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	var throttled *throttledError
+	if errors.As(checkLoginThrottle(user, clientIP(r)), &throttled) {
+		if throttled.Locked {
+			UserDB.Exec("DELETE FROM \"Login_Challenges\" WHERE \"ID_Hash\"=$1", sessionStore.HashID(req.Challenge))
+			if !isJSON {
+				setTwoFactorCookie(w, "", 0)
+			}
+			respondThrottled(w, r, throttled, safeNext(next), isJSON)
+			return
+		}
+		w.Header().Set("Retry-After", retryAfter(throttled.RetryAfter))
+		if isJSON {
+			http.Error(w, throttledMessage(throttled), http.StatusTooManyRequests)
+			return
+		}
+		renderTwoFactorLogin(w, http.StatusTooManyRequests, throttledMessage(throttled))
+		return
+	}
+	ok, err := verifySecondFactor(userID, req.Code)
+	if err != nil {
+		log.Printf("userHandler.UserLoginTwoFactorHandler; verifying code of user [%v] failed. Error: %v", userID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		log.Printf("userHandler.UserLoginTwoFactorHandler; wrong two-factor code for user [%v] from [%v].", userID, r.RemoteAddr)
+		recordLoginFailure(userID, clientIP(r))
+		if isJSON {
+			http.Error(w, "Incorrect code.", http.StatusUnauthorized)
+			return
+		}
+		renderTwoFactorLogin(w, http.StatusUnauthorized, "That code didn't work. Try the next one from your app.")
+		return
+	}
+	UserDB.Exec("DELETE FROM \"Login_Challenges\" WHERE \"ID_Hash\"=$1", sessionStore.HashID(req.Challenge))
+	if !isJSON {
+		setTwoFactorCookie(w, "", 0)
+	}
+	log.Printf("userHandler.UserLoginTwoFactorHandler; [%v] passed two-factor authentication.", user.Username)
+	finishLogin(w, r, user, safeNext(next), isJSON)
+}
+
+func findUserByID(userID int) (User, error) {
+	user := User{ID: userID}
+	err := UserDB.QueryRow(
+		"SELECT \"Username\",\"Email\",\"Password_Hash\",\"Email_Verified_At\",\"Failed_Logins\",\"Last_Failed_Login_At\",\"Locked_Until\",\"Created_At\" FROM \"Users\" WHERE \"ID\"=$1",
+		userID).Scan(&user.Username, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt, &user.FailedLogins, &user.LastFailedLoginAt, &user.LockedUntil, &user.CreatedAt)
+	return user, err
+}
+
+func renderTwoFactorLogin(w http.ResponseWriter, status int, problem string) {
+	renderUserPage(w, status, "userLoginTwoFactor", map[string]string{"Error": problem})
+}
+
+func renderUserPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	if templateCache == nil {
+		log.Print("userHandler templateCache is nil.")
+		panic("userHandler.template is nil!")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := templateCache.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("userHandler.renderUserPage(%v) error: %v", name, err)
+	}
+}
+
+/*
+Shows whether two-factor authentication is on, and the QR code while setting it up.
+*/
+func GetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	page, err := loadTwoFactorPage(user)
+	if err != nil {
+		log.Printf("userHandler.GetTwoFactor; loading two-factor state of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respondTwoFactor(w, r, http.StatusOK, page)
+}
+
+func loadTwoFactorPage(user *mAuthenticate.User) (twoFactorPage, error) {
+	var page twoFactorPage
+	var err error
+	page.Enabled, page.Secret, err = twoFactorState(user.ID)
+	if err != nil {
+		return page, err
+	}
+	page.Pending = page.Secret != ""
+	if page.Pending {
+		page.URI = totpURI(page.Secret, user.Username)
+	}
+	roles, err := userRoles(UserDB, user.ID)
+	if err != nil {
+		return page, err
+	}
+	page.Required = requiresTwoFactor(roles)
+	err = UserDB.QueryRow(
+		"SELECT COUNT(*) FROM \"User_Recovery_Codes\" WHERE \"User_ID\"=$1 AND \"Used_At\" IS NULL",
+		user.ID).Scan(&page.RecoveryCodesLeft)
+	return page, err
+}
+
+func respondTwoFactor(w http.ResponseWriter, r *http.Request, status int, page twoFactorPage) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") || isJSONRequest(r) || templateCache == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	renderUserPage(w, status, "userTwoFactor", page)
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+/*
+Reads the code posted as a form field or as {"Code"}.
+*/
+func postedCode(r *http.Request) string {
+	if isJSONRequest(r) {
+		var req struct{ Code string }
+		json.NewDecoder(r.Body).Decode(&req)
+		return req.Code
+	}
+	return r.FormValue("code")
+}
+
+/*
+Starts setting up two-factor authentication with a new secret. It is only switched on once
+ConfirmTwoFactor has seen a code made from it.
+*/
+func SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	enabled, _, err := twoFactorState(user.ID)
+	if err == nil && enabled {
+		http.Error(w, "Two-factor authentication is already on.", http.StatusConflict)
+		return
+	}
+	var secret string
+	if err == nil {
+		secret, err = newTOTPSecret()
+	}
+	if err == nil {
+		_, err = UserDB.Exec(
+			"INSERT INTO \"User_TOTP\"(\"User_ID\",\"Secret\") VALUES($1,$2) ON CONFLICT (\"User_ID\") DO UPDATE SET \"Secret\"=EXCLUDED.\"Secret\",\"Created_At\"=now(),\"Last_Step\"=0 WHERE \"User_TOTP\".\"Confirmed_At\" IS NULL",
+			user.ID, secret)
+	}
+	if err != nil {
+		log.Printf("userHandler.SetupTwoFactor; creating secret for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !isJSONRequest(r) {
+		http.Redirect(w, r, UserPathPrefix+"/2fa", http.StatusSeeOther)
+		return
+	}
+	page, err := loadTwoFactorPage(user)
+	if err != nil {
+		log.Printf("userHandler.SetupTwoFactor; loading two-factor state of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	respondTwoFactor(w, r, http.StatusCreated, page)
+}
+
+/*
+The provisioning URI of a pending setup as a QR code for authenticator apps to scan.
+*/
+func GetTwoFactorQRCode(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	_, secret, err := twoFactorState(user.ID)
+	if err != nil {
+		log.Printf("userHandler.GetTwoFactorQRCode; loading secret of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if secret == "" {
+		http.Error(w, "Start setting up two-factor authentication first.", http.StatusNotFound)
+		return
+	}
+	png, err := qrcode.Encode(totpURI(secret, user.Username), qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("userHandler.GetTwoFactorQRCode; encoding QR code failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+/*
+Switches two-factor authentication on once the user proves their app makes the right codes,
+and hands out the recovery codes. This is the only time they are shown.
+*/
+func ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	code := postedCode(r)
+	page, err := loadTwoFactorPage(user)
+	if err != nil {
+		log.Printf("userHandler.ConfirmTwoFactor; loading two-factor state of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !page.Pending {
+		http.Error(w, "Start setting up two-factor authentication first.", http.StatusConflict)
+		return
+	}
+	step, ok := verifyTOTP(page.Secret, code, time.Now(), 0)
+	if !ok {
+		page.Error = "That code didn't match. Check the time on your phone and try the next code."
+		respondTwoFactor(w, r, http.StatusBadRequest, page)
+		return
+	}
+	tx, err := UserDB.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec("UPDATE \"User_TOTP\" SET \"Confirmed_At\"=now(),\"Last_Step\"=$1 WHERE \"User_ID\"=$2", step, user.ID)
+	}
+	if err == nil {
+		page.RecoveryCodes, err = replaceRecoveryCodes(tx, user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("userHandler.ConfirmTwoFactor; enabling two-factor for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.ConfirmTwoFactor; [%v] turned on two-factor authentication.", user.Username)
+	page.Enabled, page.Pending, page.Secret, page.URI = true, false, "", ""
+	page.RecoveryCodesLeft = len(page.RecoveryCodes)
+	respondTwoFactor(w, r, http.StatusOK, page)
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := newRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if _, err := tx.Exec("DELETE FROM \"User_Recovery_Codes\" WHERE \"User_ID\"=$1", userID); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO \"User_Recovery_Codes\"(\"User_ID\",\"Code_Hash\") SELECT $1,unnest($2::bytea[])",
+		userID, pq.Array(hashes))
+	return codes, err
+}
+
+/*
+Replaces the recovery codes with new ones, e.g. when they are running out. Needs a current code.
+*/
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	page, ok := checkPostedCode(w, r, user, "userHandler.RegenerateRecoveryCodes")
+	if !ok {
+		return
+	}
+	tx, err := UserDB.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		page.RecoveryCodes, err = replaceRecoveryCodes(tx, user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("userHandler.RegenerateRecoveryCodes; replacing codes of [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	page.RecoveryCodesLeft = len(page.RecoveryCodes)
+	respondTwoFactor(w, r, http.StatusOK, page)
+}
+
+/*
+Switches two-factor authentication off. Needs a current code, and isn't allowed for roles
+that require two-factor authentication.
+*/
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := mAuthenticate.UserFromContext(r.Context())
+	page, ok := checkPostedCode(w, r, user, "userHandler.DisableTwoFactor")
+	if !ok {
+		return
+	}
+	if page.Required {
+		page.Error = "Your role requires two-factor authentication, so it can't be switched off."
+		respondTwoFactor(w, r, http.StatusForbidden, page)
+		return
+	}
+	tx, err := UserDB.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec("DELETE FROM \"User_TOTP\" WHERE \"User_ID\"=$1", user.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM \"User_Recovery_Codes\" WHERE \"User_ID\"=$1", user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("userHandler.DisableTwoFactor; disabling two-factor for [%v] failed. Error: %v", user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.DisableTwoFactor; [%v] turned off two-factor authentication.", user.Username)
+	if isJSONRequest(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, UserPathPrefix+"/2fa", http.StatusSeeOther)
+}
+
+/*
+Checks the code posted to change two-factor settings. On failure it has already answered.
+*/
+func checkPostedCode(w http.ResponseWriter, r *http.Request, user *mAuthenticate.User, where string) (twoFactorPage, bool) {
+	code := postedCode(r)
+	page, err := loadTwoFactorPage(user)
+	if err != nil {
+		log.Printf("%v; loading two-factor state of [%v] failed. Error: %v", where, user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return page, false
+	}
+	if !page.Enabled {
+		http.Error(w, "Two-factor authentication isn't on.", http.StatusConflict)
+		return page, false
+	}
+	ok, err := verifySecondFactor(user.ID, code)
+	if err != nil {
+		log.Printf("%v; verifying code of [%v] failed. Error: %v", where, user.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return page, false
+	}
+	if !ok {
+		page.Error = "That code didn't work."
+		respondTwoFactor(w, r, http.StatusBadRequest, page)
+		return page, false
+	}
+	return page, true
+}
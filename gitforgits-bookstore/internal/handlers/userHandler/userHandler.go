@@ -1,39 +1,193 @@
 package userHandler
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	_ "log"
+	"html/template"
+	"log"
+	"mime"
 	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 var UserPathPrefix string = "/user"
+var UserDB *sql.DB
+var templateCache *template.Template
+
+type User struct {
+	ID              int
+	Username        string
+	Email           string
+	PasswordHash    string `json:"-"`
+	EmailVerifiedAt *time.Time
+	CreatedAt       time.Time
+	// Login throttling state, see LoginThrottle
+	FailedLogins      int        `json:"-"`
+	LastFailedLoginAt *time.Time `json:"-"`
+	LockedUntil       *time.Time `json:"-"`
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
 
 /*
-Handles user registration
+Problems with submitted form fields, keyed by field name ("username", "email", "password").
 */
-func UserRegisterHandler(w http.ResponseWriter, r *http.Request) {
-	username := r.FormValue("username")
-	email := r.FormValue("email")
-	password := r.FormValue("password")
-	http.Error(w, fmt.Sprintf("Oops, UserRegisterHandler isn't implemented, yet. username [%v], email [%v], password [%v].", username, email, password), http.StatusNotImplemented)
+type FieldErrors map[string][]string
+
+func (fe FieldErrors) Add(field string, problem ...string) {
+	fe[field] = append(fe[field], problem...)
 }
 
 /*
-Handles user logins
+Data for the userRegister template. It never carries the password back to the browser.
 */
-func UserLoginHandler(w http.ResponseWriter, r *http.Request) {
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-	http.Error(w, fmt.Sprintf("Oops, .userLoginHandler isn't implemented, yet. username [%v], password [%v]", username, password), http.StatusNotImplemented)
+type registerPage struct {
+	Username string
+	Email    string
+	Errors   FieldErrors
 }
 
 /*
-Handles user profile actions
+Handles user registration. Browsers post the register form and get the form back with
+errors, or a redirect to the login page. JSON clients post {"Username","Email","Password"}
+and get the new user or {"errors":{...}}.
 */
-func UserProfileHandler(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Oops, .userProfileHandler isn't implemented, yet.", http.StatusNotImplemented)
+func UserRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		req struct {
+			Username string
+			Email    string
+			Password string
+		}
+		isJSON bool
+	)
+	switch r.Method {
+	case "GET":
+		renderRegister(w, http.StatusOK, registerPage{})
+		return
+	case "POST":
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported method %v", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		isJSON = true
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid registration data.", http.StatusBadRequest)
+			return
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		req.Username = r.FormValue("username")
+		req.Email = r.FormValue("email")
+		req.Password = r.FormValue("password")
+	default:
+		http.Error(w, fmt.Sprintf("Unexpected Content-Type %s", mediaType), http.StatusBadRequest)
+		return
+	}
+	newUser := User{Username: strings.TrimSpace(req.Username), Email: strings.TrimSpace(req.Email)}
+	page := registerPage{Username: newUser.Username, Email: newUser.Email, Errors: FieldErrors{}}
+
+	if !usernamePattern.MatchString(newUser.Username) {
+		page.Errors.Add("username", "Username must be 3 to 32 letters, digits, dots, dashes or underscores.")
+	}
+	if addr, err := mail.ParseAddress(newUser.Email); err != nil || addr.Address != newUser.Email {
+		page.Errors.Add("email", "Enter a valid email address, like reader@example.com.")
+	}
+	page.Errors.Add("password", Policy.Check(req.Password, newUser.Username, newUser.Email)...)
+	if len(page.Errors["password"]) == 0 {
+		delete(page.Errors, "password")
+	}
+	if len(page.Errors) > 0 {
+		registerFailed(w, isJSON, http.StatusBadRequest, page)
+		return
+	}
+	// Checked up front for friendly messages; the unique indexes still catch a race.
+	var usernameTaken, emailTaken bool
+	err := UserDB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM \"Users\" WHERE lower(\"Username\")=lower($1)), EXISTS(SELECT 1 FROM \"Users\" WHERE lower(\"Email\")=lower($2))",
+		newUser.Username, newUser.Email).Scan(&usernameTaken, &emailTaken)
+	if err != nil {
+		log.Printf("userHandler.UserRegisterHandler; uniqueness check failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if usernameTaken {
+		page.Errors.Add("username", "That username is taken.")
+	}
+	if emailTaken {
+		page.Errors.Add("email", "An account with that email address already exists.")
+	}
+	if len(page.Errors) > 0 {
+		registerFailed(w, isJSON, http.StatusConflict, page)
+		return
+	}
+
+	if newUser.PasswordHash, err = HashPassword(req.Password); err != nil {
+		log.Printf("userHandler.UserRegisterHandler; hashing password failed. Error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	err = UserDB.QueryRow(
+		"INSERT INTO \"Users\"(\"Username\",\"Email\",\"Password_Hash\") VALUES($1,$2,$3) RETURNING \"ID\",\"Created_At\"",
+		newUser.Username, newUser.Email, newUser.PasswordHash).Scan(&newUser.ID, &newUser.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		if strings.Contains(pqErr.Constraint, "Email") {
+			page.Errors.Add("email", "An account with that email address already exists.")
+		} else {
+			page.Errors.Add("username", "That username is taken.")
+		}
+		registerFailed(w, isJSON, http.StatusConflict, page)
+		return
+	} else if err != nil {
+		log.Printf("userHandler.UserRegisterHandler; inserting user [%v] failed. Error: %v", newUser.Username, err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("userHandler.UserRegisterHandler; registered user [%v] with ID [%v].", newUser.Username, newUser.ID)
+	if err := sendVerificationEmail(newUser); err != nil {
+		// They can ask for another link from the login page
+		log.Printf("userHandler.UserRegisterHandler; sending confirmation to [%v] failed. Error: %v", newUser.Username, err)
+	}
+	if !isJSON {
+		http.Redirect(w, r, "/login.html?registered=1", http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&newUser)
+}
+
+func registerFailed(w http.ResponseWriter, isJSON bool, status int, page registerPage) {
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]FieldErrors{"errors": page.Errors})
+		return
+	}
+	renderRegister(w, status, page)
+}
+
+func renderRegister(w http.ResponseWriter, status int, page registerPage) {
+	if templateCache == nil {
+		log.Print("userHandler templateCache is nil.")
+		panic("userHandler.template is nil!")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templateCache.ExecuteTemplate(w, "userRegister", page); err != nil {
+		log.Printf("userHandler.renderRegister(w,r) error: %v", err)
+	}
 }
 
 /*
@@ -53,7 +207,23 @@ Borrowed from StackOverflow answer https://stackoverflow.com/a/44391691, retriev
 func RegisterHandlers(r *mux.Router) {
 	sr := r.PathPrefix(UserPathPrefix).Subrouter()
 	sr.HandleFunc("/register", UserRegisterHandler)
-	sr.HandleFunc("/login", UserLoginHandler)
-	sr.HandleFunc("/profile", UserProfileHandler)
+	sr.HandleFunc("/login", UserLoginHandler).Methods("GET", "POST")
+	sr.HandleFunc("/login/providers", UserLoginProvidersHandler).Methods("GET")
+	sr.HandleFunc("/login/{provider:[a-z0-9-]+}/callback", UserLoginCallbackHandler).Methods("GET")
+	sr.HandleFunc("/logout", UserLogoutHandler).Methods("POST")
+	sr.HandleFunc("/logout/all", UserLogoutAllHandler).Methods("POST")
+	sr.HandleFunc("/token", UserTokenHandler).Methods("POST")
+	sr.HandleFunc("/token/revoke", UserTokenRevokeHandler).Methods("POST")
+	registerAPIKeyHandlers(sr)
+	registerTwoFactorHandlers(sr)
+	sr.HandleFunc("/verify", VerifyEmailHandler).Methods("GET")
+	sr.HandleFunc("/verify/resend", ResendVerificationHandler).Methods("GET", "POST")
+	sr.HandleFunc("/password/forgot", ForgotPasswordHandler).Methods("GET", "POST")
+	sr.HandleFunc("/password/reset", ResetPasswordHandler).Methods("GET", "POST")
+	registerProfileHandlers(sr)
 	sr.NotFoundHandler = http.HandlerFunc(UserNotFound)
 }
+
+func SetTemplateCache(t *template.Template) {
+	templateCache = t
+}
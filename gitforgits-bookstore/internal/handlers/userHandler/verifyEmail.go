@@ -0,0 +1,117 @@
+package userHandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+/*
+Data for the userEmailForm template, which asks for an email address to send a link to.
+*/
+type emailFormPage struct {
+	Title   string
+	Intro   string
+	Action  string
+	Button  string
+	Message string
+}
+
+var resendPage = emailFormPage{
+	Title:  "Confirm your email address",
+	Intro:  "Enter your email address and we'll send you a new confirmation link.",
+	Action: "/user/verify/resend",
+	Button: "Send link",
+}
+
+/*
+Emails a link that confirms the user owns their email address.
+*/
+func sendVerificationEmail(user User) error {
+	token, err := signEmailToken(purposeVerifyEmail, user.ID, VerifyEmailTTL, fingerprint(strings.ToLower(user.Email)))
+	if err != nil {
+		return err
+	}
+	return sendUserMail(user, "Confirm your email address", "emailVerify", emailData{
+		Username:  user.Username,
+		Link:      tokenLink(UserPathPrefix+"/verify", token),
+		ExpiresIn: humanDuration(VerifyEmailTTL),
+	})
+}
+
+/*
+Follows the link from the confirmation email. The link works once, for the address it was
+sent to, until it expires.
+*/
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var verified bool
+	token, err := parseEmailToken(r.URL.Query().Get("token"), purposeVerifyEmail)
+	if err == nil {
+		var email string
+		err = UserDB.QueryRow("SELECT \"Email\",\"Email_Verified_At\" IS NOT NULL FROM \"Users\" WHERE \"ID\"=$1", token.UserID).Scan(&email, &verified)
+		if err == sql.ErrNoRows || (err == nil && (verified || fingerprint(strings.ToLower(email)) != token.Bind)) {
+			err = errBadEmailToken
+		}
+	}
+	if err == nil {
+		_, err = UserDB.Exec("UPDATE \"Users\" SET \"Email_Verified_At\"=now(),\"Updated_At\"=now() WHERE \"ID\"=$1", token.UserID)
+	}
+	switch {
+	case err == errBadEmailToken && verified:
+		http.Redirect(w, r, "/login.html?verified=1", http.StatusSeeOther)
+	case err == errBadEmailToken:
+		http.Redirect(w, r, "/login.html?error=verifylink", http.StatusSeeOther)
+	case err != nil:
+		log.Printf("userHandler.VerifyEmailHandler; verifying user [%v] failed. Error: %v", token.UserID, err)
+		http.Error(w, "", http.StatusInternalServerError)
+	default:
+		log.Printf("userHandler.VerifyEmailHandler; user [%v] confirmed their email address.", token.UserID)
+		http.Redirect(w, r, "/login.html?verified=1", http.StatusSeeOther)
+	}
+}
+
+/*
+Sends a new confirmation link. The answer is the same whether or not the address belongs to
+an unconfirmed account, so it can't be used to find out who has one.
+*/
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		renderUserPage(w, http.StatusOK, "userEmailForm", resendPage)
+		return
+	}
+	email, isJSON := postedEmail(r)
+	user, err := findUser(email)
+	if err == nil && user.EmailVerifiedAt == nil && strings.EqualFold(user.Email, email) {
+		err = sendVerificationEmail(user)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("userHandler.ResendVerificationHandler; sending confirmation to [%v] failed. Error: %v", email, err)
+	}
+	page := resendPage
+	page.Message = "If that address belongs to an account that still needs confirming, a new link is on its way."
+	emailFormDone(w, isJSON, page)
+}
+
+/*
+Reads the email address posted as a form field or as {"Email"}.
+*/
+func postedEmail(r *http.Request) (string, bool) {
+	if isJSONRequest(r) {
+		var req struct{ Email string }
+		json.NewDecoder(r.Body).Decode(&req)
+		return strings.TrimSpace(req.Email), true
+	}
+	return strings.TrimSpace(r.FormValue("email")), false
+}
+
+func emailFormDone(w http.ResponseWriter, isJSON bool, page emailFormPage) {
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"Message": page.Message})
+		return
+	}
+	renderUserPage(w, http.StatusOK, "userEmailForm", page)
+}
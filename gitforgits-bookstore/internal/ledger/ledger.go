@@ -0,0 +1,151 @@
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/*
+Kinds of account. Customers hold gift card and store credit accounts, whose balances can
+never go below zero. System accounts are the other side of every transaction, such as the
+gift cards sold or the money spent on orders, and may go negative.
+*/
+const (
+	KindSystem      = "system"
+	KindGiftCard    = "gift_card"
+	KindStoreCredit = "store_credit"
+)
+
+/*
+The system accounts, made by the migration and found by name.
+*/
+const (
+	GiftCardsSold     = "gift_cards_sold"     // what issued gift cards were paid with
+	OrderTender       = "order_tender"        // gift cards and store credit spent on orders
+	StoreCreditIssued = "store_credit_issued" // refunds given as store credit
+)
+
+var (
+	ErrUnbalanced        = errors.New("ledger: entries must add up to zero")
+	ErrInsufficientFunds = errors.New("ledger: balance is too low")
+	ErrPosted            = errors.New("ledger: transaction was already posted")
+)
+
+/*
+Money moving into an account, or out of it when AmountCents is negative.
+*/
+type Entry struct {
+	AccountID   int
+	AmountCents int64
+}
+
+/*
+A set of entries that add up to zero, posted together or not at all. Key is unique, so the
+same transaction can't be posted twice. OrderID and ActorID are 0 when there is none.
+*/
+type Transaction struct {
+	Key     string
+	Kind    string
+	OrderID int
+	ActorID int
+	Actor   string
+	Memo    string
+	Entries []Entry
+}
+
+/*
+Posts t inside tx and returns its ID. Each account's balance moves with its entry in the
+same statement, which only goes through if a customer's balance stays at zero or above;
+otherwise the error wraps ErrInsufficientFunds and the caller should roll back. Accounts are
+updated in ID order, so two transactions on the same accounts can't deadlock. Posting a key
+that was posted before returns ErrPosted.
+*/
+func Post(tx *sql.Tx, t Transaction) (int, error) {
+	if t.Key == "" || t.Kind == "" {
+		return 0, errors.New("ledger: a transaction needs a key and a kind")
+	}
+	amounts := map[int]int64{}
+	var sum int64
+	for _, e := range t.Entries {
+		if e.AmountCents == 0 {
+			return 0, fmt.Errorf("ledger: entry for account [%v] is zero", e.AccountID)
+		}
+		amounts[e.AccountID] += e.AmountCents
+		sum += e.AmountCents
+	}
+	if sum != 0 || len(amounts) < 2 {
+		return 0, ErrUnbalanced
+	}
+	accounts := make([]int, 0, len(amounts))
+	for id := range amounts {
+		accounts = append(accounts, id)
+	}
+	sort.Ints(accounts)
+	var transactionID int
+	err := tx.QueryRow(
+		"INSERT INTO \"Ledger_Transactions\"(\"Key\",\"Kind\",\"Order_ID\",\"Actor_ID\",\"Actor\",\"Memo\") VALUES($1,$2,NULLIF($3,0),NULLIF($4,0),$5,$6) "+
+			"ON CONFLICT (\"Key\") DO NOTHING RETURNING \"ID\"",
+		t.Key, t.Kind, t.OrderID, t.ActorID, t.Actor, t.Memo).Scan(&transactionID)
+	if err == sql.ErrNoRows {
+		return 0, ErrPosted
+	} else if err != nil {
+		return 0, err
+	}
+	for _, id := range accounts {
+		if amounts[id] == 0 {
+			continue
+		}
+		result, err := tx.Exec(
+			"UPDATE \"Ledger_Accounts\" SET \"Balance_Cents\"=\"Balance_Cents\"+$2 WHERE \"ID\"=$1 AND (\"Kind\"='system' OR \"Balance_Cents\"+$2>=0)",
+			id, amounts[id])
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return 0, fmt.Errorf("%w: account [%v]", ErrInsufficientFunds, id)
+		}
+		if _, err = tx.Exec(
+			"INSERT INTO \"Ledger_Entries\"(\"Transaction_ID\",\"Account_ID\",\"Amount_Cents\") VALUES($1,$2,$3)",
+			transactionID, id, amounts[id]); err != nil {
+			return 0, err
+		}
+	}
+	return transactionID, nil
+}
+
+/*
+Finds a system account by name.
+*/
+func System(tx *sql.Tx, name string) (int, error) {
+	var id int
+	err := tx.QueryRow("SELECT \"ID\" FROM \"Ledger_Accounts\" WHERE \"Kind\"='system' AND \"Name\"=$1", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("ledger: there is no system account %q", name)
+	}
+	return id, err
+}
+
+/*
+Opens an empty gift card account.
+*/
+func OpenGiftCard(tx *sql.Tx) (int, error) {
+	var id int
+	err := tx.QueryRow("INSERT INTO \"Ledger_Accounts\"(\"Kind\") VALUES('gift_card') RETURNING \"ID\"").Scan(&id)
+	return id, err
+}
+
+/*
+Finds the store credit account of userID, opening it if they don't have one yet. The account
+isn't locked; Post does that in its turn.
+*/
+func StoreCredit(tx *sql.Tx, userID int) (int, error) {
+	_, err := tx.Exec("INSERT INTO \"Ledger_Accounts\"(\"Kind\",\"User_ID\") VALUES('store_credit',$1) ON CONFLICT (\"User_ID\") DO NOTHING", userID)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = tx.QueryRow("SELECT \"ID\" FROM \"Ledger_Accounts\" WHERE \"User_ID\"=$1", userID).Scan(&id)
+	return id, err
+}
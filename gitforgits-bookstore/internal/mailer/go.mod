@@ -0,0 +1,3 @@
+module golang-web-book/gitforgits-bookstore/internal/mailer
+
+go 1.22.4
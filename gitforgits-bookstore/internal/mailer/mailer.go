@@ -0,0 +1,171 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+An email. Text is required; HTML is optional and sent as the alternative part.
+*/
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+/*
+A Mailer delivers messages. SMTPMailer sends real mail; FileMailer and LogMailer are for
+development and testing without a mail server.
+*/
+type Mailer interface {
+	Send(msg Message) error
+}
+
+/*
+Sends mail through an SMTP server. net/smtp upgrades to TLS with STARTTLS when the server
+offers it, and refuses to send credentials over a connection that isn't encrypted, except
+to localhost.
+*/
+type SMTPMailer struct {
+	Addr     string // host:port, e.g. smtp.example.com:587
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(msg Message) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("mailer: bad From address: %w", err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("mailer: bad To address: %w", err)
+	}
+	body, err := Compose(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := strings.Cut(m.Addr, ":")
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, from.Address, []string{to.Address}, body)
+}
+
+/*
+Writes each message as an .eml file into Dir, where any mail client can open it.
+*/
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m FileMailer) Send(msg Message) error {
+	body, err := Compose(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o750); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%v-%v.eml", time.Now().UTC().Format("20060102T150405.000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), body, 0o640)
+}
+
+/*
+Writes messages to the log, and keeps them in Sent.
+*/
+type LogMailer struct {
+	mu   sync.Mutex
+	Sent []Message
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.mu.Lock()
+	m.Sent = append(m.Sent, msg)
+	m.mu.Unlock()
+	log.Printf("mailer.LogMailer; To: %v Subject: %v\n%v", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+/*
+Builds the RFC 5322 message: headers, then the text part, or multipart/alternative with text
+and HTML.
+*/
+func Compose(from string, msg Message, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%v: %v\r\n", k, v) }
+	for _, v := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("mailer: header contains a line break")
+		}
+	}
+	header("From", from)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	if msg.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQP(&buf, msg.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQP(buf *bytes.Buffer, text string) error {
+	qp := quotedprintable.NewWriter(buf)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
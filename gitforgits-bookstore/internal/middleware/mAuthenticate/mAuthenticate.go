@@ -1,22 +1,166 @@
 package mAuthenticate
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+var LoginURL string = "/login.html"
+var Realm string = "GitforGits Bookstore"
+
+/*
+The signed in user, as far as the rest of the application needs to know.
+*/
+type User struct {
+	ID       int
+	Username string
+	Email    string
+	Roles    []string
+	Scopes   []string // set when signed in with an API key, which may only do what its scopes allow
+	// Set when the user's roles require two-factor authentication they haven't set up yet.
+	// Until then Roles only holds the customer role.
+	NeedsTwoFactor bool
+}
+
+/*
+An Authenticator identifies the user behind a request from one kind of credential, such as a
+session cookie. It returns ErrNoCredentials when the request doesn't carry that kind at all,
+and ErrInvalidCredentials (or another error) when it does but they don't check out.
+*/
+type Authenticator interface {
+	Authenticate(r *http.Request) (*User, error)
+}
+
+var ErrNoCredentials = errors.New("mAuthenticate: no credentials")
+var ErrInvalidCredentials = errors.New("mAuthenticate: invalid credentials")
+
+/*
+Tried in order; the first one that finds credentials decides. Set up by main.
+*/
+var Authenticators []Authenticator
+
+type contextKey int
+
+const userKey contextKey = 0
+
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+/*
+Returns the user put into the context by one of the middlewares in this package.
+*/
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userKey).(*User)
+	return user, ok && user != nil
+}
+
+/*
+Runs the Authenticators against a request. Returns ErrNoCredentials if none of them found any.
+*/
+func Identify(r *http.Request) (*User, error) {
+	for _, a := range Authenticators {
+		user, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return user, err
+	}
+	return nil, ErrNoCredentials
+}
+
+/*
+Returns the token from an "Authorization: Bearer <token>" header.
+*/
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
 /*
 The AuthenticationMiddleware happens before the primary handler.
 Comes from page 50 of Web Programming with Go; Building and Scaling Interactive Web Applications with Go's Robust Ecosystem by Ian Taylor, 2023 GitforGits
-There is a little missing, here.
+
+Requests without a signed in user are turned away: browsers are redirected to the login page
+with ?next= pointing back here, API clients get 401 with a WWW-Authenticate challenge.
 */
 func AuthenticationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		/*if !userIsAuthenticated(r) {
-			http.Redirect(w, r, "/login", 302)
+		if _, ok := UserFromContext(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := Identify(r)
+		if err != nil {
+			if !errors.Is(err, ErrNoCredentials) && !errors.Is(err, ErrInvalidCredentials) {
+				log.Printf("mAuthenticate.AuthenticationMiddleware; Identify failed. Error: %v", err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			Unauthorized(w, r, err)
 			return
-		}*/
-		log.Println("AuthenticationMiddleware handler func served.")
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+/*
+Like AuthenticationMiddleware, but lets anonymous requests through. Handlers can still call
+UserFromContext to personalise the response.
+*/
+func OptionalAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := Identify(r)
+		if err == nil {
+			r = r.WithContext(WithUser(r.Context(), user))
+		} else if !errors.Is(err, ErrNoCredentials) && !errors.Is(err, ErrInvalidCredentials) {
+			log.Printf("mAuthenticate.OptionalAuthentication; Identify failed. Error: %v", err)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+/*
+Turns away a request that needs a signed in user. err is the reason from Identify, if any.
+*/
+func Unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	if isBrowser(r) {
+		http.Redirect(w, r, fmt.Sprintf("%v?next=%v", LoginURL, url.QueryEscape(returnPath(r))), http.StatusSeeOther)
+		return
+	}
+	challenge := fmt.Sprintf("Bearer realm=%q", Realm)
+	if errors.Is(err, ErrInvalidCredentials) {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "Authentication required.", http.StatusUnauthorized)
+}
+
+/*
+Browsers ask for HTML and don't send Authorization headers of their own.
+*/
+func isBrowser(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+/*
+Where to send the browser after it logs in. For anything but a GET that is the page the
+request came from, since replaying a form post through a redirect doesn't work.
+*/
+func returnPath(r *http.Request) string {
+	if r.Method == "GET" {
+		return r.URL.RequestURI()
+	}
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host && ref.Path != "" {
+		return ref.RequestURI()
+	}
+	return "/"
+}
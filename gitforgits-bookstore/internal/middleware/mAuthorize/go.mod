@@ -0,0 +1,7 @@
+module golang-web-book/gitforgits-bookstore/internal/middleware/mAuthorize
+
+go 1.22.4
+
+require github.com/flintg/gitforgits-bookstore/mAuthenticate v0.0.0-00010101000000-000000000000
+
+replace github.com/flintg/gitforgits-bookstore/mAuthenticate => ../mAuthenticate
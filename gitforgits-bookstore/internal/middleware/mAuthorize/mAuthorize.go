@@ -0,0 +1,172 @@
+package mAuthorize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+)
+
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
+const (
+	PermCatalogueWrite   = "catalogue:write"   // add, edit and delete books, covers and genres
+	PermReviewsModerate  = "reviews:moderate"  // work the review moderation queue
+	PermOrdersManage     = "orders:manage"     // handle other customers' orders
+	PermUsersManage      = "users:manage"      // assign roles
+	PermPromotionsManage = "promotions:manage" // run sales and discounts
+)
+
+// Where users whose role requires two-factor authentication set it up
+var TwoFactorSetupURL string = "/user/2fa"
+
+/*
+What each role may do. Every signed in user is a customer; customers need no extra permissions
+because everything they can do is tied to their own account.
+*/
+var RolePermissions = map[string][]string{
+	RoleCustomer: {},
+	RoleStaff:    {PermCatalogueWrite, PermReviewsModerate, PermOrdersManage},
+	RoleAdmin:    {PermCatalogueWrite, PermReviewsModerate, PermOrdersManage, PermUsersManage, PermPromotionsManage},
+}
+
+const (
+	ScopeCatalogueRead  = "catalogue:read"
+	ScopeCatalogueWrite = "catalogue:write"
+	ScopeOrdersRead     = "orders:read"
+)
+
+/*
+The permissions an API key scope lets through, on top of what the key owner's roles allow.
+Reading the catalogue and one's own orders needs no permission, only the scope.
+*/
+var ScopePermissions = map[string][]string{
+	ScopeCatalogueRead:  {},
+	ScopeCatalogueWrite: {PermCatalogueWrite},
+	ScopeOrdersRead:     {},
+}
+
+/*
+Reports whether scope is one of the scopes above.
+*/
+func ValidScope(scope string) bool {
+	_, ok := ScopePermissions[scope]
+	return ok
+}
+
+/*
+Reports whether role is one of the roles above.
+*/
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+/*
+Reports whether user holds permission through any of their roles and, when they signed in
+with an API key, through one of its scopes as well.
+*/
+func Can(user *mAuthenticate.User, permission string) bool {
+	if user == nil || !granted(user.Roles, RolePermissions, permission) {
+		return false
+	}
+	return user.Scopes == nil || granted(user.Scopes, ScopePermissions, permission)
+}
+
+/*
+Reports whether user may use scope. Interactive sign ins have every scope.
+*/
+func HasScope(user *mAuthenticate.User, scope string) bool {
+	if user == nil {
+		return false
+	}
+	if user.Scopes == nil {
+		return true
+	}
+	for _, s := range user.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func granted(names []string, permissions map[string][]string, permission string) bool {
+	for _, name := range names {
+		for _, p := range permissions[name] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+RequirePermission lets a request through only if the signed in user holds permission. It
+expects mAuthenticate.AuthenticationMiddleware to run first; anonymous requests are sent to
+log in, signed in users without the permission get 403.
+*/
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := mAuthenticate.UserFromContext(r.Context())
+			if !ok {
+				mAuthenticate.Unauthorized(w, r, mAuthenticate.ErrNoCredentials)
+				return
+			}
+			if !Can(user, permission) && user.NeedsTwoFactor {
+				log.Printf("mAuthorize.RequirePermission; [%v] needs two-factor authentication for %v %v", user.Username, r.Method, r.URL.Path)
+				http.Error(w, fmt.Sprintf("Set up two-factor authentication at %v before using staff features.", TwoFactorSetupURL), http.StatusForbidden)
+				return
+			}
+			if !Can(user, permission) {
+				log.Printf("mAuthorize.RequirePermission; [%v] lacks [%v] for %v %v", user.Username, permission, r.Method, r.URL.Path)
+				http.Error(w, "You don't have permission to do that.", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+RequireScope lets API keys through only if they carry scope. Users signed in any other way
+are not restricted by scopes. Like RequirePermission it runs after AuthenticationMiddleware.
+*/
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := mAuthenticate.UserFromContext(r.Context())
+			if !ok {
+				mAuthenticate.Unauthorized(w, r, mAuthenticate.ErrNoCredentials)
+				return
+			}
+			if !HasScope(user, scope) {
+				log.Printf("mAuthorize.RequireScope; API key of [%v] lacks scope [%v] for %v %v", user.Username, scope, r.Method, r.URL.Path)
+				http.Error(w, fmt.Sprintf("This API key needs the %v scope.", scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+RequireInteractive keeps API keys out of routes that are only for people, such as managing
+the keys themselves or writing reviews.
+*/
+func RequireInteractive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := mAuthenticate.UserFromContext(r.Context()); ok && user.Scopes != nil {
+			http.Error(w, "API keys can't be used here.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,299 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Payment method tokens the fake provider understands, one per outcome.
+*/
+const (
+	FakeCardApproved          = "fake_approved"
+	FakeCardDeclined          = "fake_declined"
+	FakeCardInsufficientFunds = "fake_insufficient_funds"
+	FakeCardChallenge         = "fake_3ds"
+	FakeCardPending           = "fake_pending"
+)
+
+type TestCard struct {
+	Token       string
+	Description string
+}
+
+var FakeCards = []TestCard{
+	{FakeCardApproved, "Approved"},
+	{FakeCardDeclined, "Declined"},
+	{FakeCardInsufficientFunds, "Declined, insufficient funds"},
+	{FakeCardChallenge, "3-D Secure challenge"},
+	{FakeCardPending, "Approved later, by webhook only"},
+}
+
+/*
+FakeProvider is a PaymentProvider that runs in-process, for development and offline testing.
+The test card tokens above choose the outcome. Challenges are answered on a page it serves
+itself, so mount it at BaseURL. Every change is sent as a signed webhook to Webhooks, after
+WebhookDelay, and retried a few times if the handler doesn't answer 2xx. Pending payments
+are approved after PendingDelay.
+*/
+type FakeProvider struct {
+	BaseURL       string
+	WebhookSecret []byte
+	Webhooks      http.Handler
+	WebhookDelay  time.Duration
+	PendingDelay  time.Duration
+
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+	keys     map[string]Authorization
+	refunds  map[string]string
+}
+
+type fakePayment struct {
+	id        string
+	status    Status
+	amount    int64
+	captured  int64
+	refunded  int64
+	voided    bool
+	returnURL string
+}
+
+func NewFakeProvider(baseURL string, webhooks http.Handler) *FakeProvider {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &FakeProvider{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		WebhookSecret: secret,
+		Webhooks:      webhooks,
+		WebhookDelay:  time.Second,
+		PendingDelay:  5 * time.Second,
+		payments:      map[string]*fakePayment{},
+		keys:          map[string]Authorization{},
+		refunds:       map[string]string{},
+	}
+}
+
+func (f *FakeProvider) Name() string { return "fake" }
+
+func (f *FakeProvider) Authorize(ctx context.Context, req AuthorizeRequest) (Authorization, error) {
+	if req.AmountCents <= 0 {
+		return Authorization{}, fmt.Errorf("payments: amount must be positive, got %v", req.AmountCents)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if auth, ok := f.keys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		return auth, nil
+	}
+	p := &fakePayment{id: "pay_fake_" + randomHex(), amount: req.AmountCents, returnURL: req.ReturnURL}
+	f.payments[p.id] = p
+	auth := Authorization{PaymentID: p.id}
+	switch req.PaymentMethod {
+	case FakeCardApproved:
+		auth.Status = StatusAuthorized
+		f.send(Event{Type: EventAuthorized, PaymentID: p.id, AmountCents: p.amount})
+	case FakeCardChallenge:
+		auth.Status, auth.ActionURL = StatusRequiresAction, f.BaseURL+"/challenge/"+p.id
+	case FakeCardPending:
+		auth.Status = StatusPending
+		time.AfterFunc(f.PendingDelay, func() { f.settle(p.id, StatusAuthorized, "") })
+	case FakeCardDeclined:
+		auth.Status, auth.DeclineReason = StatusDeclined, "card_declined"
+	case FakeCardInsufficientFunds:
+		auth.Status, auth.DeclineReason = StatusDeclined, "insufficient_funds"
+	default:
+		auth.Status, auth.DeclineReason = StatusDeclined, "unknown_test_card"
+	}
+	p.status = auth.Status
+	if auth.Status == StatusDeclined {
+		f.send(Event{Type: EventDeclined, PaymentID: p.id, DeclineReason: auth.DeclineReason})
+	}
+	if req.IdempotencyKey != "" {
+		f.keys[req.IdempotencyKey] = auth
+	}
+	return auth, nil
+}
+
+/*
+Finishes a pending or challenged payment.
+*/
+func (f *FakeProvider) settle(paymentID string, status Status, reason string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.payments[paymentID]
+	if !ok || (p.status != StatusPending && p.status != StatusRequiresAction) {
+		return false
+	}
+	p.status = status
+	if status == StatusAuthorized {
+		f.send(Event{Type: EventAuthorized, PaymentID: p.id, AmountCents: p.amount})
+	} else {
+		f.send(Event{Type: EventDeclined, PaymentID: p.id, DeclineReason: reason})
+	}
+	return true
+}
+
+/*
+Captures up to the authorized amount, once. Whatever isn't captured is released.
+*/
+func (f *FakeProvider) Capture(ctx context.Context, paymentID string, amountCents int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return ErrNotFound
+	}
+	if p.status != StatusAuthorized || p.voided || p.captured > 0 || amountCents <= 0 || amountCents > p.amount {
+		return ErrInvalidState
+	}
+	p.captured = amountCents
+	f.send(Event{Type: EventCaptured, PaymentID: p.id, AmountCents: amountCents})
+	return nil
+}
+
+func (f *FakeProvider) Void(ctx context.Context, paymentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return ErrNotFound
+	}
+	if p.voided {
+		return nil
+	}
+	if p.captured > 0 || (p.status != StatusAuthorized && p.status != StatusPending && p.status != StatusRequiresAction) {
+		return ErrInvalidState
+	}
+	p.voided = true
+	f.send(Event{Type: EventVoided, PaymentID: p.id})
+	return nil
+}
+
+func (f *FakeProvider) Refund(ctx context.Context, paymentID string, amountCents int64, idempotencyKey string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.refunds[idempotencyKey]; ok && idempotencyKey != "" {
+		return id, nil
+	}
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	if amountCents <= 0 || amountCents > p.captured-p.refunded {
+		return "", ErrInvalidState
+	}
+	p.refunded += amountCents
+	id := "re_fake_" + randomHex()
+	if idempotencyKey != "" {
+		f.refunds[idempotencyKey] = id
+	}
+	f.send(Event{Type: EventRefunded, PaymentID: p.id, AmountCents: p.refunded})
+	return id, nil
+}
+
+func (f *FakeProvider) VerifyWebhook(header http.Header, body []byte) (Event, error) {
+	var event Event
+	if err := VerifySignature(f.WebhookSecret, header.Get("Fake-Signature"), body, time.Now()); err != nil {
+		return event, err
+	}
+	err := json.Unmarshal(body, &event)
+	return event, err
+}
+
+/*
+Delivers event to Webhooks after WebhookDelay, like a processor would: late, and again if it
+isn't acknowledged.
+*/
+func (f *FakeProvider) send(event Event) {
+	if f.Webhooks == nil {
+		return
+	}
+	event.ID = "evt_fake_" + randomHex()
+	body, _ := json.Marshal(event)
+	var deliver func(attempt int)
+	deliver = func(attempt int) {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Fake-Signature", SignPayload(f.WebhookSecret, body, time.Now()))
+		rec := httptest.NewRecorder()
+		f.Webhooks.ServeHTTP(rec, req)
+		if rec.Code < 300 {
+			return
+		}
+		if attempt >= 3 {
+			log.Printf("payments.FakeProvider; giving up on webhook [%v] %v for [%v], last status %v.", event.ID, event.Type, event.PaymentID, rec.Code)
+			return
+		}
+		time.AfterFunc(f.WebhookDelay<<attempt, func() { deliver(attempt + 1) })
+	}
+	time.AfterFunc(f.WebhookDelay, func() { deliver(1) })
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<html>
+    <head><title>Fake 3-D Secure</title></head>
+    <body>
+        <h3>Fake 3-D Secure challenge</h3>
+        <p>Payment {{.ID}} of {{.Amount}} needs the cardholder to confirm it.</p>
+        <form method="POST">
+            <button type="submit" name="action" value="approve">Approve</button>
+            <button type="submit" name="action" value="fail">Fail authentication</button>
+        </form>
+    </body>
+</html>`))
+
+/*
+Serves the challenge page, /challenge/{paymentID}. Answering it settles the payment and sends
+the customer back to the ReturnURL they came with.
+*/
+func (f *FakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutPrefix(r.URL.Path, "/challenge/")
+	f.mu.Lock()
+	p, found := f.payments[id]
+	var returnURL string
+	var amount int64
+	if found {
+		returnURL, amount, found = p.returnURL, p.amount, p.status == StatusRequiresAction
+	}
+	f.mu.Unlock()
+	if !ok || !found {
+		http.Error(w, "No challenge is waiting for that payment.", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		challengePage.Execute(w, struct{ ID, Amount string }{id, fmt.Sprintf("%d.%02d", amount/100, amount%100)})
+	case http.MethodPost:
+		if r.FormValue("action") == "approve" {
+			f.settle(id, StatusAuthorized, "")
+		} else {
+			f.settle(id, StatusDeclined, "authentication_failed")
+		}
+		if returnURL == "" {
+			w.Write([]byte("Done."))
+			return
+		}
+		http.Redirect(w, r, returnURL, http.StatusSeeOther)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func randomHex() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
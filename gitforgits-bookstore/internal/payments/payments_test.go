@@ -0,0 +1,127 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	secret, body := []byte("secret"), []byte(`{"ID":"evt_1"}`)
+	signedAt := time.Unix(1_700_000_000, 0)
+	valid := SignPayload(secret, body, signedAt)
+	other := SignPayload([]byte("old secret"), body, signedAt)
+	tests := []struct {
+		name      string
+		secret    []byte
+		signature string
+		body      []byte
+		now       time.Time
+		ok        bool
+	}{
+		{"valid", secret, valid, body, signedAt, true},
+		{"inside the window", secret, valid, body, signedAt.Add(WebhookTolerance), true},
+		{"any v1 may match", secret, other + "," + strings.Split(valid, ",")[1], body, signedAt, true},
+		{"wrong secret", []byte("other"), valid, body, signedAt, false},
+		{"body changed", secret, valid, []byte(`{"ID":"evt_2"}`), signedAt, false},
+		{"no timestamp", secret, strings.Split(valid, ",")[1], body, signedAt, false},
+		{"no v1", secret, strings.Split(valid, ",")[0], body, signedAt, false},
+		{"replayed too late", secret, valid, body, signedAt.Add(WebhookTolerance + time.Second), false},
+		{"from the future", secret, valid, body, signedAt.Add(-WebhookTolerance - time.Second), false},
+		{"timestamp changed", secret, strings.Replace(valid, "t=1700000000", "t=1700000001", 1), body, signedAt, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySignature(tt.secret, tt.signature, tt.body, tt.now)
+			if tt.ok && err != nil {
+				t.Errorf("VerifySignature() = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrBadSignature) {
+				t.Errorf("VerifySignature() = %v, want ErrBadSignature", err)
+			}
+		})
+	}
+}
+
+func TestFakeProviderAuthorizeCaptureRefund(t *testing.T) {
+	events := make(chan Event, 10)
+	var fake *FakeProvider
+	fake = NewFakeProvider("http://localhost/fake", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		event, err := fake.VerifyWebhook(r.Header, body)
+		if err != nil {
+			t.Errorf("VerifyWebhook() = %v", err)
+			return
+		}
+		events <- event
+	}))
+	fake.WebhookDelay = time.Millisecond
+	next := func(want EventType, amount int64) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Type != want || event.AmountCents != amount {
+				t.Fatalf("got event %v of %v, want %v of %v", event.Type, event.AmountCents, want, amount)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %v event", want)
+		}
+	}
+	ctx := context.Background()
+
+	req := AuthorizeRequest{AmountCents: 2500, Currency: "USD", PaymentMethod: FakeCardApproved, IdempotencyKey: "order-1"}
+	auth, err := fake.Authorize(ctx, req)
+	if err != nil || auth.Status != StatusAuthorized {
+		t.Fatalf("Authorize() = %+v, %v", auth, err)
+	}
+	next(EventAuthorized, 2500)
+	if again, _ := fake.Authorize(ctx, req); again != auth {
+		t.Errorf("Authorize() with the same key = %+v, want %+v", again, auth)
+	}
+
+	if _, err = fake.Refund(ctx, auth.PaymentID, 100, ""); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Refund() before capture = %v, want ErrInvalidState", err)
+	}
+	if err = fake.Capture(ctx, auth.PaymentID, 3000); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Capture() of more than authorized = %v, want ErrInvalidState", err)
+	}
+	if err = fake.Capture(ctx, auth.PaymentID, 2000); err != nil {
+		t.Fatalf("Capture() = %v", err)
+	}
+	next(EventCaptured, 2000)
+	if err = fake.Capture(ctx, auth.PaymentID, 500); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("second Capture() = %v, want ErrInvalidState", err)
+	}
+	if err = fake.Void(ctx, auth.PaymentID); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Void() after capture = %v, want ErrInvalidState", err)
+	}
+
+	first, err := fake.Refund(ctx, auth.PaymentID, 1500, "refund-1")
+	if err != nil {
+		t.Fatalf("Refund() = %v", err)
+	}
+	next(EventRefunded, 1500)
+	if again, _ := fake.Refund(ctx, auth.PaymentID, 1500, "refund-1"); again != first {
+		t.Errorf("Refund() with the same key = %v, want %v", again, first)
+	}
+	if _, err = fake.Refund(ctx, auth.PaymentID, 501, "refund-2"); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Refund() of more than is left = %v, want ErrInvalidState", err)
+	}
+	if _, err = fake.Refund(ctx, auth.PaymentID, 500, "refund-2"); err != nil {
+		t.Fatalf("Refund() of the rest = %v", err)
+	}
+	next(EventRefunded, 2000)
+
+	declined, err := fake.Authorize(ctx, AuthorizeRequest{AmountCents: 100, PaymentMethod: FakeCardInsufficientFunds})
+	if err != nil || declined.Status != StatusDeclined || declined.DeclineReason != "insufficient_funds" {
+		t.Fatalf("Authorize() with a declined card = %+v, %v", declined, err)
+	}
+	next(EventDeclined, 0)
+	if err = fake.Capture(ctx, declined.PaymentID, 100); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Capture() of a declined payment = %v, want ErrInvalidState", err)
+	}
+}
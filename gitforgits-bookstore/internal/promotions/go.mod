@@ -0,0 +1,3 @@
+module golang-web-book/gitforgits-bookstore/internal/promotions
+
+go 1.22.4
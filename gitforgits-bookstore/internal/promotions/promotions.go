@@ -0,0 +1,282 @@
+package promotions
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+What a promotion does to the lines it applies to.
+*/
+type ActionType string
+
+const (
+	PercentOff ActionType = "percent_off" // Percent off each line
+	AmountOff  ActionType = "amount_off"  // AmountCents off the lines together, shared by what they cost
+	FreeItem   ActionType = "free_item"   // in every Buy+Free copies, the Free cheapest are free
+)
+
+/*
+Customer segments every shopper falls into. Role names such as "staff" are segments too.
+*/
+const (
+	SegmentGuest     = "guest"     // not signed in
+	SegmentNew       = "new"       // signed in, hasn't ordered yet
+	SegmentReturning = "returning" // has ordered before
+)
+
+var ErrInvalid = errors.New("promotions: promotion is not valid")
+
+/*
+When a promotion applies. Empty conditions match everything. A line must be in one of
+GenreIDs and by one of Authors, if given; the cart's subtotal and the customer's segments
+are checked for the cart as a whole.
+*/
+type Conditions struct {
+	GenreIDs         []int    `json:",omitempty"`
+	Authors          []string `json:",omitempty"` // matched ignoring case
+	MinSubtotalCents int64    `json:",omitempty"`
+	Segments         []string `json:",omitempty"` // any of them
+}
+
+type Action struct {
+	Type        ActionType
+	Percent     int   `json:",omitempty"`
+	AmountCents int64 `json:",omitempty"`
+	Buy         int   `json:",omitempty"`
+	Free        int   `json:",omitempty"`
+}
+
+/*
+A sale, such as "20% off Fantasy". Promotions with a higher Priority apply first, and each
+one discounts what earlier ones left of a line's price, so lines never go below zero.
+StartsAt and EndsAt bound when it runs; either may be nil. A CouponOnly promotion only
+applies for customers who entered one of its coupons; callers leave it out of Apply otherwise.
+*/
+type Promotion struct {
+	ID         int
+	Name       string // shown to customers next to the discount
+	Conditions Conditions
+	Action     Action
+	Priority   int
+	Active     bool
+	CouponOnly bool
+	StartsAt   *time.Time `json:",omitempty"`
+	EndsAt     *time.Time `json:",omitempty"`
+}
+
+/*
+Checks a promotion makes sense before it is saved. The error wraps ErrInvalid and says why.
+*/
+func (p Promotion) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %v", ErrInvalid, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case strings.TrimSpace(p.Name) == "":
+		return invalid("it needs a name")
+	case p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt):
+		return invalid("it must end after it starts")
+	case p.Conditions.MinSubtotalCents < 0:
+		return invalid("the minimum subtotal can't be negative")
+	}
+	for _, author := range p.Conditions.Authors {
+		if strings.TrimSpace(author) == "" {
+			return invalid("authors can't be blank")
+		}
+	}
+	for _, segment := range p.Conditions.Segments {
+		if strings.TrimSpace(segment) == "" {
+			return invalid("segments can't be blank")
+		}
+	}
+	a := p.Action
+	switch a.Type {
+	case PercentOff:
+		if a.Percent < 1 || a.Percent > 100 {
+			return invalid("the percentage must be from 1 to 100")
+		}
+	case AmountOff:
+		if a.AmountCents < 1 {
+			return invalid("the amount off must be positive")
+		}
+	case FreeItem:
+		if a.Buy < 1 || a.Free < 1 {
+			return invalid("buy and free must both be at least 1")
+		}
+	default:
+		return invalid("unknown action %q", a.Type)
+	}
+	return nil
+}
+
+/*
+Reports whether the promotion is switched on and inside its date window at now.
+*/
+func (p Promotion) Running(now time.Time) bool {
+	return p.Active && (p.StartsAt == nil || !now.Before(*p.StartsAt)) && (p.EndsAt == nil || now.Before(*p.EndsAt))
+}
+
+/*
+A cart line, as far as promotions care.
+*/
+type Line struct {
+	Author         string
+	GenreIDs       []int
+	Quantity       int
+	UnitPriceCents int64
+}
+
+/*
+Money a promotion takes off one line. Line is the index into the lines passed to Apply.
+*/
+type Discount struct {
+	Line        int
+	PromotionID int
+	Name        string
+	AmountCents int64
+}
+
+/*
+Works out the discounts on lines for a customer in segments at now. Promotions that don't
+apply are skipped; discounts of zero are left out.
+*/
+func Apply(promotions []Promotion, lines []Line, segments []string, now time.Time) []Discount {
+	sorted := append([]Promotion(nil), promotions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority > sorted[j].Priority
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	var subtotal int64
+	left := make([]int64, len(lines))
+	for i, line := range lines {
+		left[i] = line.UnitPriceCents * int64(line.Quantity)
+		subtotal += left[i]
+	}
+	var discounts []Discount
+	for _, p := range sorted {
+		if !p.Running(now) || subtotal < p.Conditions.MinSubtotalCents || !p.Conditions.matchSegments(segments) {
+			continue
+		}
+		var eligible []int
+		for i, line := range lines {
+			if left[i] > 0 && p.Conditions.matchLine(line) {
+				eligible = append(eligible, i)
+			}
+		}
+		for i, amount := range p.Action.amounts(lines, left, eligible) {
+			if amount > left[i] {
+				amount = left[i]
+			}
+			if amount <= 0 {
+				continue
+			}
+			left[i] -= amount
+			discounts = append(discounts, Discount{Line: i, PromotionID: p.ID, Name: p.Name, AmountCents: amount})
+		}
+	}
+	sort.SliceStable(discounts, func(i, j int) bool { return discounts[i].Line < discounts[j].Line })
+	return discounts
+}
+
+func (c Conditions) matchSegments(segments []string) bool {
+	if len(c.Segments) == 0 {
+		return true
+	}
+	for _, want := range c.Segments {
+		for _, have := range segments {
+			if want == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c Conditions) matchLine(line Line) bool {
+	if len(c.Authors) > 0 {
+		found := false
+		for _, author := range c.Authors {
+			found = found || strings.EqualFold(strings.TrimSpace(author), strings.TrimSpace(line.Author))
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(c.GenreIDs) > 0 {
+		for _, want := range c.GenreIDs {
+			for _, have := range line.GenreIDs {
+				if want == have {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+/*
+What the action takes off each eligible line, by line index, before capping at what is left.
+*/
+func (a Action) amounts(lines []Line, left []int64, eligible []int) map[int]int64 {
+	amounts := map[int]int64{}
+	switch a.Type {
+	case PercentOff:
+		for _, i := range eligible {
+			amounts[i] = int64(math.Round(float64(left[i]) * float64(a.Percent) / 100))
+		}
+	case AmountOff:
+		var total int64
+		for _, i := range eligible {
+			total += left[i]
+		}
+		off := a.AmountCents
+		if off > total {
+			off = total
+		}
+		if off <= 0 {
+			break
+		}
+		// Shared by what the lines cost; the cents lost to rounding go to the first lines.
+		var given int64
+		for _, i := range eligible {
+			amounts[i] = off * left[i] / total
+			given += amounts[i]
+		}
+		for _, i := range eligible {
+			if given == off {
+				break
+			}
+			if amounts[i] < left[i] {
+				amounts[i]++
+				given++
+			}
+		}
+	case FreeItem:
+		type unit struct {
+			line  int
+			price int64
+		}
+		var units []unit
+		for _, i := range eligible {
+			for n := 0; n < lines[i].Quantity; n++ {
+				units = append(units, unit{i, lines[i].UnitPriceCents})
+			}
+		}
+		sort.SliceStable(units, func(i, j int) bool { return units[i].price > units[j].price })
+		group := a.Buy + a.Free
+		for g := 0; g+group <= len(units); g += group {
+			for _, u := range units[g+a.Buy : g+group] {
+				amounts[u.line] += u.price
+			}
+		}
+	}
+	return amounts
+}
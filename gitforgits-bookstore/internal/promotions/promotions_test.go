@@ -0,0 +1,96 @@
+package promotions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	promotion := func(id, priority int, action Action) Promotion {
+		return Promotion{ID: id, Name: "P", Action: action, Priority: priority, Active: true}
+	}
+	tests := []struct {
+		name       string
+		promotions []Promotion
+		lines      []Line
+		segments   []string
+		want       []Discount
+	}{
+		{
+			name:       "percent off each line",
+			promotions: []Promotion{promotion(1, 0, Action{Type: PercentOff, Percent: 15})},
+			lines:      []Line{{Quantity: 2, UnitPriceCents: 999}, {Quantity: 1, UnitPriceCents: 500}},
+			want:       []Discount{{Line: 0, PromotionID: 1, Name: "P", AmountCents: 300}, {Line: 1, PromotionID: 1, Name: "P", AmountCents: 75}},
+		},
+		{
+			name:       "amount off shared by cost, remainder to the first lines",
+			promotions: []Promotion{promotion(1, 0, Action{Type: AmountOff, AmountCents: 101})},
+			lines:      []Line{{Quantity: 1, UnitPriceCents: 100}, {Quantity: 1, UnitPriceCents: 200}, {Quantity: 2, UnitPriceCents: 100}},
+			want:       []Discount{{Line: 0, PromotionID: 1, Name: "P", AmountCents: 21}, {Line: 1, PromotionID: 1, Name: "P", AmountCents: 40}, {Line: 2, PromotionID: 1, Name: "P", AmountCents: 40}},
+		},
+		{
+			name:       "amount off no more than the lines cost",
+			promotions: []Promotion{promotion(1, 0, Action{Type: AmountOff, AmountCents: 5000})},
+			lines:      []Line{{Quantity: 3, UnitPriceCents: 100}},
+			want:       []Discount{{Line: 0, PromotionID: 1, Name: "P", AmountCents: 300}},
+		},
+		{
+			name:       "free item is the cheapest of each group",
+			promotions: []Promotion{promotion(1, 0, Action{Type: FreeItem, Buy: 2, Free: 1})},
+			lines:      []Line{{Quantity: 2, UnitPriceCents: 500}, {Quantity: 1, UnitPriceCents: 300}, {Quantity: 1, UnitPriceCents: 100}},
+			want:       []Discount{{Line: 1, PromotionID: 1, Name: "P", AmountCents: 300}},
+		},
+		{
+			name:       "free item groups the dearest copies first",
+			promotions: []Promotion{promotion(1, 0, Action{Type: FreeItem, Buy: 2, Free: 1})},
+			lines:      []Line{{Quantity: 3, UnitPriceCents: 100}, {Quantity: 3, UnitPriceCents: 500}},
+			want:       []Discount{{Line: 0, PromotionID: 1, Name: "P", AmountCents: 100}, {Line: 1, PromotionID: 1, Name: "P", AmountCents: 500}},
+		},
+		{
+			name: "higher priority applies first, the next discounts what is left",
+			promotions: []Promotion{
+				promotion(1, 0, Action{Type: AmountOff, AmountCents: 300}),
+				promotion(2, 10, Action{Type: PercentOff, Percent: 50}),
+			},
+			lines: []Line{{Quantity: 1, UnitPriceCents: 1000}},
+			want:  []Discount{{Line: 0, PromotionID: 2, Name: "P", AmountCents: 500}, {Line: 0, PromotionID: 1, Name: "P", AmountCents: 300}},
+		},
+		{
+			name: "capped at what is left of a line",
+			promotions: []Promotion{
+				promotion(1, 1, Action{Type: PercentOff, Percent: 60}),
+				promotion(2, 0, Action{Type: FreeItem, Buy: 1, Free: 1}),
+			},
+			lines: []Line{{Quantity: 2, UnitPriceCents: 1000}},
+			want:  []Discount{{Line: 0, PromotionID: 1, Name: "P", AmountCents: 1200}, {Line: 0, PromotionID: 2, Name: "P", AmountCents: 800}},
+		},
+		{
+			name:       "nothing left for later promotions",
+			promotions: []Promotion{promotion(1, 1, Action{Type: PercentOff, Percent: 100}), promotion(2, 0, Action{Type: AmountOff, AmountCents: 100})},
+			lines:      []Line{{Quantity: 1, UnitPriceCents: 400}},
+			want:       []Discount{{Line: 0, PromotionID: 1, Name: "P", AmountCents: 400}},
+		},
+		{
+			name: "conditions pick the lines and the cart",
+			promotions: []Promotion{
+				{ID: 1, Name: "P", Action: Action{Type: PercentOff, Percent: 10}, Active: true, Conditions: Conditions{GenreIDs: []int{3}, Authors: []string{" ursula le guin"}}},
+				{ID: 2, Name: "P", Action: Action{Type: PercentOff, Percent: 10}, Active: true, Conditions: Conditions{MinSubtotalCents: 10000}},
+				{ID: 3, Name: "P", Action: Action{Type: PercentOff, Percent: 10}, Active: true, Conditions: Conditions{Segments: []string{SegmentNew}}},
+				{ID: 4, Name: "P", Action: Action{Type: PercentOff, Percent: 10}},
+			},
+			lines:    []Line{{Author: "Ursula Le Guin", GenreIDs: []int{1, 3}, Quantity: 1, UnitPriceCents: 1000}, {Author: "Ursula Le Guin", GenreIDs: []int{1}, Quantity: 1, UnitPriceCents: 1000}},
+			segments: []string{SegmentReturning},
+			want:     []Discount{{Line: 0, PromotionID: 1, Name: "P", AmountCents: 100}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Apply(tt.promotions, tt.lines, tt.segments, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
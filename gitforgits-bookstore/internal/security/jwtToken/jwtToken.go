@@ -0,0 +1,272 @@
+package jwtToken
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrMalformed  = errors.New("jwtToken: malformed token")
+	ErrUnknownKey = errors.New("jwtToken: unknown signing key")
+	ErrSignature  = errors.New("jwtToken: invalid signature")
+	ErrExpired    = errors.New("jwtToken: token expired")
+	ErrClaims     = errors.New("jwtToken: token not valid here")
+)
+
+/*
+A signing key. HS256 keys use Secret; EdDSA keys use PrivateKey to sign and PublicKey to
+verify, so a retired EdDSA key only needs its public half.
+*/
+type Key struct {
+	ID         string
+	Alg        string
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+/*
+The registered claims we use. Times are seconds since the epoch, as RFC 7519 wants.
+*/
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ID        string `json:"jti,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+/*
+Signer issues and verifies compact JWS tokens. The first key signs new tokens; every key is
+accepted when verifying, which is how keys are rotated: put the new key first, and drop the
+old one once the longest lived token signed with it has expired.
+*/
+type Signer struct {
+	Keys     []Key
+	Issuer   string
+	Audience string
+	TTL      time.Duration
+	Leeway   time.Duration // allowed clock skew between servers
+	Now      func() time.Time
+}
+
+func NewSigner(keys []Key, issuer string, ttl time.Duration) *Signer {
+	return &Signer{Keys: keys, Issuer: issuer, Audience: issuer, TTL: ttl, Leeway: 30 * time.Second, Now: time.Now}
+}
+
+/*
+Signs a token for subject that expires after TTL. It returns the token and its expiry.
+*/
+func (s *Signer) Issue(subject string) (string, time.Time, error) {
+	if len(s.Keys) == 0 {
+		return "", time.Time{}, ErrUnknownKey
+	}
+	now := s.Now()
+	expires := now.Add(s.TTL)
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, err
+	}
+	claims := Claims{
+		Issuer:    s.Issuer,
+		Subject:   subject,
+		Audience:  s.Audience,
+		ExpiresAt: expires.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(jti),
+	}
+	token, err := s.Sign(claims)
+	return token, expires, err
+}
+
+/*
+Signs claims with the first key.
+*/
+func (s *Signer) Sign(claims Claims) (string, error) {
+	if len(s.Keys) == 0 {
+		return "", ErrUnknownKey
+	}
+	key := s.Keys[0]
+	h, err := json.Marshal(header{Alg: key.Alg, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	var sig []byte
+	switch key.Alg {
+	case HS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	case EdDSA:
+		if key.PrivateKey == nil {
+			return "", fmt.Errorf("jwtToken: key %q has no private key", key.ID)
+		}
+		sig = ed25519.Sign(key.PrivateKey, []byte(signingInput))
+	default:
+		return "", fmt.Errorf("jwtToken: unsupported algorithm %q", key.Alg)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+/*
+Verifies token and returns its claims. The algorithm comes from our key, never from the
+token header, so a token can't pick a weaker check than the key was made for.
+*/
+func (s *Signer) Parse(token string) (Claims, error) {
+	var (
+		h      header
+		claims Claims
+	)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrMalformed
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &h) != nil {
+		return claims, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrMalformed
+	}
+	key, ok := s.key(h.Kid)
+	if !ok {
+		return claims, ErrUnknownKey
+	}
+	if h.Alg != key.Alg {
+		return claims, ErrSignature
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	switch key.Alg {
+	case HS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(signingInput)
+		ok = hmac.Equal(sig, mac.Sum(nil))
+	case EdDSA:
+		ok = len(key.PublicKey) == ed25519.PublicKeySize && ed25519.Verify(key.PublicKey, signingInput, sig)
+	default:
+		ok = false
+	}
+	if !ok {
+		return claims, ErrSignature
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(rawClaims, &claims) != nil {
+		return claims, ErrMalformed
+	}
+	now := s.Now()
+	if claims.ExpiresAt == 0 || now.Add(-s.Leeway).Unix() >= claims.ExpiresAt {
+		return claims, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Add(s.Leeway).Unix() < claims.NotBefore {
+		return claims, ErrClaims
+	}
+	if claims.Issuer != s.Issuer || claims.Audience != s.Audience {
+		return claims, ErrClaims
+	}
+	return claims, nil
+}
+
+func (s *Signer) key(id string) (Key, bool) {
+	for _, k := range s.Keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+/*
+Reports whether token looks like a JWT rather than an opaque token, so an authenticator can
+leave other bearer tokens to someone else.
+*/
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+/*
+Parses keys from configuration. Keys are separated by commas and look like
+"kid:HS256:<base64 secret>" or "kid:EdDSA:<base64 32 byte seed>". An EdDSA key that has been
+retired can be given as "kid:EdDSA-public:<base64 public key>" so it still verifies.
+*/
+func ParseKeys(spec string) ([]Key, error) {
+	var keys []Key
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("jwtToken: key %q is not kid:alg:material", item)
+		}
+		material, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			if material, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+				return nil, fmt.Errorf("jwtToken: key %q is not base64", parts[0])
+			}
+		}
+		key := Key{ID: parts[0], Alg: parts[1]}
+		switch parts[1] {
+		case HS256:
+			if len(material) < 32 {
+				return nil, fmt.Errorf("jwtToken: HS256 key %q must be at least 32 bytes", parts[0])
+			}
+			key.Secret = material
+		case EdDSA:
+			if len(material) != ed25519.SeedSize {
+				return nil, fmt.Errorf("jwtToken: EdDSA key %q must be a %d byte seed", parts[0], ed25519.SeedSize)
+			}
+			key.PrivateKey = ed25519.NewKeyFromSeed(material)
+			key.PublicKey = key.PrivateKey.Public().(ed25519.PublicKey)
+		case EdDSA + "-public":
+			if len(material) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("jwtToken: EdDSA public key %q must be %d bytes", parts[0], ed25519.PublicKeySize)
+			}
+			key.Alg = EdDSA
+			key.PublicKey = material
+		default:
+			return nil, fmt.Errorf("jwtToken: key %q has unsupported algorithm %q", parts[0], parts[1])
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+/*
+Makes a random HS256 key. Tokens signed with it stop working when the process restarts, so
+it is only meant for development.
+*/
+func EphemeralKey() (Key, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return Key{ID: "ephemeral", Alg: HS256, Secret: secret}, nil
+}
@@ -0,0 +1,200 @@
+package oidcClient
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Clock skew we tolerate between us and the provider.
+var Leeway = time.Minute
+
+// Keys are fetched again when a token names a kid we don't know, but no more often than this.
+var minKeyRefresh = time.Minute
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+/*
+Checks the signature and the claims of an ID token: issuer, audience, expiry and nonce.
+RS256 and ES256 signatures are supported, which covers the common providers.
+*/
+func (p *Provider) VerifyIDToken(ctx context.Context, raw string, nonce string) (Claims, error) {
+	var (
+		header struct {
+			Alg string `json:"alg"`
+			Kid string `json:"kid"`
+		}
+		registered struct {
+			Issuer    string          `json:"iss"`
+			Audience  json.RawMessage `json:"aud"`
+			AZP       string          `json:"azp"`
+			ExpiresAt int64           `json:"exp"`
+			IssuedAt  int64           `json:"iat"`
+			Nonce     string          `json:"nonce"`
+		}
+		claims Claims
+	)
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, ErrIDToken
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, ErrIDToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrIDToken
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return claims, fmt.Errorf("%w: bad signature", ErrIDToken)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return claims, fmt.Errorf("%w: bad signature", ErrIDToken)
+		}
+	default:
+		return claims, fmt.Errorf("%w: unsupported key", ErrIDToken)
+	}
+	if decodeSegment(parts[1], &registered) != nil || decodeSegment(parts[1], &claims) != nil {
+		return claims, ErrIDToken
+	}
+	now := time.Now()
+	switch {
+	case registered.Issuer != p.Issuer:
+		return claims, fmt.Errorf("%w: issuer %q", ErrIDToken, registered.Issuer)
+	case !audienceContains(registered.Audience, p.ClientID):
+		return claims, fmt.Errorf("%w: not issued to us", ErrIDToken)
+	case registered.AZP != "" && registered.AZP != p.ClientID:
+		return claims, fmt.Errorf("%w: authorized party %q", ErrIDToken, registered.AZP)
+	case now.Add(-Leeway).Unix() >= registered.ExpiresAt:
+		return claims, fmt.Errorf("%w: expired", ErrIDToken)
+	case registered.IssuedAt > now.Add(Leeway).Unix():
+		return claims, fmt.Errorf("%w: issued in the future", ErrIDToken)
+	case registered.Nonce != nonce:
+		return claims, ErrNonce
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: no subject", ErrIDToken)
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func audienceContains(raw json.RawMessage, clientID string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, aud := range many {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Finds the provider's signing key kid, fetching the key set again if it has been rotated.
+*/
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysAt) < minKeyRefresh && p.keys != nil {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrIDToken, kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, md.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = map[string]interface{}{}
+	p.keysAt = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrIDToken, kid)
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("oidcClient: bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("oidcClient: unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("oidcClient: EC key is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidcClient: unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,187 @@
+package oidcClient
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+MockProvider is a tiny OpenID Connect provider for local development and manual testing. Its
+login page asks for any email address and signs people in as that address, without a
+password. Never expose it outside a development machine.
+*/
+type MockProvider struct {
+	Issuer string
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	codes  map[string]mockGrant
+}
+
+type mockGrant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	email       string
+	name        string
+	expires     time.Time
+}
+
+var mockLoginPage = template.Must(template.New("mockLogin").Parse(`<html><body>
+<h2>Mock identity provider</h2>
+<p>Sign in to {{.ClientID}} as anyone. There is no password.</p>
+<form method="POST">
+{{range $k, $v := .Query}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">{{end}}
+<p><label>Email <input name="email" value="customer@example.com"></label></p>
+<p><label>Name <input name="name" value="Mock Customer"></label></p>
+<button type="submit">Sign in</button>
+</form></body></html>`))
+
+/*
+Makes a mock provider for issuer, the URL it will be served at (e.g. http://localhost:9000).
+*/
+func NewMockProvider(issuer string) (*MockProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockProvider{Issuer: strings.TrimSuffix(issuer, "/"), key: key, codes: map[string]mockGrant{}}, nil
+}
+
+func (m *MockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                m.Issuer,
+			"authorization_endpoint":                m.Issuer + "/authorize",
+			"token_endpoint":                        m.Issuer + "/token",
+			"jwks_uri":                              m.Issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/jwks":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "use": "sig", "alg": "RS256", "kid": "mock",
+			"n": base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("redirect_uri") == "" {
+			http.Error(w, "Expected an authorization code request with an S256 PKCE challenge.", http.StatusBadRequest)
+			return
+		}
+		mockLoginPage.Execute(w, map[string]interface{}{"ClientID": q.Get("client_id"), "Query": q})
+		return
+	}
+	r.ParseForm()
+	code, err := NewVerifier()
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = mockGrant{
+		clientID:    r.PostFormValue("client_id"),
+		redirectURI: r.PostFormValue("redirect_uri"),
+		challenge:   r.PostFormValue("code_challenge"),
+		nonce:       r.PostFormValue("nonce"),
+		email:       r.PostFormValue("email"),
+		name:        r.PostFormValue("name"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+	target, err := url.Parse(r.PostFormValue("redirect_uri"))
+	if err != nil {
+		http.Error(w, "Bad redirect_uri.", http.StatusBadRequest)
+		return
+	}
+	q := target.Query()
+	q.Set("code", code)
+	q.Set("state", r.PostFormValue("state"))
+	target.RawQuery = q.Encode()
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+func (m *MockProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	code := r.PostFormValue("code")
+	m.mu.Lock()
+	grant, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mu.Unlock()
+	clientID := r.PostFormValue("client_id")
+	if user, _, hasBasic := r.BasicAuth(); hasBasic {
+		clientID, _ = url.QueryUnescape(user)
+	}
+	switch {
+	case !ok || time.Now().After(grant.expires):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case grant.clientID != clientID || grant.redirectURI != r.PostFormValue("redirect_uri"):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case Challenge(r.PostFormValue("code_verifier")) != grant.challenge:
+		log.Print("oidcClient.MockProvider; PKCE verifier doesn't match the challenge.")
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	now := time.Now()
+	subject := sha256.Sum256([]byte(strings.ToLower(grant.email)))
+	idToken, err := m.sign(map[string]interface{}{
+		"iss": m.Issuer, "aud": grant.clientID, "iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(),
+		"sub":   base64.RawURLEncoding.EncodeToString(subject[:12]),
+		"nonce": grant.nonce, "email": grant.email, "email_verified": true, "name": grant.name,
+	})
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "mock", "token_type": "Bearer", "expires_in": 300, "id_token": idToken})
+}
+
+func (m *MockProvider) sign(claims map[string]interface{}) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "mock", "typ": "JWT"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
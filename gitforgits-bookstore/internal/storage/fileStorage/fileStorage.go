@@ -0,0 +1,149 @@
+package fileStorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("fileStorage: object not found")
+var ErrInvalidKey = errors.New("fileStorage: invalid key")
+
+/*
+Storage keeps opaque blobs (cover images, for now) under slash separated keys such as
+"covers/12/ab34cd/small.jpg". Implementations must be safe for concurrent use.
+*/
+type Storage interface {
+	// Put stores the contents of r under key, replacing anything already there.
+	Put(key string, r io.Reader) error
+	// Open returns the object stored under key, or ErrNotFound.
+	Open(key string) (Object, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// DeletePrefix removes every key that starts with prefix followed by a slash.
+	DeletePrefix(prefix string) error
+}
+
+/*
+Object is a stored blob opened for reading. It is an io.ReadSeeker so it can be handed straight
+to http.ServeContent.
+*/
+type Object interface {
+	io.ReadSeekCloser
+	ModTime() time.Time
+	Size() int64
+}
+
+/*
+LocalStorage is a Storage backed by a directory on the local filesystem.
+*/
+type LocalStorage struct {
+	Root string
+}
+
+type localObject struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (o localObject) ModTime() time.Time { return o.info.ModTime() }
+func (o localObject) Size() int64        { return o.info.Size() }
+
+/*
+Creates a LocalStorage rooted at dir, creating the directory if needed.
+*/
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("fileStorage.NewLocalStorage; could not create [%v]. Error: %w", dir, err)
+	}
+	return &LocalStorage{Root: dir}, nil
+}
+
+/*
+Maps a key onto a path below Root, refusing anything that would escape it.
+*/
+func (s *LocalStorage) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	clean := path.Clean(key)
+	if clean != key || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(clean)), nil
+}
+
+/*
+Writes to a temporary file first and renames it into place, so readers never see a
+half-written object.
+*/
+func (s *LocalStorage) Put(key string, r io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalStorage) Open(key string) (Object, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return localObject{File: f, info: info}, nil
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) DeletePrefix(prefix string) error {
+	p, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
@@ -0,0 +1,3 @@
+module golang-web-book/gitforgits-bookstore/internal/storage/sessionStore
+
+go 1.22.4
@@ -0,0 +1,179 @@
+package sessionStore
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+Manager ties a Store to the session cookie and enforces the idle and absolute timeouts.
+*/
+type Manager struct {
+	Store           Store
+	CookieName      string
+	IdleTimeout     time.Duration // a session unused for this long ends
+	AbsoluteTimeout time.Duration // a session ends this long after login, however active
+	Secure          bool
+	SameSite        http.SameSite
+	TouchEvery      time.Duration // how stale LastSeenAt may get before it is written again
+	Now             func() time.Time
+}
+
+func NewManager(store Store) *Manager {
+	return &Manager{
+		Store:           store,
+		CookieName:      "gfg_session",
+		IdleTimeout:     30 * time.Minute,
+		AbsoluteTimeout: 12 * time.Hour,
+		Secure:          true,
+		SameSite:        http.SameSiteLaxMode,
+		TouchEvery:      time.Minute,
+		Now:             time.Now,
+	}
+}
+
+/*
+Starts a new session for userID and sets the cookie. Any session the request already carried
+is ended first, so a session ID planted before login is never promoted (session fixation).
+*/
+func (m *Manager) Start(w http.ResponseWriter, r *http.Request, userID int) (Session, error) {
+	if c, err := r.Cookie(m.CookieName); err == nil {
+		if err = m.Store.Delete(c.Value); err != nil {
+			log.Printf("sessionStore.Manager.Start; could not end previous session. Error: %v", err)
+		}
+	}
+	id, err := NewID()
+	if err != nil {
+		return Session{}, err
+	}
+	now := m.Now()
+	s := Session{
+		ID:         id,
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(m.AbsoluteTimeout),
+		UserAgent:  r.UserAgent(),
+		IP:         clientIP(r),
+	}
+	if err = m.Store.Create(s); err != nil {
+		return Session{}, err
+	}
+	m.setCookie(w, s.ID, s.ExpiresAt)
+	return s, nil
+}
+
+/*
+Returns the live session carried by the request, or ErrNotFound. Sessions past either
+timeout are deleted on the way.
+*/
+func (m *Manager) Load(r *http.Request) (Session, error) {
+	c, err := r.Cookie(m.CookieName)
+	if err != nil || c.Value == "" {
+		return Session{}, ErrNotFound
+	}
+	return m.LoadID(c.Value)
+}
+
+/*
+Like Load, for a session ID that arrived some other way than the cookie.
+*/
+func (m *Manager) LoadID(id string) (Session, error) {
+	s, err := m.Store.Get(id)
+	if err != nil {
+		return Session{}, err
+	}
+	now := m.Now()
+	if !s.ExpiresAt.After(now) || now.Sub(s.LastSeenAt) >= m.IdleTimeout {
+		if err = m.Store.Delete(id); err != nil {
+			log.Printf("sessionStore.Manager.Load; could not delete expired session. Error: %v", err)
+		}
+		return Session{}, ErrNotFound
+	}
+	if now.Sub(s.LastSeenAt) >= m.TouchEvery {
+		if err = m.Store.Touch(id, now); err != nil {
+			log.Printf("sessionStore.Manager.Load; could not touch session. Error: %v", err)
+		}
+		s.LastSeenAt = now
+	}
+	return s, nil
+}
+
+/*
+Ends the session carried by the request and clears the cookie.
+*/
+func (m *Manager) End(w http.ResponseWriter, r *http.Request) error {
+	m.setCookie(w, "", time.Unix(0, 0))
+	c, err := r.Cookie(m.CookieName)
+	if err != nil {
+		return nil
+	}
+	return m.Store.Delete(c.Value)
+}
+
+/*
+Ends every session of the user who owns the request's session, on every device.
+*/
+func (m *Manager) EndAll(w http.ResponseWriter, r *http.Request) error {
+	s, err := m.Load(r)
+	if err != nil {
+		return err
+	}
+	m.setCookie(w, "", time.Unix(0, 0))
+	return m.Store.DeleteUser(s.UserID)
+}
+
+/*
+Periodically removes expired sessions from the store. Call the returned function to stop.
+*/
+func (m *Manager) StartCleanup(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := m.Now()
+				if err := m.Store.DeleteExpired(now, now.Add(-m.IdleTimeout)); err != nil {
+					log.Printf("sessionStore.Manager.StartCleanup; DeleteExpired failed. Error: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (m *Manager) setCookie(w http.ResponseWriter, value string, expires time.Time) {
+	c := &http.Cookie{
+		Name:     m.CookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   m.Secure,
+		SameSite: m.SameSite,
+	}
+	if value == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Reports whether err means there is no usable session, as opposed to a store failure.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
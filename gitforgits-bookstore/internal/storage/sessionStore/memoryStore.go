@@ -0,0 +1,76 @@
+package sessionStore
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+MemoryStore keeps sessions in process memory. Sessions are lost on restart and aren't shared
+between instances, so it suits development and single-instance deployments.
+*/
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session // keyed by HashID(ID)
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]Session{}}
+}
+
+func (m *MemoryStore) Create(s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[string(HashID(s.ID))] = s
+	return nil
+}
+
+func (m *MemoryStore) Get(id string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[string(HashID(id))]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *MemoryStore) Touch(id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := string(HashID(id))
+	if s, ok := m.sessions[key]; ok {
+		s.LastSeenAt = at
+		m.sessions[key] = s
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, string(HashID(id)))
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpired(now time.Time, lastSeenBefore time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.sessions {
+		if !s.ExpiresAt.After(now) || s.LastSeenAt.Before(lastSeenBefore) {
+			delete(m.sessions, key)
+		}
+	}
+	return nil
+}
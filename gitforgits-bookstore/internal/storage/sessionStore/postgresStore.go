@@ -0,0 +1,56 @@
+package sessionStore
+
+import (
+	"database/sql"
+	"time"
+)
+
+/*
+PostgresStore keeps sessions in the "Sessions" table, so they survive restarts and are
+shared by every instance.
+*/
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (p *PostgresStore) Create(s Session) error {
+	_, err := p.DB.Exec(
+		"INSERT INTO \"Sessions\"(\"ID_Hash\",\"User_ID\",\"Created_At\",\"Last_Seen_At\",\"Expires_At\",\"User_Agent\",\"IP\") VALUES($1,$2,$3,$4,$5,$6,$7)",
+		HashID(s.ID), s.UserID, s.CreatedAt, s.LastSeenAt, s.ExpiresAt, s.UserAgent, s.IP)
+	return err
+}
+
+func (p *PostgresStore) Get(id string) (Session, error) {
+	s := Session{ID: id}
+	err := p.DB.QueryRow(
+		"SELECT \"User_ID\",\"Created_At\",\"Last_Seen_At\",\"Expires_At\",\"User_Agent\",\"IP\" FROM \"Sessions\" WHERE \"ID_Hash\"=$1",
+		HashID(id)).Scan(&s.UserID, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.UserAgent, &s.IP)
+	if err == sql.ErrNoRows {
+		return Session{}, ErrNotFound
+	}
+	return s, err
+}
+
+func (p *PostgresStore) Touch(id string, at time.Time) error {
+	_, err := p.DB.Exec("UPDATE \"Sessions\" SET \"Last_Seen_At\"=$1 WHERE \"ID_Hash\"=$2", at, HashID(id))
+	return err
+}
+
+func (p *PostgresStore) Delete(id string) error {
+	_, err := p.DB.Exec("DELETE FROM \"Sessions\" WHERE \"ID_Hash\"=$1", HashID(id))
+	return err
+}
+
+func (p *PostgresStore) DeleteUser(userID int) error {
+	_, err := p.DB.Exec("DELETE FROM \"Sessions\" WHERE \"User_ID\"=$1", userID)
+	return err
+}
+
+func (p *PostgresStore) DeleteExpired(now time.Time, lastSeenBefore time.Time) error {
+	_, err := p.DB.Exec("DELETE FROM \"Sessions\" WHERE \"Expires_At\"<=$1 OR \"Last_Seen_At\"<$2", now, lastSeenBefore)
+	return err
+}
@@ -0,0 +1,60 @@
+package sessionStore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("sessionStore: session not found")
+
+/*
+A server-side login session. ID is the secret handed to the browser in a cookie; stores only
+ever persist its hash, so a leaked sessions table can't be replayed.
+*/
+type Session struct {
+	ID         string
+	UserID     int
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time // absolute expiry, regardless of activity
+	UserAgent  string
+	IP         string
+}
+
+/*
+Store persists sessions. Implementations must be safe for concurrent use.
+*/
+type Store interface {
+	Create(s Session) error
+	// Get returns the session with the given ID, or ErrNotFound.
+	Get(id string) (Session, error)
+	// Touch records activity on a session.
+	Touch(id string, at time.Time) error
+	Delete(id string) error
+	// DeleteUser ends every session belonging to a user ("log out everywhere").
+	DeleteUser(userID int) error
+	// DeleteExpired removes sessions past their absolute expiry or idle since before lastSeenBefore.
+	DeleteExpired(now time.Time, lastSeenBefore time.Time) error
+}
+
+/*
+Generates a new random session ID with 256 bits of entropy.
+*/
+func NewID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+The form a session ID is stored in.
+*/
+func HashID(id string) []byte {
+	sum := sha256.Sum256([]byte(id))
+	return sum[:]
+}
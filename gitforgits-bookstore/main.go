@@ -1,17 +1,29 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"strings"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/flintg/gitforgits-bookstore/bookHandler"
+	"github.com/flintg/gitforgits-bookstore/fileStorage"
 	"github.com/flintg/gitforgits-bookstore/genreHandler"
+	"github.com/flintg/gitforgits-bookstore/jwtToken"
+	"github.com/flintg/gitforgits-bookstore/mAuthenticate"
+	"github.com/flintg/gitforgits-bookstore/mailer"
+	"github.com/flintg/gitforgits-bookstore/oidcClient"
 	"github.com/flintg/gitforgits-bookstore/orderHandler"
+	"github.com/flintg/gitforgits-bookstore/payments"
+	"github.com/flintg/gitforgits-bookstore/recommendationHandler"
+	"github.com/flintg/gitforgits-bookstore/reviewHandler"
+	"github.com/flintg/gitforgits-bookstore/sessionStore"
 	"github.com/flintg/gitforgits-bookstore/userHandler"
 
 	//_ "github.com/flintg/gitforgits-bookstore/configHelper" // This isn't working. Review https://go.dev/doc/tutorial/create-module
@@ -22,6 +34,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 
@@ -36,12 +49,42 @@ type App struct {
 }
 
 type Cfg struct {
-	ServerAddress string
-	DbAddress     string
-	DbUser        string
-	DbPassword    string
-	DbHost        string
-	DbName        string
+	ServerAddress  string
+	DbAddress      string
+	DbUser         string
+	DbPassword     string
+	DbHost         string
+	DbName         string
+	CoverDir       string
+	Moderation     reviewHandler.ModerationRules
+	RecommendEvery time.Duration
+	Passwords      userHandler.PasswordPolicy
+	LoginThrottle  userHandler.LoginThrottle
+	SessionStore   string
+	SessionCookie  string
+	SessionIdle    time.Duration
+	SessionMaxAge  time.Duration
+	SessionSecure  bool
+	SessionStrict  bool
+	JWTKeys        string
+	JWTIssuer      string
+	AccessTTL      time.Duration
+	RefreshTTL     time.Duration
+	PublicURL      string
+	OIDC           []*oidcClient.Provider
+	OIDCMockAddr   string
+	Mailer         string
+	MailFrom       string
+	MailDir        string
+	SMTPAddr       string
+	SMTPUser       string
+	SMTPPassword   string
+	EmailSecret    string
+	Payments       string
+	Currency       string
+	StripeKey      string
+	StripeWebhook  string
+	WebhookDelay   time.Duration
 }
 
 type HomeTemplate struct {
@@ -68,6 +111,159 @@ func (cfg *Cfg) Load() {
 	cfg.DbPassword = os.Getenv("DB_PASSWORD")
 	cfg.DbHost = os.Getenv("DB_HOST")
 	cfg.DbName = os.Getenv("DB_NAME")
+	cfg.CoverDir = os.Getenv("COVER_DIR")
+	if cfg.CoverDir == "" {
+		cfg.CoverDir = "./web/covers"
+	}
+	cfg.RecommendEvery = time.Hour
+	if v, err := time.ParseDuration(os.Getenv("RECOMMENDATIONS_INTERVAL")); err == nil && v > 0 {
+		cfg.RecommendEvery = v
+	}
+	//Password policy. Unset values keep the defaults from userHandler.Policy
+	cfg.Passwords = userHandler.Policy
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil {
+		cfg.Passwords.MinLength = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH")); err == nil {
+		cfg.Passwords.MaxLength = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("PASSWORD_REQUIRE_MIXED_CASE")); err == nil {
+		cfg.Passwords.RequireMixedCase = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("PASSWORD_REQUIRE_DIGIT")); err == nil {
+		cfg.Passwords.RequireDigit = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("PASSWORD_REQUIRE_SYMBOL")); err == nil {
+		cfg.Passwords.RequireSymbol = v
+	}
+	//Failed logins. Unset values keep the defaults from userHandler.Throttle
+	cfg.LoginThrottle = userHandler.Throttle
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_FREE_ATTEMPTS")); err == nil {
+		cfg.LoginThrottle.FreeAttempts = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_IP_FREE_ATTEMPTS")); err == nil {
+		cfg.LoginThrottle.IPFreeAttempts = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("LOGIN_MAX_DELAY")); err == nil && v > 0 {
+		cfg.LoginThrottle.MaxDelay = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_THRESHOLD")); err == nil {
+		cfg.LoginThrottle.LockoutThreshold = v // 0 turns locking off
+	}
+	if v, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_DURATION")); err == nil && v > 0 {
+		cfg.LoginThrottle.LockoutDuration = v
+	}
+	//Sessions
+	cfg.SessionStore = os.Getenv("SESSION_STORE") // "postgres" (default) or "memory"
+	cfg.SessionCookie = os.Getenv("SESSION_COOKIE_NAME")
+	cfg.SessionIdle = 30 * time.Minute
+	if v, err := time.ParseDuration(os.Getenv("SESSION_IDLE_TIMEOUT")); err == nil && v > 0 {
+		cfg.SessionIdle = v
+	}
+	cfg.SessionMaxAge = 12 * time.Hour
+	if v, err := time.ParseDuration(os.Getenv("SESSION_ABSOLUTE_TIMEOUT")); err == nil && v > 0 {
+		cfg.SessionMaxAge = v
+	}
+	cfg.SessionSecure = true // set SESSION_COOKIE_SECURE=false when developing over plain http
+	if v, err := strconv.ParseBool(os.Getenv("SESSION_COOKIE_SECURE")); err == nil {
+		cfg.SessionSecure = v
+	}
+	cfg.SessionStrict = strings.EqualFold(os.Getenv("SESSION_SAMESITE"), "strict")
+	//API tokens. JWT_KEYS is a comma separated list of kid:alg:base64key, the first one signs
+	cfg.JWTKeys = os.Getenv("JWT_KEYS")
+	cfg.JWTIssuer = os.Getenv("JWT_ISSUER")
+	if cfg.JWTIssuer == "" {
+		cfg.JWTIssuer = "gitforgits-bookstore"
+	}
+	cfg.AccessTTL = 15 * time.Minute
+	if v, err := time.ParseDuration(os.Getenv("JWT_ACCESS_TTL")); err == nil && v > 0 {
+		cfg.AccessTTL = v
+	}
+	cfg.RefreshTTL = userHandler.RefreshTTL
+	if v, err := time.ParseDuration(os.Getenv("JWT_REFRESH_TTL")); err == nil && v > 0 {
+		cfg.RefreshTTL = v
+	}
+	//External login providers, e.g. OIDC_PROVIDERS=google with OIDC_GOOGLE_ISSUER, OIDC_GOOGLE_CLIENT_ID,
+	//OIDC_GOOGLE_CLIENT_SECRET, and optionally OIDC_GOOGLE_NAME and OIDC_GOOGLE_SCOPES
+	cfg.PublicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if cfg.PublicURL == "" {
+		cfg.PublicURL = "http://localhost" + cfg.ServerAddress
+	}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		env := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &oidcClient.Provider{
+			Name:         name,
+			DisplayName:  os.Getenv(env + "NAME"),
+			Issuer:       os.Getenv(env + "ISSUER"),
+			ClientID:     os.Getenv(env + "CLIENT_ID"),
+			ClientSecret: os.Getenv(env + "CLIENT_SECRET"),
+			RedirectURL:  cfg.PublicURL + userHandler.UserPathPrefix + "/login/" + name + "/callback",
+			Scopes:       strings.Fields(os.Getenv(env + "SCOPES")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			log.Printf("Login provider [%v] needs %vISSUER and %vCLIENT_ID, skipping it.", name, env, env)
+			continue
+		}
+		if provider.DisplayName == "" {
+			provider.DisplayName = name
+		}
+		cfg.OIDC = append(cfg.OIDC, provider)
+	}
+	//Development only: serve a mock login provider, e.g. OIDC_MOCK_ADDR=:9000
+	cfg.OIDCMockAddr = os.Getenv("OIDC_MOCK_ADDR")
+	//Account emails. MAILER is "smtp", "file" (writes .eml files to MAIL_DIR) or "log" (default)
+	cfg.Mailer = os.Getenv("MAILER")
+	cfg.MailFrom = os.Getenv("MAIL_FROM")
+	if cfg.MailFrom == "" {
+		cfg.MailFrom = "GitforGits Bookstore <no-reply@localhost>"
+	}
+	cfg.MailDir = os.Getenv("MAIL_DIR")
+	if cfg.MailDir == "" {
+		cfg.MailDir = "./mail"
+	}
+	cfg.SMTPAddr = os.Getenv("SMTP_ADDR")
+	cfg.SMTPUser = os.Getenv("SMTP_USERNAME")
+	cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	cfg.EmailSecret = os.Getenv("EMAIL_TOKEN_SECRET") // base64, at least 32 bytes
+	//Payments. PAYMENT_PROVIDER is "stripe", or "fake" for in-process test cards. It must be set
+	cfg.Payments = os.Getenv("PAYMENT_PROVIDER")
+	cfg.Currency = strings.ToUpper(os.Getenv("PAYMENT_CURRENCY"))
+	if cfg.Currency == "" {
+		cfg.Currency = "USD"
+	}
+	cfg.StripeKey = os.Getenv("STRIPE_SECRET_KEY")
+	cfg.StripeWebhook = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	cfg.WebhookDelay = time.Second
+	if v, err := time.ParseDuration(os.Getenv("FAKE_PAYMENT_WEBHOOK_DELAY")); err == nil && v >= 0 {
+		cfg.WebhookDelay = v
+	}
+	//Review moderation. Unset values keep the defaults from reviewHandler.Rules
+	cfg.Moderation = reviewHandler.Rules
+	if v, err := strconv.ParseBool(os.Getenv("REVIEW_AUTO_APPROVE")); err == nil {
+		cfg.Moderation.AutoApprove = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("REVIEW_TRUSTED_AFTER")); err == nil {
+		cfg.Moderation.TrustedAfterApproved = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("REVIEW_MAX_LINKS")); err == nil {
+		cfg.Moderation.MaxLinks = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("REVIEW_REPORT_THRESHOLD")); err == nil {
+		cfg.Moderation.ReportThreshold = v
+	}
+	cfg.Moderation.BlockedTerms = strings.Split(os.Getenv("REVIEW_BLOCKED_TERMS"), ",")
+	if termsFile := os.Getenv("REVIEW_BLOCKED_TERMS_FILE"); termsFile != "" {
+		// One term per line, e.g. a stock profanity list
+		if terms, err := os.ReadFile(termsFile); err != nil {
+			log.Printf("Could not read REVIEW_BLOCKED_TERMS_FILE [%v]. Error: %v", termsFile, err)
+		} else {
+			cfg.Moderation.BlockedTerms = append(cfg.Moderation.BlockedTerms, strings.Split(string(terms), "\n")...)
+		}
+	}
 }
 
 func (a *App) Initialize() {
@@ -86,12 +282,119 @@ func (a *App) Initialize() {
 		} else {
 			bookHandler.BookDB = a.DB
 			genreHandler.GenreDB = a.DB
+			reviewHandler.ReviewDB = a.DB
+			recommendationHandler.RecommendationDB = a.DB
+			userHandler.UserDB = a.DB
+			orderHandler.OrderDB = a.DB
 			log.Print("We have a connection to the database.")
 		}
 	}
 	a.DB.SetMaxOpenConns(100)
 	a.DB.SetMaxIdleConns(50)
 	a.DB.SetConnMaxLifetime(time.Minute * 5)
+	//Session storage
+	var sessions sessionStore.Store = sessionStore.NewPostgresStore(a.DB)
+	if a.Configs.SessionStore == "memory" {
+		sessions = sessionStore.NewMemoryStore()
+	}
+	userHandler.Sessions = sessionStore.NewManager(sessions)
+	userHandler.Sessions.IdleTimeout = a.Configs.SessionIdle
+	userHandler.Sessions.AbsoluteTimeout = a.Configs.SessionMaxAge
+	userHandler.Sessions.Secure = a.Configs.SessionSecure
+	orderHandler.CartCookieSecure = a.Configs.SessionSecure
+	if a.Configs.SessionCookie != "" {
+		userHandler.Sessions.CookieName = a.Configs.SessionCookie
+	}
+	if a.Configs.SessionStrict {
+		userHandler.Sessions.SameSite = http.SameSiteStrictMode
+	}
+	//API tokens
+	keys, err := jwtToken.ParseKeys(a.Configs.JWTKeys)
+	if err != nil {
+		log.Printf("App.Initialize(); JWT_KEYS is invalid, API tokens disabled. Error: %v", err)
+	} else {
+		if len(keys) == 0 {
+			log.Print("App.Initialize(); JWT_KEYS is not set, signing API tokens with a key that only lasts until restart.")
+			key, keyErr := jwtToken.EphemeralKey()
+			if keyErr != nil {
+				panic(keyErr)
+			}
+			keys = append(keys, key)
+		}
+		userHandler.Tokens = jwtToken.NewSigner(keys, a.Configs.JWTIssuer, a.Configs.AccessTTL)
+		userHandler.RefreshTTL = a.Configs.RefreshTTL
+	}
+	//Account emails
+	switch a.Configs.Mailer {
+	case "smtp":
+		userHandler.Mail = mailer.SMTPMailer{Addr: a.Configs.SMTPAddr, Username: a.Configs.SMTPUser, Password: a.Configs.SMTPPassword, From: a.Configs.MailFrom}
+	case "file":
+		userHandler.Mail = mailer.FileMailer{Dir: a.Configs.MailDir, From: a.Configs.MailFrom}
+	default:
+		userHandler.Mail = &mailer.LogMailer{}
+	}
+	userHandler.PublicURL = a.Configs.PublicURL
+	if secret, secretErr := base64.StdEncoding.DecodeString(a.Configs.EmailSecret); secretErr == nil && len(secret) >= 32 {
+		userHandler.TokenSecret = secret
+	} else {
+		log.Print("App.Initialize(); EMAIL_TOKEN_SECRET is missing or too short, email links will only work until restart.")
+		userHandler.TokenSecret = make([]byte, 32)
+		if _, randErr := rand.Read(userHandler.TokenSecret); randErr != nil {
+			panic(randErr)
+		}
+	}
+	//Payments
+	orderHandler.PublicURL = a.Configs.PublicURL
+	orderHandler.Currency = a.Configs.Currency
+	switch a.Configs.Payments {
+	case "stripe":
+		orderHandler.Payments = &payments.StripeProvider{SecretKey: a.Configs.StripeKey, WebhookSecret: a.Configs.StripeWebhook}
+	case "fake":
+		log.Print("App.Initialize(); taking payments with the FAKE provider. Never do this in production.")
+		fake := payments.NewFakeProvider(a.Configs.PublicURL+"/payments/fake", http.HandlerFunc(orderHandler.PaymentWebhook))
+		fake.WebhookDelay = a.Configs.WebhookDelay
+		orderHandler.Payments = fake
+		orderHandler.TestCards = payments.FakeCards
+	default:
+		log.Fatalf("App.Initialize(); PAYMENT_PROVIDER must be \"stripe\" or \"fake\", got [%v]", a.Configs.Payments)
+	}
+	//External login providers
+	if a.Configs.OIDCMockAddr != "" {
+		issuer := "http://" + a.Configs.OIDCMockAddr
+		if strings.HasPrefix(a.Configs.OIDCMockAddr, ":") {
+			issuer = "http://localhost" + a.Configs.OIDCMockAddr
+		}
+		mock, mockErr := oidcClient.NewMockProvider(issuer)
+		if mockErr != nil {
+			panic(mockErr)
+		}
+		log.Printf("App.Initialize(); serving a MOCK login provider at [%v]. Never do this in production.", issuer)
+		go func() {
+			log.Printf("Mock login provider stopped. Error: %v", http.ListenAndServe(a.Configs.OIDCMockAddr, mock))
+		}()
+		a.Configs.OIDC = append(a.Configs.OIDC, &oidcClient.Provider{
+			Name:        "mock",
+			DisplayName: "Mock provider",
+			Issuer:      issuer,
+			ClientID:    "gitforgits-bookstore",
+			RedirectURL: a.Configs.PublicURL + userHandler.UserPathPrefix + "/login/mock/callback",
+		})
+	}
+	for _, provider := range a.Configs.OIDC {
+		userHandler.Providers[provider.Name] = provider
+	}
+	//Authentication: who is making each request. JWTs and API keys first, other bearer tokens are session IDs
+	mAuthenticate.Authenticators = []mAuthenticate.Authenticator{
+		userHandler.JWTAuthenticator{},
+		userHandler.APIKeyAuthenticator{},
+		userHandler.SessionAuthenticator{},
+	}
+	//Cover image storage
+	if coverStorage, err := fileStorage.NewLocalStorage(a.Configs.CoverDir); err != nil {
+		log.Printf("App.Initialize(); cover uploads disabled. Error: %v", err)
+	} else {
+		bookHandler.CoverStorage = coverStorage
+	}
 	//Initialize Router and Routes
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
@@ -109,11 +412,22 @@ func (a *App) initializeRoutes() {
 	//Book routing
 	bookHandler.BookPathPrefix = "/books" //default is /book (singular)
 	bookHandler.RegisterHandlers(a.Router)
+	//Review moderation routing
+	reviewHandler.Rules = a.Configs.Moderation
+	reviewHandler.RegisterModerationHandlers(a.Router)
 	//User routing
+	userHandler.Policy = a.Configs.Passwords
+	userHandler.Throttle = a.Configs.LoginThrottle
 	userHandler.RegisterHandlers(a.Router)
+	userHandler.RegisterAdminHandlers(a.Router)
 	//Order routing
 	orderHandler.OrderPathPrefix = "/orders" //default is /order (signular)
 	orderHandler.RegisterHandlers(a.Router)
+	orderHandler.RegisterAdminHandlers(a.Router)
+	userHandler.LoginHooks = append(userHandler.LoginHooks, orderHandler.MergeGuestCart)
+	if fake, ok := orderHandler.Payments.(*payments.FakeProvider); ok {
+		a.Router.PathPrefix("/payments/fake/").Handler(http.StripPrefix("/payments/fake", fake))
+	}
 	//Genre routing
 	genreHandler.GenrePathPrefix = "/genres" //default is /genre (singular)
 	genreHandler.RegisterHandlers(a.Router)
@@ -143,7 +457,7 @@ func (a *App) initializeRoutes() {
 			defer InternalServerErrorHandler(w, r)
 			handlr.ServeHTTP(w, r)
 		})
-	}, RateLimit, RequestThrottle)
+	}, RateLimit, RequestThrottle, mAuthenticate.OptionalAuthentication)
 }
 
 /*
@@ -249,6 +563,15 @@ func (a *App) loadTemplates() {
 	//bookHandler.LoadTemplates()
 	bookHandler.SetTemplateCache(TemplateCache)
 	genreHandler.SetTemplateCache(TemplateCache)
+	reviewHandler.SetTemplateCache(TemplateCache)
+	userHandler.SetTemplateCache(TemplateCache)
+	orderHandler.SetTemplateCache(TemplateCache)
+	emailLocation := "./web/templates/email/*.txt"
+	emailTemplates, err := texttemplate.ParseGlob(emailLocation)
+	if err != nil {
+		log.Fatalf("Could not load email templates from [%v]. Error: %v", emailLocation, err)
+	}
+	userHandler.SetEmailTemplates(emailTemplates)
 }
 
 func (a *App) homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -272,5 +595,19 @@ func main() {
 	app.Initialize()
 	defer app.DB.Close() //must happen in main because if it's done inside Initialize, the connection closes at the end of the function.
 	app.loadTemplates()
+	stopSessionCleanup := userHandler.Sessions.StartCleanup(10 * time.Minute)
+	defer stopSessionCleanup()
+	if userHandler.UserDB != nil {
+		stopTokenCleanup := userHandler.StartTokenCleanup(time.Hour)
+		defer stopTokenCleanup()
+	}
+	if orderHandler.OrderDB != nil {
+		stopCartCleanup := orderHandler.StartCartCleanup(time.Hour)
+		defer stopCartCleanup()
+	}
+	if recommendationHandler.RecommendationDB != nil {
+		stopRecommendations := recommendationHandler.StartJob(app.Configs.RecommendEvery)
+		defer stopRecommendations()
+	}
 	app.Run(app.Configs.ServerAddress)
 }
@@ -20,7 +20,27 @@ require (
 	github.com/flintg/gitforgits-bookstore/orderHandler v0.0.0-00010101000000-000000000000
 )
 
-require github.com/flintg/gitforgits-bookstore/mAuthenticate v0.0.0-00010101000000-000000000000 // indirect
+require (
+	github.com/flintg/gitforgits-bookstore/ledger v0.0.0-00010101000000-000000000000 // indirect
+	github.com/flintg/gitforgits-bookstore/mAuthorize v0.0.0-00010101000000-000000000000 // indirect
+	github.com/flintg/gitforgits-bookstore/promotions v0.0.0-00010101000000-000000000000 // indirect
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/image v0.18.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+)
+
+require (
+	github.com/flintg/gitforgits-bookstore/fileStorage v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/jwtToken v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/mAuthenticate v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/mailer v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/oidcClient v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/payments v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/recommendationHandler v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/reviewHandler v0.0.0-00010101000000-000000000000
+	github.com/flintg/gitforgits-bookstore/sessionStore v0.0.0-00010101000000-000000000000
+)
 
 //replace github.com/flintg/gitforgits-bookstore/configHelper => ./gitforgits-bookstore/utils/configHelper
 replace github.com/flintg/gitforgits-bookstore/userHandler => ./gitforgits-bookstore/internal/handlers/userHandler
@@ -32,3 +52,25 @@ replace github.com/flintg/gitforgits-bookstore/orderHandler => ./gitforgits-book
 replace github.com/flintg/gitforgits-bookstore/genreHandler => ./gitforgits-bookstore/internal/handlers/genreHandler
 
 replace github.com/flintg/gitforgits-bookstore/mAuthenticate => ./gitforgits-bookstore/internal/middleware/mAuthenticate
+
+replace github.com/flintg/gitforgits-bookstore/fileStorage => ./gitforgits-bookstore/internal/storage/fileStorage
+
+replace github.com/flintg/gitforgits-bookstore/reviewHandler => ./gitforgits-bookstore/internal/handlers/reviewHandler
+
+replace github.com/flintg/gitforgits-bookstore/recommendationHandler => ./gitforgits-bookstore/internal/handlers/recommendationHandler
+
+replace github.com/flintg/gitforgits-bookstore/sessionStore => ./gitforgits-bookstore/internal/storage/sessionStore
+
+replace github.com/flintg/gitforgits-bookstore/mAuthorize => ./gitforgits-bookstore/internal/middleware/mAuthorize
+
+replace github.com/flintg/gitforgits-bookstore/jwtToken => ./gitforgits-bookstore/internal/security/jwtToken
+
+replace github.com/flintg/gitforgits-bookstore/oidcClient => ./gitforgits-bookstore/internal/security/oidcClient
+
+replace github.com/flintg/gitforgits-bookstore/mailer => ./gitforgits-bookstore/internal/mailer
+
+replace github.com/flintg/gitforgits-bookstore/payments => ./gitforgits-bookstore/internal/payments
+
+replace github.com/flintg/gitforgits-bookstore/promotions => ./gitforgits-bookstore/internal/promotions
+
+replace github.com/flintg/gitforgits-bookstore/ledger => ./gitforgits-bookstore/internal/ledger